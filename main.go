@@ -8,6 +8,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"network-check/modules"
 	"network-check/utils"
@@ -16,6 +18,15 @@ import (
 )
 
 func main() {
+	// "network-check bwserver" runs the throughput test server instead of the TUI
+	if len(os.Args) > 1 && os.Args[1] == "bwserver" {
+		if err := modules.RunBandwidthServer(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "bwserver:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// initialize with field names so struct changes are safe
 	initialModel := utils.Model{
 		AvailableChoices: []utils.AvailableChoice{
@@ -49,16 +60,36 @@ func main() {
 				UpdateFunc: modules.UpdateDHCP,
 				ViewFunc:   modules.ChosenDHCPView,
 			},
+			{
+				Name:       "Check IPv6 RA / DHCPv6",
+				UpdateFunc: modules.UpdateIPv6RA,
+				ViewFunc:   modules.ChosenIPv6RAView,
+			},
 			{
 				Name:       "Check ARP tables",
 				UpdateFunc: modules.UpdateARP,
 				ViewFunc:   modules.ChosenARPView,
 			},
+			{
+				Name:       "Scan subnet",
+				UpdateFunc: modules.UpdateLANScan,
+				ViewFunc:   modules.ChosenLANScanView,
+			},
+			{
+				Name:       "Scan remote ports",
+				UpdateFunc: modules.UpdatePortScan,
+				ViewFunc:   modules.ChosenPortScanView,
+			},
 			{
 				Name:       "Check routing tables",
 				UpdateFunc: modules.UpdateRouting,
 				ViewFunc:   modules.ChosenRoutingView,
 			},
+			{
+				Name:       "Check reverse-path filtering",
+				UpdateFunc: modules.UpdateRPFilter,
+				ViewFunc:   modules.ChosenRPFilterView,
+			},
 			{
 				Name:       "Check firewall rules",
 				UpdateFunc: modules.UpdateFirewall,
@@ -69,6 +100,21 @@ func main() {
 				UpdateFunc: modules.UpdateOpenPorts,
 				ViewFunc:   modules.ChosenOpenPortsView,
 			},
+			{
+				Name:       "Browse TCP connections",
+				UpdateFunc: modules.UpdateConnections,
+				ViewFunc:   modules.ChosenConnectionsView,
+			},
+			{
+				Name:       "Time HTTP(S) requests",
+				UpdateFunc: modules.UpdateHTTPTiming,
+				ViewFunc:   modules.ChosenHTTPTimingView,
+			},
+			{
+				Name:       "Inspect TLS endpoint",
+				UpdateFunc: modules.UpdateTLSCheck,
+				ViewFunc:   modules.ChosenTLSCheckView,
+			},
 			{
 				Name:       "Check traceroute",
 				UpdateFunc: modules.UpdateTraceroute,
@@ -79,6 +125,16 @@ func main() {
 				UpdateFunc: modules.UpdateBandwidth,
 				ViewFunc:   modules.ChosenBandwidthView,
 			},
+			{
+				Name:       "Test throughput (bwserver)",
+				UpdateFunc: modules.UpdateThroughput,
+				ViewFunc:   modules.ChosenThroughputView,
+			},
+			{
+				Name:       "Test bufferbloat (latency under load)",
+				UpdateFunc: modules.UpdateBufferbloat,
+				ViewFunc:   modules.ChosenBufferbloatView,
+			},
 			{
 				Name:       "Check latency",
 				UpdateFunc: modules.UpdateLatency,
@@ -104,6 +160,11 @@ func main() {
 				UpdateFunc: modules.UpdateNetworkInterfaces,
 				ViewFunc:   modules.ChosenNetworkInterfacesView,
 			},
+			{
+				Name:       "Monitor interface traffic",
+				UpdateFunc: modules.UpdateIfTraffic,
+				ViewFunc:   modules.ChosenIfTrafficView,
+			},
 			{
 				Name:       "Check proxy settings",
 				UpdateFunc: modules.UpdateProxy,
@@ -156,30 +217,116 @@ func main() {
 		DHCPFound:   false,
 		DHCPInfo:    "",
 
+		// IPv6 RA / DHCPv6 defaults
+		RATimeout: 6,
+		RAChan:    nil,
+		RALog:     []string{},
+
 		// ARP defaults
-		ARPChan: nil,
-		ARPLog:  []string{},
+		ARPChan:     nil,
+		ARPLog:      []string{},
+		ARPEntries:  []utils.Neighbor{},
+		ARPSortCol:  0,
+		ARPSortDesc: false,
+
+		// ARP monitor defaults
+		ARPMonitorSecs: 30,
+		ARPMonChan:     nil,
+		ARPMonLog:      []string{},
+
+		// LAN scan defaults
+		ScanChan:     nil,
+		ScanLog:      []string{},
+		ScanHosts:    []utils.ScanHost{},
+		ScanRate:     100,
+		ScanMaxHosts: 4096,
+
+		// Port scan defaults
+		PortScanChan:    nil,
+		PortScanLog:     []string{},
+		PortScanPorts:   []utils.PortProbe{},
+		PortScanWorkers: 64,
+		PortScanTimeout: 2 * time.Second,
+
+		// Service identification defaults
+		IdentifyChan: nil,
 
 		// Routing defaults
-		RouteChan: nil,
-		RouteLog:  []string{},
+		RouteChan:     nil,
+		RouteLog:      []string{},
+		RouteRules:    []utils.RouteRule{},
+		RouteEntries:  []utils.RouteEntry{},
+		RouteFindings: []string{},
+		RouteLookup:   []string{},
+		RouteKernel:   []string{},
+
+		// Reverse-path filtering defaults
+		RPFilterChan: nil,
+		RPFilterLog:  []string{},
 
 		// Firewall defaults
-		FirewallChan: nil,
-		FirewallLog:  []string{},
+		FirewallChan:      nil,
+		FirewallLog:       []string{},
+		FirewallTables:    []utils.FirewallTable{},
+		FirewallOpen:      map[string]bool{},
+		FirewallTrace:     nil,
+		FirewallFindings:  []utils.FirewallFinding{},
+		FirewallWatchChan: nil,
 
 		// Open ports defaults
-		OpenPortsChan: nil,
-		OpenPortsLog:  []string{},
+		OpenPortsChan:    nil,
+		OpenPortsLog:     []string{},
+		OpenPortsSockets: []utils.Socket{},
+
+		// Connections defaults
+		ConnChan:    nil,
+		ConnLog:     []string{},
+		ConnEntries: []utils.Socket{},
+
+		// HTTP timing defaults
+		HTTPTimingChan:  nil,
+		HTTPTimingLog:   []string{},
+		HTTPTimings:     []utils.HTTPTiming{},
+		HTTPTimingCount: 5,
+
+		// TLS inspection defaults
+		TLSCheckChan: nil,
+		TLSCheckLog:  []string{},
 
 		// Traceroute defaults
-		TraceChan:   nil,
-		TraceLog:    []string{},
-		TraceTarget: "8.8.8.8",
+		TraceChan:     nil,
+		TraceLog:      []string{},
+		TraceTarget:   "8.8.8.8",
+		TraceProto:    "icmp",
+		TraceHops:     []utils.TraceHop{},
+		TraceInfo:     map[string]utils.TraceHopInfo{},
+		TraceInterval: time.Second,
+		TraceMaxHops:  30,
 
 		// Bandwidth defaults
-		BandwidthChan: nil,
-		BandwidthLog:  []string{},
+		BandwidthChan:    nil,
+		BandwidthLog:     []string{},
+		BandwidthHistory: []utils.SpeedResult{},
+
+		// Throughput test defaults
+		ThroughputChan:      nil,
+		ThroughputLog:       []string{},
+		ThroughputIntervals: []utils.BwInterval{},
+		ThroughputSecs:      10,
+		ThroughputStreams:   4,
+
+		// Bufferbloat test defaults
+		BloatChan:    nil,
+		BloatLog:     []string{},
+		BloatSamples: []utils.BloatSample{},
+		BloatLoads:   []utils.BloatLoad{},
+		BloatSecs:    10,
+
+		// Interface traffic monitor defaults
+		IfTrafficChan:  nil,
+		IfTrafficLog:   []string{},
+		IfTrafficHist:  map[string][]utils.IfSample{},
+		IfTrafficTotal: map[string]utils.IfSample{},
 
 		// Latency defaults
 		LatencyChan: nil,
@@ -2,71 +2,75 @@ package modules
 
 import (
 	"bufio"
-	"context"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
 	"network-check/utils"
-	"os/exec"
+	"os"
+	"sort"
 	"strings"
-	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-// Simple ARP table check: runs "ip neigh show" (preferred) or falls back to "arp -n".
-// Streams lines into a channel from a goroutine and collects them into m.ARPLog.
+// Neighbor table check: dumps the IPv4 (ARP) and IPv6 (NDP) neighbor tables
+// over rtnetlink, falling back to /proc/net/arp for IPv4 only. Entries are
+// streamed as utils.NeighborResult values, enriched with the MAC vendor from
+// the offline OUI database and shown as a sortable table.
+
+var neighborColumns = []string{"IP", "MAC", "Iface", "State", "Vendor"}
+
 func UpdateARP(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
-	switch msg.(type) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if !m.Loaded {
+			return m, nil
+		}
+		switch msg.String() {
+		case "s":
+			m.ARPSortCol = (m.ARPSortCol + 1) % len(neighborColumns)
+			sortNeighbors(m.ARPEntries, m.ARPSortCol, m.ARPSortDesc)
+		case "r":
+			m.ARPSortDesc = !m.ARPSortDesc
+			sortNeighbors(m.ARPEntries, m.ARPSortCol, m.ARPSortDesc)
+		case "m":
+			return startARPMonitor(m)
+		}
+		return m, nil
+
 	case utils.FrameMsg:
+		if m.ARPMonChan != nil {
+			return pollARPMonitor(m)
+		}
+
 		if !m.Loaded && m.ARPChan == nil {
-			m.ARPChan = make(chan string, 256)
-			go func(ch chan<- string) {
+			m.ARPChan = make(chan utils.NeighborResult, 1024)
+			m.ARPEntries = []utils.Neighbor{}
+			m.ARPLog = []string{}
+			m.ARPMonLog = []string{}
+			go func(ch chan<- utils.NeighborResult) {
 				defer close(ch)
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-
-				// try ip neigh first
-				cmd := exec.CommandContext(ctx, "ip", "neigh", "show")
-				stdout, err := cmd.StdoutPipe()
-				if err == nil {
-					if err := cmd.Start(); err == nil {
-						scanner := bufio.NewScanner(stdout)
-						for scanner.Scan() {
-							line := strings.TrimSpace(scanner.Text())
-							if line != "" {
-								select {
-								case ch <- line:
-								default:
-								}
-							}
-						}
-						_ = cmd.Wait()
-						return
-					}
-				}
 
-				// fallback to arp -n
-				cmd = exec.CommandContext(ctx, "arp", "-n")
-				stdout, err = cmd.StdoutPipe()
-				if err == nil {
-					if err := cmd.Start(); err == nil {
-						scanner := bufio.NewScanner(stdout)
-						for scanner.Scan() {
-							line := strings.TrimSpace(scanner.Text())
-							if line != "" {
-								select {
-								case ch <- line:
-								default:
-								}
-							}
-						}
-						_ = cmd.Wait()
-						return
-					}
+				entries, err := readNeighbors()
+				if err != nil {
+					ch <- utils.NeighborResult{Msg: fmt.Sprintf("netlink neighbor dump failed (%v), falling back to /proc/net/arp (IPv4 only)", err)}
+					entries, err = readProcARP()
 				}
-
-				// if both fail, emit a helpful message
-				select {
-				case ch <- "could not run 'ip neigh' or 'arp -n' (permission or binary missing)":
-				default:
+				if err != nil {
+					ch <- utils.NeighborResult{Msg: fmt.Sprintf("could not read the neighbor table: %v", err)}
+					return
+				}
+				gateways := map[string]bool{}
+				for _, gw := range defaultGateways() {
+					gateways[gw] = true
+				}
+				for _, n := range entries {
+					n.Gateway = gateways[n.IP]
+					if n.MAC != "" {
+						n.Vendor = lookupVendor(n.MAC)
+					}
+					ch <- utils.NeighborResult{Entry: n}
 				}
 			}(m.ARPChan)
 
@@ -77,19 +81,19 @@ func UpdateARP(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 		if m.ARPChan != nil {
 			for {
 				select {
-				case line, ok := <-m.ARPChan:
+				case r, ok := <-m.ARPChan:
 					if !ok {
 						// channel closed -> finished
 						m.ARPChan = nil
 						m.Loaded = true
+						sortNeighbors(m.ARPEntries, m.ARPSortCol, m.ARPSortDesc)
 						return m, nil
 					}
-					trim := strings.TrimSpace(line)
-					if trim == "" {
+					if r.Msg != "" {
+						m.ARPLog = append(m.ARPLog, r.Msg)
 						continue
 					}
-					m.ARPLog = append(m.ARPLog, trim)
-					return m, utils.Frame()
+					m.ARPEntries = append(m.ARPEntries, r.Entry)
 				default:
 					return m, utils.Frame()
 				}
@@ -99,20 +103,199 @@ func UpdateARP(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// readProcARP parses /proc/net/arp. Flags 0x2 means the entry is complete;
+// the kernel does not expose the finer NUD state there.
+func readProcARP() ([]utils.Neighbor, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []utils.Neighbor
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		// IP address  HW type  Flags  HW address  Mask  Device
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		state := "INCOMPLETE"
+		switch fields[2] {
+		case "0x2":
+			state = "REACHABLE"
+		case "0x6":
+			state = "PERMANENT"
+		}
+		mac := fields[3]
+		if mac == "00:00:00:00:00:00" {
+			mac = ""
+		}
+		out = append(out, utils.Neighbor{IP: fields[0], MAC: mac, Iface: fields[5], State: state})
+	}
+	return out, sc.Err()
+}
+
+// defaultGateways returns the next hops of the IPv4 and IPv6 default routes in
+// the main table, read from /proc/net/route and /proc/net/ipv6_route.
+func defaultGateways() []string {
+	var gws []string
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Scan() // header
+		for sc.Scan() {
+			// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+				continue
+			}
+			b, err := hex.DecodeString(fields[2])
+			if err != nil || len(b) != 4 {
+				continue
+			}
+			// little-endian u32 in the file
+			gw := net.IPv4(b[3], b[2], b[1], b[0])
+			if !gw.IsUnspecified() {
+				gws = append(gws, gw.String())
+			}
+		}
+		f.Close()
+	}
+	if f, err := os.Open("/proc/net/ipv6_route"); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			// dst dst_len src src_len next_hop metric refcnt use flags iface
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 10 || fields[1] != "00" || strings.Trim(fields[0], "0") != "" {
+				continue
+			}
+			b, err := hex.DecodeString(fields[4])
+			if err != nil || len(b) != 16 {
+				continue
+			}
+			gw := net.IP(b)
+			if !gw.IsUnspecified() {
+				gws = append(gws, gw.String())
+			}
+		}
+		f.Close()
+	}
+	return gws
+}
+
+func sortNeighbors(entries []utils.Neighbor, col int, desc bool) {
+	less := func(a, b utils.Neighbor) bool {
+		switch col {
+		case 1:
+			return a.MAC < b.MAC
+		case 2:
+			return a.Iface < b.Iface
+		case 3:
+			return a.State < b.State
+		case 4:
+			return a.Vendor < b.Vendor
+		default:
+			return compareIP(a.IP, b.IP) < 0
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+// compareIP orders IPv4 before IPv6 and numerically within a family.
+func compareIP(a, b string) int {
+	ia, ib := net.ParseIP(a), net.ParseIP(b)
+	if ia == nil || ib == nil {
+		return strings.Compare(a, b)
+	}
+	a4, b4 := ia.To4() != nil, ib.To4() != nil
+	if a4 != b4 {
+		if a4 {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(ia.To16(), ib.To16())
+}
+
 func ChosenARPView(m utils.Model) string {
-	header := utils.KeywordStyle.Render("ARP tables:") + " ip neigh / arp -n\n\n"
+	header := utils.KeywordStyle.Render("Neighbor table:") + " ARP / NDP via netlink\n\n"
+
+	var notes string
+	if len(m.ARPLog) > 0 {
+		notes = utils.SubtleStyle.Render(strings.Join(m.ARPLog, "\n")) + "\n\n"
+	}
+
+	if m.ARPMonChan != nil || len(m.ARPMonLog) > 0 {
+		return header + notes + arpMonitorView(m)
+	}
 
 	if !m.Loaded {
-		body := utils.SubtleStyle.Render("querying ARP/neighbour table...")
-		if len(m.ARPLog) > 0 {
-			body = strings.Join(m.ARPLog, "\n")
+		body := utils.SubtleStyle.Render(fmt.Sprintf("querying neighbor table... %d entries", len(m.ARPEntries)))
+		return header + notes + body + "\n\n" + utils.SubtleStyle.Render("Running...")
+	}
+
+	if len(m.ARPEntries) == 0 {
+		return header + notes + utils.SubtleStyle.Render("No neighbor entries collected.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	}
+
+	// count states, highlighting the ones that indicate unreachable neighbors
+	counts := map[string]int{}
+	for _, n := range m.ARPEntries {
+		counts[n.State]++
+	}
+	var parts []string
+	for _, st := range []string{"REACHABLE", "STALE", "DELAY", "PROBE", "PERMANENT", "FAILED", "INCOMPLETE"} {
+		if counts[st] > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", st, counts[st]))
+		}
+	}
+	summary := utils.SubtleStyle.Render(fmt.Sprintf("%d entries: %s", len(m.ARPEntries), strings.Join(parts, " ")))
+	if bad := counts["FAILED"] + counts["INCOMPLETE"]; bad > 0 {
+		summary += "\n" + utils.WarnStyle.Render(fmt.Sprintf("%d FAILED/INCOMPLETE entries: those neighbors do not answer ARP/NDP", bad))
+	}
+	for _, n := range m.ARPEntries {
+		if n.Gateway && (n.State == "FAILED" || n.State == "INCOMPLETE") {
+			summary += "\n" + utils.WarnStyle.Render(fmt.Sprintf("default gateway %s on %s is %s: gateway likely unreachable", n.IP, n.Iface, n.State))
 		}
-		return header + body + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
 	}
 
-	// finished: show collected ARP entries or message
-	if len(m.ARPLog) == 0 {
-		return header + utils.SubtleStyle.Render("No ARP entries collected or command failed.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	// table
+	var cols []string
+	for i, c := range neighborColumns {
+		if i == m.ARPSortCol {
+			arrow := "▲"
+			if m.ARPSortDesc {
+				arrow = "▼"
+			}
+			c += arrow
+		}
+		cols = append(cols, c)
+	}
+	rows := []string{fmt.Sprintf("%-40s %-18s %-12s %-11s %-2s %s", cols[0], cols[1], cols[2], cols[3], "R", cols[4])}
+	for _, n := range m.ARPEntries {
+		router := ""
+		if n.Router {
+			router = "R"
+		}
+		mac := n.MAC
+		if mac == "" {
+			mac = "-"
+		}
+		row := fmt.Sprintf("%-40s %-18s %-12s %-11s %-2s %s", n.IP, mac, n.Iface, n.State, router, n.Vendor)
+		if n.State == "FAILED" || n.State == "INCOMPLETE" {
+			rows = append(rows, utils.WarnStyle.Render(row))
+		} else {
+			rows = append(rows, utils.SubtleStyle.Render(row))
+		}
 	}
-	return header + utils.SubtleStyle.Render(strings.Join(m.ARPLog, "\n")) + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+
+	footer := utils.SubtleStyle.Render("s: sort column • r: reverse order • m: monitor for ARP spoofing") + "\n" +
+		utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	return header + notes + summary + "\n\n" + strings.Join(rows, "\n") + "\n\n" + footer
 }
@@ -0,0 +1,464 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// ARP spoofing and duplicate address detection. Started from the neighbor
+// table view with "m": for m.ARPMonitorSecs seconds every IPv4 interface is
+// captured with the same pcap helper the frame analyzer uses, our own
+// addresses are probed (RFC 5227 ARP probes), and the collected ARP traffic is
+// checked for:
+//   - one MAC claiming several IPs (gateway impersonation when one is a gateway)
+//   - one IP flapping between MACs during the window
+//   - gratuitous ARP storms
+//   - replies claiming one of our own addresses (duplicate IP)
+//   - ARP sender MAC that differs from the Ethernet source
+// Findings are streamed with timestamps and a few evidence packets each.
+
+const (
+	arpStormPerSecond = 5 // gratuitous ARPs from one sender in one second
+	arpEvidenceMax    = 3
+)
+
+// arpEvent is one captured ARP packet.
+type arpEvent struct {
+	ts     time.Time
+	iface  string
+	op     uint16
+	ethSrc string
+	srcMAC string
+	srcIP  string
+	dstMAC string
+	dstIP  string
+}
+
+func (e arpEvent) String() string {
+	op := "request"
+	if e.op == layers.ARPReply {
+		op = "reply"
+	}
+	s := fmt.Sprintf("%s %s ARP %s %s (%s) -> %s (%s)", e.ts.Format("15:04:05.000"), e.iface, op, e.srcIP, e.srcMAC, e.dstIP, e.dstMAC)
+	if e.ethSrc != e.srcMAC {
+		s += " eth src " + e.ethSrc
+	}
+	return s
+}
+
+func (e arpEvent) gratuitous() bool {
+	return e.srcIP == e.dstIP && e.srcIP != "0.0.0.0"
+}
+
+// arpLocal is an interface we capture on and whose addresses we probe.
+type arpLocal struct {
+	name  string
+	mac   net.HardwareAddr
+	addrs []net.IP
+}
+
+// startARPMonitor switches the ARP view into monitoring mode.
+func startARPMonitor(m utils.Model) (utils.Model, tea.Cmd) {
+	secs := m.ARPMonitorSecs
+	if secs <= 0 {
+		secs = 30
+	}
+	m.Loaded = false
+	m.ARPMonLog = []string{}
+	m.ARPMonChan = make(chan string, 1024)
+	go func(ch chan<- string, window time.Duration, table []utils.Neighbor) {
+		defer close(ch)
+		send := func(s string) {
+			select {
+			case ch <- s:
+			default:
+			}
+		}
+		for _, f := range monitorARP(window, table, send) {
+			send(f)
+		}
+	}(m.ARPMonChan, time.Duration(secs)*time.Second, append([]utils.Neighbor(nil), m.ARPEntries...))
+	return m, utils.Frame()
+}
+
+// pollARPMonitor drains the monitor channel; Loaded is set again once it closes.
+func pollARPMonitor(m utils.Model) (utils.Model, tea.Cmd) {
+	for {
+		select {
+		case line, ok := <-m.ARPMonChan:
+			if !ok {
+				m.ARPMonChan = nil
+				m.Loaded = true
+				return m, nil
+			}
+			m.ARPMonLog = append(m.ARPMonLog, line)
+		default:
+			return m, utils.Frame()
+		}
+	}
+}
+
+func arpLocalInterfaces() []arpLocal {
+	var out []arpLocal
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, ifc := range ifs {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 || len(ifc.HardwareAddr) != 6 {
+			continue
+		}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			continue
+		}
+		l := arpLocal{name: ifc.Name, mac: ifc.HardwareAddr}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+				l.addrs = append(l.addrs, ipn.IP.To4())
+			}
+		}
+		if len(l.addrs) > 0 {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// monitorARP captures ARP on every IPv4 interface for the window, probes our
+// own addresses and returns the findings.
+func monitorARP(window time.Duration, table []utils.Neighbor, send func(string)) []string {
+	locals := arpLocalInterfaces()
+	if len(locals) == 0 {
+		return []string{"no up IPv4 interface with a MAC address to monitor"}
+	}
+
+	events := make(chan arpEvent, 4096)
+	done := make(chan struct{})
+	deadline := time.Now().Add(window)
+	started := 0
+	for _, l := range locals {
+		handle, err := openLiveCapture(l.name, false, 100*time.Millisecond, "arp")
+		if err != nil {
+			send(fmt.Sprintf("%s: capture failed (requires root / libpcap): %v", l.name, err))
+			continue
+		}
+		started++
+		send(fmt.Sprintf("%s: monitoring ARP for %s", l.name, window))
+		go func(l arpLocal, h *pcap.Handle) {
+			defer func() { done <- struct{}{} }()
+			defer h.Close()
+			probed := make(chan struct{})
+			go func() {
+				probeOwnAddresses(h, l, send)
+				close(probed)
+			}()
+			captureARP(h, l.name, deadline, events)
+			// never close the handle while a probe may still write to it
+			<-probed
+		}(l, handle)
+	}
+	if started == 0 {
+		return []string{"ARP monitor could not capture on any interface"}
+	}
+
+	var captured []arpEvent
+	for finished := 0; finished < started; {
+		select {
+		case e := <-events:
+			captured = append(captured, e)
+		case <-done:
+			finished++
+		}
+	}
+	// drain events queued before the last capture goroutine returned
+	for len(events) > 0 {
+		captured = append(captured, <-events)
+	}
+	send(fmt.Sprintf("captured %d ARP packets", len(captured)))
+	return analyzeARP(captured, locals, table)
+}
+
+func captureARP(h *pcap.Handle, iface string, deadline time.Time, events chan<- arpEvent) {
+	for time.Now().Before(deadline) {
+		data, ci, err := h.ReadPacketData()
+		if err != nil {
+			if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+				continue
+			}
+			return
+		}
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+		arpLayer, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+		if !ok || len(arpLayer.SourceProtAddress) != 4 || len(arpLayer.DstProtAddress) != 4 {
+			continue
+		}
+		e := arpEvent{
+			ts:     ci.Timestamp,
+			iface:  iface,
+			op:     arpLayer.Operation,
+			srcMAC: net.HardwareAddr(arpLayer.SourceHwAddress).String(),
+			srcIP:  net.IP(arpLayer.SourceProtAddress).String(),
+			dstMAC: net.HardwareAddr(arpLayer.DstHwAddress).String(),
+			dstIP:  net.IP(arpLayer.DstProtAddress).String(),
+		}
+		if eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+			e.ethSrc = eth.SrcMAC.String()
+		} else {
+			e.ethSrc = e.srcMAC
+		}
+		if e.ts.IsZero() {
+			e.ts = time.Now()
+		}
+		select {
+		case events <- e:
+		default:
+		}
+	}
+}
+
+// probeOwnAddresses sends three RFC 5227 ARP probes (sender IP 0.0.0.0) for
+// each of our addresses, one second apart. Any host answering for one of
+// them shows up as a duplicate in analyzeARP.
+func probeOwnAddresses(h *pcap.Handle, l arpLocal, send func(string)) {
+	for i := 0; i < 3; i++ {
+		for _, ip := range l.addrs {
+			eth := layers.Ethernet{
+				SrcMAC:       l.mac,
+				DstMAC:       layers.EthernetBroadcast,
+				EthernetType: layers.EthernetTypeARP,
+			}
+			arp := layers.ARP{
+				AddrType:          layers.LinkTypeEthernet,
+				Protocol:          layers.EthernetTypeIPv4,
+				HwAddressSize:     6,
+				ProtAddressSize:   4,
+				Operation:         layers.ARPRequest,
+				SourceHwAddress:   l.mac,
+				SourceProtAddress: net.IPv4zero.To4(),
+				DstHwAddress:      make([]byte, 6),
+				DstProtAddress:    ip,
+			}
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &eth, &arp); err != nil {
+				continue
+			}
+			if err := h.WritePacketData(buf.Bytes()); err != nil {
+				send(fmt.Sprintf("%s: ARP probe for %s failed: %v", l.name, ip, err))
+				return
+			}
+			if i == 0 {
+				send(fmt.Sprintf("%s: probing %s for duplicate address", l.name, ip))
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// analyzeARP turns captured packets (plus the neighbor table) into findings.
+func analyzeARP(events []arpEvent, locals []arpLocal, table []utils.Neighbor) []string {
+	var findings []string
+	evidence := func(evs []arpEvent) string {
+		var lines []string
+		for i, e := range evs {
+			if i == arpEvidenceMax {
+				lines = append(lines, fmt.Sprintf("    ... %d more", len(evs)-arpEvidenceMax))
+				break
+			}
+			lines = append(lines, "    "+e.String())
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	ownMAC := map[string]bool{}
+	ownIP := map[string]string{} // ip -> our MAC on that interface
+	for _, l := range locals {
+		ownMAC[l.mac.String()] = true
+		for _, ip := range l.addrs {
+			ownIP[ip.String()] = l.mac.String()
+		}
+	}
+	gateways := map[string]bool{}
+	for _, gw := range defaultGateways() {
+		gateways[gw] = true
+	}
+
+	// one MAC claiming several IPs, from captured senders and the neighbor table
+	macIPs := map[string]map[string]bool{}
+	macEvents := map[string][]arpEvent{}
+	addClaim := func(mac, ip string) {
+		if mac == "" || ip == "0.0.0.0" || net.ParseIP(ip).To4() == nil || ownMAC[mac] {
+			return
+		}
+		if macIPs[mac] == nil {
+			macIPs[mac] = map[string]bool{}
+		}
+		macIPs[mac][ip] = true
+	}
+	for _, n := range table {
+		addClaim(n.MAC, n.IP)
+	}
+	for _, e := range events {
+		addClaim(e.srcMAC, e.srcIP)
+		if !ownMAC[e.srcMAC] {
+			macEvents[e.srcMAC] = append(macEvents[e.srcMAC], e)
+		}
+	}
+	for _, mac := range sortedKeys(macIPs) {
+		if len(macIPs[mac]) < 2 {
+			continue
+		}
+		ips := sortedKeys(macIPs[mac])
+		var gw []string
+		for _, ip := range ips {
+			if gateways[ip] {
+				gw = append(gw, ip)
+			}
+		}
+		f := fmt.Sprintf("WARNING MAC %s claims %d IPs: %s", mac, len(ips), strings.Join(ips, ", "))
+		if len(gw) > 0 {
+			f = fmt.Sprintf("ALERT possible gateway impersonation: MAC %s claims gateway %s and %d other IPs (%s)",
+				mac, strings.Join(gw, ", "), len(ips)-len(gw), strings.Join(ips, ", "))
+		}
+		if evs := macEvents[mac]; len(evs) > 0 {
+			f += "\n" + evidence(evs)
+		}
+		findings = append(findings, f)
+	}
+
+	// one IP flapping between MACs during the window
+	ipEvents := map[string][]arpEvent{}
+	for _, e := range events {
+		if e.srcIP != "0.0.0.0" {
+			ipEvents[e.srcIP] = append(ipEvents[e.srcIP], e)
+		}
+	}
+	for _, ip := range sortedKeys(ipEvents) {
+		evs := ipEvents[ip]
+		macs := map[string]bool{}
+		changes := 0
+		var flips []arpEvent
+		for i, e := range evs {
+			macs[e.srcMAC] = true
+			if i > 0 && e.srcMAC != evs[i-1].srcMAC {
+				changes++
+				flips = append(flips, evs[i-1], e)
+			}
+		}
+		if len(macs) < 2 {
+			continue
+		}
+		if _, ok := ownIP[ip]; ok {
+			// reported below as a duplicate address
+			continue
+		}
+		findings = append(findings, fmt.Sprintf("WARNING %s flapped between %d MACs (%s), %d changes from %s to %s\n%s",
+			ip, len(macs), strings.Join(sortedKeys(macs), ", "), changes,
+			evs[0].ts.Format("15:04:05.000"), evs[len(evs)-1].ts.Format("15:04:05.000"), evidence(flips)))
+	}
+
+	// gratuitous ARP storms: too many gratuitous ARPs from one sender in a second
+	type bucket struct {
+		mac string
+		sec int64
+	}
+	grat := map[bucket][]arpEvent{}
+	for _, e := range events {
+		if e.gratuitous() {
+			b := bucket{e.srcMAC, e.ts.Unix()}
+			grat[b] = append(grat[b], e)
+		}
+	}
+	stormed := map[string]bool{}
+	var buckets []bucket
+	for b := range grat {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].sec < buckets[j].sec })
+	for _, b := range buckets {
+		evs := grat[b]
+		if len(evs) < arpStormPerSecond || stormed[b.mac] {
+			continue
+		}
+		stormed[b.mac] = true
+		findings = append(findings, fmt.Sprintf("WARNING gratuitous ARP storm from %s: %d in one second at %s\n%s",
+			b.mac, len(evs), time.Unix(b.sec, 0).Format("15:04:05"), evidence(evs)))
+	}
+
+	// duplicate addresses: someone else uses one of our IPs
+	dups := map[string][]arpEvent{}
+	for _, e := range events {
+		mine, ok := ownIP[e.srcIP]
+		if ok && e.srcMAC != mine && !ownMAC[e.srcMAC] {
+			dups[e.srcIP] = append(dups[e.srcIP], e)
+		}
+		// another host probing for our address at the same time (RFC 5227 conflict)
+		if mine, ok := ownIP[e.dstIP]; ok && e.srcIP == "0.0.0.0" && e.srcMAC != mine && !ownMAC[e.srcMAC] {
+			dups[e.dstIP] = append(dups[e.dstIP], e)
+		}
+	}
+	for _, ip := range sortedKeys(dups) {
+		evs := dups[ip]
+		findings = append(findings, fmt.Sprintf("ALERT duplicate address: %s is also used by %s (first seen %s)\n%s",
+			ip, evs[0].srcMAC, evs[0].ts.Format("15:04:05.000"), evidence(evs)))
+	}
+
+	// ARP sender hardware address that does not match the Ethernet source
+	mismatch := map[string][]arpEvent{}
+	for _, e := range events {
+		if e.ethSrc != "" && e.ethSrc != e.srcMAC && !ownMAC[e.ethSrc] {
+			mismatch[e.ethSrc] = append(mismatch[e.ethSrc], e)
+		}
+	}
+	for _, src := range sortedKeys(mismatch) {
+		evs := mismatch[src]
+		findings = append(findings, fmt.Sprintf("WARNING %s sends ARP with a different sender MAC (%s)\n%s",
+			src, evs[0].srcMAC, evidence(evs)))
+	}
+
+	if len(findings) == 0 {
+		findings = append(findings, "No ARP spoofing or duplicate address detected.")
+	}
+	return findings
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// arpMonitorView renders the monitor progress and findings below the notes.
+func arpMonitorView(m utils.Model) string {
+	var lines []string
+	for _, l := range m.ARPMonLog {
+		if strings.HasPrefix(l, "ALERT") || strings.HasPrefix(l, "WARNING") {
+			lines = append(lines, utils.WarnStyle.Render(l))
+		} else {
+			lines = append(lines, utils.SubtleStyle.Render(l))
+		}
+	}
+	body := strings.Join(lines, "\n")
+	if m.ARPMonChan != nil {
+		if body == "" {
+			body = utils.SubtleStyle.Render("starting ARP monitor...")
+		}
+		return body + "\n\n" + utils.SubtleStyle.Render(fmt.Sprintf("Monitoring for %ds...", m.ARPMonitorSecs))
+	}
+	return body + "\n\n" + utils.SubtleStyle.Render("m: monitor again") + "\n" +
+		utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+}
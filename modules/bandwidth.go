@@ -2,98 +2,77 @@ package modules
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"network-check/utils"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-// Check bandwidth: try `speedtest` (Ookla) then `speedtest-cli` (python) as fallback.
-// Streams output into m.BandwidthLog and marks Loaded when finished.
+// Check bandwidth: try `speedtest` (Ookla), then `speedtest-cli` (python) and
+// `librespeed-cli` as fallbacks, each in its JSON output mode. Whichever ran,
+// the output is parsed into a utils.SpeedResult so download, upload, latency,
+// jitter, server and ISP show the same way, and every result is appended to
+// a history file (speedtestHistoryFile) the view compares with.
 // Conservative: uses a timeout so it won't hang indefinitely.
 
+// speedtestHistoryFile holds one JSON result per line, under dataDir.
+const speedtestHistoryFile = "speedtests.jsonl"
+
+// speedtestHistoryShown is the number of earlier results listed.
+const speedtestHistoryShown = 5
+
+// speedtestTool is one backend and the parser of its JSON output.
+type speedtestTool struct {
+	name  string
+	args  []string
+	parse func([]byte) (utils.SpeedResult, error)
+}
+
+var speedtestTools = []speedtestTool{
+	{"speedtest", []string{"--format=json", "--accept-license", "--accept-gdpr"}, parseOoklaJSON},
+	{"speedtest-cli", []string{"--json", "--secure"}, parseSpeedtestCliJSON},
+	// the python tool also installs itself as "speedtest" on some systems
+	{"speedtest", []string{"--json", "--secure"}, parseSpeedtestCliJSON},
+	{"librespeed-cli", []string{"--json"}, parseLibrespeedJSON},
+}
+
 func UpdateBandwidth(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 	switch msg.(type) {
 	case utils.FrameMsg:
 		if !m.Loaded && m.BandwidthChan == nil {
-			m.BandwidthChan = make(chan string, 512)
-			go func(ch chan<- string) {
-				defer close(ch)
-				// give the check a reasonable overall timeout
-				ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-				defer cancel()
-
-				try := func(name string, args ...string) bool {
-					cmd := exec.CommandContext(ctx, name, args...)
-					stdout, err := cmd.StdoutPipe()
-					if err != nil {
-						return false
-					}
-					stderr, _ := cmd.StderrPipe()
-					if err := cmd.Start(); err != nil {
-						return false
-					}
-					// stream stdout
-					outScanner := bufio.NewScanner(stdout)
-					go func() {
-						for outScanner.Scan() {
-							select {
-							case ch <- outScanner.Text():
-							default:
-							}
-						}
-					}()
-					// stream stderr too
-					errScanner := bufio.NewScanner(stderr)
-					for errScanner.Scan() {
-						select {
-						case ch <- errScanner.Text():
-						default:
-						}
-					}
-					_ = cmd.Wait()
-					return true
-				}
-
-				// try known backends
-				if try("speedtest", "--simple") {
-					return
-				}
-				if try("speedtest-cli", "--simple") {
-					return
-				}
-				if try("librespeed-cli", "--simple") {
-					return
-				}
-
-				// nothing worked -- emit helpful message
-				select {
-				case ch <- "no speedtest binary available (tried: speedtest, speedtest-cli, fast) or they require privileges":
-				default:
-				}
-			}(m.BandwidthChan)
+			m.BandwidthLog = []string{}
+			m.BandwidthResult = nil
+			m.BandwidthHistory = readSpeedtestHistory()
+			m.BandwidthChan = make(chan utils.BandwidthResult, 512)
+			go runSpeedtest(m.BandwidthChan)
 			return m, utils.Frame()
 		}
 
 		if m.BandwidthChan != nil {
 			for {
 				select {
-				case line, ok := <-m.BandwidthChan:
+				case r, ok := <-m.BandwidthChan:
 					if !ok {
 						m.BandwidthChan = nil
 						m.Loaded = true
 						return m, nil
 					}
-					trim := strings.TrimSpace(line)
-					if trim == "" {
+					if r.Result != nil {
+						m.BandwidthResult = r.Result
 						continue
 					}
-					// keep log, and also try to capture concise summary lines
-					m.BandwidthLog = append(m.BandwidthLog, trim)
-					return m, utils.Frame()
+					if trim := strings.TrimSpace(r.Msg); trim != "" {
+						m.BandwidthLog = append(m.BandwidthLog, trim)
+					}
 				default:
 					return m, utils.Frame()
 				}
@@ -103,34 +82,356 @@ func UpdateBandwidth(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
-func ChosenBandwidthView(m utils.Model) string {
-	header := utils.KeywordStyle.Render("Bandwidth check:") + " speedtest / speedtest-cli\n\n"
+// runSpeedtest runs the first backend that is installed and produces a
+// result, and saves that result to the history.
+func runSpeedtest(ch chan<- utils.BandwidthResult) {
+	defer close(ch)
+	note := func(s string) {
+		select {
+		case ch <- utils.BandwidthResult{Msg: s}:
+		default:
+		}
+	}
+	// give the check a reasonable overall timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+	defer cancel()
 
-	if !m.Loaded {
-		body := utils.SubtleStyle.Render("running bandwidth test...")
-		if len(m.BandwidthLog) > 0 {
-			body = strings.Join(m.BandwidthLog, "\n")
+	tried := map[string]bool{}
+	for _, t := range speedtestTools {
+		if _, err := exec.LookPath(t.name); err != nil {
+			continue
 		}
-		return header + body + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+		note(fmt.Sprintf("running %s %s (takes about 30 s)...", t.name, strings.Join(t.args, " ")))
+		tried[t.name] = true
+		var stdout bytes.Buffer
+		cmd := exec.CommandContext(ctx, t.name, t.args...)
+		cmd.Stdout = &stdout
+		stderr, _ := cmd.StderrPipe()
+		if err := cmd.Start(); err != nil {
+			note(fmt.Sprintf("%s: %v", t.name, err))
+			continue
+		}
+		// stream stderr, where the tools report problems
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			note(t.name + ": " + sc.Text())
+		}
+		waitErr := cmd.Wait()
+		r, err := t.parse(stdout.Bytes())
+		if err != nil {
+			if waitErr != nil {
+				err = fmt.Errorf("%v (%v)", err, waitErr)
+			}
+			note(fmt.Sprintf("%s: no result: %v", t.name, err))
+			continue
+		}
+		if r.Time.IsZero() {
+			r.Time = time.Now()
+		}
+		if err := appendSpeedtestHistory(r); err != nil {
+			note("could not save the result: " + err.Error())
+		}
+		ch <- utils.BandwidthResult{Result: &r}
+		return
 	}
 
-	if len(m.BandwidthLog) == 0 {
-		return header + utils.SubtleStyle.Render("No bandwidth output collected or command failed.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	if len(tried) == 0 {
+		// nothing worked -- emit helpful message
+		note("no speedtest binary available (tried: speedtest, speedtest-cli, librespeed-cli) or they require privileges; to test between your own hosts, run 'network-check bwserver' on one and \"Test throughput (bwserver)\" on the other")
 	}
+}
 
-	// show collected output (try to surface common summary lines at top)
-	var summary []string
-	for _, l := range m.BandwidthLog {
-		ll := strings.ToLower(l)
-		if strings.Contains(ll, "download") || strings.Contains(ll, "upload") || strings.Contains(ll, "ping") || strings.Contains(ll, "download:") || strings.Contains(ll, "upload:") || strings.Contains(ll, "bytes/sec") || strings.Contains(ll, "mbit/s") || strings.Contains(ll, "mbps") {
-			summary = append(summary, l)
+// parseOoklaJSON parses "speedtest --format=json". Bandwidths are in bytes
+// per second; problems come as {"type":"log","level":"error"} lines.
+func parseOoklaJSON(b []byte) (utils.SpeedResult, error) {
+	var last error = errors.New("no result in the output")
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var v struct {
+			Type      string `json:"type"`
+			Level     string `json:"level"`
+			Message   string `json:"message"`
+			Timestamp string `json:"timestamp"`
+			Ping      struct {
+				Jitter  float64 `json:"jitter"`
+				Latency float64 `json:"latency"`
+			} `json:"ping"`
+			Download struct {
+				Bandwidth float64 `json:"bandwidth"`
+			} `json:"download"`
+			Upload struct {
+				Bandwidth float64 `json:"bandwidth"`
+			} `json:"upload"`
+			PacketLoss *float64 `json:"packetLoss"`
+			ISP        string   `json:"isp"`
+			Interface  struct {
+				ExternalIP string `json:"externalIp"`
+			} `json:"interface"`
+			Server struct {
+				Host     string `json:"host"`
+				Name     string `json:"name"`
+				Location string `json:"location"`
+				Country  string `json:"country"`
+			} `json:"server"`
+			Result struct {
+				URL string `json:"url"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(line, &v); err != nil {
+			last = err
+			continue
+		}
+		switch v.Type {
+		case "log":
+			if v.Level == "error" {
+				last = errors.New(v.Message)
+			}
+			continue
+		case "result":
+		default:
+			continue
+		}
+		r := utils.SpeedResult{
+			Tool:       "speedtest (Ookla)",
+			Time:       parseTimestamp(v.Timestamp),
+			Download:   v.Download.Bandwidth * 8,
+			Upload:     v.Upload.Bandwidth * 8,
+			Latency:    msDuration(v.Ping.Latency),
+			Jitter:     msDuration(v.Ping.Jitter),
+			PacketLoss: -1,
+			Server:     joinNonEmpty(" — ", v.Server.Name, joinNonEmpty(", ", v.Server.Location, v.Server.Country)),
+			ServerHost: v.Server.Host,
+			ISP:        v.ISP,
+			ClientIP:   v.Interface.ExternalIP,
+			URL:        v.Result.URL,
 		}
+		if v.PacketLoss != nil {
+			r.PacketLoss = *v.PacketLoss
+		}
+		return r, nil
+	}
+	return utils.SpeedResult{}, last
+}
+
+// parseSpeedtestCliJSON parses "speedtest-cli --json". Rates are in bits per
+// second and the ping in ms; it measures neither jitter nor loss.
+func parseSpeedtestCliJSON(b []byte) (utils.SpeedResult, error) {
+	var v struct {
+		Download  float64 `json:"download"`
+		Upload    float64 `json:"upload"`
+		Ping      float64 `json:"ping"`
+		Timestamp string  `json:"timestamp"`
+		Share     string  `json:"share"`
+		Server    struct {
+			Name    string `json:"name"`
+			Country string `json:"country"`
+			Sponsor string `json:"sponsor"`
+			Host    string `json:"host"`
+		} `json:"server"`
+		Client struct {
+			IP  string `json:"ip"`
+			ISP string `json:"isp"`
+		} `json:"client"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(b), &v); err != nil {
+		return utils.SpeedResult{}, err
+	}
+	if v.Download == 0 && v.Upload == 0 {
+		return utils.SpeedResult{}, errors.New("no measurement in the output")
+	}
+	return utils.SpeedResult{
+		Tool:       "speedtest-cli",
+		Time:       parseTimestamp(v.Timestamp),
+		Download:   v.Download,
+		Upload:     v.Upload,
+		Latency:    msDuration(v.Ping),
+		PacketLoss: -1,
+		Server:     joinNonEmpty(" — ", v.Server.Sponsor, joinNonEmpty(", ", v.Server.Name, v.Server.Country)),
+		ServerHost: v.Server.Host,
+		ISP:        v.Client.ISP,
+		ClientIP:   v.Client.IP,
+		URL:        v.Share,
+	}, nil
+}
+
+// parseLibrespeedJSON parses "librespeed-cli --json": a list with one
+// result per server, rates in Mbit/s, ping and jitter in ms.
+func parseLibrespeedJSON(b []byte) (utils.SpeedResult, error) {
+	var list []struct {
+		Timestamp string `json:"timestamp"`
+		Server    struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		} `json:"server"`
+		Client struct {
+			IP  string `json:"ip"`
+			Org string `json:"org"`
+		} `json:"client"`
+		Ping     float64 `json:"ping"`
+		Jitter   float64 `json:"jitter"`
+		Download float64 `json:"download"`
+		Upload   float64 `json:"upload"`
+		Share    string  `json:"share"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(b), &list); err != nil {
+		return utils.SpeedResult{}, err
+	}
+	if len(list) == 0 {
+		return utils.SpeedResult{}, errors.New("no measurement in the output")
 	}
-	var body string
-	if len(summary) > 0 {
-		body = "Summary:\n" + strings.Join(summary, "\n") + "\n\nRaw output:\n" + strings.Join(m.BandwidthLog, "\n")
+	v := list[0]
+	return utils.SpeedResult{
+		Tool:       "librespeed-cli",
+		Time:       parseTimestamp(v.Timestamp),
+		Download:   v.Download * 1e6,
+		Upload:     v.Upload * 1e6,
+		Latency:    msDuration(v.Ping),
+		Jitter:     msDuration(v.Jitter),
+		PacketLoss: -1,
+		Server:     v.Server.Name,
+		ServerHost: v.Server.URL,
+		ISP:        v.Client.Org,
+		ClientIP:   v.Client.IP,
+		URL:        v.Share,
+	}, nil
+}
+
+// parseTimestamp accepts the RFC 3339 timestamps of the tools; a zero time
+// (replaced by the current time) otherwise.
+func parseTimestamp(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
+
+func msDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// joinNonEmpty joins the parts that are not empty.
+func joinNonEmpty(sep string, parts ...string) string {
+	var out []string
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return strings.Join(out, sep)
+}
+
+func appendSpeedtestHistory(r utils.SpeedResult) error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, speedtestHistoryFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readSpeedtestHistory returns the saved results, skipping lines it cannot
+// parse.
+func readSpeedtestHistory() []utils.SpeedResult {
+	dir, err := dataDir()
+	if err != nil {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(dir, speedtestHistoryFile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var out []utils.SpeedResult
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r utils.SpeedResult
+		if json.Unmarshal(sc.Bytes(), &r) == nil {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func formatMbps(bps float64) string {
+	return fmt.Sprintf("%.1f Mbit/s", bps/1e6)
+}
+
+// speedResultLines renders a result as aligned label/value lines.
+func speedResultLines(r utils.SpeedResult) []string {
+	lat := formatRTT(r.Latency)
+	if r.Jitter > 0 {
+		lat += fmt.Sprintf(" (jitter %s)", formatRTT(r.Jitter))
+	}
+	rows := [][2]string{
+		{"Download", formatMbps(r.Download)},
+		{"Upload", formatMbps(r.Upload)},
+		{"Latency", lat},
+	}
+	if r.PacketLoss >= 0 {
+		rows = append(rows, [2]string{"Packet loss", fmt.Sprintf("%.1f%%", r.PacketLoss)})
+	}
+	rows = append(rows,
+		[2]string{"Server", joinNonEmpty(" ", r.Server, parenthesize(r.ServerHost))},
+		[2]string{"ISP", joinNonEmpty(" ", r.ISP, parenthesize(r.ClientIP))},
+		[2]string{"Tool", r.Tool},
+	)
+	if r.URL != "" {
+		rows = append(rows, [2]string{"Result", r.URL})
+	}
+	var out []string
+	for _, row := range rows {
+		if row[1] != "" {
+			out = append(out, fmt.Sprintf("%-12s %s", row[0], row[1]))
+		}
+	}
+	return out
+}
+
+func parenthesize(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "(" + s + ")"
+}
+
+func ChosenBandwidthView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("Bandwidth check:") + " speedtest / speedtest-cli / librespeed-cli\n\n"
+
+	var b strings.Builder
+	if len(m.BandwidthLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.BandwidthLog, "\n")) + "\n\n")
+	}
+
+	if !m.Loaded {
+		return header + b.String() + utils.SubtleStyle.Render("Running bandwidth test...")
+	}
+
+	if r := m.BandwidthResult; r != nil {
+		b.WriteString(utils.KeywordStyle.Render(strings.Join(speedResultLines(*r), "\n")) + "\n\n")
 	} else {
-		body = "Raw output:\n" + strings.Join(m.BandwidthLog, "\n")
+		b.WriteString(utils.SubtleStyle.Render("No bandwidth result collected or command failed.") + "\n\n")
+	}
+
+	if h := m.BandwidthHistory; len(h) > 0 {
+		rows := []string{fmt.Sprintf("%-16s %14s %14s %9s  %s", "Earlier results", "Download", "Upload", "Latency", "Server")}
+		for _, r := range h[max(0, len(h)-speedtestHistoryShown):] {
+			rows = append(rows, fmt.Sprintf("%-16s %14s %14s %9s  %s", r.Time.Local().Format("2006-01-02 15:04"), formatMbps(r.Download), formatMbps(r.Upload), formatRTT(r.Latency), r.Server))
+		}
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(rows, "\n")) + "\n\n")
 	}
-	return header + utils.SubtleStyle.Render(body) + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	return header + b.String() + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
 }
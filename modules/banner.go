@@ -0,0 +1,339 @@
+package modules
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Service identification for open TCP ports, shared by the open ports and
+// remote port checks ("i" in either view). Each port is tried in turn with:
+// a passive read for servers that speak first (SSH, SMTP, FTP, POP3, IMAP,
+// MySQL), a TLS handshake offering h2/http/1.1 (certificate subject, ALPN,
+// then HTTP over TLS), a plain HTTP HEAD, and a Redis INFO command. Every
+// attempt uses a fresh connection so one protocol's garbage does not confuse
+// the next.
+
+// identifyWorkers is the number of ports identified at once.
+const identifyWorkers = 16
+
+const identifyTimeout = 3 * time.Second
+
+// identifyTarget is one open port; index points back into the view's table.
+type identifyTarget struct {
+	index int
+	ip    string
+	name  string // host name for SNI and the HTTP Host header
+	port  int
+}
+
+// startIdentify identifies the targets in the background. Like the ARP
+// monitor, Loaded is cleared until the channel closes.
+func startIdentify(m utils.Model, targets []identifyTarget) (utils.Model, tea.Cmd) {
+	m.Loaded = false
+	m.IdentifyChan = make(chan utils.IdentifyResult, len(targets))
+	go func(ch chan<- utils.IdentifyResult) {
+		defer close(ch)
+		sem := make(chan struct{}, identifyWorkers)
+		var wg sync.WaitGroup
+		for _, t := range targets {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				ch <- utils.IdentifyResult{Index: t.index, ID: identifyService(t.ip, t.name, t.port, identifyTimeout)}
+			}()
+		}
+		wg.Wait()
+	}(m.IdentifyChan)
+	return m, utils.Frame()
+}
+
+// pollIdentify drains the identification channel into the view's table.
+func pollIdentify(m utils.Model, apply func(*utils.Model, utils.IdentifyResult)) (utils.Model, tea.Cmd) {
+	for {
+		select {
+		case r, ok := <-m.IdentifyChan:
+			if !ok {
+				m.IdentifyChan = nil
+				m.Loaded = true
+				return m, nil
+			}
+			apply(&m, r)
+		default:
+			return m, utils.Frame()
+		}
+	}
+}
+
+// identifyService runs the probes against one port until one recognizes it.
+func identifyService(ip, name string, port int, timeout time.Duration) utils.ServiceID {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	if name == "" {
+		name = ip
+	}
+
+	greeting := grabBanner(addr, nil, timeout/2, timeout)
+	if id, ok := parseGreeting(greeting, port); ok {
+		return id
+	}
+	if id, ok := probeTLS(addr, name, timeout); ok {
+		return id
+	}
+	if id, ok := parseHTTP(grabBanner(addr, httpHead(name), timeout, timeout)); ok {
+		return id
+	}
+	if id, ok := parseRedis(grabBanner(addr, []byte("*2\r\n$4\r\nINFO\r\n$6\r\nserver\r\n"), timeout, timeout)); ok {
+		return id
+	}
+
+	id := utils.ServiceID{Service: "unknown", Detail: "no banner, not TLS/HTTP/Redis"}
+	if len(greeting) > 0 {
+		id.Detail = "banner: " + printable(greeting, 60)
+	}
+	return id
+}
+
+// grabBanner connects, optionally sends a request, and returns the first
+// bytes the server sends within wait.
+func grabBanner(addr string, req []byte, wait, timeout time.Duration) []byte {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(wait))
+	if len(req) > 0 {
+		if _, err := c.Write(req); err != nil {
+			return nil
+		}
+	}
+	buf := make([]byte, 4096)
+	n, _ := c.Read(buf)
+	return buf[:n]
+}
+
+func httpHead(host string) []byte {
+	return []byte("HEAD / HTTP/1.1\r\nHost: " + host + "\r\nUser-Agent: network-check\r\nConnection: close\r\n\r\n")
+}
+
+// parseGreeting recognizes servers that announce themselves on connect.
+func parseGreeting(b []byte, port int) (utils.ServiceID, bool) {
+	if len(b) == 0 {
+		return utils.ServiceID{}, false
+	}
+	// MySQL/MariaDB: 3 byte length, sequence, then protocol 10 and a
+	// NUL-terminated version, or an error packet (0xff) when the host is refused
+	if len(b) > 7 && int(b[0])|int(b[1])<<8|int(b[2])<<16 == len(b)-4 {
+		switch b[4] {
+		case 0x0a:
+			v := b[5:]
+			if i := bytes.IndexByte(v, 0); i >= 0 {
+				v = v[:i]
+			}
+			svc := "mysql"
+			if bytes.Contains(v, []byte("MariaDB")) {
+				svc = "mariadb"
+			}
+			return utils.ServiceID{Service: svc, Version: string(v), Detail: "handshake"}, true
+		case 0xff:
+			code := binary.LittleEndian.Uint16(b[5:7])
+			return utils.ServiceID{Service: "mysql", Detail: fmt.Sprintf("refuses this host: error %d %s", code, printable(b[7:], 80))}, true
+		}
+	}
+
+	line := firstLine(b)
+	switch {
+	case strings.HasPrefix(line, "SSH-"):
+		// SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13
+		proto, v, _ := strings.Cut(line[4:], "-")
+		return utils.ServiceID{Service: "ssh", Version: v, Detail: "protocol " + proto}, true
+	case strings.HasPrefix(line, "220"):
+		text := strings.TrimLeft(line[3:], " -")
+		up := strings.ToUpper(text)
+		svc := "smtp"
+		if strings.Contains(up, "FTP") || (port == 21 && !strings.Contains(up, "SMTP")) {
+			svc = "ftp"
+		}
+		return utils.ServiceID{Service: svc, Version: bannerSoftware(text), Detail: line}, true
+	case strings.HasPrefix(line, "+OK"):
+		return utils.ServiceID{Service: "pop3", Version: bannerSoftware(strings.TrimSpace(line[3:])), Detail: line}, true
+	case strings.HasPrefix(line, "* OK"):
+		return utils.ServiceID{Service: "imap", Version: bannerSoftware(strings.TrimSpace(line[4:])), Detail: line}, true
+	}
+	return utils.ServiceID{}, false
+}
+
+// bannerSoftware picks the software name out of a greeting such as
+// "mail.example.com ESMTP Postfix (Ubuntu)" or "(vsFTPd 3.0.5)".
+func bannerSoftware(text string) string {
+	for _, known := range []string{"Postfix", "Exim", "Sendmail", "Microsoft ESMTP", "OpenSMTPD", "vsFTPd", "ProFTPD", "Pure-FTPd", "FileZilla", "Dovecot", "Cyrus", "Courier"} {
+		if i := strings.Index(strings.ToLower(text), strings.ToLower(known)); i >= 0 {
+			v := text[i:]
+			if j := strings.IndexAny(v, "()[]"); j >= 0 {
+				v = v[:j]
+			}
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// probeTLS performs a handshake and, unless h2 was negotiated, asks for the
+// HTTP server header over the encrypted connection.
+func probeTLS(addr, name string, timeout time.Duration) (utils.ServiceID, bool) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: true, // we describe the certificate, not trust it
+		NextProtos:         []string{"h2", "http/1.1"},
+	}
+	if net.ParseIP(name) == nil {
+		cfg.ServerName = name
+	}
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, cfg)
+	if err != nil {
+		return utils.ServiceID{}, false
+	}
+	defer c.Close()
+	st := c.ConnectionState()
+
+	var parts []string
+	if len(st.PeerCertificates) > 0 {
+		cert := st.PeerCertificates[0]
+		subject := cert.Subject.CommonName
+		if subject == "" && len(cert.DNSNames) > 0 {
+			subject = cert.DNSNames[0]
+		}
+		parts = append(parts, "cert "+subject)
+		if len(cert.DNSNames) > 1 {
+			parts = append(parts, fmt.Sprintf("%d SANs", len(cert.DNSNames)))
+		}
+		if issuer := cert.Issuer.CommonName; issuer != "" {
+			parts = append(parts, "issuer "+issuer)
+		}
+		parts = append(parts, "expires "+cert.NotAfter.Format("2006-01-02"))
+	}
+	alpn := st.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	parts = append(parts, "ALPN "+alpn, tls.VersionName(st.Version))
+	id := utils.ServiceID{Service: "tls", Detail: strings.Join(parts, ", ")}
+
+	switch alpn {
+	case "h2":
+		id.Service = "https"
+		id.Version = "HTTP/2"
+	default:
+		_ = c.SetDeadline(time.Now().Add(timeout))
+		if _, err := c.Write(httpHead(name)); err == nil {
+			buf := make([]byte, 4096)
+			n, _ := c.Read(buf)
+			if h, ok := parseHTTP(buf[:n]); ok {
+				id.Service = "https"
+				id.Version = h.Version
+				id.Detail = h.Detail + ", " + id.Detail
+			}
+		}
+	}
+	return id, true
+}
+
+// parseHTTP reads the status line and Server header of a response.
+func parseHTTP(b []byte) (utils.ServiceID, bool) {
+	if !bytes.HasPrefix(b, []byte("HTTP/")) {
+		return utils.ServiceID{}, false
+	}
+	id := utils.ServiceID{Service: "http", Detail: firstLine(b)}
+	for _, l := range strings.Split(string(b), "\r\n")[1:] {
+		if k, v, ok := strings.Cut(l, ":"); ok && strings.EqualFold(k, "Server") {
+			id.Version = strings.TrimSpace(v)
+		}
+	}
+	return id, true
+}
+
+// parseRedis recognizes the reply to INFO server, or the errors Redis sends
+// when authentication or protected mode stops it.
+func parseRedis(b []byte) (utils.ServiceID, bool) {
+	s := string(b)
+	switch {
+	case strings.HasPrefix(s, "$") && strings.Contains(s, "redis_version:"):
+		id := utils.ServiceID{Service: "redis"}
+		for _, l := range strings.Split(s, "\r\n") {
+			if v, ok := strings.CutPrefix(l, "redis_version:"); ok {
+				id.Version = v
+			}
+			if v, ok := strings.CutPrefix(l, "redis_mode:"); ok {
+				id.Detail = "mode " + v + ", no authentication required"
+			}
+		}
+		return id, true
+	case strings.HasPrefix(s, "-NOAUTH"):
+		return utils.ServiceID{Service: "redis", Detail: "authentication required"}, true
+	case strings.HasPrefix(s, "-DENIED"):
+		return utils.ServiceID{Service: "redis", Detail: "protected mode, refuses remote clients"}, true
+	}
+	return utils.ServiceID{}, false
+}
+
+func firstLine(b []byte) string {
+	line, _, _ := strings.Cut(string(b), "\n")
+	return printable([]byte(strings.TrimRight(line, "\r")), 120)
+}
+
+// printable replaces control bytes with dots and shortens to limit runes.
+func printable(b []byte, limit int) string {
+	out := []rune(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '�' {
+			return '.'
+		}
+		return r
+	}, string(b)))
+	if len(out) > limit {
+		return string(out[:limit]) + "…"
+	}
+	return string(out)
+}
+
+// serviceLabel renders a table's service column: the identified service and
+// version, or the well-known port name until identification ran. A service
+// that differs from what the port is known for is pointed out.
+func serviceLabel(known string, id *utils.ServiceID) string {
+	if id == nil {
+		return known
+	}
+	label := id.Service
+	if id.Version != "" {
+		label += " " + id.Version
+	}
+	if id.Detail != "" {
+		label += " (" + id.Detail + ")"
+	}
+	if known != "" && !serviceMatches(known, id.Service) {
+		label += ", not " + known
+	}
+	return label
+}
+
+// serviceAliases are identified services that fit a well-known port name.
+var serviceAliases = map[string][]string{
+	"https": {"tls"}, "https-alt": {"https", "tls"}, "http-alt": {"http"}, "mysql": {"mariadb"},
+	"smtps": {"smtp", "tls"}, "submission": {"smtp"}, "imaps": {"imap", "tls"}, "pop3s": {"pop3", "tls"},
+}
+
+// serviceMatches reports whether an identified service is what the port
+// number suggests.
+func serviceMatches(known, found string) bool {
+	return found == known || found == "unknown" || slices.Contains(serviceAliases[known], found)
+}
@@ -0,0 +1,602 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"network-check/utils"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Bufferbloat test: latency while the link is saturated. Ping runs on the
+// idle link for bloatIdleSecs, then for m.BloatSecs each under download,
+// upload and both at once. The load comes from a bwserver (bw_server.go)
+// over m.ThroughputStreams TCP streams, or from downloading a large file
+// over HTTP(S), which only loads the download direction. Every loaded phase
+// is graded on how far its median latency rises above the idle one, with
+// the thresholds of the common web bufferbloat tests; the worst phase
+// grades the link. A phase whose load failed or stayed below bloatMinLoad
+// measured an idle link and is not graded.
+
+const bloatIdleSecs = 5
+
+// bloatPingInterval is the ping -i argument, the smallest allowed without
+// root.
+const bloatPingInterval = "0.2"
+
+// bloatMinReplies is how many replies a phase needs to be graded.
+const bloatMinReplies = 5
+
+// bloatMinLoad is the rate, in bytes per second, each loaded direction must
+// reach for its phase to be graded.
+const bloatMinLoad = 125_000 // 1 Mbit/s
+
+// bloatSparkWidth is the width of the latency sparkline of each phase.
+const bloatSparkWidth = 30
+
+var bloatPhases = []string{"idle", "download", "upload", "bidirectional"}
+
+// bloatGrades are the grades and the latency rise, in ms, each stays below.
+var bloatGrades = []struct {
+	grade string
+	below float64
+}{
+	{"A+", 5}, {"A", 30}, {"B", 60}, {"C", 200}, {"D", 400}, {"F", 0},
+}
+
+var pingTimeRe = regexp.MustCompile(`time[=<]\s*([\d.]+)\s*ms`)
+
+// bloatLoadGen is where the load comes from: a bwserver address or a URL.
+type bloatLoadGen struct {
+	addr    string
+	url     string
+	streams int
+}
+
+func (l bloatLoadGen) String() string {
+	if l.url != "" {
+		return fmt.Sprintf("%s (%d parallel downloads)", l.url, l.streams)
+	}
+	return fmt.Sprintf("bwserver %s (%d TCP streams)", l.addr, l.streams)
+}
+
+func UpdateBufferbloat(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg.(type) {
+	case utils.FrameMsg:
+		if !m.Loaded && m.BloatChan == nil {
+			if !m.InputSubmitted {
+				return utils.PromptInput(m, "load source: BWSERVER[:PORT] or the URL of a large file, optionally followed by the host to ping:", m.BloatTarget), nil
+			}
+			m.InputSubmitted = false
+			m.BloatLog = []string{}
+			m.BloatSamples = []utils.BloatSample{}
+			m.BloatLoads = []utils.BloatLoad{}
+			m.BloatPhase = ""
+			m.BloatShaping = nil
+			load, target, err := parseBloatSpec(m.Input, m.PingIP, m.ThroughputStreams)
+			if err != nil {
+				m.BloatLog = append(m.BloatLog, err.Error())
+				m.Loaded = true
+				return m, nil
+			}
+			m.BloatTarget = strings.TrimSpace(m.Input)
+			m.BloatChan = make(chan utils.BloatResult, 256)
+			go runBufferbloat(m.BloatChan, load, target, max(m.BloatSecs, 3))
+			return m, utils.Frame()
+		}
+
+		if m.BloatChan != nil {
+			for {
+				select {
+				case r, ok := <-m.BloatChan:
+					if !ok {
+						m.BloatChan = nil
+						m.BloatPhase = ""
+						m.Loaded = true
+						return m, nil
+					}
+					switch {
+					case r.Sample != nil:
+						m.BloatSamples = append(m.BloatSamples, *r.Sample)
+					case r.Load != nil:
+						m.BloatLoads = append(m.BloatLoads, *r.Load)
+					case r.Shaping != nil:
+						m.BloatShaping = r.Shaping
+					case r.Phase != "":
+						m.BloatPhase = r.Phase
+					case r.Msg != "":
+						m.BloatLog = append(m.BloatLog, r.Msg)
+					}
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseBloatSpec parses "BWSERVER[:PORT] | URL [PING_TARGET]".
+func parseBloatSpec(input, pingIP string, streams int) (bloatLoadGen, string, error) {
+	f := strings.Fields(input)
+	if len(f) == 0 || len(f) > 2 {
+		return bloatLoadGen{}, "", fmt.Errorf("expected BWSERVER[:PORT] or URL, then optionally the host to ping, got %q", input)
+	}
+	load := bloatLoadGen{streams: max(streams, 1)}
+	if strings.HasPrefix(f[0], "http://") || strings.HasPrefix(f[0], "https://") {
+		u, err := url.Parse(f[0])
+		if err != nil || u.Host == "" {
+			return bloatLoadGen{}, "", fmt.Errorf("invalid URL %q", f[0])
+		}
+		load.url = u.String()
+	} else {
+		load.addr = f[0]
+		if _, _, err := net.SplitHostPort(load.addr); err != nil {
+			load.addr = net.JoinHostPort(strings.Trim(load.addr, "[]"), strconv.Itoa(bwPort))
+		}
+	}
+	target := pingIP
+	if len(f) > 1 {
+		target = f[1]
+	}
+	if target == "" {
+		target = "8.8.8.8"
+	}
+	return load, target, nil
+}
+
+// runBufferbloat runs the phases one after the other.
+func runBufferbloat(ch chan<- utils.BloatResult, load bloatLoadGen, target string, secs int) {
+	defer close(ch)
+	ch <- utils.BloatResult{Msg: fmt.Sprintf("pinging %s every %s s; load from %s, %d s per loaded phase", target, bloatPingInterval, load, secs)}
+
+	if shaping, err := localShaping(); err != nil {
+		ch <- utils.BloatResult{Msg: "could not list the qdiscs of this host: " + err.Error()}
+	} else {
+		ch <- utils.BloatResult{Shaping: shaping}
+	}
+
+	if load.addr != "" {
+		c, err := net.DialTimeout("tcp", load.addr, bwJoinWait)
+		if err != nil {
+			ch <- utils.BloatResult{Msg: fmt.Sprintf("no bwserver at %s: %v (run 'network-check bwserver' there)", load.addr, err)}
+			return
+		}
+		if ip, ok := c.RemoteAddr().(*net.TCPAddr); ok && addressRange(ip.IP) != "" {
+			ch <- utils.BloatResult{Msg: fmt.Sprintf("NOTE: the bwserver is at a %s address, so the load only crosses the local network and the internet link's queue is not tested", addressRange(ip.IP))}
+		}
+		c.Close()
+	}
+
+	for _, phase := range bloatPhases {
+		var dirs []string
+		d := time.Duration(secs) * time.Second
+		switch phase {
+		case "idle":
+			d = bloatIdleSecs * time.Second
+		case "bidirectional":
+			dirs = []string{"download", "upload"}
+		default:
+			dirs = []string{phase}
+		}
+		if load.url != "" && slices.Contains(dirs, "upload") {
+			ch <- utils.BloatResult{Msg: phase + ": skipped, a download cannot load the upload direction (use a bwserver)"}
+			continue
+		}
+
+		ch <- utils.BloatResult{Phase: phase}
+		var wg sync.WaitGroup
+		for _, dir := range dirs {
+			wg.Add(1)
+			go func(dir string) {
+				defer wg.Done()
+				rate, err := load.run(dir, d)
+				switch {
+				case err != nil:
+					ch <- utils.BloatResult{Msg: fmt.Sprintf("%s: %s load: %v, phase not graded", phase, dir, err)}
+				case rate < bloatMinLoad:
+					ch <- utils.BloatResult{Msg: fmt.Sprintf("%s: %s load only reached %sbit/s, phase not graded", phase, dir, formatBitRate(rate))}
+				}
+				if rate > 0 {
+					ch <- utils.BloatResult{Load: &utils.BloatLoad{Phase: phase, Dir: dir, Rate: rate}}
+				}
+			}(dir)
+		}
+		err := bloatPing(ch, phase, target, d)
+		wg.Wait()
+		if err != nil {
+			ch <- utils.BloatResult{Msg: fmt.Sprintf("%s: ping %s: %v", phase, target, err)}
+			if phase == "idle" {
+				return
+			}
+		}
+	}
+}
+
+// run loads one direction for d and returns the rate reached, in bytes per
+// second.
+func (l bloatLoadGen) run(dir string, d time.Duration) (uint64, error) {
+	if l.url != "" {
+		return bloatDownload(l.url, l.streams, d)
+	}
+	req := bwRequest{Proto: "tcp", Dir: dir, Streams: l.streams, Secs: int(d / time.Second)}
+	res := make(chan utils.BwResult, 2*req.Secs+16)
+	err := runBwDirection(res, l.addr, req)
+	close(res)
+	var rate uint64
+	for r := range res {
+		if r.Interval != nil && r.Interval.Sec == 0 {
+			rate = bwIntervalRate(*r.Interval)
+		}
+	}
+	return rate, err
+}
+
+// bloatDownload fetches url over streams parallel requests for d, starting
+// over whenever a transfer ends. The proxy settings of the environment
+// apply.
+func bloatDownload(u string, streams int, d time.Duration) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	var got atomic.Uint64
+	errs := make(chan error, streams)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bwBlockSize)
+			for ctx.Err() == nil {
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					if ctx.Err() == nil {
+						errs <- err
+					}
+					return
+				}
+				if resp.StatusCode != http.StatusOK {
+					resp.Body.Close()
+					errs <- errors.New(resp.Status)
+					return
+				}
+				for {
+					n, err := resp.Body.Read(buf)
+					got.Add(uint64(n))
+					if err != nil {
+						break
+					}
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	rate := uint64(float64(got.Load()) / time.Since(start).Seconds())
+	select {
+	case err := <-errs:
+		return rate, err
+	default:
+		return rate, nil
+	}
+}
+
+// bloatPing pings target for d and sends every reply, and every probe ping
+// reports unanswered, as a sample of phase. ping -O is iputils only: when
+// ping gives up at once without it, it runs again for the rest of d.
+func bloatPing(ch chan<- utils.BloatResult, phase, target string, d time.Duration) error {
+	start := time.Now()
+	replies, err := bloatPingRun(ch, phase, d, "-n", "-O", "-i", bloatPingInterval, "-W", "1", target)
+	if replies == 0 && time.Since(start) < d/2 {
+		replies, err = bloatPingRun(ch, phase, d-time.Since(start), "-n", "-i", bloatPingInterval, target)
+	}
+	if replies == 0 && err == nil {
+		err = errors.New("no reply")
+	}
+	if replies > 0 {
+		return nil
+	}
+	return err
+}
+
+func bloatPingRun(ch chan<- utils.BloatResult, phase string, d time.Duration, args ...string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ping", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	replies := 0
+	sc := bufio.NewScanner(stdout)
+	for sc.Scan() {
+		line := sc.Text()
+		if m := pingTimeRe.FindStringSubmatch(line); m != nil {
+			ms, _ := strconv.ParseFloat(m[1], 64)
+			ch <- utils.BloatResult{Sample: &utils.BloatSample{Phase: phase, RTT: time.Duration(ms * float64(time.Millisecond))}}
+			replies++
+		} else if strings.Contains(line, "no answer yet") {
+			ch <- utils.BloatResult{Sample: &utils.BloatSample{Phase: phase, Lost: true}}
+		}
+	}
+	err = cmd.Wait()
+	if msg := strings.TrimSpace(stderr.String()); replies == 0 && msg != "" {
+		lines := strings.Split(msg, "\n")
+		return 0, errors.New(lines[len(lines)-1])
+	}
+	if ctx.Err() != nil {
+		// stopped at the end of the phase
+		err = nil
+	}
+	return replies, err
+}
+
+// localShaping lists the qdiscs of this host that limit the rate: cake
+// with a bandwidth, htb, hfsc and tbf, and anything on an ifb device
+// (ingress shaping). fq_codel alone does not count, it only helps where
+// the host itself is the bottleneck.
+func localShaping() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "tc", "qdisc", "show").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseShapingQdiscs(string(out)), nil
+}
+
+func parseShapingQdiscs(out string) []string {
+	shaping := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "qdisc" {
+			continue
+		}
+		kind, dev, rate := f[1], "", ""
+		for i := 2; i+1 < len(f); i++ {
+			switch f[i] {
+			case "dev":
+				dev = f[i+1]
+			case "bandwidth", "rate":
+				if rate == "" {
+					rate = f[i+1]
+				}
+			}
+		}
+		switch {
+		case kind == "cake" && rate != "" && rate != "unlimited":
+		case kind == "htb" || kind == "hfsc" || kind == "tbf":
+		case strings.HasPrefix(dev, "ifb") && kind != "noqueue":
+		default:
+			continue
+		}
+		s := kind + " on " + dev
+		if rate != "" {
+			s += " at " + rate
+		}
+		if !slices.Contains(shaping, s) {
+			shaping = append(shaping, s)
+		}
+	}
+	return shaping
+}
+
+// bloatStats summarizes the samples of one phase: replies, probes lost,
+// and the median and 95th percentile RTT in ms.
+func bloatStats(samples []utils.BloatSample, phase string) (n, lost int, median, p95 float64) {
+	var rtts []float64
+	for _, s := range samples {
+		switch {
+		case s.Phase != phase:
+		case s.Lost:
+			lost++
+		default:
+			rtts = append(rtts, float64(s.RTT)/float64(time.Millisecond))
+		}
+	}
+	if len(rtts) == 0 {
+		return 0, lost, 0, 0
+	}
+	sort.Float64s(rtts)
+	at := func(p float64) float64 {
+		return rtts[min(len(rtts)-1, int(p*float64(len(rtts))))]
+	}
+	return len(rtts), lost, at(0.5), at(0.95)
+}
+
+func bloatGrade(rise float64) string {
+	for _, g := range bloatGrades {
+		if rise < g.below {
+			return g.grade
+		}
+	}
+	return "F"
+}
+
+// bloatGradeRank orders the grades from A+ (0) to F, -1 for none.
+func bloatGradeRank(grade string) int {
+	for i, g := range bloatGrades {
+		if g.grade == grade {
+			return i
+		}
+	}
+	return -1
+}
+
+// bloatLoaded tells whether every direction of phase carried a real load.
+func bloatLoaded(loads []utils.BloatLoad, phase string) bool {
+	dirs := []string{phase}
+	if phase == "bidirectional" {
+		dirs = []string{"download", "upload"}
+	}
+	for _, dir := range dirs {
+		if !slices.ContainsFunc(loads, func(l utils.BloatLoad) bool {
+			return l.Phase == phase && l.Dir == dir && l.Rate >= bloatMinLoad
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// bloatRise is how far the median latency of phase rises above the idle
+// one, false while either has too few replies or phase had no load.
+func bloatRise(samples []utils.BloatSample, loads []utils.BloatLoad, phase string) (float64, bool) {
+	if !bloatLoaded(loads, phase) {
+		return 0, false
+	}
+	n0, _, idle, _ := bloatStats(samples, "idle")
+	n, _, med, _ := bloatStats(samples, phase)
+	if n0 < bloatMinReplies || n < bloatMinReplies {
+		return 0, false
+	}
+	return max(0, med-idle), true
+}
+
+// bloatOverall is the grade of the worst loaded phase.
+func bloatOverall(samples []utils.BloatSample, loads []utils.BloatLoad) (grade, phase string, rise float64) {
+	for _, p := range bloatPhases[1:] {
+		r, ok := bloatRise(samples, loads, p)
+		if !ok {
+			continue
+		}
+		if g := bloatGrade(r); grade == "" || bloatGradeRank(g) > bloatGradeRank(grade) {
+			grade, phase, rise = g, p, r
+		}
+	}
+	return grade, phase, rise
+}
+
+// bloatFindings explains the grade and points at the fix.
+func bloatFindings(m utils.Model) []string {
+	var out []string
+	grade, phase, rise := bloatOverall(m.BloatSamples, m.BloatLoads)
+	switch rank := bloatGradeRank(grade); {
+	case grade == "":
+	case rank >= bloatGradeRank("C"):
+		out = append(out, fmt.Sprintf("WARNING: latency rises by %.0f ms under %s load: bufferbloat, packets wait in an oversized queue at the bottleneck, usually the modem or router", rise, phase))
+		if m.BloatShaping != nil && len(m.BloatShaping) == 0 {
+			out = append(out, "WARNING: no traffic shaping is configured on this host (see Check QoS settings): enable SQM (cake, or fq_codel under a rate limit a little below the line rate) on the router, or shape with tc here if this host is the router")
+		} else if len(m.BloatShaping) > 0 {
+			out = append(out, fmt.Sprintf("NOTE: this host shapes with %s, yet the queue still grows: set the rate below what the line really carries, or the bottleneck is another device", strings.Join(m.BloatShaping, ", ")))
+		}
+	case rank == bloatGradeRank("B"):
+		out = append(out, fmt.Sprintf("NOTE: latency rises by %.0f ms under %s load: noticeable in calls and games while the link is busy", rise, phase))
+	}
+
+	for _, p := range bloatPhases[1:] {
+		if !bloatLoaded(m.BloatLoads, p) {
+			continue
+		}
+		if n, lost, _, _ := bloatStats(m.BloatSamples, p); n+lost > 0 && float64(lost) >= 0.05*float64(n+lost) {
+			out = append(out, fmt.Sprintf("WARNING: %d of %d pings lost under %s load: the queue overflows instead of only growing", lost, n+lost, p))
+		}
+	}
+	return out
+}
+
+func ChosenBufferbloatView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("Bufferbloat test:") + " latency idle and under download, upload and bidirectional load\n\n"
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
+
+	var b strings.Builder
+	if len(m.BloatLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.BloatLog, "\n")) + "\n\n")
+	}
+
+	// one sparkline scale for all phases, so they compare at a glance
+	top := 0.0
+	for _, s := range m.BloatSamples {
+		top = max(top, float64(s.RTT)/float64(time.Millisecond))
+	}
+
+	rows := []string{fmt.Sprintf("%-14s %12s %12s %5s %5s %9s %9s %8s %-7s %s", "Phase", "Down", "Up", "Pings", "Lost", "Median", "p95", "Rise", "Grade", "Latency")}
+	for _, p := range bloatPhases {
+		n, lost, med, p95 := bloatStats(m.BloatSamples, p)
+		if n+lost == 0 && p != m.BloatPhase {
+			continue
+		}
+		rate := map[string]string{"download": "", "upload": ""}
+		for _, l := range m.BloatLoads {
+			if l.Phase == p {
+				rate[l.Dir] = formatBitRate(l.Rate) + "bit/s"
+			}
+		}
+		rise, grade := "", ""
+		if r, ok := bloatRise(m.BloatSamples, m.BloatLoads, p); ok && p != "idle" {
+			rise, grade = fmt.Sprintf("+%.0fms", r), bloatGrade(r)
+		} else if p != "idle" && p != m.BloatPhase {
+			// the load ended with the phase, so it is known by now
+			grade = "no load"
+		}
+		var rtts []float64
+		for _, s := range m.BloatSamples {
+			if s.Phase == p && !s.Lost {
+				rtts = append(rtts, float64(s.RTT)/float64(time.Millisecond))
+			}
+		}
+		name := p
+		if p == m.BloatPhase {
+			name += " ..."
+		}
+		row := fmt.Sprintf("%-14s %12s %12s %5d %5d %9s %9s %8s %-7s %s", name, rate["download"], rate["upload"], n, lost,
+			fmt.Sprintf("%.1fms", med), fmt.Sprintf("%.1fms", p95), rise, grade, sparkline(rtts, bloatSparkWidth, top))
+		if bloatGradeRank(grade) >= bloatGradeRank("C") {
+			rows = append(rows, utils.WarnStyle.Render(row))
+		} else {
+			rows = append(rows, utils.SubtleStyle.Render(row))
+		}
+	}
+	if len(rows) > 1 {
+		b.WriteString(strings.Join(rows, "\n") + "\n\n")
+	}
+
+	if grade, phase, rise := bloatOverall(m.BloatSamples, m.BloatLoads); grade != "" {
+		line := fmt.Sprintf("Bufferbloat grade: %s (latency +%.0f ms under %s load)", grade, rise, phase)
+		if m.BloatChan != nil {
+			line += ", so far"
+		}
+		b.WriteString(utils.KeywordStyle.Render(line) + "\n\n")
+	}
+
+	if findings := utils.RenderFindings(bloatFindings(m)); findings != "" {
+		b.WriteString(findings + "\n\n")
+	}
+
+	if m.BloatChan != nil {
+		return header + b.String() + utils.SubtleStyle.Render("Running... press esc to quit.")
+	}
+	return header + b.String() + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+}
@@ -0,0 +1,464 @@
+package modules
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Built-in throughput server, started with "network-check bwserver". It
+// listens on one TCP and one UDP port (bwPort by default) and runs the tests
+// the throughput check (throughput.go) asks for, so links between two of
+// our own hosts can be measured without speedtest servers on the internet.
+//
+// Every test opens a control connection: the client sends a bwRequest as a
+// JSON line and the server answers with a bwReply carrying a session token.
+// TCP tests then open Streams more connections that start with a bwHello
+// line naming the token; the server either fills them (download) or drains
+// them (upload). UDP tests use datagrams that start with the token, a
+// sequence number and the send time (bwUDPHeader); for a download the
+// client first sends a few datagrams with sequence 0 so the server learns
+// where to send; those must come from the control connection's address, so
+// a token seen on the wire cannot aim a download at someone else. The side
+// that receives does the accounting; for uploads the server reports every
+// second on the control connection (bwReport).
+
+const bwPort = 5221
+
+// Limits the server enforces on requests.
+const (
+	bwMaxSecs     = 60
+	bwMaxStreams  = 32
+	bwMaxRate     = 10_000_000_000 // bits per second
+	bwMaxSessions = 4              // tests running at once
+	bwJoinWait    = 5 * time.Second
+	bwBlockSize   = 128 << 10
+	bwUDPHeader   = 16
+	bwUDPDefault  = 1200 // datagram payload size, below common tunnel MTUs
+)
+
+// bwRequest describes one direction of a test.
+type bwRequest struct {
+	Proto   string `json:"proto"` // tcp or udp
+	Dir     string `json:"dir"`   // download (server to client) or upload
+	Streams int    `json:"streams,omitempty"`
+	Secs    int    `json:"secs"`
+	Rate    uint64 `json:"rate,omitempty"` // udp target rate, bits per second
+	Size    int    `json:"size,omitempty"` // udp datagram size
+}
+
+type bwReply struct {
+	Token uint32 `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// bwHello is the first line of every TCP connection: a request for a
+// control connection, the session token for a data stream.
+type bwHello struct {
+	Request *bwRequest `json:"request,omitempty"`
+	Join    uint32     `json:"join,omitempty"`
+}
+
+// bwReport is one second of an upload as the server received it; Done marks
+// the last report, with the totals of the whole test.
+type bwReport struct {
+	Sec     int    `json:"sec"`
+	Bytes   uint64 `json:"bytes"`
+	Packets int    `json:"packets,omitempty"`
+	Lost    int    `json:"lost,omitempty"`
+	Jitter  int64  `json:"jitter_us,omitempty"`
+	Done    bool   `json:"done,omitempty"`
+}
+
+// bwSession is a test in progress on the server.
+type bwSession struct {
+	token uint32
+	peer  net.IP // the control connection's client
+	req   bwRequest
+	joins chan net.Conn // TCP data streams as they connect
+	hello chan *net.UDPAddr
+	udp   bwUDPStats
+}
+
+type bwServer struct {
+	udp      *net.UDPConn
+	mu       sync.Mutex
+	sessions map[uint32]*bwSession
+}
+
+// RunBandwidthServer is the entry point of "network-check bwserver".
+func RunBandwidthServer(args []string) error {
+	fs := flag.NewFlagSet("bwserver", flag.ContinueOnError)
+	listen := fs.String("listen", ":"+strconv.Itoa(bwPort), "TCP and UDP address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	uaddr, err := net.ResolveUDPAddr("udp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	uc, err := net.ListenUDP("udp", uaddr)
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+	log.Printf("bwserver listening on %s (tcp and udp)", ln.Addr())
+	return serveBandwidth(ln, uc, log.Printf)
+}
+
+// serveBandwidth accepts tests until ln is closed.
+func serveBandwidth(ln net.Listener, uc *net.UDPConn, logf func(string, ...any)) error {
+	s := &bwServer{udp: uc, sessions: map[uint32]*bwSession{}}
+	go s.readUDP()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(c, logf)
+	}
+}
+
+func (s *bwServer) handle(c net.Conn, logf func(string, ...any)) {
+	br := bufio.NewReader(c)
+	_ = c.SetReadDeadline(time.Now().Add(bwJoinWait))
+	line, err := br.ReadBytes('\n')
+	var h bwHello
+	if err != nil || json.Unmarshal(line, &h) != nil {
+		c.Close()
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+
+	if h.Request == nil {
+		s.mu.Lock()
+		sess := s.sessions[h.Join]
+		s.mu.Unlock()
+		if sess == nil {
+			c.Close()
+			return
+		}
+		// keep what the reader already buffered of an upload
+		select {
+		case sess.joins <- bwConn{Conn: c, r: br}:
+		default:
+			c.Close()
+		}
+		return
+	}
+
+	defer c.Close()
+	enc := json.NewEncoder(c)
+	req := *h.Request
+	if err := checkBwRequest(&req); err != nil {
+		_ = enc.Encode(bwReply{Error: err.Error()})
+		return
+	}
+	sess := &bwSession{req: req, joins: make(chan net.Conn, req.Streams), hello: make(chan *net.UDPAddr, 1)}
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		sess.peer = a.IP
+	}
+	var token uint32
+	s.mu.Lock()
+	if len(s.sessions) >= bwMaxSessions {
+		s.mu.Unlock()
+		_ = enc.Encode(bwReply{Error: fmt.Sprintf("busy: %d tests already running, try again later", bwMaxSessions)})
+		return
+	}
+	for token == 0 || s.sessions[token] != nil {
+		var b [4]byte
+		_, _ = rand.Read(b[:])
+		token = binary.BigEndian.Uint32(b[:])
+	}
+	sess.token = token
+	s.sessions[token] = sess
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, token)
+		s.mu.Unlock()
+	}()
+	if err := enc.Encode(bwReply{Token: token}); err != nil {
+		return
+	}
+
+	what := fmt.Sprintf("%s %s for %d s", req.Proto, req.Dir, req.Secs)
+	if req.Proto == "tcp" {
+		what += fmt.Sprintf(", %d streams", req.Streams)
+	} else {
+		what += fmt.Sprintf(" at %sbit/s", formatBitRate(req.Rate/8))
+	}
+	logf("%s: %s", c.RemoteAddr(), what)
+
+	var total bwReport
+	if req.Proto == "tcp" {
+		total, err = s.runTCP(sess, enc)
+	} else {
+		total, err = s.runUDP(sess, c.RemoteAddr(), enc)
+	}
+	if err != nil {
+		logf("%s: %v", c.RemoteAddr(), err)
+		_ = enc.Encode(bwReply{Error: err.Error()})
+		return
+	}
+	if req.Dir == "upload" {
+		logf("%s: received %s in %d s (%sbit/s)", c.RemoteAddr(), formatByteCount(total.Bytes), req.Secs, formatBitRate(total.Bytes/uint64(req.Secs)))
+	}
+}
+
+// checkBwRequest validates a request and fills in defaults.
+func checkBwRequest(r *bwRequest) error {
+	if r.Proto != "tcp" && r.Proto != "udp" {
+		return fmt.Errorf("unknown protocol %q", r.Proto)
+	}
+	if r.Dir != "download" && r.Dir != "upload" {
+		return fmt.Errorf("unknown direction %q", r.Dir)
+	}
+	if r.Secs < 1 || r.Secs > bwMaxSecs {
+		return fmt.Errorf("test length must be 1 to %d s", bwMaxSecs)
+	}
+	if r.Proto == "tcp" {
+		r.Streams = max(r.Streams, 1)
+		if r.Streams > bwMaxStreams {
+			return fmt.Errorf("at most %d streams", bwMaxStreams)
+		}
+		return nil
+	}
+	r.Streams = 0
+	if r.Rate == 0 || r.Rate > bwMaxRate {
+		return fmt.Errorf("UDP rate must be between 1 bit/s and %sbit/s", formatBitRate(bwMaxRate/8))
+	}
+	if r.Size == 0 {
+		r.Size = bwUDPDefault
+	}
+	if r.Size < bwUDPHeader || r.Size > 65000 {
+		return fmt.Errorf("datagram size must be %d to 65000 bytes", bwUDPHeader)
+	}
+	return nil
+}
+
+// bwConn is a data stream whose first line was read through r.
+type bwConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bwConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// runTCP waits for the data streams, then sends or drains them for the
+// length of the test.
+func (s *bwServer) runTCP(sess *bwSession, enc *json.Encoder) (bwReport, error) {
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	wait := time.After(bwJoinWait)
+	for len(conns) < sess.req.Streams {
+		select {
+		case c := <-sess.joins:
+			conns = append(conns, c)
+		case <-wait:
+			return bwReport{}, fmt.Errorf("only %d of %d streams connected", len(conns), sess.req.Streams)
+		}
+	}
+
+	end := time.Now().Add(time.Duration(sess.req.Secs) * time.Second)
+	var received atomic.Uint64
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			buf := make([]byte, bwBlockSize)
+			if sess.req.Dir == "download" {
+				_ = c.SetWriteDeadline(end)
+				for time.Now().Before(end) {
+					if _, err := c.Write(buf); err != nil {
+						return
+					}
+				}
+				return
+			}
+			_ = c.SetReadDeadline(end)
+			for {
+				n, err := c.Read(buf)
+				received.Add(uint64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(c)
+	}
+	if sess.req.Dir == "download" {
+		wg.Wait()
+		return bwReport{}, nil
+	}
+	return reportEverySecond(sess.req.Secs, enc, func() bwReport {
+		return bwReport{Bytes: received.Load()}
+	}, wg.Wait)
+}
+
+// reportEverySecond sends the change of the cumulative counters read by
+// snapshot once per second, then the totals once wait returns.
+func reportEverySecond(secs int, enc *json.Encoder, snapshot func() bwReport, wait func()) (bwReport, error) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	var prev bwReport
+	for sec := 1; sec <= secs; sec++ {
+		<-tick.C
+		cur := snapshot()
+		r := bwReport{Sec: sec, Bytes: cur.Bytes - prev.Bytes, Packets: cur.Packets - prev.Packets, Lost: cur.Lost - prev.Lost, Jitter: cur.Jitter}
+		if err := enc.Encode(r); err != nil {
+			return bwReport{}, err
+		}
+		prev = cur
+	}
+	wait()
+	total := snapshot()
+	total.Done = true
+	return total, enc.Encode(total)
+}
+
+// runUDP sends datagrams at the requested rate to the address the client's
+// hello came from, or accounts for the datagrams the client sends.
+func (s *bwServer) runUDP(sess *bwSession, ctrl net.Addr, enc *json.Encoder) (bwReport, error) {
+	secs := time.Duration(sess.req.Secs) * time.Second
+	if sess.req.Dir == "upload" {
+		// datagrams still in flight when the client stops count too
+		return reportEverySecond(sess.req.Secs, enc, sess.udp.report, func() { time.Sleep(500 * time.Millisecond) })
+	}
+	var to *net.UDPAddr
+	select {
+	case to = <-sess.hello:
+	case <-time.After(bwJoinWait):
+		return bwReport{}, fmt.Errorf("no UDP datagram from %s: is udp/%d blocked?", ctrl, bwPort)
+	}
+	err := sendUDPPaced(func(b []byte) error {
+		_, err := s.udp.WriteToUDP(b, to)
+		return err
+	}, sess.token, sess.req.Rate, sess.req.Size, secs)
+	return bwReport{}, err
+}
+
+// readUDP hands every datagram to the session its token names, if it comes
+// from the host that opened the session.
+func (s *bwServer) readUDP() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n < bwUDPHeader {
+			continue
+		}
+		s.mu.Lock()
+		sess := s.sessions[binary.BigEndian.Uint32(buf)]
+		s.mu.Unlock()
+		if sess == nil || !sess.peer.Equal(from.IP) {
+			continue
+		}
+		if binary.BigEndian.Uint32(buf[4:]) == 0 {
+			select {
+			case sess.hello <- from:
+			default:
+			}
+			continue
+		}
+		sess.udp.add(buf[:n], time.Now())
+	}
+}
+
+// sendUDPPaced sends size-byte datagrams numbered from 1 for d, spread so the
+// rate is reached every millisecond rather than in bursts.
+func sendUDPPaced(send func([]byte) error, token uint32, rate uint64, size int, d time.Duration) error {
+	b := make([]byte, size)
+	binary.BigEndian.PutUint32(b, token)
+	start := time.Now()
+	var seq uint32
+	for {
+		elapsed := time.Since(start)
+		if elapsed >= d {
+			return nil
+		}
+		due := uint32(float64(rate) * elapsed.Seconds() / 8 / float64(size))
+		for seq < due {
+			seq++
+			binary.BigEndian.PutUint32(b[4:], seq)
+			binary.BigEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+			// a full socket buffer (ENOBUFS) only shows up as loss
+			if err := send(b); errors.Is(err, net.ErrClosed) {
+				return err
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// bwUDPStats accounts for received datagrams: loss from the gaps in the
+// sequence numbers and interarrival jitter as in RFC 3550, which only needs
+// the difference of the two clocks to stay constant.
+type bwUDPStats struct {
+	mu       sync.Mutex
+	bytes    uint64
+	packets  int
+	maxSeq   uint32
+	transit  time.Duration
+	jitter   float64 // ns
+	received bool
+}
+
+func (u *bwUDPStats) add(b []byte, at time.Time) {
+	seq := binary.BigEndian.Uint32(b[4:])
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(b[8:])))
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bytes += uint64(len(b))
+	u.packets++
+	u.maxSeq = max(u.maxSeq, seq)
+	transit := at.Sub(sent)
+	if u.received {
+		d := float64(transit - u.transit)
+		if d < 0 {
+			d = -d
+		}
+		u.jitter += (d - u.jitter) / 16
+	}
+	u.transit, u.received = transit, true
+}
+
+// report returns the cumulative counters.
+func (u *bwUDPStats) report() bwReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return bwReport{
+		Bytes:   u.bytes,
+		Packets: u.packets,
+		Lost:    max(0, int(u.maxSeq)-u.packets),
+		Jitter:  int64(u.jitter / 1000),
+	}
+}
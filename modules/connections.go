@@ -0,0 +1,366 @@
+package modules
+
+import (
+	"fmt"
+	"net"
+	"network-check/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Browse TCP connections: every TCP socket that is not listening, from
+// /proc/net (sockets.go) with its owning process, joined by inode with the
+// tcp_info the kernel reports over sock_diag (RTT, rttvar, cwnd,
+// retransmissions, delivery rate). The table can be sorted by any column and
+// filtered by words, which makes retransmitting connections and CLOSE-WAIT
+// pile-ups easy to find.
+
+var connColumns = []string{"State", "Local", "Peer", "Process", "RTT", "Retrans", "Cwnd", "Send-Q", "Recv-Q", "Rate"}
+
+// connRows is the number of table rows shown at once.
+const connRows = 30
+
+// closeWaitPileup is the number of CLOSE-WAIT sockets held by one process
+// above which it is reported as not closing its connections.
+const closeWaitPileup = 10
+
+func UpdateConnections(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if !m.Loaded {
+			return m, nil
+		}
+		switch msg.String() {
+		case "s":
+			m.ConnSortCol = (m.ConnSortCol + 1) % len(connColumns)
+			sortConnections(m.ConnEntries, m.ConnSortCol, m.ConnSortDesc)
+		case "r":
+			m.ConnSortDesc = !m.ConnSortDesc
+			sortConnections(m.ConnEntries, m.ConnSortCol, m.ConnSortDesc)
+		case "/":
+			return utils.PromptInput(m, "Filter connections (all words must match, e.g. close-wait, :443, firefox, retrans):", m.ConnFilter), nil
+		case "j", "down":
+			if m.ConnOffset+connRows < len(filterConnections(m.ConnEntries, m.ConnFilter)) {
+				m.ConnOffset++
+			}
+		case "k", "up":
+			if m.ConnOffset > 0 {
+				m.ConnOffset--
+			}
+		case "u":
+			// dump again; keys only arrive once the last dump is read to
+			// the end, so no worker is left blocked on the old channel
+			m.Loaded = false
+			m.ConnChan = nil
+			return m, utils.Frame()
+		}
+		return m, nil
+
+	case utils.FrameMsg:
+		if m.Loaded && m.InputSubmitted {
+			m.InputSubmitted = false
+			m.ConnFilter = strings.TrimSpace(m.Input)
+			m.ConnOffset = 0
+			return m, nil
+		}
+
+		if !m.Loaded && m.ConnChan == nil {
+			m.ConnChan = make(chan utils.SocketResult, 8192)
+			m.ConnLog = []string{}
+			m.ConnEntries = []utils.Socket{}
+			m.ConnOffset = 0
+			go func(ch chan<- utils.SocketResult) {
+				defer close(ch)
+				// blocking: busy servers have more sockets than any buffer,
+				// and the CLOSE-WAIT counts need all of them
+				send := func(r utils.SocketResult) { ch <- r }
+				note := func(s string) { send(utils.SocketResult{Msg: s}) }
+
+				socks, err := allSockets(note)
+				if err != nil {
+					note(fmt.Sprintf("cannot read /proc/net: %v", err))
+					return
+				}
+				info, err := readTCPInfo()
+				if err != nil {
+					note(fmt.Sprintf("sock_diag failed (%v): TCP internals are not available", err))
+				}
+				foreign := 0
+				for _, s := range socks {
+					if !strings.HasPrefix(s.Proto, "tcp") || s.State == "LISTEN" {
+						continue
+					}
+					if ti, ok := info[s.Inode]; ok && s.Netns == "" && s.Inode != 0 {
+						s.TCP = &ti
+					}
+					if s.Netns != "" {
+						foreign++
+					}
+					send(utils.SocketResult{Entry: s})
+				}
+				if foreign > 0 {
+					note(fmt.Sprintf("%d connections belong to other network namespaces: their TCP internals are not shown", foreign))
+				}
+			}(m.ConnChan)
+			return m, utils.Frame()
+		}
+
+		// poll channel
+		if m.ConnChan != nil {
+			for {
+				select {
+				case r, ok := <-m.ConnChan:
+					if !ok {
+						m.ConnChan = nil
+						m.Loaded = true
+						sortConnections(m.ConnEntries, m.ConnSortCol, m.ConnSortDesc)
+						return m, nil
+					}
+					if r.Msg != "" {
+						m.ConnLog = append(m.ConnLog, r.Msg)
+						continue
+					}
+					m.ConnEntries = append(m.ConnEntries, r.Entry)
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// connValue returns the numeric value of a tcp_info column, -1 when unknown.
+func connValue(s utils.Socket, col int) float64 {
+	switch col {
+	case 7:
+		return float64(s.TxQueue)
+	case 8:
+		return float64(s.RxQueue)
+	}
+	if s.TCP == nil {
+		return -1
+	}
+	switch col {
+	case 4:
+		return float64(s.TCP.RTT)
+	case 5:
+		return float64(s.TCP.TotalRetrans)
+	case 6:
+		return float64(s.TCP.Cwnd)
+	case 9:
+		return float64(s.TCP.DeliveryRate)
+	}
+	return -1
+}
+
+func sortConnections(entries []utils.Socket, col int, desc bool) {
+	less := func(a, b utils.Socket) bool {
+		switch col {
+		case 0:
+			if a.State != b.State {
+				return a.State < b.State
+			}
+			return compareIP(a.Remote, b.Remote) < 0
+		case 1:
+			if c := compareIP(a.Local, b.Local); c != 0 {
+				return c < 0
+			}
+			return a.LocalPort < b.LocalPort
+		case 2:
+			if c := compareIP(a.Remote, b.Remote); c != 0 {
+				return c < 0
+			}
+			return a.RemotePort < b.RemotePort
+		case 3:
+			return socketOwner(a) < socketOwner(b)
+		}
+		return connValue(a, col) < connValue(b, col)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+// connTroubled reports connections worth a look: stuck in retransmission
+// timeouts, retransmitting more than 1% of what they sent, or waiting for the
+// local application to close them.
+func connTroubled(s utils.Socket) bool {
+	if s.State == "CLOSE-WAIT" {
+		return true
+	}
+	if s.TCP == nil {
+		return false
+	}
+	return s.TCP.Timeouts > 0 || (s.TCP.BytesRetrans > 0 && s.TCP.BytesRetrans*100 > s.TCP.BytesSent)
+}
+
+// connText is what the filter words are matched against.
+func connText(s utils.Socket) string {
+	parts := []string{s.State, socketAddr(s), net.JoinHostPort(s.Remote, strconv.Itoa(s.RemotePort)), socketOwner(s), s.User, s.Unit, s.Container, s.Netns}
+	if s.TCP != nil && s.TCP.TotalRetrans > 0 {
+		parts = append(parts, "retrans")
+	}
+	return strings.ToLower(strings.Join(parts, " "))
+}
+
+func filterConnections(entries []utils.Socket, filter string) []utils.Socket {
+	words := strings.Fields(strings.ToLower(filter))
+	if len(words) == 0 {
+		return entries
+	}
+	var out []utils.Socket
+	for _, s := range entries {
+		text := connText(s)
+		ok := true
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// formatRTT prints a duration in milliseconds with a precision that suits
+// LAN and WAN round trips alike.
+func formatRTT(d time.Duration) string {
+	ms := float64(d) / float64(time.Millisecond)
+	if ms < 10 {
+		return fmt.Sprintf("%.2fms", ms)
+	}
+	return fmt.Sprintf("%.0fms", ms)
+}
+
+// formatBitRate prints a rate given in bytes per second as bits per second.
+func formatBitRate(bytesPerSec uint64) string {
+	bits := float64(bytesPerSec) * 8
+	switch {
+	case bits >= 1e9:
+		return fmt.Sprintf("%.1fG", bits/1e9)
+	case bits >= 1e6:
+		return fmt.Sprintf("%.1fM", bits/1e6)
+	case bits >= 1e3:
+		return fmt.Sprintf("%.0fK", bits/1e3)
+	}
+	return fmt.Sprintf("%.0f", bits)
+}
+
+// connFindings summarizes CLOSE-WAIT pile-ups and connections in
+// retransmission timeout.
+func connFindings(entries []utils.Socket) []string {
+	var out []string
+	closeWait := map[string]int{}
+	for _, s := range entries {
+		if s.State == "CLOSE-WAIT" {
+			closeWait[socketOwner(s)]++
+		}
+		if s.TCP != nil && s.TCP.Timeouts > 0 {
+			out = append(out, fmt.Sprintf("WARNING: %s → %s (%s) is in retransmission timeout #%d: the peer or the path stopped acknowledging data",
+				socketAddr(s), net.JoinHostPort(s.Remote, strconv.Itoa(s.RemotePort)), socketOwner(s), s.TCP.Timeouts))
+		}
+	}
+	for _, owner := range sortedKeys(closeWait) {
+		if n := closeWait[owner]; n >= closeWaitPileup {
+			out = append(out, fmt.Sprintf("WARNING: %s holds %d CLOSE-WAIT connections: the peers hung up but the application never closes its sockets (descriptor leak)", owner, n))
+		}
+	}
+	return out
+}
+
+func ChosenConnectionsView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("TCP connections:") + " /proc/net/tcp[6] with tcp_info from sock_diag\n\n"
+
+	var notes string
+	if len(m.ConnLog) > 0 {
+		notes = utils.SubtleStyle.Render(strings.Join(m.ConnLog, "\n")) + "\n\n"
+	}
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
+
+	if !m.Loaded {
+		body := utils.SubtleStyle.Render(fmt.Sprintf("reading sockets... %d connections", len(m.ConnEntries)))
+		return header + notes + body + "\n\n" + utils.SubtleStyle.Render("Running...")
+	}
+
+	if len(m.ConnEntries) == 0 {
+		return header + notes + utils.SubtleStyle.Render("No TCP connections found.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	}
+
+	counts := map[string]int{}
+	for _, s := range m.ConnEntries {
+		counts[s.State]++
+	}
+	var parts []string
+	for _, st := range sortedKeys(counts) {
+		parts = append(parts, fmt.Sprintf("%s=%d", st, counts[st]))
+	}
+	summary := utils.SubtleStyle.Render(fmt.Sprintf("%d connections: %s", len(m.ConnEntries), strings.Join(parts, " ")))
+	if findings := utils.RenderFindings(connFindings(m.ConnEntries)); findings != "" {
+		summary += "\n" + findings
+	}
+
+	shown := filterConnections(m.ConnEntries, m.ConnFilter)
+	if m.ConnFilter != "" {
+		summary += "\n" + utils.KeywordStyle.Render(fmt.Sprintf("filter %q: %d of %d connections", m.ConnFilter, len(shown), len(m.ConnEntries)))
+	}
+
+	var cols []string
+	for i, c := range connColumns {
+		if i == m.ConnSortCol {
+			arrow := "▲"
+			if m.ConnSortDesc {
+				arrow = "▼"
+			}
+			c += arrow
+		}
+		cols = append(cols, c)
+	}
+	format := "%-12s %-28s %-28s %-20s %9s %9s %6s %8s %8s %7s"
+	rows := []string{fmt.Sprintf(format, cols[0], cols[1], cols[2], cols[3], cols[4], cols[5], cols[6], cols[7], cols[8], cols[9])}
+	end := min(m.ConnOffset+connRows, len(shown))
+	for _, s := range shown[min(m.ConnOffset, end):end] {
+		rtt, retrans, cwnd, rate := "-", "-", "-", "-"
+		if t := s.TCP; t != nil {
+			rtt = formatRTT(t.RTT) + "±" + strings.TrimSuffix(formatRTT(t.RTTVar), "ms")
+			retrans = strconv.FormatUint(uint64(t.TotalRetrans), 10)
+			if t.Retrans > 0 {
+				retrans = fmt.Sprintf("%d/%d", t.Retrans, t.TotalRetrans)
+			}
+			cwnd = strconv.FormatUint(uint64(t.Cwnd), 10)
+			rate = formatBitRate(t.DeliveryRate)
+		}
+		row := fmt.Sprintf(format, s.State, socketAddr(s), net.JoinHostPort(s.Remote, strconv.Itoa(s.RemotePort)),
+			socketOwner(s), rtt, retrans, cwnd, formatCount(s.TxQueue), formatCount(s.RxQueue), rate)
+		if connTroubled(s) {
+			rows = append(rows, utils.WarnStyle.Render(row))
+		} else {
+			rows = append(rows, utils.SubtleStyle.Render(row))
+		}
+	}
+	if len(shown) > end || m.ConnOffset > 0 {
+		rows = append(rows, utils.SubtleStyle.Render(fmt.Sprintf("rows %d-%d of %d", min(m.ConnOffset+1, end), end, len(shown))))
+	}
+
+	footer := utils.SubtleStyle.Render("s: sort column • r: reverse order • /: filter • j/k: scroll • u: refresh") + "\n" +
+		utils.SubtleStyle.Render("RTT is smoothed RTT ± rttvar; Retrans is in flight/total; Rate is the delivery rate in bit/s") + "\n" +
+		utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	return header + notes + summary + "\n\n" + strings.Join(rows, "\n") + "\n\n" + footer
+}
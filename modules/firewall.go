@@ -1,8 +1,8 @@
 package modules
 
 import (
-	"bufio"
 	"context"
+	"fmt"
 	"network-check/utils"
 	"os/exec"
 	"strings"
@@ -11,57 +11,104 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-// Check firewall rules: prefer nftables, fall back to iptables or ufw.
-// Streams lines into a channel from a goroutine and collects them into m.FirewallLog.
+// Check firewall rules: parses "nft -j list ruleset" and "iptables-save -c" /
+// "ip6tables-save -c" into one model of tables, chains and rules with their
+// counters (utils.FirewallTable), and shows it as a collapsible tree. ufw
+// status is added as notes. iptables-nft dumps are skipped when nft already
+// showed the same kernel ruleset. Once loaded, "t" opens the packet tracer
+// (firewall_trace.go) and "w" watches the counters live (firewall_watch.go).
+
+// firewallTreeHeight is the number of tree lines shown around the cursor.
+const firewallTreeHeight = 30
+
 func UpdateFirewall(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
-	switch msg.(type) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if !m.Loaded {
+			return m, nil
+		}
+		nodes := firewallNodes(m)
+		switch msg.String() {
+		case "t":
+			flow := m.FirewallFlow
+			if flow == "" {
+				flow = "tcp from 192.0.2.10 to 127.0.0.1 dport 22 iif eth0 state new"
+			}
+			return utils.PromptInput(m, "Flow to trace: [tcp|udp|icmp] from SRC to DST [sport N] [dport N] [iif DEV] [oif DEV] [state new|established|related] [mark N]", flow), nil
+		case "f":
+			m.FirewallAllFindings = !m.FirewallAllFindings
+		case "w":
+			if m.FirewallWatchChan != nil {
+				return stopFirewallWatch(m), nil
+			}
+			return startFirewallWatch(m)
+		case "j", "down":
+			if m.FirewallCursor < len(nodes)-1 {
+				m.FirewallCursor++
+			}
+		case "k", "up":
+			if m.FirewallCursor > 0 {
+				m.FirewallCursor--
+			}
+		case "enter", " ":
+			if m.FirewallCursor < len(nodes) && nodes[m.FirewallCursor].key != "" {
+				key := nodes[m.FirewallCursor].key
+				m.FirewallOpen[key] = !m.FirewallOpen[key]
+			}
+		case "e":
+			for _, t := range m.FirewallTables {
+				m.FirewallOpen[firewallTableKey(t)] = true
+				for _, c := range t.Chains {
+					m.FirewallOpen[firewallTableKey(t)+"/"+c.Name] = true
+				}
+			}
+		case "c":
+			for k := range m.FirewallOpen {
+				m.FirewallOpen[k] = false
+			}
+			m.FirewallCursor = 0
+		}
+		if n := len(firewallNodes(m)); m.FirewallCursor >= n {
+			m.FirewallCursor = max(n-1, 0)
+		}
+		return m, nil
+
 	case utils.FrameMsg:
+		if m.Loaded && m.InputSubmitted {
+			tm, cmd := startFirewallTrace(m)
+			if m.FirewallWatchChan != nil && cmd == nil {
+				// keep the watch loop ticking after the trace
+				cmd = utils.Frame()
+			}
+			return tm, cmd
+		}
+		if m.FirewallWatchChan != nil {
+			return pollFirewallWatch(m)
+		}
+
 		if !m.Loaded && m.FirewallChan == nil {
-			m.FirewallChan = make(chan string, 512)
-			go func(ch chan<- string) {
+			m.FirewallChan = make(chan utils.FirewallResult, 512)
+			m.FirewallLog = []string{}
+			m.FirewallTables = []utils.FirewallTable{}
+			m.FirewallOpen = map[string]bool{}
+			m.FirewallCursor = 0
+			m.FirewallTrace = nil
+			m.FirewallFindings = []utils.FirewallFinding{}
+			go func(ch chan<- utils.FirewallResult) {
 				defer close(ch)
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-
-				// try nftables first
-				cmds := [][]string{
-					{"nft", "list", "ruleset"},
-					{"iptables", "-L", "-n", "-v"},
-					{"ufw", "status", "numbered"},
+				// blocking: large rulesets outgrow the buffer, and a table
+				// or finding dropped here would be missing without a trace
+				send := func(r utils.FirewallResult) { ch <- r }
+				tables, fe := collectFirewall(func(s string) { send(utils.FirewallResult{Msg: s}) })
+				for _, t := range tables {
+					send(utils.FirewallResult{Table: &t})
 				}
-
-				for _, args := range cmds {
-					cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-					stdout, err := cmd.StdoutPipe()
-					if err != nil {
-						continue
-					}
-					if err := cmd.Start(); err != nil {
-						continue
-					}
-					scanner := bufio.NewScanner(stdout)
-					for scanner.Scan() {
-						line := strings.TrimRight(scanner.Text(), "\r\n")
-						if line != "" {
-							select {
-							case ch <- line:
-							default:
-							}
-						}
-					}
-					_ = cmd.Wait()
-					// if we produced output, assume this backend worked and return
-					// (we detect that by checking if channel has data - but chan is buffered,
-					// so check via a small probe by sending a marker would be intrusive).
-					// Instead, if the command produced at least one line, continue to next step
-					// by short sleep; otherwise try next backend.
-					time.Sleep(50 * time.Millisecond)
-				}
-
-				// If none produced output, emit helpful message
-				select {
-				case ch <- "no firewall binary produced output (nft/iptables/ufw missing or requires privileges)":
-				default:
+				for _, f := range analyzeFirewall(tables, fe) {
+					send(utils.FirewallResult{Finding: &f})
 				}
 			}(m.FirewallChan)
 
@@ -72,19 +119,25 @@ func UpdateFirewall(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 		if m.FirewallChan != nil {
 			for {
 				select {
-				case line, ok := <-m.FirewallChan:
+				case r, ok := <-m.FirewallChan:
 					if !ok {
 						// finished
 						m.FirewallChan = nil
 						m.Loaded = true
 						return m, nil
 					}
-					trim := strings.TrimSpace(line)
-					if trim == "" {
+					if r.Table != nil {
+						m.FirewallTables = append(m.FirewallTables, *r.Table)
+						m.FirewallOpen[firewallTableKey(*r.Table)] = true
 						continue
 					}
-					m.FirewallLog = append(m.FirewallLog, trim)
-					return m, utils.Frame()
+					if r.Finding != nil {
+						m.FirewallFindings = append(m.FirewallFindings, *r.Finding)
+						continue
+					}
+					if trim := strings.TrimSpace(r.Msg); trim != "" {
+						m.FirewallLog = append(m.FirewallLog, trim)
+					}
 				default:
 					return m, utils.Frame()
 				}
@@ -94,20 +147,313 @@ func UpdateFirewall(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// runFirewallCmd runs one backend command with a timeout.
+func runFirewallCmd(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return exec.CommandContext(ctx, args[0], args[1:]...).Output()
+}
+
+// collectFirewall reads every backend and returns the parsed tables and the
+// frontend states; status lines go to note.
+func collectFirewall(note func(string)) ([]utils.FirewallTable, fwFrontends) {
+	var fe fwFrontends
+	tables := readFirewallTables(note)
+
+	if out, err := runFirewallCmd("ufw", "status", "verbose"); err == nil {
+		for _, l := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(l, "Status:") || strings.HasPrefix(l, "Default:") || strings.HasPrefix(l, "Logging:") {
+				note("ufw " + strings.TrimSpace(l))
+			}
+			if st, ok := strings.CutPrefix(l, "Status:"); ok {
+				fe.ufw = strings.TrimSpace(st)
+			}
+		}
+	}
+	if out, err := runFirewallCmd("firewall-cmd", "--state"); len(out) > 0 || err == nil {
+		fe.firewalld = strings.TrimSpace(string(out))
+		note("firewalld " + fe.firewalld)
+	}
+
+	if len(tables) == 0 {
+		note("no firewall binary produced output (nft/iptables/ufw missing or requires privileges)")
+	}
+	return tables, fe
+}
+
+// readFirewallTables dumps the nft and iptables rulesets. iptables tables are
+// named "iptables-legacy" only when iptables-legacy-save returned them, so
+// the backend mix finding rests on what the legacy backend really holds.
+func readFirewallTables(note func(string)) []utils.FirewallTable {
+	var tables []utils.FirewallTable
+	nftOK := false
+	if out, err := runFirewallCmd("nft", "-j", "list", "ruleset"); err != nil {
+		note(fmt.Sprintf("nft: %v", err))
+	} else if t, err := parseNftJSON(out); err != nil {
+		note(fmt.Sprintf("nft: could not parse JSON output: %v", err))
+	} else {
+		nftOK = true
+		tables = append(tables, t...)
+	}
+
+	for _, backend := range []string{"iptables", "ip6tables"} {
+		// the legacy backend can hold rules next to nf_tables, loaded by
+		// older tools; iptables before 1.8 has no -legacy-save
+		legacy, legacyErr := runFirewallCmd(backend+"-legacy-save", "-c")
+		if legacyErr == nil {
+			t, _ := parseIptablesSave(string(legacy), backend+"-legacy")
+			tables = append(tables, t...)
+		}
+
+		out, err := runFirewallCmd(backend+"-save", "-c")
+		if err != nil {
+			note(fmt.Sprintf("%s-save: %v", backend, err))
+			continue
+		}
+		t, variant := parseIptablesSave(string(out), backend)
+		if variant == "" {
+			variant = iptablesVariant(backend)
+		}
+		switch {
+		case variant == "legacy" && legacyErr == nil:
+			// the same rules iptables-legacy-save just returned
+		case variant == "legacy":
+			tables = append(tables, t...)
+		case nftOK:
+			note(fmt.Sprintf("%s uses the nf_tables backend: its rules are part of the nft ruleset above", backend))
+		default:
+			tables = append(tables, t...)
+		}
+	}
+
+	return tables
+}
+
+// rereadFirewallTables dumps the given backends again, as named in
+// FirewallTable.Backend, for the counter watch. Each iptables label is the
+// prefix of its save command.
+func rereadFirewallTables(backends []string) []utils.FirewallTable {
+	var tables []utils.FirewallTable
+	for _, b := range backends {
+		if b == "nftables" {
+			if out, err := runFirewallCmd("nft", "-j", "list", "ruleset"); err == nil {
+				if t, err := parseNftJSON(out); err == nil {
+					tables = append(tables, t...)
+				}
+			}
+			continue
+		}
+		if out, err := runFirewallCmd(b+"-save", "-c"); err == nil {
+			t, _ := parseIptablesSave(string(out), b)
+			tables = append(tables, t...)
+		}
+	}
+	return tables
+}
+
+func firewallTableKey(t utils.FirewallTable) string {
+	return t.Backend + "/" + t.Family + "/" + t.Name
+}
+
+// fwNode is one visible line of the tree; key is set for foldable nodes.
+type fwNode struct {
+	key  string
+	text string
+	warn bool
+	hot  bool // counters climbing in watch mode
+	drop bool // a drop/reject rule or policy
+}
+
+// firewallNodes flattens the expanded part of the tree.
+func firewallNodes(m utils.Model) []fwNode {
+	flagged := map[string]bool{}
+	for _, f := range m.FirewallFindings {
+		if f.Severity == "WARNING" && f.Chain != "" {
+			flagged[fmt.Sprintf("%s/%s/%d", f.Table, f.Chain, f.Handle)] = true
+		}
+	}
+
+	var nodes []fwNode
+	for _, t := range m.FirewallTables {
+		tk := firewallTableKey(t)
+		rules := 0
+		for _, c := range t.Chains {
+			rules += len(c.Rules)
+		}
+		nodes = append(nodes, fwNode{key: tk, text: fmt.Sprintf("%s %s table %s %s (%d chains, %d rules)",
+			foldMark(m.FirewallOpen[tk]), t.Backend, t.Family, t.Name, len(t.Chains), rules)})
+		if !m.FirewallOpen[tk] {
+			continue
+		}
+		for _, c := range t.Chains {
+			ck := tk + "/" + c.Name
+			desc := "regular chain"
+			if c.Hook != "" {
+				desc = fmt.Sprintf("type %s hook %s priority %d policy %s", c.Type, c.Hook, c.Priority, c.Policy)
+				if c.Packets > 0 || c.Bytes > 0 {
+					desc += fmt.Sprintf(" [%s pkts %s]", formatCount(c.Packets), formatByteCount(c.Bytes))
+				}
+				if d := m.FirewallDeltas[ck]; d[0] > 0 {
+					desc += fmt.Sprintf(" +%s pkts/s to policy", formatCount(d[0]))
+				}
+			}
+			nodes = append(nodes, fwNode{key: ck, text: fmt.Sprintf("  %s chain %s: %s, %d rules",
+				foldMark(m.FirewallOpen[ck]), c.Name, desc, len(c.Rules)),
+				hot: m.FirewallDeltas[ck][0] > 0, drop: c.Policy == "drop"})
+			if !m.FirewallOpen[ck] {
+				continue
+			}
+			for _, r := range c.Rules {
+				hits := fmt.Sprintf("%8s %8s", "-", "-")
+				if r.Counter {
+					hits = fmt.Sprintf("%8s %8s", formatCount(r.Packets), formatByteCount(r.Bytes))
+				}
+				d := m.FirewallDeltas[firewallRuleKey(t, c, r)]
+				if m.FirewallWatchChan != nil {
+					rate := ""
+					if d[0] > 0 {
+						rate = "+" + formatCount(d[0])
+					}
+					hits += fmt.Sprintf(" %7s", rate)
+				}
+				mark := " "
+				if flagged[fmt.Sprintf("%s/%s/%d", tk, c.Name, r.Handle)] {
+					mark = "!"
+				}
+				nodes = append(nodes, fwNode{
+					text: fmt.Sprintf("    %s %s  #%-4d %s", mark, hits, r.Handle, r.Text),
+					warn: mark == "!",
+					hot:  d[0] > 0,
+					drop: r.Verdict == "drop" || r.Verdict == "reject",
+				})
+			}
+		}
+	}
+	return nodes
+}
+
+func foldMark(open bool) string {
+	if open {
+		return "▾"
+	}
+	return "▸"
+}
+
+// formatCount shortens a counter: 1234567 -> "1.2M".
+func formatCount(n uint64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fG", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1e4:
+		return fmt.Sprintf("%.1fK", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+func formatByteCount(n uint64) string {
+	return formatCount(n) + "B"
+}
+
 func ChosenFirewallView(m utils.Model) string {
-	header := utils.KeywordStyle.Render("Firewall rules:") + " nft/iptables/ufw\n\n"
+	header := utils.KeywordStyle.Render("Firewall rules:") + " nftables / iptables-save / ufw\n\n"
+
+	var notes string
+	if len(m.FirewallLog) > 0 {
+		notes = utils.SubtleStyle.Render(strings.Join(m.FirewallLog, "\n")) + "\n\n"
+	}
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
 
 	if !m.Loaded {
-		body := utils.SubtleStyle.Render("querying firewall rules...")
-		if len(m.FirewallLog) > 0 {
-			body = strings.Join(m.FirewallLog, "\n")
+		body := utils.SubtleStyle.Render(fmt.Sprintf("querying firewall rules... %d tables", len(m.FirewallTables)))
+		return header + notes + body + "\n\n" + utils.SubtleStyle.Render("Running...")
+	}
+
+	if len(m.FirewallTables) == 0 {
+		return header + notes + utils.SubtleStyle.Render("No firewall output collected or command failed.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	}
+
+	var trace string
+	if m.FirewallTrace != nil {
+		trace = firewallTraceView(m) + "\n\n"
+	}
+
+	var findings string
+	if len(m.FirewallFindings) > 0 {
+		findings = firewallFindingsView(m) + "\n\n"
+	}
+
+	var watch string
+	if m.FirewallWatchChan != nil {
+		watch = firewallHotView(m) + "\n\n"
+	}
+
+	// window of the tree around the cursor
+	nodes := firewallNodes(m)
+	start := 0
+	if m.FirewallCursor >= firewallTreeHeight {
+		start = m.FirewallCursor - firewallTreeHeight + 1
+	}
+	end := min(start+firewallTreeHeight, len(nodes))
+
+	columns := fmt.Sprintf("      %8s %8s", "packets", "bytes")
+	if m.FirewallWatchChan != nil {
+		columns += fmt.Sprintf(" %7s", "pkts/s")
+	}
+	lines := []string{utils.SubtleStyle.Render(columns)}
+	for i := start; i < end; i++ {
+		n := nodes[i]
+		prefix := "  "
+		if i == m.FirewallCursor {
+			prefix = utils.CheckboxStyle.Render("> ")
 		}
-		return header + body + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+		switch {
+		case i == m.FirewallCursor:
+			lines = append(lines, prefix+n.text)
+		case n.hot && n.drop:
+			lines = append(lines, prefix+utils.WarnStyle.Render(n.text))
+		case n.hot:
+			lines = append(lines, prefix+utils.KeywordStyle.Render(n.text))
+		case n.warn:
+			lines = append(lines, prefix+utils.WarnStyle.Render(n.text))
+		default:
+			lines = append(lines, prefix+utils.SubtleStyle.Render(n.text))
+		}
+	}
+	if len(nodes) > end {
+		lines = append(lines, utils.SubtleStyle.Render(fmt.Sprintf("  ... %d more", len(nodes)-end)))
 	}
 
-	// finished: show collected firewall rules or message
-	if len(m.FirewallLog) == 0 {
-		return header + utils.SubtleStyle.Render("No firewall output collected or command failed.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	footer := utils.SubtleStyle.Render("j/k: move • enter: fold/unfold • e: expand all • c: collapse all • t: trace a packet • f: all findings • w: watch counters") + "\n" +
+		utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	return header + notes + findings + trace + watch + strings.Join(lines, "\n") + "\n\n" + footer
+}
+
+// firewallFindingsView lists the hygiene findings, warnings first; only the
+// first few are shown unless "f" was pressed.
+func firewallFindingsView(m utils.Model) string {
+	const collapsed = 10
+	var lines []string
+	zero := 0
+	for _, f := range m.FirewallFindings {
+		if f.Severity == "NOTE" && strings.Contains(f.Text, "no hits since boot") {
+			zero++
+		}
+		line := f.Severity + ": " + f.Text
+		if f.Severity == "WARNING" {
+			lines = append(lines, utils.WarnStyle.Render(line))
+		} else {
+			lines = append(lines, utils.SubtleStyle.Render(line))
+		}
+	}
+	if !m.FirewallAllFindings && len(lines) > collapsed {
+		more := len(lines) - collapsed
+		lines = append(lines[:collapsed], utils.SubtleStyle.Render(fmt.Sprintf("... %d more (f: show all)", more)))
 	}
-	return header + utils.SubtleStyle.Render(strings.Join(m.FirewallLog, "\n")) + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	title := fmt.Sprintf("Findings (%d, %d rules without hits since boot; flagged rules are marked ! in the tree)", len(m.FirewallFindings), zero)
+	return utils.KeywordStyle.Render(title) + "\n" + strings.Join(lines, "\n")
 }
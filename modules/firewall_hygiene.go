@@ -0,0 +1,329 @@
+package modules
+
+import (
+	"fmt"
+	"net"
+	"network-check/utils"
+	"strconv"
+	"strings"
+)
+
+// Firewall rule hygiene: static checks over the parsed ruleset. Rules that
+// can never match because an earlier terminal rule in the same chain covers
+// them, duplicates, rules with zero hits since boot, accept-all input/forward
+// paths while an interface has a public address, legacy iptables rules next
+// to an nftables ruleset, and ufw/firewalld state that disagrees with what is
+// loaded in the kernel.
+
+// fwFrontends is what the firewall frontends report about themselves.
+type fwFrontends struct {
+	ufw       string // "active", "inactive" or "" when ufw is not installed
+	firewalld string // "running", "not running" or ""
+}
+
+// fwTerminal are verdicts after which no later rule in the chain is reached.
+var fwTerminal = map[string]bool{
+	"accept": true, "drop": true, "reject": true, "return": true, "goto": true,
+	"masquerade": true, "snat": true, "dnat": true, "redirect": true,
+}
+
+func analyzeFirewall(tables []utils.FirewallTable, fe fwFrontends) []utils.FirewallFinding {
+	var out []utils.FirewallFinding
+	var zero []utils.FirewallFinding
+
+	for _, t := range tables {
+		key := firewallTableKey(t)
+		for _, c := range t.Chains {
+			for j, b := range c.Rules {
+				at := func(sev, text string) utils.FirewallFinding {
+					return utils.FirewallFinding{Severity: sev, Table: key, Chain: c.Name, Handle: b.Handle,
+						Text: fmt.Sprintf("%s %s/%s #%d: %s (%s)", t.Backend, t.Name, c.Name, b.Handle, text, b.Text)}
+				}
+				for i := 0; i < j; i++ {
+					a := c.Rules[i]
+					if fwRuleKey(a) == fwRuleKey(b) {
+						out = append(out, at("WARNING", fmt.Sprintf("duplicate of #%d", a.Handle)))
+						break
+					}
+					if fwTerminal[a.Verdict] && fwCovers(a, b) {
+						out = append(out, at("WARNING", fmt.Sprintf("can never match, shadowed by #%d (%s)", a.Handle, a.Text)))
+						break
+					}
+				}
+				if b.Counter && b.Packets == 0 {
+					zero = append(zero, at("NOTE", "no hits since boot"))
+				}
+			}
+		}
+	}
+
+	out = append(out, fwExposure(tables)...)
+	out = append(out, fwBackendMix(tables)...)
+	out = append(out, fwFrontendState(tables, fe)...)
+	return append(out, zero...)
+}
+
+// fwRuleKey identifies a rule for duplicate detection (counters excluded).
+func fwRuleKey(r utils.FirewallRule) string {
+	var parts []string
+	for _, m := range r.Matches {
+		parts = append(parts, m.Raw)
+	}
+	return strings.Join(parts, " ") + " | " + r.Verdict + " " + r.Target + " " + strings.Join(r.Statements, " ")
+}
+
+// fwCovers reports whether every packet matching b also matches a.
+func fwCovers(a, b utils.FirewallRule) bool {
+	for _, am := range a.Matches {
+		if am.Field == "" {
+			return false
+		}
+		found := false
+		for _, bm := range b.Matches {
+			if bm.Field != am.Field || bm.Negate != am.Negate {
+				continue
+			}
+			if !am.Negate && fwValuesSubset(am.Field, bm.Values, am.Values) {
+				found = true
+			}
+			if am.Negate && fwValuesSubset(am.Field, am.Values, bm.Values) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// fwValuesSubset reports whether every value in sub is contained in sup.
+func fwValuesSubset(field string, sub, sup []string) bool {
+	for _, s := range sub {
+		ok := false
+		for _, p := range sup {
+			if fwValueWithin(field, s, p) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return len(sub) > 0
+}
+
+func fwValueWithin(field, s, p string) bool {
+	switch field {
+	case "saddr", "daddr":
+		sn, pn := fwPrefix(s), fwPrefix(p)
+		if sn == nil || pn == nil {
+			return s == p
+		}
+		so, _ := sn.Mask.Size()
+		po, _ := pn.Mask.Size()
+		return po <= so && pn.Contains(sn.IP)
+	case "sport", "dport":
+		slo, shi, ok1 := fwPortRange(s)
+		plo, phi, ok2 := fwPortRange(p)
+		return ok1 && ok2 && plo <= slo && shi <= phi
+	case "proto":
+		if n, ok := fwProtoNumbers[s]; ok {
+			s = n
+		}
+		if n, ok := fwProtoNumbers[p]; ok {
+			p = n
+		}
+		return s == p || p == "all"
+	case "iif", "oif":
+		if strings.HasSuffix(s, "+") || strings.HasSuffix(s, "*") {
+			return s == p
+		}
+		return fwIfaceMatch(p, s)
+	}
+	return s == p
+}
+
+func fwPrefix(v string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(v); err == nil {
+		return n
+	}
+	if ip := net.ParseIP(v); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return nil
+}
+
+func fwPortRange(v string) (int, int, bool) {
+	lo, hi, isRange := strings.Cut(v, "-")
+	a, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !isRange {
+		return a, a, true
+	}
+	b, err := strconv.Atoi(hi)
+	return a, b, err == nil
+}
+
+// exposedInterfaces lists interfaces holding a public (global, non-private)
+// address, per family.
+func exposedInterfaces() map[int][]string {
+	out := map[int][]string{}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return out
+	}
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || !ipn.IP.IsGlobalUnicast() || ipn.IP.IsPrivate() {
+				continue
+			}
+			fam := 6
+			if ipn.IP.To4() != nil {
+				fam = 4
+			}
+			out[fam] = append(out[fam], fmt.Sprintf("%s (%s)", ifc.Name, ipn.IP))
+		}
+	}
+	return out
+}
+
+// fwExposure flags input/forward paths that accept everything while the host
+// has a public address.
+func fwExposure(tables []utils.FirewallTable) []utils.FirewallFinding {
+	var out []utils.FirewallFinding
+	exposed := exposedInterfaces()
+	for _, fam := range []int{4, 6} {
+		if len(exposed[fam]) == 0 {
+			continue
+		}
+		hooks := []string{"input"}
+		fwd := "/proc/sys/net/ipv4/ip_forward"
+		if fam == 6 {
+			fwd = "/proc/sys/net/ipv6/conf/all/forwarding"
+		}
+		if n, _ := readSysctlInt(fwd); n == 1 {
+			hooks = append(hooks, "forward")
+		}
+		for _, hook := range hooks {
+			filtering := false
+			for _, t := range tables {
+				if !fwTableApplies(t, fam) {
+					continue
+				}
+				for _, c := range t.Chains {
+					if c.Hook != hook || c.Type != "filter" {
+						continue
+					}
+					if c.Policy != "accept" || fwChainRejects(t, c, map[string]bool{}) {
+						filtering = true
+					}
+				}
+			}
+			if !filtering {
+				out = append(out, utils.FirewallFinding{Severity: "WARNING", Text: fmt.Sprintf(
+					"IPv%d %s accepts everything (policy accept, no drop/reject rule) while %s has a public address",
+					fam, hook, strings.Join(exposed[fam], ", "))})
+			}
+		}
+	}
+	return out
+}
+
+// fwChainRejects reports whether a chain, or a chain it jumps to, can drop.
+func fwChainRejects(t utils.FirewallTable, c utils.FirewallChain, seen map[string]bool) bool {
+	if seen[c.Name] {
+		return false
+	}
+	seen[c.Name] = true
+	for _, r := range c.Rules {
+		switch r.Verdict {
+		case "drop", "reject":
+			return true
+		case "jump", "goto":
+			for _, sub := range t.Chains {
+				if sub.Name == r.Target && fwChainRejects(t, sub, seen) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// fwBackendMix warns when iptables-legacy-save returned rules while nftables
+// holds rules too.
+func fwBackendMix(tables []utils.FirewallTable) []utils.FirewallFinding {
+	var nft, legacy []string
+	for _, t := range tables {
+		active := false
+		for _, c := range t.Chains {
+			if len(c.Rules) > 0 || (c.Policy != "" && c.Policy != "accept") {
+				active = true
+			}
+		}
+		if !active {
+			continue
+		}
+		name := t.Backend + " " + t.Family + " " + t.Name
+		switch {
+		case strings.HasSuffix(t.Backend, "-legacy"):
+			legacy = append(legacy, name)
+		case t.Backend == "nftables":
+			nft = append(nft, name)
+		}
+	}
+	if len(nft) == 0 || len(legacy) == 0 {
+		return nil
+	}
+	return []utils.FirewallFinding{{Severity: "WARNING", Text: fmt.Sprintf(
+		"both iptables-legacy (%s) and nftables (%s) hold rules: packets pass both rulesets and a drop in either wins, which tools usually do not show",
+		strings.Join(legacy, ", "), strings.Join(nft, ", "))}}
+}
+
+// fwFrontendState compares ufw/firewalld status with the loaded ruleset.
+func fwFrontendState(tables []utils.FirewallTable, fe fwFrontends) []utils.FirewallFinding {
+	var out []utils.FirewallFinding
+	ufwChains, firewalld := 0, false
+	for _, t := range tables {
+		if t.Name == "firewalld" {
+			firewalld = true
+		}
+		for _, c := range t.Chains {
+			if strings.HasPrefix(c.Name, "ufw-") || strings.HasPrefix(c.Name, "ufw6-") {
+				ufwChains++
+			}
+			if strings.HasPrefix(c.Name, "IN_public") || strings.HasPrefix(c.Name, "filter_IN_") {
+				firewalld = true
+			}
+		}
+	}
+	switch {
+	case fe.ufw == "active" && ufwChains == 0:
+		out = append(out, utils.FirewallFinding{Severity: "WARNING", Text: "ufw reports active but no ufw chains are loaded in the kernel (rules flushed or loaded into another backend)"})
+	case fe.ufw == "inactive" && ufwChains > 0:
+		out = append(out, utils.FirewallFinding{Severity: "NOTE", Text: fmt.Sprintf("ufw reports inactive but %d ufw chains are still loaded", ufwChains)})
+	}
+	switch {
+	case fe.firewalld == "running" && !firewalld:
+		out = append(out, utils.FirewallFinding{Severity: "WARNING", Text: "firewalld reports running but its table/chains are not in the kernel ruleset (flushed by another tool?)"})
+	case fe.firewalld == "not running" && firewalld:
+		out = append(out, utils.FirewallFinding{Severity: "NOTE", Text: "firewalld is not running but its rules are still loaded"})
+	}
+	if fe.ufw == "active" && fe.firewalld == "running" {
+		out = append(out, utils.FirewallFinding{Severity: "WARNING", Text: "ufw and firewalld are both active and will overwrite each other's rules"})
+	}
+	return out
+}
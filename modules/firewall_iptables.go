@@ -0,0 +1,301 @@
+package modules
+
+import (
+	"fmt"
+	"network-check/utils"
+	"strconv"
+	"strings"
+)
+
+// Parser for "iptables-save -c" / "ip6tables-save -c". Tables start with
+// "*name", chains are declared as ":NAME POLICY [packets:bytes]" and rules are
+// "[packets:bytes] -A CHAIN options...". Built-in chains are mapped to the
+// hook and priority they have in the kernel so both backends can be shown and
+// traced the same way.
+
+// iptablesPriorities are the netfilter hook priorities of the legacy tables.
+var iptablesPriorities = map[string]int{"raw": -300, "mangle": -150, "nat": -100, "filter": 0, "security": 50}
+
+// iptablesVerdicts are the targets that end evaluation in the current chain.
+var iptablesVerdicts = map[string]string{"ACCEPT": "accept", "DROP": "drop", "REJECT": "reject", "RETURN": "return"}
+
+// iptablesTerminal are extension targets that also stop traversal.
+var iptablesTerminal = map[string]bool{
+	"DNAT": true, "SNAT": true, "MASQUERADE": true, "REDIRECT": true, "NFQUEUE": true, "TPROXY": true,
+}
+
+// parseIptablesSave parses one *-save dump. variant is "nf_tables" or
+// "legacy" when the "# Generated by" header names the save tool of one
+// backend (iptables-nft-save, xtables-save before iptables 1.8.3,
+// iptables-legacy-save), empty when it is plain iptables-save.
+func parseIptablesSave(data, backend string) (tables []utils.FirewallTable, variant string) {
+	var cur *utils.FirewallTable
+	chainIdx := map[string]int{}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#"):
+			if f := strings.Fields(line); len(f) >= 4 && f[1] == "Generated" && f[2] == "by" {
+				switch {
+				case strings.Contains(f[3], "-nft-save"), strings.HasPrefix(f[3], "xtables-save"):
+					variant = "nf_tables"
+				case strings.Contains(f[3], "-legacy-save"):
+					variant = "legacy"
+				}
+			}
+			continue
+		case strings.HasPrefix(line, "*"):
+			family := "ip"
+			if strings.HasPrefix(backend, "ip6tables") {
+				family = "ip6"
+			}
+			tables = append(tables, utils.FirewallTable{Backend: backend, Family: family, Name: line[1:]})
+			cur = &tables[len(tables)-1]
+			chainIdx = map[string]int{}
+			continue
+		case line == "COMMIT" || cur == nil:
+			continue
+		case strings.HasPrefix(line, ":"):
+			// :INPUT ACCEPT [12:3456]
+			fields := strings.Fields(line[1:])
+			if len(fields) < 2 {
+				continue
+			}
+			c := utils.FirewallChain{Name: fields[0]}
+			if fields[1] != "-" {
+				c.Policy = strings.ToLower(fields[1])
+				c.Hook = strings.ToLower(fields[0])
+				c.Type = "filter"
+				switch {
+				case cur.Name == "nat":
+					c.Type = "nat"
+				case cur.Name == "mangle" && c.Hook == "output":
+					c.Type = "route"
+				}
+				c.Priority = iptablesPriorities[cur.Name]
+				if cur.Name == "nat" && (c.Hook == "postrouting" || c.Hook == "input") {
+					c.Priority = 100
+				}
+			}
+			if len(fields) > 2 {
+				c.Packets, c.Bytes = parseIptablesCounters(fields[2])
+			}
+			chainIdx[c.Name] = len(cur.Chains)
+			cur.Chains = append(cur.Chains, c)
+			continue
+		}
+
+		var pkts, bytes uint64
+		counted := false
+		if strings.HasPrefix(line, "[") {
+			if i := strings.Index(line, "]"); i > 0 {
+				pkts, bytes = parseIptablesCounters(line[:i+1])
+				counted = true
+				line = strings.TrimSpace(line[i+1:])
+			}
+		}
+		tok := splitShellWords(line)
+		if len(tok) < 2 || tok[0] != "-A" {
+			continue
+		}
+		ci, ok := chainIdx[tok[1]]
+		if !ok {
+			continue
+		}
+		r := parseIptablesRule(tok[2:], chainIdx)
+		if counted {
+			r.Counter, r.Packets, r.Bytes = true, pkts, bytes
+		}
+		r.Handle = len(cur.Chains[ci].Rules) + 1
+		cur.Chains[ci].Rules = append(cur.Chains[ci].Rules, r)
+	}
+	return tables, variant
+}
+
+// iptablesVariant asks backend -V which backend it drives: iptables 1.8 and
+// later print "(nf_tables)" or "(legacy)" after the version, older ones
+// only know the legacy backend.
+func iptablesVariant(backend string) string {
+	out, err := runFirewallCmd(backend, "-V")
+	if err == nil && strings.Contains(string(out), "(nf_tables)") {
+		return "nf_tables"
+	}
+	return "legacy"
+}
+
+// parseIptablesCounters parses "[packets:bytes]".
+func parseIptablesCounters(s string) (uint64, uint64) {
+	s = strings.Trim(s, "[]")
+	p, b, _ := strings.Cut(s, ":")
+	pk, _ := strconv.ParseUint(p, 10, 64)
+	by, _ := strconv.ParseUint(b, 10, 64)
+	return pk, by
+}
+
+// parseIptablesRule parses the options after "-A CHAIN".
+func parseIptablesRule(tok []string, chains map[string]int) utils.FirewallRule {
+	var r utils.FirewallRule
+	r.Text = strings.Join(quoteWords(tok), " ")
+
+	// args collects the values of an option up to the next option
+	args := func(i int) ([]string, int) {
+		var out []string
+		for i+1 < len(tok) && !strings.HasPrefix(tok[i+1], "-") && tok[i+1] != "!" {
+			i++
+			out = append(out, tok[i])
+		}
+		return out, i
+	}
+	list := func(v []string, portRange bool) []string {
+		var out []string
+		for _, s := range v {
+			for _, e := range strings.Split(s, ",") {
+				if portRange {
+					e = strings.Replace(e, ":", "-", 1)
+				}
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+
+	neg := false
+	module := ""
+	target := false
+	for i := 0; i < len(tok); i++ {
+		t := tok[i]
+		if t == "!" {
+			neg = true
+			continue
+		}
+		vals, next := args(i)
+		add := func(field string, values []string) {
+			raw := strings.Join(append([]string{t}, vals...), " ")
+			if neg {
+				raw = "! " + raw
+			}
+			r.Matches = append(r.Matches, utils.FirewallMatch{Field: field, Negate: neg, Values: values, Raw: raw})
+		}
+		switch {
+		case target:
+			// target options, e.g. --to-destination, --log-prefix, --reject-with
+			if len(r.Statements) > 0 {
+				r.Statements[len(r.Statements)-1] += " " + strings.Join(quoteWords(append([]string{t}, vals...)), " ")
+			}
+		case t == "-s" || t == "--source":
+			add("saddr", list(vals, false))
+		case t == "-d" || t == "--destination":
+			add("daddr", list(vals, false))
+		case t == "-p" || t == "--protocol":
+			add("proto", list(vals, false))
+		case t == "-i" || t == "--in-interface":
+			add("iif", vals)
+		case t == "-o" || t == "--out-interface":
+			add("oif", vals)
+		case t == "--dport" || t == "--dports" || t == "--destination-port" || t == "--destination-ports":
+			add("dport", list(vals, true))
+		case t == "--sport" || t == "--sports" || t == "--source-port" || t == "--source-ports":
+			add("sport", list(vals, true))
+		case t == "--ctstate" || t == "--state":
+			add("ct state", list([]string{strings.ToLower(strings.Join(vals, ","))}, false))
+		case t == "--mark" && module == "mark":
+			add("mark", vals)
+		case t == "--icmp-type" || t == "--icmpv6-type":
+			add("icmp type", vals)
+		case t == "--comment":
+			r.Comment = strings.Join(vals, " ")
+		case t == "-m" || t == "--match":
+			module = strings.Join(vals, "")
+		case t == "-j" || t == "--jump" || t == "-g" || t == "--goto":
+			name := strings.Join(vals, "")
+			r.Target = name
+			target = true
+			switch {
+			case t == "-g" || t == "--goto":
+				r.Verdict = "goto"
+			case iptablesVerdicts[name] != "":
+				r.Verdict = iptablesVerdicts[name]
+				r.Target = ""
+			case isUserChain(chains, name):
+				r.Verdict = "jump"
+			default:
+				if iptablesTerminal[name] {
+					r.Verdict = strings.ToLower(name)
+				}
+				r.Statements = append(r.Statements, name)
+			}
+		case t == "-c" && len(vals) == 2:
+			// counters given inline ("-c packets bytes")
+			r.Counter = true
+			r.Packets, _ = strconv.ParseUint(vals[0], 10, 64)
+			r.Bytes, _ = strconv.ParseUint(vals[1], 10, 64)
+		default:
+			// a match this parser does not model; keep it so the tracer can flag it
+			raw := strings.Join(quoteWords(append([]string{t}, vals...)), " ")
+			if module != "" {
+				raw = "-m " + module + " " + raw
+			}
+			if neg {
+				raw = "! " + raw
+			}
+			if t != "-4" && t != "-6" {
+				r.Matches = append(r.Matches, utils.FirewallMatch{Negate: neg, Raw: raw})
+			}
+		}
+		neg = false
+		i = next
+	}
+	return r
+}
+
+func isUserChain(chains map[string]int, name string) bool {
+	_, ok := chains[name]
+	return ok
+}
+
+// splitShellWords splits a rule line the way the shell would, honouring
+// double quotes and backslash escapes as written by iptables-save.
+func splitShellWords(s string) []string {
+	var out []string
+	var cur strings.Builder
+	inQuote, have := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(s[i])
+			have = true
+		case c == '"':
+			inQuote = !inQuote
+			have = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if have {
+				out = append(out, cur.String())
+				cur.Reset()
+				have = false
+			}
+		default:
+			cur.WriteByte(c)
+			have = true
+		}
+	}
+	if have {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+// quoteWords re-quotes words containing spaces for display.
+func quoteWords(words []string) []string {
+	out := make([]string, len(words))
+	for i, w := range words {
+		if strings.ContainsAny(w, " \t") || w == "" {
+			w = fmt.Sprintf("%q", w)
+		}
+		out[i] = w
+	}
+	return out
+}
@@ -0,0 +1,332 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"network-check/utils"
+	"strconv"
+	"strings"
+)
+
+// Parser for "nft -j list ruleset". The JSON schema (libnftables-json(5)) is
+// a flat list of table, chain and rule objects; rule expressions are turned
+// into utils.FirewallMatch values where the field is one the tracer
+// understands, and kept as raw text otherwise.
+
+type nftObject struct {
+	Table *struct {
+		Family string `json:"family"`
+		Name   string `json:"name"`
+	} `json:"table"`
+	Chain *struct {
+		Family string          `json:"family"`
+		Table  string          `json:"table"`
+		Name   string          `json:"name"`
+		Type   string          `json:"type"`
+		Hook   string          `json:"hook"`
+		Prio   json.RawMessage `json:"prio"`
+		Policy string          `json:"policy"`
+	} `json:"chain"`
+	Rule *struct {
+		Family  string           `json:"family"`
+		Table   string           `json:"table"`
+		Chain   string           `json:"chain"`
+		Handle  int              `json:"handle"`
+		Comment string           `json:"comment"`
+		Expr    []map[string]any `json:"expr"`
+	} `json:"rule"`
+}
+
+// nftStandardPriorities maps the symbolic chain priorities nft may print.
+var nftStandardPriorities = map[string]int{
+	"raw": -300, "mangle": -150, "dstnat": -100, "filter": 0, "security": 50, "srcnat": 100, "out": 100,
+}
+
+func parseNftJSON(data []byte) ([]utils.FirewallTable, error) {
+	var doc struct {
+		Nftables []nftObject `json:"nftables"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var tables []utils.FirewallTable
+	tableIdx := map[string]int{}
+	chainIdx := map[string]int{}
+	for _, o := range doc.Nftables {
+		switch {
+		case o.Table != nil:
+			tableIdx[o.Table.Family+" "+o.Table.Name] = len(tables)
+			tables = append(tables, utils.FirewallTable{Backend: "nftables", Family: o.Table.Family, Name: o.Table.Name})
+
+		case o.Chain != nil:
+			ti, ok := tableIdx[o.Chain.Family+" "+o.Chain.Table]
+			if !ok {
+				continue
+			}
+			c := utils.FirewallChain{Name: o.Chain.Name, Type: o.Chain.Type, Hook: o.Chain.Hook, Policy: o.Chain.Policy}
+			if c.Hook != "" && c.Policy == "" {
+				c.Policy = "accept"
+			}
+			if len(o.Chain.Prio) > 0 {
+				var n json.Number
+				var s string
+				if json.Unmarshal(o.Chain.Prio, &n) == nil {
+					p, _ := n.Int64()
+					c.Priority = int(p)
+				} else if json.Unmarshal(o.Chain.Prio, &s) == nil {
+					c.Priority = nftStandardPriorities[s]
+				}
+			}
+			chainIdx[o.Chain.Family+" "+o.Chain.Table+" "+o.Chain.Name] = len(tables[ti].Chains)
+			tables[ti].Chains = append(tables[ti].Chains, c)
+
+		case o.Rule != nil:
+			ti, ok := tableIdx[o.Rule.Family+" "+o.Rule.Table]
+			if !ok {
+				continue
+			}
+			ci, ok := chainIdx[o.Rule.Family+" "+o.Rule.Table+" "+o.Rule.Chain]
+			if !ok {
+				continue
+			}
+			r := nftRule(o.Rule.Expr)
+			r.Handle = o.Rule.Handle
+			r.Comment = o.Rule.Comment
+			if r.Comment != "" {
+				r.Text += fmt.Sprintf(" comment %q", r.Comment)
+			}
+			tables[ti].Chains[ci].Rules = append(tables[ti].Chains[ci].Rules, r)
+		}
+	}
+	return tables, nil
+}
+
+// nftRule converts the expression list of one rule.
+func nftRule(exprs []map[string]any) utils.FirewallRule {
+	var r utils.FirewallRule
+	var text []string
+	for _, e := range exprs {
+		for key, v := range e {
+			switch key {
+			case "match":
+				mm, _ := v.(map[string]any)
+				ms := nftMatch(mm)
+				r.Matches = append(r.Matches, ms...)
+				text = append(text, ms[len(ms)-1].Raw)
+			case "counter":
+				r.Counter = true
+				if c, ok := v.(map[string]any); ok {
+					r.Packets = nftUint(c["packets"])
+					r.Bytes = nftUint(c["bytes"])
+				}
+				text = append(text, "counter")
+			case "accept", "drop", "return", "continue":
+				r.Verdict = key
+				text = append(text, key)
+			case "reject":
+				r.Verdict = key
+				text = append(text, "reject")
+			case "jump", "goto":
+				r.Verdict = key
+				if t, ok := v.(map[string]any); ok {
+					r.Target, _ = t["target"].(string)
+				}
+				text = append(text, key+" "+r.Target)
+			case "masquerade", "snat", "dnat", "redirect", "queue", "tproxy":
+				// terminal statements
+				r.Verdict = key
+				r.Target = key
+				s := nftStatement(key, v)
+				r.Statements = append(r.Statements, s)
+				text = append(text, s)
+			case "limit", "quota":
+				// these only let some packets through, so they act as matches
+				s := nftStatement(key, v)
+				r.Matches = append(r.Matches, utils.FirewallMatch{Raw: s})
+				text = append(text, s)
+			default:
+				s := nftStatement(key, v)
+				r.Statements = append(r.Statements, s)
+				text = append(text, s)
+			}
+		}
+	}
+	r.Text = strings.Join(text, " ")
+	return r
+}
+
+// nftMatch converts a match expression. Port and address matches imply a
+// protocol or family, which is returned as an extra match before the real one
+// so the caller can use the last element for the rule text.
+func nftMatch(m map[string]any) []utils.FirewallMatch {
+	op, _ := m["op"].(string)
+	field, implied, left := nftLeft(m["left"])
+	values := nftValues(m["right"])
+
+	match := utils.FirewallMatch{Field: field, Values: values, Negate: op == "!="}
+	switch op {
+	case "", "==", "!=", "in":
+	case "<", ">", "<=", ">=":
+		// only port/number comparisons are understood, as ranges
+		if len(values) == 1 {
+			if n, err := strconv.Atoi(values[0]); err == nil {
+				lo, hi := 0, 65535
+				switch op {
+				case "<":
+					hi = n - 1
+				case "<=":
+					hi = n
+				case ">":
+					lo = n + 1
+				case ">=":
+					lo = n
+				}
+				match.Values = []string{fmt.Sprintf("%d-%d", lo, hi)}
+				break
+			}
+		}
+		match.Field = ""
+	default:
+		// bitwise flag tests and the like
+		match.Field = ""
+	}
+
+	right := strings.Join(values, ", ")
+	if len(values) > 1 {
+		right = "{ " + right + " }"
+	}
+	switch op {
+	case "", "==", "in":
+		match.Raw = left + " " + right
+	default:
+		match.Raw = left + " " + op + " " + right
+	}
+
+	var out []utils.FirewallMatch
+	if implied.Field != "" {
+		out = append(out, implied)
+	}
+	return append(out, match)
+}
+
+// nftLeft maps the left-hand side of a match to a normalized field, an
+// implied protocol/family match, and its nft spelling.
+func nftLeft(v any) (string, utils.FirewallMatch, string) {
+	var implied utils.FirewallMatch
+	m, _ := v.(map[string]any)
+	if p, ok := m["payload"].(map[string]any); ok {
+		proto, _ := p["protocol"].(string)
+		f, _ := p["field"].(string)
+		if proto == "" {
+			return "", implied, fmt.Sprintf("@%v,%v,%v", p["base"], p["offset"], p["len"])
+		}
+		raw := proto + " " + f
+		switch {
+		case (proto == "ip" || proto == "ip6") && (f == "saddr" || f == "daddr"):
+			nf := "ipv4"
+			if proto == "ip6" {
+				nf = "ipv6"
+			}
+			implied = utils.FirewallMatch{Field: "nfproto", Values: []string{nf}, Raw: "meta nfproto " + nf}
+			return f, implied, raw
+		case (proto == "ip" && f == "protocol") || (proto == "ip6" && f == "nexthdr"):
+			return "proto", implied, raw
+		case f == "sport" || f == "dport":
+			if proto != "th" {
+				implied = utils.FirewallMatch{Field: "proto", Values: []string{proto}, Raw: "meta l4proto " + proto}
+			}
+			return f, implied, raw
+		case (proto == "icmp" || proto == "icmpv6") && f == "type":
+			l4 := "icmp"
+			if proto == "icmpv6" {
+				l4 = "ipv6-icmp"
+			}
+			implied = utils.FirewallMatch{Field: "proto", Values: []string{l4}, Raw: "meta l4proto " + l4}
+			return "icmp type", implied, raw
+		}
+		return "", implied, raw
+	}
+	if meta, ok := m["meta"].(map[string]any); ok {
+		key, _ := meta["key"].(string)
+		switch key {
+		case "iifname", "iif":
+			return "iif", implied, key
+		case "oifname", "oif":
+			return "oif", implied, key
+		case "l4proto":
+			return "proto", implied, "meta l4proto"
+		case "nfproto":
+			return "nfproto", implied, "meta nfproto"
+		case "mark":
+			return "mark", implied, "meta mark"
+		}
+		return "", implied, "meta " + key
+	}
+	if ct, ok := m["ct"].(map[string]any); ok {
+		key, _ := ct["key"].(string)
+		if key == "state" {
+			return "ct state", implied, "ct state"
+		}
+		return "", implied, "ct " + key
+	}
+	b, _ := json.Marshal(v)
+	return "", implied, string(b)
+}
+
+// nftValues flattens the right-hand side of a match into strings.
+func nftValues(v any) []string {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{x}
+	case json.Number:
+		return []string{x.String()}
+	case bool:
+		return []string{strconv.FormatBool(x)}
+	case []any:
+		var out []string
+		for _, e := range x {
+			out = append(out, nftValues(e)...)
+		}
+		return out
+	case map[string]any:
+		if s, ok := x["set"]; ok {
+			return nftValues(s)
+		}
+		if p, ok := x["prefix"].(map[string]any); ok {
+			return []string{fmt.Sprintf("%v/%v", p["addr"], p["len"])}
+		}
+		if r, ok := x["range"].([]any); ok && len(r) == 2 {
+			return []string{fmt.Sprintf("%v-%v", r[0], r[1])}
+		}
+	}
+	b, _ := json.Marshal(v)
+	return []string{string(b)}
+}
+
+// nftStatement renders a non-match statement compactly, e.g. "log prefix x".
+func nftStatement(key string, v any) string {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) == 0 {
+		return key
+	}
+	parts := []string{key}
+	for _, k := range sortedKeys(m) {
+		val := strings.Join(nftValues(m[k]), ",")
+		parts = append(parts, k+" "+val)
+	}
+	return strings.Join(parts, " ")
+}
+
+func nftUint(v any) uint64 {
+	if n, ok := v.(json.Number); ok {
+		u, _ := strconv.ParseUint(n.String(), 10, 64)
+		return u
+	}
+	return 0
+}
@@ -0,0 +1,520 @@
+package modules
+
+import (
+	"fmt"
+	"net"
+	"network-check/utils"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Firewall packet tracer: evaluates a described flow against the parsed
+// nftables/iptables model. The hooks the packet passes are derived from the
+// input interface and whether the destination is a local address; at every
+// hook the base chains of all tables are run in priority order, following
+// jump/goto/return, until a rule gives a verdict or the chain policy applies.
+// Matches the tracer cannot evaluate (named sets, tcp flags, limits...) are
+// treated as not matching and reported, so the answer is never silently wrong.
+
+type fwFlow struct {
+	family      int // 4 or 6
+	proto       string
+	src, dst    net.IP
+	sport       int
+	dport       int
+	iif, oif    string
+	state       string
+	mark        uint32
+	local       bool // destination is one of our addresses
+	localOrigin bool // no input interface: generated by this host
+}
+
+var fwProtoNumbers = map[string]string{
+	"icmp": "1", "tcp": "6", "udp": "17", "gre": "47", "esp": "50", "ah": "51",
+	"ipv6-icmp": "58", "icmpv6": "58", "sctp": "132", "udplite": "136",
+}
+
+// parseFirewallFlow accepts key/value pairs: "tcp from 10.0.0.5 to
+// 192.168.1.10 dport 5432 iif eth0 [sport N] [oif DEV] [state new] [mark N]".
+func parseFirewallFlow(s string) (fwFlow, error) {
+	f := fwFlow{proto: "tcp", state: "new"}
+	fields := strings.Fields(strings.ToLower(s))
+	for i := 0; i < len(fields); i++ {
+		key := fields[i]
+		if _, ok := fwProtoNumbers[key]; ok {
+			f.proto = key
+			continue
+		}
+		if i+1 >= len(fields) {
+			return f, fmt.Errorf("%q needs a value", key)
+		}
+		i++
+		val := fields[i]
+		var err error
+		switch key {
+		case "proto":
+			f.proto = val
+		case "from", "src", "saddr":
+			if f.src = net.ParseIP(val); f.src == nil {
+				err = fmt.Errorf("%q is not an IP address", val)
+			}
+		case "to", "dst", "daddr":
+			if f.dst = net.ParseIP(val); f.dst == nil {
+				err = fmt.Errorf("%q is not an IP address", val)
+			}
+		case "sport":
+			f.sport, err = strconv.Atoi(val)
+		case "dport", "port":
+			f.dport, err = strconv.Atoi(val)
+		case "iif", "in":
+			f.iif = val
+		case "oif", "out":
+			f.oif = val
+		case "state":
+			f.state = val
+		case "mark":
+			var n uint64
+			n, err = strconv.ParseUint(val, 0, 32)
+			f.mark = uint32(n)
+		default:
+			err = fmt.Errorf("unknown keyword %q", key)
+		}
+		if err != nil {
+			return f, err
+		}
+	}
+	if f.dst == nil {
+		return f, fmt.Errorf("a destination (to ADDR) is required")
+	}
+	f.family = 6
+	if f.dst.To4() != nil {
+		f.family = 4
+	}
+	if f.src != nil && (f.src.To4() != nil) != (f.family == 4) {
+		return f, fmt.Errorf("source and destination are different address families")
+	}
+	f.local = isLocalAddress(f.dst)
+	f.localOrigin = f.iif == ""
+	return f, nil
+}
+
+func isLocalAddress(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hooks returns the netfilter hooks the flow passes, in order.
+func (f fwFlow) hooks() []string {
+	switch {
+	case f.localOrigin:
+		return []string{"output", "postrouting"}
+	case f.local:
+		return []string{"prerouting", "input"}
+	}
+	return []string{"prerouting", "forward", "postrouting"}
+}
+
+func (f fwFlow) String() string {
+	s := f.proto
+	if f.src != nil {
+		s += " from " + f.src.String()
+	}
+	if f.sport != 0 {
+		s += " sport " + strconv.Itoa(f.sport)
+	}
+	s += " to " + f.dst.String()
+	if f.dport != 0 {
+		s += " dport " + strconv.Itoa(f.dport)
+	}
+	if f.iif != "" {
+		s += " iif " + f.iif
+	}
+	if f.oif != "" {
+		s += " oif " + f.oif
+	}
+	s += " state " + f.state
+	if f.mark != 0 {
+		s += fmt.Sprintf(" mark 0x%x", f.mark)
+	}
+	return s
+}
+
+// fwEvalMatch evaluates one condition: 1 match, 0 no match, -1 unknown (with
+// the condition text).
+func fwEvalMatch(mt utils.FirewallMatch, f fwFlow) (int, string) {
+	if mt.Field == "" {
+		return -1, mt.Raw
+	}
+	var ok, known = false, true
+	switch mt.Field {
+	case "nfproto":
+		want := "ipv4"
+		if f.family == 6 {
+			want = "ipv6"
+		}
+		ok = fwAny(mt.Values, func(v string) bool { return v == want })
+	case "saddr", "daddr":
+		ip := f.src
+		if mt.Field == "daddr" {
+			ip = f.dst
+		}
+		if ip == nil {
+			return -1, mt.Raw + " (flow has no source address)"
+		}
+		for _, v := range mt.Values {
+			m, k := fwAddrMatch(v, ip)
+			ok = ok || m
+			known = known && k
+		}
+	case "proto":
+		want := fwProtoNumbers[f.proto]
+		ok = fwAny(mt.Values, func(v string) bool {
+			if n, found := fwProtoNumbers[v]; found {
+				v = n
+			}
+			return v == want || v == "all"
+		})
+	case "sport", "dport":
+		port := f.sport
+		if mt.Field == "dport" {
+			port = f.dport
+		}
+		for _, v := range mt.Values {
+			m, k := fwPortMatch(v, port)
+			ok = ok || m
+			known = known && k
+		}
+	case "iif", "oif":
+		name := f.iif
+		if mt.Field == "oif" {
+			name = f.oif
+			if name == "" {
+				return -1, mt.Raw + " (output interface not given)"
+			}
+		}
+		ok = fwAny(mt.Values, func(v string) bool { return fwIfaceMatch(v, name) })
+	case "ct state":
+		ok = fwAny(mt.Values, func(v string) bool { return v == f.state })
+	case "mark":
+		ok = fwAny(mt.Values, func(v string) bool {
+			val, mask, _ := strings.Cut(v, "/")
+			n, err1 := strconv.ParseUint(val, 0, 32)
+			m := uint64(0xffffffff)
+			var err2 error
+			if mask != "" {
+				m, err2 = strconv.ParseUint(mask, 0, 32)
+			}
+			if err1 != nil || err2 != nil {
+				known = false
+				return false
+			}
+			return uint64(f.mark)&m == n
+		})
+	default:
+		return -1, mt.Raw
+	}
+	if !known && !ok {
+		return -1, mt.Raw
+	}
+	if ok != mt.Negate {
+		return 1, ""
+	}
+	return 0, ""
+}
+
+func fwAny(values []string, fn func(string) bool) bool {
+	for _, v := range values {
+		if fn(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// fwAddrMatch handles addresses, prefixes and "a-b" ranges; named sets are unknown.
+func fwAddrMatch(v string, ip net.IP) (match, known bool) {
+	if strings.HasPrefix(v, "@") {
+		return false, false
+	}
+	if lo, hi, ok := strings.Cut(v, "-"); ok {
+		a, b := net.ParseIP(lo), net.ParseIP(hi)
+		if a == nil || b == nil {
+			return false, false
+		}
+		return compareIP(ip.String(), a.String()) >= 0 && compareIP(ip.String(), b.String()) <= 0, true
+	}
+	if _, n, err := net.ParseCIDR(v); err == nil {
+		return n.Contains(ip), true
+	}
+	if a := net.ParseIP(v); a != nil {
+		return a.Equal(ip), true
+	}
+	return false, false
+}
+
+func fwPortMatch(v string, port int) (match, known bool) {
+	if lo, hi, ok := strings.Cut(v, "-"); ok {
+		a, err1 := strconv.Atoi(lo)
+		b, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil {
+			return false, false
+		}
+		return port >= a && port <= b, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return false, false
+	}
+	return port == n, true
+}
+
+// fwIfaceMatch supports the iptables "eth+" and nft "eth*" wildcards.
+func fwIfaceMatch(pattern, name string) bool {
+	if p, ok := strings.CutSuffix(pattern, "+"); ok {
+		return strings.HasPrefix(name, p)
+	}
+	if p, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, p)
+	}
+	return pattern == name
+}
+
+// fwTableApplies reports whether a table sees the flow's address family.
+func fwTableApplies(t utils.FirewallTable, family int) bool {
+	switch t.Family {
+	case "inet":
+		return true
+	case "ip":
+		return family == 4
+	case "ip6":
+		return family == 6
+	}
+	return false
+}
+
+type fwBaseChain struct {
+	table *utils.FirewallTable
+	chain *utils.FirewallChain
+}
+
+// traceFirewall runs the flow through every hook. The verdict is ACCEPT
+// unless a base chain drops or rejects the packet.
+func traceFirewall(tables []utils.FirewallTable, f fwFlow) utils.FirewallTrace {
+	out := utils.FirewallTrace{
+		Lines:   []string{"flow: " + f.String(), "path: " + strings.Join(f.hooks(), " → ")},
+		Verdict: "ACCEPT",
+	}
+
+	for _, hook := range f.hooks() {
+		var bases []fwBaseChain
+		for ti := range tables {
+			t := &tables[ti]
+			if !fwTableApplies(*t, f.family) {
+				continue
+			}
+			for ci := range t.Chains {
+				if t.Chains[ci].Hook == hook {
+					bases = append(bases, fwBaseChain{t, &t.Chains[ci]})
+				}
+			}
+		}
+		sort.SliceStable(bases, func(i, j int) bool { return bases[i].chain.Priority < bases[j].chain.Priority })
+		if len(bases) == 0 {
+			continue
+		}
+		out.Lines = append(out.Lines, "", "hook "+hook+":")
+		for _, b := range bases {
+			c := traceChain(b.table, b.chain, f)
+			out.Lines = append(out.Lines, c.Lines...)
+			out.Skipped = out.Skipped || c.Skipped
+			if c.Verdict == "DROP" || c.Verdict == "REJECT" {
+				out.Verdict = c.Verdict
+				out.At = fmt.Sprintf("%s %s %s/%s", b.table.Backend, b.table.Family, b.table.Name, b.chain.Name)
+				return out
+			}
+		}
+	}
+	return out
+}
+
+// fwTraceVerdictLine is the conclusion of a trace as shown. A rule that
+// could not be evaluated may have changed the verdict either way.
+func fwTraceVerdictLine(tr utils.FirewallTrace) string {
+	line := "verdict: " + tr.Verdict
+	if tr.At != "" {
+		line += " in " + tr.At
+	}
+	if tr.Skipped {
+		line += " unless one of the skipped rules (?) matched"
+	}
+	return line
+}
+
+// traceChain evaluates one base chain, following jumps. Its verdict is that
+// of the chain: ACCEPT (also for NAT and similar statements that end it),
+// DROP or REJECT.
+func traceChain(t *utils.FirewallTable, base *utils.FirewallChain, f fwFlow) utils.FirewallTrace {
+	chains := map[string]*utils.FirewallChain{}
+	for i := range t.Chains {
+		chains[t.Chains[i].Name] = &t.Chains[i]
+	}
+	label := fmt.Sprintf("%s %s %s", t.Backend, t.Family, t.Name)
+
+	type frame struct {
+		chain *utils.FirewallChain
+		next  int
+	}
+	var out []string
+	skipped := false
+	stack := []frame{{base, 0}}
+	depth := 0
+	out = append(out, fmt.Sprintf("  %s/%s (priority %d, policy %s)", label, base.Name, base.Priority, base.Policy))
+	done := func(verdict string) utils.FirewallTrace {
+		if verdict == "" {
+			verdict = "accept"
+		}
+		return utils.FirewallTrace{Lines: out, Verdict: strings.ToUpper(verdict), Skipped: skipped}
+	}
+
+	for len(stack) > 0 {
+		if depth++; depth > 10000 {
+			out = append(out, "    ! evaluation loop, giving up")
+			return done("accept")
+		}
+		top := &stack[len(stack)-1]
+		c := top.chain
+		indent := strings.Repeat("  ", len(stack)+1)
+		if top.next >= len(c.Rules) {
+			// end of chain: the base chain's policy once the stack is empty
+			// (a goto replaced the base frame, so c may be a regular chain),
+			// back to the caller otherwise
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				out = append(out, fmt.Sprintf("%sno rule matched in %s, policy of %s: %s", indent, c.Name, base.Name, base.Policy))
+				return done(base.Policy)
+			}
+			out = append(out, fmt.Sprintf("%send of %s, back to %s", indent, c.Name, stack[len(stack)-1].chain.Name))
+			continue
+		}
+		r := c.Rules[top.next]
+		top.next++
+
+		matched := true
+		var unknown []string
+		for _, mt := range r.Matches {
+			res, raw := fwEvalMatch(mt, f)
+			if res == 0 {
+				matched = false
+				break
+			}
+			if res < 0 {
+				unknown = append(unknown, raw)
+			}
+		}
+		if matched && len(unknown) > 0 {
+			out = append(out, fmt.Sprintf("%s? #%d skipped, cannot evaluate: %s", indent, r.Handle, strings.Join(unknown, "; ")))
+			skipped = true
+			continue
+		}
+		if !matched {
+			continue
+		}
+
+		out = append(out, fmt.Sprintf("%s#%d matched: %s", indent, r.Handle, r.Text))
+		switch r.Verdict {
+		case "", "continue":
+			// log, counter, mark...: keep going
+		case "accept", "drop", "reject":
+			return done(r.Verdict)
+		case "return":
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				out = append(out, fmt.Sprintf("%sreturn from base chain, policy %s", indent, base.Policy))
+				return done(base.Policy)
+			}
+		case "jump", "goto":
+			target, ok := chains[r.Target]
+			if !ok {
+				out = append(out, fmt.Sprintf("%s! chain %s not found", indent, r.Target))
+				continue
+			}
+			if r.Verdict == "goto" {
+				stack = stack[:len(stack)-1]
+			}
+			stack = append(stack, frame{target, 0})
+		default:
+			// NAT, queue and similar statements end this chain
+			out = append(out, fmt.Sprintf("%s%s ends the chain (packet continues)", indent, r.Verdict))
+			return done("accept")
+		}
+	}
+	return done(base.Policy)
+}
+
+// startFirewallTrace runs the tracer on the submitted flow.
+func startFirewallTrace(m utils.Model) (utils.Model, tea.Cmd) {
+	m.InputSubmitted = false
+	m.FirewallFlow = strings.TrimSpace(m.Input)
+	f, err := parseFirewallFlow(m.FirewallFlow)
+	if err != nil {
+		m.FirewallTrace = &utils.FirewallTrace{Lines: []string{"WARNING: " + err.Error()}}
+		return m, nil
+	}
+	note := ""
+	if f.oif == "" && !f.local {
+		if dev := egressDevice(f); dev != "" {
+			f.oif = dev
+			note = "oif " + dev + " taken from the routing table"
+		}
+	}
+	tr := traceFirewall(m.FirewallTables, f)
+	if note != "" {
+		tr.Lines = slices.Insert(tr.Lines, 1, note)
+	}
+	m.FirewallTrace = &tr
+	return m, nil
+}
+
+// egressDevice asks the route lookup which interface the flow leaves on.
+func egressDevice(f fwFlow) string {
+	routes, err := readRoutes()
+	if err != nil {
+		return ""
+	}
+	rules, _ := readRules()
+	sortRules(rules)
+	_, res := resolveRoute(rules, routes, routeFlow{dst: f.dst, src: f.src, family: f.family, iif: f.iif, mark: f.mark})
+	// a multipath route leaves on any of its devices
+	if res.reject != "" || len(res.devs) != 1 {
+		return ""
+	}
+	return res.devs[0]
+}
+
+func firewallTraceView(m utils.Model) string {
+	tr := m.FirewallTrace
+	out := utils.KeywordStyle.Render("Packet trace") + "\n" + utils.RenderFindings(tr.Lines)
+	switch tr.Verdict {
+	case "":
+	case "DROP", "REJECT":
+		out += "\n\n" + utils.WarnStyle.Render(fwTraceVerdictLine(*tr))
+	default:
+		out += "\n\n" + utils.KeywordStyle.Render(fwTraceVerdictLine(*tr))
+	}
+	return out
+}
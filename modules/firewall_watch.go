@@ -0,0 +1,220 @@
+package modules
+
+import (
+	"fmt"
+	"network-check/utils"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Firewall watch mode: "w" in the firewall view re-reads the nft/iptables
+// counters every firewallWatchInterval and shows how much each rule matched
+// since the last read. Rules whose counters climb are highlighted in the tree
+// and listed on top, so a connection attempt that keeps failing can be tied to
+// the rule that drops it. Only the backends the loaded tables came from are
+// dumped again; ufw/firewalld state and the findings are left as loaded.
+
+const firewallWatchInterval = 2 * time.Second
+
+// firewallHotLines is the number of climbing rules listed above the tree.
+const firewallHotLines = 8
+
+// startFirewallWatch starts polling the counters. Loaded stays set so the view
+// keeps its keys and b still goes back; the worker stops when
+// FirewallWatchStop is closed.
+func startFirewallWatch(m utils.Model) (utils.Model, tea.Cmd) {
+	m.FirewallWatchChan = make(chan []utils.FirewallTable, 4)
+	m.FirewallWatchStop = make(chan struct{})
+	m.FirewallDeltas = map[string][2]uint64{}
+	m.FirewallWatchTotal = map[string]uint64{}
+	m.FirewallWatchAt = time.Now()
+	var backends []string
+	for _, t := range m.FirewallTables {
+		if !slices.Contains(backends, t.Backend) {
+			backends = append(backends, t.Backend)
+		}
+	}
+	go func(ch chan<- []utils.FirewallTable, stop <-chan struct{}) {
+		defer close(ch)
+		tick := time.NewTicker(firewallWatchInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+			}
+			tables := rereadFirewallTables(backends)
+			select {
+			case ch <- tables:
+			default:
+			}
+		}
+	}(m.FirewallWatchChan, m.FirewallWatchStop)
+	return m, utils.Frame()
+}
+
+// stopFirewallWatch ends watch mode and drops the deltas.
+func stopFirewallWatch(m utils.Model) utils.Model {
+	if m.FirewallWatchStop != nil {
+		close(m.FirewallWatchStop)
+	}
+	m.FirewallWatchStop = nil
+	m.FirewallWatchChan = nil
+	m.FirewallDeltas = nil
+	m.FirewallWatchTotal = nil
+	return m
+}
+
+// pollFirewallWatch applies the snapshots that arrived since the last frame.
+func pollFirewallWatch(m utils.Model) (utils.Model, tea.Cmd) {
+	for {
+		select {
+		case tables, ok := <-m.FirewallWatchChan:
+			if !ok {
+				return stopFirewallWatch(m), nil
+			}
+			if len(tables) == 0 {
+				// a failed read; keep the last ruleset instead of emptying the tree
+				continue
+			}
+			now := time.Now()
+			elapsed := now.Sub(m.FirewallWatchAt).Seconds()
+			m.FirewallWatchAt = now
+			m.FirewallDeltas = map[string][2]uint64{}
+			for k, d := range firewallDeltas(m.FirewallTables, tables) {
+				m.FirewallWatchTotal[k] += d[0]
+				if elapsed > 0 {
+					d = [2]uint64{uint64(float64(d[0])/elapsed + 0.5), uint64(float64(d[1])/elapsed + 0.5)}
+				}
+				m.FirewallDeltas[k] = d
+			}
+			m.FirewallTables = tables
+			if n := len(firewallNodes(m)); m.FirewallCursor >= n {
+				m.FirewallCursor = max(n-1, 0)
+			}
+		default:
+			return m, utils.Frame()
+		}
+	}
+}
+
+// firewallRuleKey identifies a rule across snapshots; chain policy counters
+// use the chain key alone. nft handles stay with their rule, but an iptables
+// handle is the rule's position, which an inserted rule shifts, so those are
+// keyed by their text (identical rules in a chain share the key).
+func firewallRuleKey(t utils.FirewallTable, c utils.FirewallChain, r utils.FirewallRule) string {
+	if t.Backend == "nftables" {
+		return fmt.Sprintf("%s/%s/%d", firewallTableKey(t), c.Name, r.Handle)
+	}
+	return firewallTableKey(t) + "/" + c.Name + "/" + r.Text
+}
+
+// firewallDeltas returns the packet/byte increase of every rule and chain
+// policy present in both snapshots. Counters that went down (ruleset reloaded
+// or zeroed) count as no increase.
+func firewallDeltas(prev, cur []utils.FirewallTable) map[string][2]uint64 {
+	before := map[string][2]uint64{}
+	for _, t := range prev {
+		for _, c := range t.Chains {
+			before[firewallTableKey(t)+"/"+c.Name] = [2]uint64{c.Packets, c.Bytes}
+			for _, r := range c.Rules {
+				if r.Counter {
+					before[firewallRuleKey(t, c, r)] = [2]uint64{r.Packets, r.Bytes}
+				}
+			}
+		}
+	}
+
+	out := map[string][2]uint64{}
+	add := func(key string, pkts, bytes uint64) {
+		b, ok := before[key]
+		if !ok || pkts <= b[0] {
+			return
+		}
+		d := [2]uint64{pkts - b[0], 0}
+		if bytes > b[1] {
+			d[1] = bytes - b[1]
+		}
+		out[key] = d
+	}
+	for _, t := range cur {
+		for _, c := range t.Chains {
+			add(firewallTableKey(t)+"/"+c.Name, c.Packets, c.Bytes)
+			for _, r := range c.Rules {
+				if r.Counter {
+					add(firewallRuleKey(t, c, r), r.Packets, r.Bytes)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// firewallHotView lists the rules that matched since watch mode started,
+// busiest first, with drop/reject rules highlighted.
+func firewallHotView(m utils.Model) string {
+	type hot struct {
+		name, verdict string
+		rate, total   uint64
+	}
+	var rules []hot
+	for _, t := range m.FirewallTables {
+		for _, c := range t.Chains {
+			for _, r := range c.Rules {
+				k := firewallRuleKey(t, c, r)
+				if m.FirewallWatchTotal[k] == 0 {
+					continue
+				}
+				rules = append(rules, hot{
+					name:    fmt.Sprintf("%s %s/%s #%d %s", t.Backend, t.Name, c.Name, r.Handle, r.Text),
+					verdict: r.Verdict,
+					rate:    m.FirewallDeltas[k][0],
+					total:   m.FirewallWatchTotal[k],
+				})
+			}
+			// iptables keeps a counter for packets that fell through to the policy
+			k := firewallTableKey(t) + "/" + c.Name
+			if c.Hook != "" && m.FirewallWatchTotal[k] > 0 {
+				rules = append(rules, hot{
+					name:    fmt.Sprintf("%s %s/%s policy %s", t.Backend, t.Name, c.Name, c.Policy),
+					verdict: c.Policy,
+					rate:    m.FirewallDeltas[k][0],
+					total:   m.FirewallWatchTotal[k],
+				})
+			}
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].rate != rules[j].rate {
+			return rules[i].rate > rules[j].rate
+		}
+		return rules[i].total > rules[j].total
+	})
+
+	title := fmt.Sprintf("Watching counters every %s (w: stop)", firewallWatchInterval)
+	if len(rules) == 0 {
+		return utils.KeywordStyle.Render(title) + "\n" + utils.SubtleStyle.Render("no rule counter has moved yet")
+	}
+	lines := []string{utils.KeywordStyle.Render(title), utils.SubtleStyle.Render(fmt.Sprintf("%8s %8s  rule", "pkts/s", "total"))}
+	for i, r := range rules {
+		if i == firewallHotLines {
+			lines = append(lines, utils.SubtleStyle.Render(fmt.Sprintf("... %d more", len(rules)-i)))
+			break
+		}
+		line := fmt.Sprintf("%8s %8s  %s", "+"+formatCount(r.rate), formatCount(r.total), r.name)
+		switch {
+		case r.verdict == "drop" || r.verdict == "reject":
+			lines = append(lines, utils.WarnStyle.Render(line))
+		case r.rate > 0:
+			lines = append(lines, utils.KeywordStyle.Render(line))
+		default:
+			lines = append(lines, utils.SubtleStyle.Render(line))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -105,7 +105,7 @@ func startCaptureCmd(ch chan<- string) tea.Cmd {
 	return func() tea.Msg {
 		go func() {
 			// Try to open a live capture on the "any" device (works on Linux).
-			handle, err := pcap.OpenLive("any", 65535, true, pcap.BlockForever)
+			handle, err := openLiveCapture("any", true, pcap.BlockForever, "")
 			if err == nil {
 				defer handle.Close()
 				packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
@@ -280,6 +280,22 @@ func startCaptureCmd(ch chan<- string) tea.Cmd {
 	}
 }
 
+// openLiveCapture opens a live pcap handle on device and applies an optional
+// BPF filter. Shared by the frame analyzer and the ARP monitor.
+func openLiveCapture(device string, promisc bool, timeout time.Duration, filter string) (*pcap.Handle, error) {
+	handle, err := pcap.OpenLive(device, 65535, promisc, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if filter != "" {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
+	return handle, nil
+}
+
 func readLoopCmd(ch <-chan string) tea.Cmd {
 	return func() tea.Msg {
 		// block until a line is available or channel closed
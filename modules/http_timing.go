@@ -0,0 +1,523 @@
+package modules
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"network-check/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// HTTP(S) request timing: the user enters a URL, optionally with the
+// number of runs (m.HTTPTimingCount by default) and -k to skip certificate
+// verification. Every run starts on a fresh connection and follows
+// redirects itself, so each hop is timed on its own: DNS lookup, TCP
+// connect, TLS handshake, waiting for the first byte and the transfer of
+// the body. The proxy the proxy check finds (proxy.go) is used. Runs are
+// drawn as a waterfall and the medians tell which phase makes the site
+// slow.
+
+const httpMaxRedirects = 10
+
+const httpTimeout = 30 * time.Second
+
+const httpWaterfallWidth = 60
+
+// httpPhases name the waterfall segments, in the order they happen.
+var httpPhases = []struct {
+	name  string
+	style lipgloss.Style
+}{
+	{"dns", lipgloss.NewStyle().Foreground(lipgloss.Color("39"))},
+	{"connect", lipgloss.NewStyle().Foreground(lipgloss.Color("214"))},
+	{"tls", lipgloss.NewStyle().Foreground(lipgloss.Color("135"))},
+	{"wait", lipgloss.NewStyle().Foreground(lipgloss.Color("42"))},
+	{"transfer", lipgloss.NewStyle().Foreground(lipgloss.Color("211"))},
+}
+
+func UpdateHTTPTiming(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg.(type) {
+	case utils.FrameMsg:
+		if !m.Loaded && m.HTTPTimingChan == nil {
+			if !m.InputSubmitted {
+				return utils.PromptInput(m, "URL to time, optionally followed by the number of runs and -k to skip certificate checks:", m.HTTPTimingTarget), nil
+			}
+			m.InputSubmitted = false
+			m.HTTPTimingLog = []string{}
+			m.HTTPTimings = []utils.HTTPTiming{}
+			target, count, insecure, err := parseHTTPTimingSpec(m.Input, m.HTTPTimingCount)
+			if err != nil {
+				m.HTTPTimingLog = append(m.HTTPTimingLog, err.Error())
+				m.Loaded = true
+				return m, nil
+			}
+			m.HTTPTimingTarget = strings.TrimSpace(m.Input)
+			m.HTTPTimingChan = make(chan utils.HTTPTimingResult, 64)
+			go runHTTPTiming(m.HTTPTimingChan, target, count, insecure)
+			return m, utils.Frame()
+		}
+
+		if m.HTTPTimingChan != nil {
+			for {
+				select {
+				case r, ok := <-m.HTTPTimingChan:
+					if !ok {
+						m.HTTPTimingChan = nil
+						m.Loaded = true
+						return m, nil
+					}
+					if r.Msg != "" {
+						m.HTTPTimingLog = append(m.HTTPTimingLog, r.Msg)
+						continue
+					}
+					m.HTTPTimings = append(m.HTTPTimings, *r.Timing)
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseHTTPTimingSpec parses "URL [COUNT] [-k]". URLs without a scheme
+// are taken as https.
+func parseHTTPTimingSpec(input string, count int) (string, int, bool, error) {
+	var target string
+	insecure := false
+	count = max(count, 1)
+	for _, f := range strings.Fields(input) {
+		switch n, err := strconv.Atoi(f); {
+		case f == "-k" || f == "--insecure":
+			insecure = true
+		case err == nil && target != "":
+			if n < 1 || n > 100 {
+				return "", 0, false, fmt.Errorf("invalid number of runs %q (1 to 100)", f)
+			}
+			count = n
+		case target == "":
+			target = f
+		default:
+			return "", 0, false, fmt.Errorf("unexpected %q: expected URL [COUNT] [-k]", f)
+		}
+	}
+	if target == "" {
+		return "", 0, false, errors.New("no URL given")
+	}
+	if !strings.Contains(target, "://") {
+		target = "https://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", 0, false, fmt.Errorf("invalid URL %q (http or https)", target)
+	}
+	return u.String(), count, insecure, nil
+}
+
+// runHTTPTiming runs the requests, one run after the other.
+func runHTTPTiming(ch chan<- utils.HTTPTimingResult, target string, count int, insecure bool) {
+	defer close(ch)
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+	pc := detectProxy(ctx)
+	cancel()
+	if pc.HTTP != "" || pc.HTTPS != "" {
+		ch <- utils.HTTPTimingResult{Msg: "proxy: " + pc.String()}
+	}
+	proxy := pc.proxyFunc()
+	if u, _ := url.Parse(target); u != nil {
+		if p, _ := proxy(&http.Request{URL: u}); p != nil {
+			ch <- utils.HTTPTimingResult{Msg: fmt.Sprintf("requests to %s go through %s: connect and DNS times are the proxy's", u.Host, p.Host)}
+		}
+	}
+	if insecure {
+		ch <- utils.HTTPTimingResult{Msg: "certificate verification is off (-k)"}
+	}
+
+	for run := 1; run <= count; run++ {
+		tr := &http.Transport{
+			Proxy:               proxy,
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: insecure},
+			ForceAttemptHTTP2:   true,
+		}
+		client := &http.Client{
+			Transport: tr,
+			Timeout:   httpTimeout,
+			// redirects are followed below, to time every hop
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		start := time.Now()
+		u := target
+		for hop := 0; ; hop++ {
+			if hop > httpMaxRedirects {
+				ch <- utils.HTTPTimingResult{Msg: fmt.Sprintf("run %d: stopped after %d redirects", run, httpMaxRedirects)}
+				break
+			}
+			t, at, next := timeHTTPRequest(client, u)
+			t.Run, t.Hop, t.Offset = run, hop, at.Sub(start)
+			ch <- utils.HTTPTimingResult{Timing: &t}
+			if next == "" {
+				break
+			}
+			u = next
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+// timeHTTPRequest makes one request and reads the whole body. next is the
+// redirect target, if the response is a redirect.
+func timeHTTPRequest(client *http.Client, u string) (t utils.HTTPTiming, start time.Time, next string) {
+	var mu sync.Mutex
+	var dnsStart, connStart, tlsStart, wrote, first time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			t.DNS = time.Since(dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			// happy eyeballs may dial several addresses, the first start counts
+			if connStart.IsZero() {
+				connStart = time.Now()
+			}
+		},
+		ConnectDone: func(_, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && t.Addr == "" {
+				t.Connect, t.Addr = time.Since(connStart), addr
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			t.TLS = time.Since(tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if t.Addr == "" {
+				t.Addr = info.Conn.RemoteAddr().String()
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			wrote = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if first.IsZero() {
+				first = time.Now()
+			}
+		},
+	}
+
+	t.URL = u
+	start = time.Now()
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, u, nil)
+	if err != nil {
+		t.Err = err.Error()
+		return t, start, ""
+	}
+	req.Header.Set("User-Agent", "network-check")
+	resp, err := client.Do(req)
+	if err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		t.Total = time.Since(start)
+		t.Err = err.Error()
+		return t, start, ""
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	end := time.Now()
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if first.IsZero() {
+		first = end
+	}
+	if !wrote.IsZero() {
+		t.Wait = first.Sub(wrote)
+	}
+	t.TTFB, t.Transfer, t.Total = first.Sub(start), end.Sub(first), end.Sub(start)
+	t.Bytes, t.Status, t.Code, t.Proto = n, resp.Status, resp.StatusCode, resp.Proto
+	if err != nil {
+		t.Err = "reading the body: " + err.Error()
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if loc, err := resp.Location(); err == nil {
+			next = loc.String()
+		}
+	}
+	return t, start, next
+}
+
+// httpPhaseTimes are the waterfall segments of a request, in httpPhases
+// order. What the phases leave out of the time to first byte (writing the
+// request, a proxy's CONNECT) goes to wait.
+func httpPhaseTimes(t utils.HTTPTiming) []time.Duration {
+	wait := max(t.Wait, t.TTFB-t.DNS-t.Connect-t.TLS)
+	return []time.Duration{t.DNS, t.Connect, t.TLS, wait, t.Transfer}
+}
+
+// httpWaterfall draws a request as a bar on a scale of width characters
+// for span.
+func httpWaterfall(t utils.HTTPTiming, span time.Duration, width int) string {
+	if span <= 0 {
+		return ""
+	}
+	col := func(d time.Duration) int {
+		return int(float64(d) / float64(span) * float64(width))
+	}
+	var b strings.Builder
+	b.WriteString(strings.Repeat(" ", col(t.Offset)))
+	at, drawn := t.Offset, col(t.Offset)
+	for i, d := range httpPhaseTimes(t) {
+		at += d
+		n := col(at) - drawn
+		if d > 0 && n == 0 {
+			// every phase that took time shows
+			n = 1
+		}
+		if n > 0 {
+			b.WriteString(httpPhases[i].style.Render(strings.Repeat("█", n)))
+			drawn += n
+		}
+	}
+	return b.String()
+}
+
+func medianDuration(ds []time.Duration) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	s := append([]time.Duration(nil), ds...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[len(s)/2]
+}
+
+// httpMedians are the median phase times and total of the runs that got
+// an answer, each phase summed over the hops of a run.
+func httpMedians(ts []utils.HTTPTiming) (phases []time.Duration, total time.Duration, runs int) {
+	type runSum struct {
+		phases []time.Duration
+		total  time.Duration
+		failed bool
+	}
+	sums := map[int]*runSum{}
+	for _, t := range ts {
+		r := sums[t.Run]
+		if r == nil {
+			r = &runSum{phases: make([]time.Duration, len(httpPhases))}
+			sums[t.Run] = r
+		}
+		for i, d := range httpPhaseTimes(t) {
+			r.phases[i] += d
+		}
+		r.total = max(r.total, t.Offset+t.Total)
+		r.failed = r.failed || t.Err != ""
+	}
+	per := make([][]time.Duration, len(httpPhases))
+	var totals []time.Duration
+	for _, r := range sums {
+		if r.failed {
+			continue
+		}
+		for i, d := range r.phases {
+			per[i] = append(per[i], d)
+		}
+		totals = append(totals, r.total)
+	}
+	for _, ds := range per {
+		phases = append(phases, medianDuration(ds))
+	}
+	return phases, medianDuration(totals), len(totals)
+}
+
+// httpTimingFindings names the slow phase and what usually causes it.
+func httpTimingFindings(ts []utils.HTTPTiming) []string {
+	var out []string
+	phases, total, runs := httpMedians(ts)
+	if runs > 0 && total > 0 {
+		slow := 0
+		for i, d := range phases {
+			if d > phases[slow] {
+				slow = i
+			}
+		}
+		out = append(out, fmt.Sprintf("NOTE: %s is the slowest phase, %s of %s median (%.0f%%)", httpPhases[slow].name, formatRTT(phases[slow]), formatRTT(total), 100*float64(phases[slow])/float64(total)))
+
+		dns, connect, tlsTime, wait := phases[0], phases[1], phases[2], phases[3]
+		if dns > 100*time.Millisecond {
+			out = append(out, fmt.Sprintf("WARNING: DNS lookups take %s: a slow or distant resolver (see Check DNS)", formatRTT(dns)))
+		}
+		if connect > 150*time.Millisecond {
+			out = append(out, fmt.Sprintf("WARNING: TCP connects take %s: the server is far away or the path is congested (see Check latency and Check traceroute)", formatRTT(connect)))
+		}
+		if tlsTime > 100*time.Millisecond && tlsTime > 3*connect {
+			out = append(out, fmt.Sprintf("WARNING: the TLS handshake takes %s, far more than the round trip of the connect: a large certificate chain, a busy server or an intercepting proxy", formatRTT(tlsTime)))
+		}
+		if wait > 500*time.Millisecond {
+			out = append(out, fmt.Sprintf("WARNING: the server takes %s to start answering: the slowness is on the server side (application or backend), not the network", formatRTT(wait)))
+		}
+	}
+
+	runTotals := map[int]time.Duration{}
+	redirects := map[int]time.Duration{}
+	for _, t := range ts {
+		switch {
+		case t.Err != "":
+			out = append(out, fmt.Sprintf("WARNING: run %d: %s: %s", t.Run, t.URL, t.Err))
+		case t.Code >= 400:
+			out = append(out, fmt.Sprintf("WARNING: run %d: %s answered %s", t.Run, t.URL, t.Status))
+		}
+		if t.Bytes >= 1<<20 && t.Transfer > time.Second {
+			if rate := uint64(float64(t.Bytes) / t.Transfer.Seconds()); rate < 125_000 {
+				out = append(out, fmt.Sprintf("WARNING: run %d transferred %s at %sbit/s", t.Run, formatByteCount(uint64(t.Bytes)), formatBitRate(rate)))
+			}
+		}
+		if t.Err == "" {
+			runTotals[t.Run] = max(runTotals[t.Run], t.Offset+t.Total)
+		}
+		if t.Hop > 0 {
+			redirects[t.Run] = t.Offset
+		}
+	}
+	if len(redirects) > 0 {
+		var costs []time.Duration
+		hops := 0
+		for _, t := range ts {
+			if t.Hop > 0 {
+				hops++
+			}
+		}
+		for _, d := range redirects {
+			costs = append(costs, d)
+		}
+		out = append(out, fmt.Sprintf("NOTE: %.1f redirects per run cost %s median before the final URL starts loading", float64(hops)/float64(len(redirects)), formatRTT(medianDuration(costs))))
+	}
+	var totals []time.Duration
+	for _, d := range runTotals {
+		totals = append(totals, d)
+	}
+	if len(totals) >= 3 {
+		sort.Slice(totals, func(i, j int) bool { return totals[i] < totals[j] })
+		if med, worst := totals[len(totals)/2], totals[len(totals)-1]; worst > 3*med && worst-med > 100*time.Millisecond {
+			out = append(out, fmt.Sprintf("NOTE: the slowest run took %s against %s median: response times vary a lot", formatRTT(worst), formatRTT(med)))
+		}
+	}
+	return out
+}
+
+func ChosenHTTPTimingView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("HTTP timing:") + " DNS, connect, TLS, first byte and transfer of each request\n\n"
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
+
+	var b strings.Builder
+	if len(m.HTTPTimingLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.HTTPTimingLog, "\n")) + "\n\n")
+	}
+
+	if len(m.HTTPTimings) > 0 {
+		cell := func(d time.Duration) string {
+			if d == 0 {
+				return "-"
+			}
+			return formatRTT(d)
+		}
+		rows := []string{fmt.Sprintf("%-6s %-26s %-9s %9s %9s %9s %9s %9s %9s %9s %9s", "Run", "Status", "Proto", "DNS", "Connect", "TLS", "Wait", "Transfer", "TTFB", "Total", "Size")}
+		var span time.Duration
+		for _, t := range m.HTTPTimings {
+			span = max(span, t.Offset+t.Total)
+			run := strconv.Itoa(t.Run)
+			if t.Hop > 0 {
+				run += "." + strconv.Itoa(t.Hop)
+			}
+			status := t.Status
+			if t.Err != "" {
+				status = "error"
+			}
+			row := fmt.Sprintf("%-6s %-26s %-9s %9s %9s %9s %9s %9s %9s %9s %9s", run, clipText(status, 26), t.Proto,
+				cell(t.DNS), cell(t.Connect), cell(t.TLS), cell(t.Wait), cell(t.Transfer), cell(t.TTFB), cell(t.Total), formatByteCount(uint64(t.Bytes)))
+			if t.Hop > 0 || t.Code >= 300 {
+				row += "  " + clipText(t.URL, 60)
+			}
+			if t.Err != "" || t.Code >= 400 {
+				rows = append(rows, utils.WarnStyle.Render(row))
+			} else {
+				rows = append(rows, utils.SubtleStyle.Render(row))
+			}
+		}
+		b.WriteString(strings.Join(rows, "\n") + "\n\n")
+
+		var legend []string
+		for _, p := range httpPhases {
+			legend = append(legend, p.style.Render("█")+" "+p.name)
+		}
+		b.WriteString(utils.KeywordStyle.Render("Waterfall") + utils.SubtleStyle.Render(fmt.Sprintf(" (0 to %s)  ", formatRTT(span))) + strings.Join(legend, "  ") + "\n")
+		for _, t := range m.HTTPTimings {
+			run := strconv.Itoa(t.Run)
+			if t.Hop > 0 {
+				run += "." + strconv.Itoa(t.Hop)
+			}
+			b.WriteString(utils.SubtleStyle.Render(fmt.Sprintf("%-6s│", run)) + httpWaterfall(t, span, httpWaterfallWidth) + "\n")
+		}
+		b.WriteString("\n")
+
+		if phases, total, runs := httpMedians(m.HTTPTimings); runs > 0 {
+			parts := make([]string, len(phases))
+			for i, d := range phases {
+				parts[i] = fmt.Sprintf("%s %s", httpPhases[i].name, formatRTT(d))
+			}
+			b.WriteString(utils.KeywordStyle.Render(fmt.Sprintf("Median of %d runs: %s, total %s", runs, strings.Join(parts, ", "), formatRTT(total))) + "\n\n")
+		}
+
+		if findings := utils.RenderFindings(httpTimingFindings(m.HTTPTimings)); findings != "" {
+			b.WriteString(findings + "\n\n")
+		}
+	} else if m.HTTPTimingChan != nil {
+		b.WriteString(utils.SubtleStyle.Render("requesting...") + "\n\n")
+	}
+
+	if m.HTTPTimingChan != nil {
+		return header + b.String() + utils.SubtleStyle.Render("Running... press esc to quit.")
+	}
+	return header + b.String() + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+}
@@ -0,0 +1,109 @@
+package modules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"network-check/utils"
+)
+
+func TestHTTPTimingLocalServer(t *testing.T) {
+	// a proxy that cannot be reached: loopback requests must bypass it
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+	t.Setenv("HTTPS_PROXY", "http://127.0.0.1:1")
+	t.Setenv("NO_PROXY", "")
+
+	const body = "hello, waterfall"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/final", http.StatusFound)
+	})
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(body))
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	ch := make(chan utils.HTTPTimingResult, 64)
+	go runHTTPTiming(ch, srv.URL+"/start", 1, true)
+	var timings []utils.HTTPTiming
+	for r := range ch {
+		if r.Timing != nil {
+			timings = append(timings, *r.Timing)
+		}
+		if strings.Contains(r.Msg, "go through") {
+			t.Errorf("loopback request reported as proxied: %s", r.Msg)
+		}
+	}
+
+	if len(timings) != 2 {
+		t.Fatalf("got %d requests, want the redirect and its target: %+v", len(timings), timings)
+	}
+	redirect, final := timings[0], timings[1]
+	for _, tm := range timings {
+		if tm.Err != "" {
+			t.Fatalf("hop %d (%s): %s", tm.Hop, tm.URL, tm.Err)
+		}
+		if tm.Run != 1 || tm.Proto != "HTTP/2.0" {
+			t.Errorf("hop %d: run %d proto %q, want run 1 over HTTP/2.0", tm.Hop, tm.Run, tm.Proto)
+		}
+		if tm.TTFB <= 0 || tm.Total < tm.TTFB || tm.Total < tm.TTFB+tm.Transfer {
+			t.Errorf("hop %d: inconsistent times ttfb %s transfer %s total %s", tm.Hop, tm.TTFB, tm.Transfer, tm.Total)
+		}
+	}
+
+	if redirect.Hop != 0 || redirect.Code != http.StatusFound || !strings.HasSuffix(redirect.URL, "/start") {
+		t.Errorf("first hop: %d %d %s, want hop 0, 302 for /start", redirect.Hop, redirect.Code, redirect.URL)
+	}
+	if redirect.Connect <= 0 || redirect.TLS <= 0 {
+		t.Errorf("first hop: connect %s tls %s, want both measured on the new connection", redirect.Connect, redirect.TLS)
+	}
+	if !strings.HasPrefix(redirect.Addr, "127.0.0.1:") {
+		t.Errorf("first hop connected to %q, want the server rather than the proxy", redirect.Addr)
+	}
+
+	if final.Hop != 1 || final.Code != http.StatusOK || final.Status != "200 OK" || !strings.HasSuffix(final.URL, "/final") {
+		t.Errorf("second hop: %d %q %s, want hop 1, 200 OK for /final", final.Hop, final.Status, final.URL)
+	}
+	if final.Bytes != int64(len(body)) {
+		t.Errorf("second hop read %d bytes, want %d", final.Bytes, len(body))
+	}
+	if final.TTFB < 20*time.Millisecond {
+		t.Errorf("second hop ttfb %s, want at least the handler's 20ms", final.TTFB)
+	}
+	if final.Offset < redirect.Total {
+		t.Errorf("second hop starts at %s, before the first one ended (%s)", final.Offset, redirect.Total)
+	}
+}
+
+func TestProxyFuncBypass(t *testing.T) {
+	pc := proxyConfig{HTTP: "proxy.example:3128", HTTPS: "proxy.example:3128", NoProxy: ".corp.example, 10.0.0.0/8"}
+	proxy := pc.proxyFunc()
+	for _, tc := range []struct {
+		url     string
+		proxied bool
+	}{
+		{"http://127.0.0.1:8080/", false},
+		{"https://[::1]/", false},
+		{"http://localhost/", false},
+		{"https://intranet.corp.example/", false},
+		{"http://10.1.2.3/", false},
+		{"https://example.com/", true},
+	} {
+		u, _ := url.Parse(tc.url)
+		p, err := proxy(&http.Request{URL: u})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err)
+		}
+		if (p != nil) != tc.proxied {
+			t.Errorf("%s: proxy %v, want proxied %v", tc.url, p, tc.proxied)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"network-check/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Passive interface traffic monitor: /proc/net/dev is read every second and
+// the change of each interface's counters shown as rx/tx bits and packets
+// per second, with the errors, drops and FIFO errors/overruns of the last
+// second and since the monitor started. Sparklines cover the last
+// ifTrafficHistory seconds, scaled to the link speed when sysfs knows it,
+// which tells a saturated link apart from an idle one without sending a
+// byte. Like the firewall watch, Loaded is set while polling so the view
+// keeps its keys and b goes back.
+
+const ifTrafficInterval = time.Second
+
+// ifTrafficHistory is the number of samples kept per interface (5 minutes).
+const ifTrafficHistory = 300
+
+// ifSparkWidth is the width of a sparkline; each character covers
+// ifTrafficHistory/ifSparkWidth samples.
+const ifSparkWidth = 60
+
+// ifSaturated is the share of the link speed from which a direction is
+// reported as saturated.
+const ifSaturated = 0.9
+
+func UpdateIfTraffic(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if !m.Loaded {
+			return m, nil
+		}
+		switch msg.String() {
+		case "a":
+			m.IfTrafficAll = !m.IfTrafficAll
+		case "r":
+			m.IfTrafficHist = map[string][]utils.IfSample{}
+			m.IfTrafficTotal = map[string]utils.IfSample{}
+		}
+		return m, nil
+
+	case utils.FrameMsg:
+		if !m.Loaded && m.IfTrafficChan == nil {
+			m.IfTrafficLog = []string{}
+			m.IfTrafficLast = utils.IfReading{}
+			m.IfTrafficHist = map[string][]utils.IfSample{}
+			m.IfTrafficTotal = map[string]utils.IfSample{}
+			m.IfTrafficChan = make(chan utils.IfReading, 4)
+			m.IfTrafficStop = make(chan struct{})
+			go pollIfCounters(m.IfTrafficChan, m.IfTrafficStop)
+			m.Loaded = true
+			return m, utils.Frame()
+		}
+
+		if m.IfTrafficChan != nil {
+			for {
+				select {
+				case r, ok := <-m.IfTrafficChan:
+					if !ok {
+						m.IfTrafficChan = nil
+						m.IfTrafficStop = nil
+						return m, nil
+					}
+					if r.Err != "" {
+						m.IfTrafficLog = append(m.IfTrafficLog, r.Err)
+						continue
+					}
+					addIfReading(&m, r)
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// pollIfCounters reads the counters every ifTrafficInterval until stop is
+// closed. It gives up when /proc/net/dev cannot be read at all.
+func pollIfCounters(ch chan<- utils.IfReading, stop <-chan struct{}) {
+	defer close(ch)
+	tick := time.NewTicker(ifTrafficInterval)
+	defer tick.Stop()
+	for {
+		counters, err := readIfCounters()
+		r := utils.IfReading{At: time.Now(), Counters: counters}
+		if err != nil {
+			r.Err = fmt.Sprintf("could not read interface counters: %v", err)
+		}
+		select {
+		case ch <- r:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// readIfCounters parses /proc/net/dev and adds what only sysfs has: ring
+// overruns, link speed and operational state.
+func readIfCounters() ([]utils.IfCounters, error) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []utils.IfCounters
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		c, ok := parseNetDevLine(sc.Text())
+		if !ok {
+			continue
+		}
+		sys := filepath.Join("/sys/class/net", c.Name)
+		c.RxOver = readSysUint(filepath.Join(sys, "statistics", "rx_over_errors"))
+		c.Speed = int(readSysUint(filepath.Join(sys, "speed")))
+		if b, err := os.ReadFile(filepath.Join(sys, "operstate")); err == nil {
+			c.OperState = strings.TrimSpace(string(b))
+		}
+		out = append(out, c)
+	}
+	return out, sc.Err()
+}
+
+// parseNetDevLine parses "  eth0: rx bytes packets errs drop fifo frame
+// compressed multicast | tx bytes packets errs drop fifo colls carrier
+// compressed"; the two header lines are rejected.
+func parseNetDevLine(line string) (utils.IfCounters, bool) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return utils.IfCounters{}, false
+	}
+	f := strings.Fields(rest)
+	if len(f) < 16 {
+		return utils.IfCounters{}, false
+	}
+	v := make([]uint64, 16)
+	for i := range v {
+		n, err := strconv.ParseUint(f[i], 10, 64)
+		if err != nil {
+			return utils.IfCounters{}, false
+		}
+		v[i] = n
+	}
+	return utils.IfCounters{
+		Name:    strings.TrimSpace(name),
+		RxBytes: v[0], RxPackets: v[1], RxErrs: v[2], RxDrop: v[3], RxFifo: v[4],
+		TxBytes: v[8], TxPackets: v[9], TxErrs: v[10], TxDrop: v[11], TxFifo: v[12], TxColls: v[13],
+	}, true
+}
+
+// readSysUint reads a number from sysfs; 0 when missing (speed reads -1 or
+// fails with EINVAL on links that are down).
+func readSysUint(path string) uint64 {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// addIfReading turns a reading into one sample per interface present in
+// the previous reading too.
+func addIfReading(m *utils.Model, r utils.IfReading) {
+	prev := map[string]utils.IfCounters{}
+	for _, c := range m.IfTrafficLast.Counters {
+		prev[c.Name] = c
+	}
+	secs := r.At.Sub(m.IfTrafficLast.At).Seconds()
+	for _, c := range r.Counters {
+		p, ok := prev[c.Name]
+		if !ok || secs <= 0 {
+			continue
+		}
+		// counters that went backwards (driver reset, 32-bit wrap) count as 0
+		d := func(cur, old uint64) uint64 {
+			if cur < old {
+				return 0
+			}
+			return cur - old
+		}
+		s := utils.IfSample{
+			RxBits: float64(d(c.RxBytes, p.RxBytes)) * 8 / secs,
+			TxBits: float64(d(c.TxBytes, p.TxBytes)) * 8 / secs,
+			RxPkts: float64(d(c.RxPackets, p.RxPackets)) / secs,
+			TxPkts: float64(d(c.TxPackets, p.TxPackets)) / secs,
+			Errs:   d(c.RxErrs, p.RxErrs) + d(c.TxErrs, p.TxErrs),
+			Drops:  d(c.RxDrop, p.RxDrop) + d(c.TxDrop, p.TxDrop),
+			Fifo:   d(c.RxFifo, p.RxFifo) + d(c.TxFifo, p.TxFifo) + d(c.RxOver, p.RxOver),
+		}
+		h := append(m.IfTrafficHist[c.Name], s)
+		if len(h) > ifTrafficHistory {
+			h = h[len(h)-ifTrafficHistory:]
+		}
+		m.IfTrafficHist[c.Name] = h
+		t := m.IfTrafficTotal[c.Name]
+		t.Errs += s.Errs
+		t.Drops += s.Drops
+		t.Fifo += s.Fifo
+		m.IfTrafficTotal[c.Name] = t
+	}
+	m.IfTrafficLast = r
+}
+
+// sparkline draws vals in at most width characters, each the peak of the
+// samples it covers, scaled to top (the peak of vals when top is 0).
+func sparkline(vals []float64, width int, top float64) string {
+	bars := []rune("▁▂▃▄▅▆▇█")
+	if len(vals) == 0 {
+		return ""
+	}
+	per := max(1, (len(vals)+width-1)/width)
+	var peaks []float64
+	for i := 0; i < len(vals); i += per {
+		p := 0.0
+		for _, v := range vals[i:min(i+per, len(vals))] {
+			p = max(p, v)
+		}
+		peaks = append(peaks, p)
+	}
+	if top <= 0 {
+		for _, p := range peaks {
+			top = max(top, p)
+		}
+	}
+	var b strings.Builder
+	for _, p := range peaks {
+		i := 0
+		if top > 0 {
+			i = min(len(bars)-1, int(p/top*float64(len(bars)-1)+0.5))
+		}
+		b.WriteRune(bars[i])
+	}
+	return b.String()
+}
+
+// ifTrafficShown lists the interfaces to show: by default those that are
+// not loopback, not down and moved traffic since the monitor started.
+func ifTrafficShown(m utils.Model) []utils.IfCounters {
+	var out []utils.IfCounters
+	for _, c := range m.IfTrafficLast.Counters {
+		if !m.IfTrafficAll {
+			if c.Name == "lo" || c.OperState == "down" {
+				continue
+			}
+			idle := true
+			for _, s := range m.IfTrafficHist[c.Name] {
+				if s.RxPkts > 0 || s.TxPkts > 0 {
+					idle = false
+					break
+				}
+			}
+			if idle {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// ifTrafficFindings flags saturated links and growing error counters.
+func ifTrafficFindings(m utils.Model, shown []utils.IfCounters) []string {
+	var out []string
+	for _, c := range shown {
+		h := m.IfTrafficHist[c.Name]
+		if len(h) == 0 {
+			continue
+		}
+		// average over the last 5 seconds against the link speed
+		recent := h[max(0, len(h)-5):]
+		var rx, tx float64
+		for _, s := range recent {
+			rx += s.RxBits / float64(len(recent))
+			tx += s.TxBits / float64(len(recent))
+		}
+		if c.Speed > 0 {
+			link := float64(c.Speed) * 1e6
+			for _, d := range []struct {
+				dir  string
+				bits float64
+			}{{"receive", rx}, {"transmit", tx}} {
+				if d.bits >= ifSaturated*link {
+					out = append(out, fmt.Sprintf("WARNING: %s %s is saturated: %sbit/s of %d Mbit/s (%.0f%%) over the last %d s",
+						c.Name, d.dir, formatBitRate(uint64(d.bits/8)), c.Speed, 100*d.bits/link, len(recent)))
+				}
+			}
+		}
+		t := m.IfTrafficTotal[c.Name]
+		if t.Errs > 0 || t.Fifo > 0 {
+			out = append(out, fmt.Sprintf("WARNING: %s: %d errors and %d FIFO errors/overruns since the monitor started (bad cable, duplex mismatch or a NIC that cannot keep up)", c.Name, t.Errs, t.Fifo))
+		} else if t.Drops > 0 {
+			out = append(out, fmt.Sprintf("NOTE: %s dropped %d packets since the monitor started (full queues, or traffic nobody listens for)", c.Name, t.Drops))
+		}
+	}
+	return out
+}
+
+func ChosenIfTrafficView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("Interface traffic:") + fmt.Sprintf(" /proc/net/dev every %s\n\n", ifTrafficInterval)
+
+	var b strings.Builder
+	if len(m.IfTrafficLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.IfTrafficLog, "\n")) + "\n\n")
+	}
+
+	shown := ifTrafficShown(m)
+	if len(shown) > 0 {
+		rows := []string{fmt.Sprintf("%-14s %6s %10s %10s %9s %9s %6s %6s %6s", "Interface", "Speed", "Rx bit/s", "Tx bit/s", "Rx pkt/s", "Tx pkt/s", "Errs", "Drops", "FIFO")}
+		for _, c := range shown {
+			h := m.IfTrafficHist[c.Name]
+			var s utils.IfSample
+			if len(h) > 0 {
+				s = h[len(h)-1]
+			}
+			speed := "?"
+			if c.Speed > 0 {
+				speed = formatBitRate(uint64(c.Speed) * 1e6 / 8)
+			}
+			row := fmt.Sprintf("%-14s %6s %10s %10s %9.0f %9.0f %6d %6d %6d", c.Name, speed,
+				formatBitRate(uint64(s.RxBits/8)), formatBitRate(uint64(s.TxBits/8)), s.RxPkts, s.TxPkts, s.Errs, s.Drops, s.Fifo)
+			if s.Errs > 0 || s.Fifo > 0 {
+				rows = append(rows, utils.WarnStyle.Render(row))
+			} else {
+				rows = append(rows, utils.KeywordStyle.Render(row))
+			}
+
+			// sparklines share one scale so rx and tx compare at a glance
+			top := float64(c.Speed) * 1e6
+			var rx, tx []float64
+			peak := 0.0
+			for _, s := range h {
+				rx, tx = append(rx, s.RxBits), append(tx, s.TxBits)
+				peak = max(peak, s.RxBits, s.TxBits)
+			}
+			if top == 0 {
+				top = peak
+			}
+			scale := fmt.Sprintf("peak %sbit/s over %s", formatBitRate(uint64(peak/8)), time.Duration(len(h))*ifTrafficInterval)
+			rows = append(rows,
+				utils.SubtleStyle.Render("  rx "+sparkline(rx, ifSparkWidth, top)),
+				utils.SubtleStyle.Render("  tx "+sparkline(tx, ifSparkWidth, top)+"  "+scale))
+		}
+		b.WriteString(strings.Join(rows, "\n") + "\n\n")
+
+		if findings := utils.RenderFindings(ifTrafficFindings(m, shown)); findings != "" {
+			b.WriteString(findings + "\n\n")
+		}
+	} else if m.IfTrafficChan != nil {
+		b.WriteString(utils.SubtleStyle.Render("waiting for traffic...") + "\n\n")
+	}
+	b.WriteString(utils.SubtleStyle.Render("a: show all interfaces (loopback, down, idle) • r: reset history and totals") + "\n\n")
+
+	if m.IfTrafficChan != nil {
+		return header + b.String() + utils.SubtleStyle.Render("Monitoring... press esc to quit or b to go back.")
+	}
+	return header + b.String() + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+}
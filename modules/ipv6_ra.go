@@ -0,0 +1,551 @@
+package modules
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// IPv6 router advertisement and DHCPv6 inspection.
+// The worker opens a raw ICMPv6 socket, sends a Router Solicitation on every
+// IPv6-capable interface and listens for Router Advertisements for
+// m.RATimeout seconds. It then runs a DHCPv6 Solicit/Advertise exchange on the
+// same interfaces and finally emits findings (multiple default routers,
+// RA flags that disagree with what the DHCPv6 servers do).
+// Both sockets need root (or CAP_NET_RAW / CAP_NET_BIND_SERVICE).
+
+// ND option types not named by gopacket (RFC 4191, RFC 8106).
+const (
+	ndOptRouteInfo = 24
+	ndOptRDNSS     = 25
+	ndOptDNSSL     = 31
+)
+
+// raInfo is what we keep from one router advertisement.
+type raInfo struct {
+	iface    string
+	router   string
+	lifetime uint16
+	managed  bool
+	other    bool
+}
+
+// dhcp6Info is what we keep from one DHCPv6 Advertise.
+type dhcp6Info struct {
+	iface  string
+	server string
+}
+
+func UpdateIPv6RA(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	switch msg.(type) {
+	case utils.FrameMsg:
+		if !m.Loaded && m.RAChan == nil {
+			m.RAChan = make(chan string, 512)
+			timeout := m.RATimeout
+			if timeout <= 0 {
+				timeout = 6
+			}
+			go func(ch chan<- string, timeout int) {
+				defer close(ch)
+
+				send := func(s string) {
+					select {
+					case ch <- s:
+					default:
+					}
+				}
+
+				ifaces := ipv6Interfaces()
+				if len(ifaces) == 0 {
+					send("no up interface with an IPv6 link-local address found")
+					return
+				}
+
+				ras := listenRouterAdvertisements(ifaces, time.Duration(timeout)*time.Second, send)
+				advs := solicitDHCPv6(ifaces, 3*time.Second, send)
+
+				for _, f := range ipv6Findings(ifaces, ras, advs) {
+					send(f)
+				}
+			}(m.RAChan, timeout)
+
+			return m, utils.Frame()
+		}
+
+		if m.RAChan != nil {
+			for {
+				select {
+				case line, ok := <-m.RAChan:
+					if !ok {
+						m.RAChan = nil
+						m.Loaded = true
+						return m, nil
+					}
+					trim := strings.TrimRight(line, " \t")
+					if strings.TrimSpace(trim) == "" {
+						continue
+					}
+					m.RALog = append(m.RALog, trim)
+					return m, utils.Frame()
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// ipv6Interface is an up, multicast-capable interface with a link-local address.
+type ipv6Interface struct {
+	iface     net.Interface
+	linkLocal net.IP
+}
+
+func ipv6Interfaces() []ipv6Interface {
+	var out []ipv6Interface
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, ifc := range ifs {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 || ifc.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.To4() != nil || !ipn.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			out = append(out, ipv6Interface{iface: ifc, linkLocal: ipn.IP})
+			break
+		}
+	}
+	return out
+}
+
+// listenRouterAdvertisements sends a Router Solicitation on each interface and
+// collects Router Advertisements until the timeout expires.
+func listenRouterAdvertisements(ifaces []ipv6Interface, timeout time.Duration, send func(string)) []raInfo {
+	conn, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		send(fmt.Sprintf("cannot open raw ICMPv6 socket (requires root): %v", err))
+		return nil
+	}
+	defer conn.Close()
+
+	// Neighbor Discovery messages must be sent with hop limit 255 or routers drop them.
+	if ipc, ok := conn.(*net.IPConn); ok {
+		_ = setMulticastHopLimit(ipc, 255)
+	}
+
+	// Router Solicitation: type 133, code 0, checksum (filled by kernel), reserved,
+	// followed by a source link-layer address option when we have a MAC.
+	for _, ifc := range ifaces {
+		rs := []byte{133, 0, 0, 0, 0, 0, 0, 0}
+		if len(ifc.iface.HardwareAddr) == 6 {
+			rs = append(rs, byte(layers.ICMPv6OptSourceAddress), 1)
+			rs = append(rs, ifc.iface.HardwareAddr...)
+		}
+		dst := &net.IPAddr{IP: net.ParseIP("ff02::2"), Zone: ifc.iface.Name}
+		if _, err := conn.WriteTo(rs, dst); err != nil {
+			send(fmt.Sprintf("%s: router solicitation failed: %v", ifc.iface.Name, err))
+			continue
+		}
+		send(fmt.Sprintf("%s: sent router solicitation from %s", ifc.iface.Name, ifc.linkLocal))
+	}
+	send(fmt.Sprintf("listening for router advertisements (%s)...", timeout))
+
+	var out []raInfo
+	seen := map[string]bool{}
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		_ = conn.SetReadDeadline(deadline)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n < 16 || buf[0] != byte(layers.ICMPv6TypeRouterAdvertisement) {
+			continue
+		}
+		src, _ := addr.(*net.IPAddr)
+		if src == nil {
+			continue
+		}
+		key := src.String()
+		if seen[key] {
+			// unsolicited and solicited RAs from the same router carry the same data
+			continue
+		}
+		seen[key] = true
+
+		ra := &layers.ICMPv6RouterAdvertisement{}
+		if err := ra.DecodeFromBytes(buf[4:n], gopacket.NilDecodeFeedback); err != nil {
+			send(fmt.Sprintf("RA from %s: undecodable (%v)", key, err))
+			continue
+		}
+		info := raInfo{
+			iface:    src.Zone,
+			router:   src.IP.String(),
+			lifetime: ra.RouterLifetime,
+			managed:  ra.ManagedAddressConfig(),
+			other:    ra.OtherConfig(),
+		}
+		out = append(out, info)
+		for _, l := range describeRouterAdvertisement(key, ra) {
+			send(l)
+		}
+	}
+	if len(out) == 0 {
+		send("no router advertisements received")
+	}
+	return out
+}
+
+// describeRouterAdvertisement renders the RA header and its options as log lines.
+func describeRouterAdvertisement(from string, ra *layers.ICMPv6RouterAdvertisement) []string {
+	var flags []string
+	if ra.ManagedAddressConfig() {
+		flags = append(flags, "M")
+	}
+	if ra.OtherConfig() {
+		flags = append(flags, "O")
+	}
+	if ra.Flags&0x20 != 0 {
+		flags = append(flags, "H")
+	}
+	flagStr := "-"
+	if len(flags) > 0 {
+		flagStr = strings.Join(flags, ",")
+	}
+	lines := []string{fmt.Sprintf("RA from %s: router lifetime=%ds flags=%s prf=%s hop limit=%d reachable=%dms retrans=%dms",
+		from, ra.RouterLifetime, flagStr, routerPreference((ra.Flags>>3)&0x3), ra.HopLimit, ra.ReachableTime, ra.RetransTimer)}
+	if ra.RouterLifetime == 0 {
+		lines = append(lines, "  not a default router (lifetime 0)")
+	}
+
+	for _, o := range ra.Options {
+		d := o.Data
+		switch o.Type {
+		case layers.ICMPv6OptSourceAddress:
+			if len(d) >= 6 {
+				lines = append(lines, fmt.Sprintf("  source link-layer address %s", net.HardwareAddr(d[:6])))
+			}
+		case layers.ICMPv6OptMTU:
+			if len(d) >= 6 {
+				lines = append(lines, fmt.Sprintf("  MTU %d", binary.BigEndian.Uint32(d[2:6])))
+			}
+		case layers.ICMPv6OptPrefixInfo:
+			if len(d) < 30 {
+				continue
+			}
+			var pf []string
+			if d[1]&0x80 != 0 {
+				pf = append(pf, "L")
+			}
+			if d[1]&0x40 != 0 {
+				pf = append(pf, "A")
+			}
+			pfStr := "-"
+			if len(pf) > 0 {
+				pfStr = strings.Join(pf, ",")
+			}
+			lines = append(lines, fmt.Sprintf("  prefix %s/%d flags=%s valid=%s preferred=%s",
+				net.IP(d[14:30]), d[0], pfStr, ndLifetime(binary.BigEndian.Uint32(d[2:6])), ndLifetime(binary.BigEndian.Uint32(d[6:10]))))
+		case ndOptRouteInfo:
+			if len(d) < 6 {
+				continue
+			}
+			prefix := make(net.IP, net.IPv6len)
+			copy(prefix, d[6:])
+			lines = append(lines, fmt.Sprintf("  route %s/%d prf=%s lifetime=%s",
+				prefix, d[0], routerPreference((d[1]>>3)&0x3), ndLifetime(binary.BigEndian.Uint32(d[2:6]))))
+		case ndOptRDNSS:
+			if len(d) < 22 {
+				continue
+			}
+			var servers []string
+			for i := 6; i+16 <= len(d); i += 16 {
+				servers = append(servers, net.IP(d[i:i+16]).String())
+			}
+			lines = append(lines, fmt.Sprintf("  RDNSS %s lifetime=%s", strings.Join(servers, ", "), ndLifetime(binary.BigEndian.Uint32(d[2:6]))))
+		case ndOptDNSSL:
+			if len(d) < 7 {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("  DNSSL %s lifetime=%s", strings.Join(decodeDNSNames(d[6:]), ", "), ndLifetime(binary.BigEndian.Uint32(d[2:6]))))
+		}
+	}
+	return lines
+}
+
+// routerPreference maps the 2-bit preference field from RFC 4191.
+func routerPreference(p uint8) string {
+	switch p {
+	case 1:
+		return "high"
+	case 3:
+		return "low"
+	case 2:
+		return "reserved"
+	default:
+		return "medium"
+	}
+}
+
+func ndLifetime(s uint32) string {
+	if s == 0xffffffff {
+		return "infinite"
+	}
+	return fmt.Sprintf("%ds", s)
+}
+
+// decodeDNSNames decodes uncompressed DNS wire-format names (DNSSL, DHCPv6 domain list).
+// Zero padding between and after names is skipped.
+func decodeDNSNames(b []byte) []string {
+	var names, labels []string
+	for i := 0; i < len(b); {
+		l := int(b[i])
+		i++
+		if l == 0 {
+			if len(labels) > 0 {
+				names = append(names, strings.Join(labels, "."))
+				labels = nil
+			}
+			continue
+		}
+		if i+l > len(b) {
+			break
+		}
+		labels = append(labels, string(b[i:i+l]))
+		i += l
+	}
+	return names
+}
+
+// solicitDHCPv6 sends a DHCPv6 Solicit on each interface and reports every Advertise.
+func solicitDHCPv6(ifaces []ipv6Interface, timeout time.Duration, send func(string)) []dhcp6Info {
+	var out []dhcp6Info
+	for _, ifc := range ifaces {
+		conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: ifc.linkLocal, Port: 546, Zone: ifc.iface.Name})
+		if err != nil {
+			send(fmt.Sprintf("%s: cannot bind DHCPv6 client port 546 (requires root): %v", ifc.iface.Name, err))
+			continue
+		}
+
+		xid := make([]byte, 3)
+		_, _ = rand.Read(xid)
+		solicit, err := buildDHCPv6Solicit(xid, ifc.iface)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		dst := &net.UDPAddr{IP: net.ParseIP("ff02::1:2"), Port: 547, Zone: ifc.iface.Name}
+		if _, err := conn.WriteToUDP(solicit, dst); err != nil {
+			send(fmt.Sprintf("%s: DHCPv6 solicit failed: %v", ifc.iface.Name, err))
+			conn.Close()
+			continue
+		}
+		send(fmt.Sprintf("%s: sent DHCPv6 solicit (xid %x)", ifc.iface.Name, xid))
+
+		got := 0
+		buf := make([]byte, 1500)
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			_ = conn.SetReadDeadline(deadline)
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			d := &layers.DHCPv6{}
+			if err := d.DecodeFromBytes(buf[:n], gopacket.NilDecodeFeedback); err != nil {
+				continue
+			}
+			if d.MsgType != layers.DHCPv6MsgTypeAdverstise || string(d.TransactionID) != string(xid) {
+				continue
+			}
+			got++
+			out = append(out, dhcp6Info{iface: ifc.iface.Name, server: from.IP.String()})
+			for _, l := range describeDHCPv6Advertise(from.IP.String(), d) {
+				send(l)
+			}
+		}
+		conn.Close()
+		if got == 0 {
+			send(fmt.Sprintf("%s: no DHCPv6 advertise received", ifc.iface.Name))
+		}
+	}
+	return out
+}
+
+func buildDHCPv6Solicit(xid []byte, ifc net.Interface) ([]byte, error) {
+	// DUID-LL (type 3, hardware type 1 = ethernet) when a MAC is known, else DUID-UUID-like random id
+	duid := []byte{0, 3, 0, 1}
+	if len(ifc.HardwareAddr) > 0 {
+		duid = append(duid, ifc.HardwareAddr...)
+	} else {
+		rnd := make([]byte, 16)
+		_, _ = rand.Read(rnd)
+		duid = append([]byte{0, 4}, rnd...)
+	}
+	iana := make([]byte, 12)
+	binary.BigEndian.PutUint32(iana[0:4], uint32(ifc.Index))
+	oro := []byte{0, byte(layers.DHCPv6OptDNSServers), 0, byte(layers.DHCPv6OptDomainList)}
+
+	d := &layers.DHCPv6{
+		MsgType:       layers.DHCPv6MsgTypeSolicit,
+		TransactionID: xid,
+		Options: layers.DHCPv6Options{
+			layers.NewDHCPv6Option(layers.DHCPv6OptClientID, duid),
+			layers.NewDHCPv6Option(layers.DHCPv6OptElapsedTime, []byte{0, 0}),
+			layers.NewDHCPv6Option(layers.DHCPv6OptIANA, iana),
+			layers.NewDHCPv6Option(layers.DHCPv6OptOro, oro),
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := d.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func describeDHCPv6Advertise(from string, d *layers.DHCPv6) []string {
+	lines := []string{fmt.Sprintf("DHCPv6 advertise from %s", from)}
+	for _, o := range d.Options {
+		switch o.Code {
+		case layers.DHCPv6OptPreference:
+			if len(o.Data) >= 1 {
+				lines = append(lines, fmt.Sprintf("  preference %d", o.Data[0]))
+			}
+		case layers.DHCPv6OptIANA:
+			// IAID(4) T1(4) T2(4) followed by IA options (IAADDR, status code)
+			if len(o.Data) < 12 {
+				continue
+			}
+			for _, sub := range dhcpv6SubOptions(o.Data[12:]) {
+				switch sub.Code {
+				case layers.DHCPv6OptIAAddr:
+					if len(sub.Data) >= 24 {
+						lines = append(lines, fmt.Sprintf("  address %s preferred=%s valid=%s",
+							net.IP(sub.Data[0:16]), ndLifetime(binary.BigEndian.Uint32(sub.Data[16:20])), ndLifetime(binary.BigEndian.Uint32(sub.Data[20:24]))))
+					}
+				case layers.DHCPv6OptStatusCode:
+					lines = append(lines, "  IA_NA "+dhcpv6Status(sub.Data))
+				}
+			}
+		case layers.DHCPv6OptDNSServers:
+			var servers []string
+			for i := 0; i+16 <= len(o.Data); i += 16 {
+				servers = append(servers, net.IP(o.Data[i:i+16]).String())
+			}
+			lines = append(lines, "  DNS "+strings.Join(servers, ", "))
+		case layers.DHCPv6OptDomainList:
+			lines = append(lines, "  domain list "+strings.Join(decodeDNSNames(o.Data), ", "))
+		case layers.DHCPv6OptStatusCode:
+			lines = append(lines, "  "+dhcpv6Status(o.Data))
+		}
+	}
+	return lines
+}
+
+func dhcpv6SubOptions(b []byte) []layers.DHCPv6Option {
+	var out []layers.DHCPv6Option
+	for len(b) >= 4 {
+		l := int(binary.BigEndian.Uint16(b[2:4]))
+		if 4+l > len(b) {
+			break
+		}
+		out = append(out, layers.NewDHCPv6Option(layers.DHCPv6Opt(binary.BigEndian.Uint16(b[0:2])), b[4:4+l]))
+		b = b[4+l:]
+	}
+	return out
+}
+
+func dhcpv6Status(b []byte) string {
+	if len(b) < 2 {
+		return "status (empty)"
+	}
+	return fmt.Sprintf("status %d %s", binary.BigEndian.Uint16(b[0:2]), string(b[2:]))
+}
+
+// ipv6Findings compares the RAs and DHCPv6 advertises collected per interface.
+func ipv6Findings(ifaces []ipv6Interface, ras []raInfo, advs []dhcp6Info) []string {
+	var out []string
+	for _, ifc := range ifaces {
+		name := ifc.iface.Name
+		var defaults []string
+		managed, other, anyRA := false, false, false
+		for _, ra := range ras {
+			if ra.iface != name {
+				continue
+			}
+			anyRA = true
+			managed = managed || ra.managed
+			other = other || ra.other
+			if ra.lifetime > 0 {
+				defaults = append(defaults, ra.router)
+			}
+		}
+		servers := 0
+		for _, a := range advs {
+			if a.iface == name {
+				servers++
+			}
+		}
+
+		sort.Strings(defaults)
+		if len(defaults) > 1 {
+			out = append(out, fmt.Sprintf("WARNING %s: %d routers advertise a default route (%s)", name, len(defaults), strings.Join(defaults, ", ")))
+		}
+		switch {
+		case managed && servers == 0:
+			out = append(out, fmt.Sprintf("WARNING %s: RA sets M flag but no DHCPv6 server answered", name))
+		case !managed && servers > 0:
+			out = append(out, fmt.Sprintf("WARNING %s: DHCPv6 server answered but no RA sets the M flag (hosts may not use it)", name))
+		case other && !managed && servers == 0:
+			out = append(out, fmt.Sprintf("NOTE %s: RA sets O flag; stateless DHCPv6 was not probed by the solicit", name))
+		}
+		if servers > 1 {
+			out = append(out, fmt.Sprintf("NOTE %s: %d DHCPv6 servers answered", name, servers))
+		}
+		if !anyRA && servers > 0 {
+			out = append(out, fmt.Sprintf("WARNING %s: DHCPv6 present but no router advertisement (no default route will be learned)", name))
+		}
+	}
+	if len(out) == 0 && len(ras) > 0 {
+		out = append(out, "No RA/DHCPv6 inconsistencies detected.")
+	}
+	return out
+}
+
+func ChosenIPv6RAView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("IPv6 RA / DHCPv6:") + " router solicitation + DHCPv6 solicit\n\n"
+
+	if !m.Loaded {
+		body := utils.SubtleStyle.Render(fmt.Sprintf("listening for router advertisements (timeout: %ds)...", m.RATimeout))
+		if len(m.RALog) > 0 {
+			body = strings.Join(m.RALog, "\n")
+		}
+		return header + body + "\n\n" + utils.SubtleStyle.Render("Running...")
+	}
+
+	if len(m.RALog) == 0 {
+		return header + utils.SubtleStyle.Render("No IPv6 router or DHCPv6 output collected.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	}
+	return header + utils.SubtleStyle.Render(strings.Join(m.RALog, "\n")) + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+}
@@ -0,0 +1,590 @@
+package modules
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"network-check/utils"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Active LAN host discovery. The user enters a CIDR, or leaves the prompt
+// empty to sweep every directly connected IPv4 prefix (interface addresses
+// and link-scope routes). On-link prefixes are swept with ARP requests over
+// pcap; anything else, or when pcap is unavailable, falls back to ICMP echo
+// (raw socket, needs root) and finally to TCP connects on common ports.
+// Probes are paced at m.ScanRate per second and prefixes larger than
+// m.ScanMaxHosts addresses are refused so a /16 can't be swept by accident.
+// Live hosts stream in as they answer, with MAC, vendor, reverse DNS and RTT.
+
+var scanTCPPorts = []int{80, 443, 22}
+
+// scanTarget is one prefix to sweep and, when on-link, where to send ARP from.
+type scanTarget struct {
+	prefix *net.IPNet
+	iface  *net.Interface
+	src    net.IP
+}
+
+func UpdateLANScan(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg.(type) {
+	case utils.FrameMsg:
+		if !m.Loaded && m.ScanChan == nil {
+			if !m.InputSubmitted {
+				return utils.PromptInput(m, "CIDR to sweep (leave empty for all directly connected IPv4 prefixes):", ""), nil
+			}
+			m.ScanChan = make(chan utils.ScanResult, 1024)
+			m.ScanLog = []string{}
+			m.ScanHosts = []utils.ScanHost{}
+			m.ScanProbed = 0
+			m.ScanTotal = 0
+			go runLANScan(m.ScanChan, strings.TrimSpace(m.Input), m.ScanRate, m.ScanMaxHosts)
+			return m, utils.Frame()
+		}
+
+		if m.ScanChan != nil {
+			for {
+				select {
+				case r, ok := <-m.ScanChan:
+					if !ok {
+						m.ScanChan = nil
+						m.Loaded = true
+						return m, nil
+					}
+					switch {
+					case r.Msg != "":
+						m.ScanLog = append(m.ScanLog, r.Msg)
+					case r.Host.IP != "":
+						m.ScanHosts = append(m.ScanHosts, r.Host)
+						sort.SliceStable(m.ScanHosts, func(i, j int) bool {
+							return compareIP(m.ScanHosts[i].IP, m.ScanHosts[j].IP) < 0
+						})
+					default:
+						m.ScanProbed = r.Probed
+						m.ScanTotal = r.Total
+					}
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+func runLANScan(ch chan<- utils.ScanResult, input string, rate, maxHosts int) {
+	defer close(ch)
+	if rate <= 0 {
+		rate = 100
+	}
+	if maxHosts <= 0 {
+		maxHosts = 4096
+	}
+	note := func(s string) { ch <- utils.ScanResult{Msg: s} }
+
+	targets, err := scanTargets(input)
+	if err != nil {
+		note(err.Error())
+		return
+	}
+	if len(targets) == 0 {
+		note("no directly connected IPv4 prefix found; enter a CIDR instead")
+		return
+	}
+
+	// size check first so the progress total is known up front
+	var runnable []scanTarget
+	total := 0
+	for _, t := range targets {
+		n := prefixHostCount(t.prefix)
+		if n > maxHosts {
+			note(fmt.Sprintf("skipping %s: %d addresses exceeds the limit of %d (enter a smaller CIDR)", t.prefix, n, maxHosts))
+			continue
+		}
+		runnable = append(runnable, t)
+		total += n
+	}
+
+	var probed int64
+	progress := func() {
+		n := int(atomic.AddInt64(&probed, 1))
+		if n%16 == 0 || n == total {
+			select {
+			case ch <- utils.ScanResult{Probed: n, Total: total}:
+			default:
+			}
+		}
+	}
+	ch <- utils.ScanResult{Probed: 0, Total: total}
+
+	// enrich hosts (reverse DNS can be slow) without blocking the sweep
+	var wg sync.WaitGroup
+	var seenMu sync.Mutex
+	seen := map[string]bool{}
+	found := func(h utils.ScanHost, onLink bool) {
+		seenMu.Lock()
+		dup := seen[h.IP]
+		seen[h.IP] = true
+		seenMu.Unlock()
+		if dup {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h.MAC == "" && onLink {
+				h.MAC = neighborMAC(h.IP)
+			}
+			if h.MAC != "" {
+				h.Vendor = lookupVendor(h.MAC)
+			}
+			h.Name = reverseName(h.IP, 2*time.Second)
+			ch <- utils.ScanResult{Host: h}
+		}()
+	}
+
+	for _, t := range runnable {
+		hosts := prefixHosts(t.prefix)
+		if t.iface != nil {
+			note(fmt.Sprintf("%s: ARP sweep of %d addresses on %s at %d/s", t.prefix, len(hosts), t.iface.Name, rate))
+			err := arpSweep(t, hosts, rate, func(h utils.ScanHost) { found(h, true) }, progress)
+			if err == nil {
+				continue
+			}
+			note(fmt.Sprintf("%s: ARP sweep unavailable (%v), falling back to ICMP/TCP", t.prefix, err))
+		} else {
+			note(fmt.Sprintf("%s: not on-link, probing %d addresses with ICMP/TCP at %d/s", t.prefix, len(hosts), rate))
+		}
+		probeSweep(hosts, rate, func(h utils.ScanHost) { found(h, t.iface != nil) }, progress, note)
+	}
+	wg.Wait()
+	note(fmt.Sprintf("sweep finished: %d addresses probed", atomic.LoadInt64(&probed)))
+}
+
+// scanTargets parses the user's CIDR (or single address), or collects the
+// directly connected prefixes when input is empty.
+func scanTargets(input string) ([]scanTarget, error) {
+	var prefixes []*net.IPNet
+	if input != "" {
+		if !strings.Contains(input, "/") {
+			input += "/32"
+		}
+		_, ipn, err := net.ParseCIDR(input)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", input, err)
+		}
+		if ipn.IP.To4() == nil {
+			return nil, fmt.Errorf("only IPv4 prefixes can be swept (%s)", ipn)
+		}
+		prefixes = append(prefixes, ipn)
+	} else {
+		prefixes = connectedPrefixes()
+	}
+
+	var out []scanTarget
+	for _, p := range prefixes {
+		t := scanTarget{prefix: p}
+		t.iface, t.src = onLinkInterface(p)
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// connectedPrefixes returns the IPv4 networks of interface addresses and of
+// link-scope routes (gateway 0.0.0.0) in /proc/net/route.
+func connectedPrefixes() []*net.IPNet {
+	var out []*net.IPNet
+	seen := map[string]bool{}
+	add := func(ipn *net.IPNet) {
+		if ipn == nil || ipn.IP.IsLoopback() || ipn.IP.IsLinkLocalUnicast() || seen[ipn.String()] {
+			return
+		}
+		seen[ipn.String()] = true
+		out = append(out, ipn)
+	}
+
+	ifs, _ := net.Interfaces()
+	for _, ifc := range ifs {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+				add(&net.IPNet{IP: ipn.IP.To4().Mask(ipn.Mask), Mask: ipn.Mask})
+			}
+		}
+	}
+
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Scan() // header
+		for sc.Scan() {
+			// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 8 || fields[2] != "00000000" || fields[1] == "00000000" {
+				continue
+			}
+			dst, err1 := hex.DecodeString(fields[1])
+			mask, err2 := hex.DecodeString(fields[7])
+			if err1 != nil || err2 != nil || len(dst) != 4 || len(mask) != 4 {
+				continue
+			}
+			// little-endian u32s in the file
+			add(&net.IPNet{
+				IP:   net.IPv4(dst[3], dst[2], dst[1], dst[0]).To4(),
+				Mask: net.IPv4Mask(mask[3], mask[2], mask[1], mask[0]),
+			})
+		}
+		f.Close()
+	}
+	return out
+}
+
+// onLinkInterface finds the interface whose connected network contains the
+// whole prefix, and our address on it.
+func onLinkInterface(p *net.IPNet) (*net.Interface, net.IP) {
+	pOnes, _ := p.Mask.Size()
+	ifs, _ := net.Interfaces()
+	for i := range ifs {
+		ifc := ifs[i]
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 || len(ifc.HardwareAddr) != 6 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil {
+				continue
+			}
+			ones, _ := ipn.Mask.Size()
+			if ones <= pOnes && ipn.Contains(p.IP) {
+				return &ifc, ipn.IP.To4()
+			}
+		}
+	}
+	return nil, nil
+}
+
+func prefixHostCount(p *net.IPNet) int {
+	ones, bits := p.Mask.Size()
+	n := int(math.Pow(2, float64(bits-ones)))
+	if n > 2 {
+		n -= 2 // network and broadcast
+	}
+	return n
+}
+
+// prefixHosts lists the usable addresses of an IPv4 prefix.
+func prefixHosts(p *net.IPNet) []net.IP {
+	ones, bits := p.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	base := binary.BigEndian.Uint32(p.IP.To4())
+	first, last := base, base+size-1
+	if size > 2 {
+		first++
+		last--
+	}
+	var out []net.IP
+	for v := first; v <= last && v >= first; v++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, v)
+		out = append(out, ip)
+	}
+	return out
+}
+
+// arpSweep sends one ARP request per address from t.src and reports every reply.
+func arpSweep(t scanTarget, hosts []net.IP, rate int, found func(utils.ScanHost), progress func()) error {
+	h, err := openLiveCapture(t.iface.Name, false, 50*time.Millisecond, "arp")
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	var mu sync.Mutex
+	sent := map[string]time.Time{}
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			data, ci, err := h.ReadPacketData()
+			if err != nil {
+				if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+					continue
+				}
+				return
+			}
+			pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+			arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+			if !ok || arp.Operation != layers.ARPReply || len(arp.SourceProtAddress) != 4 {
+				continue
+			}
+			ip := net.IP(arp.SourceProtAddress).String()
+			mu.Lock()
+			at, ok := sent[ip]
+			mu.Unlock()
+			if !ok {
+				continue
+			}
+			rtt := ci.Timestamp.Sub(at)
+			if ci.Timestamp.IsZero() || rtt < 0 {
+				rtt = time.Since(at)
+			}
+			found(utils.ScanHost{IP: ip, MAC: net.HardwareAddr(arp.SourceHwAddress).String(), RTT: rtt, Method: "arp"})
+		}
+	}()
+
+	tick := time.NewTicker(time.Second / time.Duration(rate))
+	defer tick.Stop()
+	var werr error
+	for _, ip := range hosts {
+		<-tick.C
+		if ip.Equal(t.src) {
+			progress()
+			continue
+		}
+		eth := layers.Ethernet{SrcMAC: t.iface.HardwareAddr, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP}
+		arp := layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   t.iface.HardwareAddr,
+			SourceProtAddress: t.src,
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    ip.To4(),
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &eth, &arp); err != nil {
+			werr = err
+			break
+		}
+		mu.Lock()
+		sent[ip.String()] = time.Now()
+		mu.Unlock()
+		if err := h.WritePacketData(buf.Bytes()); err != nil {
+			werr = err
+			break
+		}
+		progress()
+	}
+
+	// give late replies a chance
+	if werr == nil {
+		time.Sleep(2 * time.Second)
+	}
+	close(stop)
+	<-readerDone
+	return werr
+}
+
+// probeSweep tries ICMP echo over a raw socket and falls back to TCP connects.
+func probeSweep(hosts []net.IP, rate int, found func(utils.ScanHost), progress func(), note func(string)) {
+	err := icmpSweep(hosts, rate, found, progress)
+	if err == nil {
+		return
+	}
+	note(fmt.Sprintf("ICMP echo unavailable (%v), using TCP connect to ports %v", err, scanTCPPorts))
+	tcpSweep(hosts, rate, found, progress)
+}
+
+func icmpSweep(hosts []net.IP, rate int, found func(utils.ScanHost), progress func()) error {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	id := uint16(os.Getpid() & 0xffff)
+
+	var mu sync.Mutex
+	sent := map[string]time.Time{}
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		buf := make([]byte, 1500)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				continue
+			}
+			reply := &layers.ICMPv4{}
+			if err := reply.DecodeFromBytes(buf[:n], gopacket.NilDecodeFeedback); err != nil {
+				continue
+			}
+			if reply.TypeCode.Type() != layers.ICMPv4TypeEchoReply || reply.Id != id {
+				continue
+			}
+			ipAddr, ok := addr.(*net.IPAddr)
+			if !ok {
+				continue
+			}
+			ip := ipAddr.IP.String()
+			mu.Lock()
+			at, ok := sent[ip]
+			mu.Unlock()
+			if ok {
+				found(utils.ScanHost{IP: ip, RTT: time.Since(at), Method: "icmp"})
+			}
+		}
+	}()
+
+	tick := time.NewTicker(time.Second / time.Duration(rate))
+	defer tick.Stop()
+	for i, ip := range hosts {
+		<-tick.C
+		echo := layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+			Id:       id,
+			Seq:      uint16(i),
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, &echo, gopacket.Payload("network-check")); err != nil {
+			continue
+		}
+		mu.Lock()
+		sent[ip.String()] = time.Now()
+		mu.Unlock()
+		_, _ = conn.WriteTo(buf.Bytes(), &net.IPAddr{IP: ip})
+		progress()
+	}
+	time.Sleep(2 * time.Second)
+	close(stop)
+	<-readerDone
+	return nil
+}
+
+// tcpSweep treats a host as alive when a connect succeeds or is refused (RST).
+func tcpSweep(hosts []net.IP, rate int, found func(utils.ScanHost), progress func()) {
+	jobs := make(chan net.IP)
+	var wg sync.WaitGroup
+	for w := 0; w < 64; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range jobs {
+				for _, port := range scanTCPPorts {
+					start := time.Now()
+					c, err := net.DialTimeout("tcp4", net.JoinHostPort(ip.String(), fmt.Sprint(port)), 700*time.Millisecond)
+					if err == nil {
+						c.Close()
+					}
+					if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+						found(utils.ScanHost{IP: ip.String(), RTT: time.Since(start), Method: fmt.Sprintf("tcp/%d", port)})
+						break
+					}
+				}
+				progress()
+			}
+		}()
+	}
+	tick := time.NewTicker(time.Second / time.Duration(rate))
+	defer tick.Stop()
+	for _, ip := range hosts {
+		<-tick.C
+		jobs <- ip
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// neighborMAC looks an address up in the kernel neighbor table.
+func neighborMAC(ip string) string {
+	entries, err := readNeighbors()
+	if err != nil {
+		entries, _ = readProcARP()
+	}
+	for _, n := range entries {
+		if n.IP == ip {
+			return n.MAC
+		}
+	}
+	return ""
+}
+
+func reverseName(ip string, timeout time.Duration) string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+func ChosenLANScanView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("LAN host discovery:") + " ARP / ICMP / TCP sweep\n\n"
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
+
+	var b strings.Builder
+	if len(m.ScanLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.ScanLog, "\n")) + "\n\n")
+	}
+	if m.ScanTotal > 0 {
+		b.WriteString(utils.Progressbar(float64(m.ScanProbed)/float64(m.ScanTotal)) + "\n")
+		b.WriteString(utils.SubtleStyle.Render(fmt.Sprintf("probed %d/%d • %d hosts up", m.ScanProbed, m.ScanTotal, len(m.ScanHosts))) + "\n\n")
+	}
+
+	if len(m.ScanHosts) > 0 {
+		rows := []string{fmt.Sprintf("%-16s %-18s %-24s %-9s %-7s %s", "IP", "MAC", "Vendor", "RTT", "Method", "Name")}
+		for _, h := range m.ScanHosts {
+			mac := h.MAC
+			if mac == "" {
+				mac = "-"
+			}
+			vendor := h.Vendor
+			if len(vendor) > 24 {
+				vendor = vendor[:23] + "…"
+			}
+			rtt := fmt.Sprintf("%.1fms", float64(h.RTT.Microseconds())/1000)
+			rows = append(rows, fmt.Sprintf("%-16s %-18s %-24s %-9s %-7s %s", h.IP, mac, vendor, rtt, h.Method, h.Name))
+		}
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(rows, "\n")) + "\n\n")
+	} else if m.Loaded {
+		b.WriteString(utils.SubtleStyle.Render("No live hosts found.") + "\n\n")
+	}
+
+	label := "Running..."
+	if m.Loaded {
+		label = "Completed. Press esc to quit or b to go back."
+	}
+	return header + b.String() + utils.SubtleStyle.Render(label)
+}
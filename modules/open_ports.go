@@ -1,73 +1,80 @@
 package modules
 
 import (
-	"bufio"
 	"context"
+	"fmt"
+	"net"
 	"network-check/utils"
 	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-// Check open ports: prefer `ss -lntu` then fall back to `netstat -tuln`.
-// Streams lines into a channel from a goroutine and collects them into m.OpenPortsLog.
+// Check open ports: listening TCP sockets and bound UDP/raw sockets parsed
+// from /proc/net (sockets.go) with their owning process, systemd unit and
+// container. Each socket is classified by where it can be reached from
+// (loopback only, LAN addresses, a public address, or all interfaces) and,
+// for every interface it is reachable on, run through the firewall tracer
+// (firewall_trace.go) as a new inbound connection. Without /proc the raw
+// output of `ss -lntu` or `netstat -tuln` is shown instead.
+
+// exposureRank orders the table: most exposed first.
+var exposureRank = map[string]int{"public": 0, "all": 1, "LAN": 2, "loopback": 3}
+
+// localServicePorts are services that are normally only meant for local or
+// backend clients.
+var localServicePorts = map[int]string{
+	2375: "docker API", 3306: "MySQL", 5432: "PostgreSQL", 5984: "CouchDB", 6379: "Redis",
+	9200: "Elasticsearch", 11211: "memcached", 27017: "MongoDB",
+}
+
 func UpdateOpenPorts(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
-	switch msg.(type) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if m.Loaded && msg.String() == "i" {
+			if targets := localIdentifyTargets(m.OpenPortsSockets); len(targets) > 0 {
+				return startIdentify(m, targets)
+			}
+		}
+		return m, nil
+
 	case utils.FrameMsg:
+		if m.IdentifyChan != nil {
+			return pollIdentify(m, func(m *utils.Model, r utils.IdentifyResult) {
+				id := r.ID
+				m.OpenPortsSockets[r.Index].ID = &id
+			})
+		}
 		if !m.Loaded && m.OpenPortsChan == nil {
-			m.OpenPortsChan = make(chan string, 512)
-			go func(ch chan<- string) {
+			m.OpenPortsChan = make(chan utils.SocketResult, 4096)
+			m.OpenPortsLog = []string{}
+			m.OpenPortsSockets = []utils.Socket{}
+			go func(ch chan<- utils.SocketResult) {
 				defer close(ch)
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
+				// blocking: busy hosts listen on more sockets than any
+				// buffer, and the exposure findings come after them
+				send := func(r utils.SocketResult) { ch <- r }
+				note := func(s string) { send(utils.SocketResult{Msg: s}) }
 
-				cmds := [][]string{
-					{"ss", "-lntu"},      // show listening TCP/UDP numeric
-					{"netstat", "-tuln"}, // fallback
-				}
-
-				for _, args := range cmds {
-					cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-					stdout, err := cmd.StdoutPipe()
-					if err != nil {
-						continue
+				socks, err := allSockets(note)
+				if err != nil {
+					note(fmt.Sprintf("cannot read /proc/net (%v), showing ss/netstat output", err))
+					for _, l := range openPortsCommand() {
+						note(l)
 					}
-					if err := cmd.Start(); err != nil {
-						continue
-					}
-					scanner := bufio.NewScanner(stdout)
-					first := true
-					for scanner.Scan() {
-						line := strings.TrimSpace(scanner.Text())
-						// skip empty lines; keep header from first command
-						if line == "" {
-							continue
-						}
-						// skip the very first header line if it's unhelpful and we already have results
-						if first {
-							first = false
-						}
-						select {
-						case ch <- line:
-						default:
-						}
-					}
-					_ = cmd.Wait()
-					// if we got output from this command, don't try other backends
-					// (small heuristic: if channel buffered some data)
-					// we can't inspect channel length reliably across goroutines in all cases,
-					// but assume success if we reached here with scanner output.
-					// continue to next stage to allow multiple outputs if desired.
-					// brief pause so UI picks up streamed lines
-					time.Sleep(50 * time.Millisecond)
+					return
 				}
-
-				// if nothing written, emit helpful message
-				select {
-				case ch <- "no output from ss/netstat (missing or permission issue)":
-				default:
+				listening := classifySockets(socks, note)
+				for _, s := range listening {
+					send(utils.SocketResult{Entry: s})
+				}
+				for _, f := range exposureFindings(listening) {
+					note(f)
 				}
 			}(m.OpenPortsChan)
 			return m, utils.Frame()
@@ -77,17 +84,17 @@ func UpdateOpenPorts(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 		if m.OpenPortsChan != nil {
 			for {
 				select {
-				case line, ok := <-m.OpenPortsChan:
+				case r, ok := <-m.OpenPortsChan:
 					if !ok {
 						m.OpenPortsChan = nil
 						m.Loaded = true
 						return m, nil
 					}
-					if strings.TrimSpace(line) == "" {
+					if r.Msg != "" {
+						m.OpenPortsLog = append(m.OpenPortsLog, r.Msg)
 						continue
 					}
-					m.OpenPortsLog = append(m.OpenPortsLog, line)
-					return m, utils.Frame()
+					m.OpenPortsSockets = append(m.OpenPortsSockets, r.Entry)
 				default:
 					return m, utils.Frame()
 				}
@@ -97,20 +104,345 @@ func UpdateOpenPorts(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// localIdentifyTargets lists the TCP listeners of our namespace to identify,
+// dialing loopback for wildcard binds.
+func localIdentifyTargets(socks []utils.Socket) []identifyTarget {
+	var out []identifyTarget
+	for i, s := range socks {
+		if !strings.HasPrefix(s.Proto, "tcp") || s.Netns != "" {
+			continue
+		}
+		ip := net.ParseIP(s.Local)
+		if ip == nil {
+			continue
+		}
+		switch {
+		case ip.IsUnspecified() && ip.To4() != nil:
+			ip = net.IPv4(127, 0, 0, 1)
+		case ip.IsUnspecified():
+			ip = net.IPv6loopback
+		}
+		out = append(out, identifyTarget{index: i, ip: ip.String(), port: s.LocalPort})
+	}
+	return out
+}
+
+// openPortsCommand runs `ss -lntu`, or `netstat -tuln` when ss is missing.
+func openPortsCommand() []string {
+	for _, args := range [][]string{{"ss", "-lntu"}, {"netstat", "-tuln"}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+		cancel()
+		if err != nil {
+			continue
+		}
+		var lines []string
+		for _, l := range strings.Split(string(out), "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		if len(lines) > 0 {
+			return lines
+		}
+	}
+	return []string{"no output from ss/netstat (missing or permission issue)"}
+}
+
+// ifAddr is one address of an up interface.
+type ifAddr struct {
+	name string
+	net  *net.IPNet
+}
+
+func upInterfaceAddrs() []ifAddr {
+	var out []ifAddr
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok {
+				out = append(out, ifAddr{ifc.Name, ipn})
+			}
+		}
+	}
+	return out
+}
+
+// classifySockets keeps the listening sockets, sets their exposure and runs
+// the firewall cross-check for the ones of our own namespace.
+func classifySockets(socks []utils.Socket, note func(string)) []utils.Socket {
+	addrs := upInterfaceAddrs()
+	tables := readFirewallTables(func(string) {})
+	if len(tables) == 0 {
+		note("no firewall ruleset could be read (nothing loaded, or not running as root): firewall cross-check skipped")
+	}
+	dualStack := true
+	if n, ok := readSysctlInt("/proc/sys/net/ipv6/bindv6only"); ok && n == 1 {
+		dualStack = false
+	}
+
+	var out []utils.Socket
+	for _, s := range socks {
+		tcp := strings.HasPrefix(s.Proto, "tcp")
+		if (tcp && s.State != "LISTEN") || (!tcp && s.State != "UNCONN") {
+			continue
+		}
+		ip := net.ParseIP(s.Local)
+		s.Exposure, _ = socketExposure(ip, addrs)
+		if len(tables) > 0 && s.Netns == "" && s.Exposure != "loopback" && !strings.HasPrefix(s.Proto, "raw") {
+			s.Firewall = socketFirewall(tables, s, reachableAddrs(ip, addrs, dualStack))
+		}
+		out = append(out, s)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if exposureRank[a.Exposure] != exposureRank[b.Exposure] {
+			return exposureRank[a.Exposure] < exposureRank[b.Exposure]
+		}
+		if a.LocalPort != b.LocalPort {
+			return a.LocalPort < b.LocalPort
+		}
+		return a.Proto < b.Proto
+	})
+	return out
+}
+
+// socketExposure classifies a bind address: loopback, LAN (private, ULA or
+// link-local address), public, or all interfaces for the wildcard address.
+// It also returns the interface holding the address.
+func socketExposure(ip net.IP, addrs []ifAddr) (string, string) {
+	switch {
+	case ip == nil:
+		return "", ""
+	case ip.IsUnspecified():
+		return "all", ""
+	case ip.IsLoopback():
+		return "loopback", "lo"
+	}
+	dev := ""
+	for _, a := range addrs {
+		if a.net.IP.Equal(ip) {
+			dev = a.name
+		}
+	}
+	if dev != "" && strings.HasPrefix(dev, "lo") {
+		return "loopback", dev
+	}
+	if ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return "LAN", dev
+	}
+	return "public", dev
+}
+
+// reachableAddrs lists the interface addresses a socket bound to ip accepts
+// connections on, excluding loopback.
+func reachableAddrs(ip net.IP, addrs []ifAddr, dualStack bool) []ifAddr {
+	var out []ifAddr
+	v4 := ip.To4() != nil
+	for _, a := range addrs {
+		if a.net.IP.IsLoopback() {
+			continue
+		}
+		av4 := a.net.IP.To4() != nil
+		switch {
+		case !ip.IsUnspecified():
+			if a.net.IP.Equal(ip) {
+				out = append(out, a)
+			}
+		case av4 == v4, !v4 && av4 && dualStack:
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// probeSource picks the source of a simulated inbound connection: a host
+// from the internet for public addresses, a neighbor on the subnet otherwise.
+func probeSource(a ifAddr) net.IP {
+	ip := a.net.IP
+	if !ip.IsPrivate() && !ip.IsLinkLocalUnicast() {
+		if ip.To4() != nil {
+			return net.ParseIP("198.51.100.7")
+		}
+		return net.ParseIP("2001:db8::7")
+	}
+	if ip.To4() != nil {
+		if src := samplePrefixHost(a.net); src != nil {
+			return src
+		}
+	}
+	// first or second host of the prefix, or the address next to ours on
+	// point-to-point links
+	src := append(net.IP(nil), ip.Mask(a.net.Mask)...)
+	for i := 1; i <= 2; i++ {
+		src[len(src)-1]++
+		if !src.Equal(ip) {
+			return src
+		}
+	}
+	src = append(net.IP(nil), ip...)
+	src[len(src)-1] ^= 1
+	return src
+}
+
+// socketFirewall traces a new connection to the socket from every interface
+// it is reachable on and summarizes the verdicts, e.g. "ACCEPT eth0, DROP
+// wg0". A "?" marks verdicts reached after skipping rules the tracer cannot
+// evaluate.
+func socketFirewall(tables []utils.FirewallTable, s utils.Socket, reach []ifAddr) string {
+	byVerdict := map[string][]string{}
+	for _, a := range reach {
+		f := fwFlow{
+			proto: strings.TrimSuffix(s.Proto, "6"), src: probeSource(a), dst: a.net.IP,
+			sport: 40000, dport: s.LocalPort, iif: a.name, state: "new", local: true,
+		}
+		f.family = 6
+		if a.net.IP.To4() != nil {
+			f.family, f.src, f.dst = 4, f.src.To4(), f.dst.To4()
+		}
+		tr := traceFirewall(tables, f)
+		v := tr.Verdict
+		if tr.Skipped {
+			v += "?"
+		}
+		if !slices.Contains(byVerdict[v], a.name) {
+			byVerdict[v] = append(byVerdict[v], a.name)
+		}
+	}
+	var parts []string
+	for _, v := range sortedKeys(byVerdict) {
+		parts = append(parts, v+" "+strings.Join(byVerdict[v], ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// socketAddr formats the bind address like ss: "0.0.0.0:22", "[::]:22",
+// and "proto N" for raw sockets.
+func socketAddr(s utils.Socket) string {
+	if strings.HasPrefix(s.Proto, "raw") {
+		return fmt.Sprintf("%s proto %d", s.Local, s.LocalPort)
+	}
+	return net.JoinHostPort(s.Local, strconv.Itoa(s.LocalPort))
+}
+
+func socketOwner(s utils.Socket) string {
+	if s.PID == 0 {
+		return "?"
+	}
+	return fmt.Sprintf("%s/%d", s.Command, s.PID)
+}
+
+// publicInterfaces returns the interfaces holding a public address.
+func publicInterfaces() map[string]bool {
+	public := map[string]bool{}
+	for _, a := range upInterfaceAddrs() {
+		if a.net.IP.IsGlobalUnicast() && !a.net.IP.IsPrivate() {
+			public[a.name] = true
+		}
+	}
+	return public
+}
+
+// firewallAccepts returns the interfaces the firewall cross-check accepted
+// new connections on, and the subset of them with a public address.
+func firewallAccepts(s utils.Socket, public map[string]bool) (open, exposed []string) {
+	for _, part := range strings.Split(s.Firewall, ", ") {
+		if devs, ok := strings.CutPrefix(part, "ACCEPT"); ok {
+			open = append(open, strings.Split(strings.TrimLeft(devs, "? "), ",")...)
+		}
+	}
+	for _, d := range open {
+		if public[d] {
+			exposed = append(exposed, d)
+		}
+	}
+	return open, exposed
+}
+
+// exposureFindings flags sockets that outsiders can connect to.
+func exposureFindings(socks []utils.Socket) []string {
+	var out []string
+	public := publicInterfaces()
+	for _, s := range socks {
+		if s.Exposure == "loopback" || s.Netns != "" || strings.HasPrefix(s.Proto, "raw") {
+			continue
+		}
+		what := fmt.Sprintf("%s %s (%s)", s.Proto, socketAddr(s), socketOwner(s))
+		open, exposed := firewallAccepts(s, public)
+		switch {
+		case len(exposed) > 0:
+			out = append(out, fmt.Sprintf("WARNING: %s is reachable from the internet: the firewall accepts new connections on %s, which has a public address", what, strings.Join(exposed, ", ")))
+		case s.Firewall == "" && s.Exposure == "public":
+			out = append(out, fmt.Sprintf("WARNING: %s listens on a public address and the firewall could not be checked", what))
+		}
+		if name, ok := localServicePorts[s.LocalPort]; ok && (len(open) > 0 || s.Firewall == "") {
+			out = append(out, fmt.Sprintf("NOTE: %s looks like %s, which is usually bound to 127.0.0.1 only; it is reachable on %s", what, name, s.Exposure))
+		}
+		if s.Command == "docker-proxy" {
+			out = append(out, fmt.Sprintf("NOTE: %s is a published container port: connections are DNATed to the container and filtered in FORWARD/DOCKER-USER, so the INPUT verdict above does not apply", what))
+		}
+	}
+	return out
+}
+
 func ChosenOpenPortsView(m utils.Model) string {
-	header := utils.KeywordStyle.Render("Open ports:") + " ss -lntu / netstat -tuln\n\n"
+	header := utils.KeywordStyle.Render("Open ports:") + " listening sockets from /proc/net with owner, exposure and firewall verdict\n\n"
+
+	var body string
+	if notes := utils.RenderFindings(m.OpenPortsLog); notes != "" {
+		body = notes + "\n\n"
+	}
+
+	if !m.Loaded && m.IdentifyChan == nil {
+		return header + body + utils.SubtleStyle.Render(fmt.Sprintf("scanning listening sockets... %d found", len(m.OpenPortsSockets))) + "\n\n" + utils.SubtleStyle.Render("Running...")
+	}
 
-	if !m.Loaded {
-		body := utils.SubtleStyle.Render("scanning listening sockets...")
-		if len(m.OpenPortsLog) > 0 {
-			body = strings.Join(m.OpenPortsLog, "\n")
+	if len(m.OpenPortsSockets) == 0 {
+		if body == "" {
+			body = utils.SubtleStyle.Render("No listening sockets found or command failed.") + "\n\n"
 		}
-		return header + body + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+		return header + body + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	}
+
+	counts := map[string]int{}
+	for _, s := range m.OpenPortsSockets {
+		counts[s.Exposure]++
 	}
+	summary := utils.SubtleStyle.Render(fmt.Sprintf("%d sockets: %d on all interfaces, %d on public addresses, %d LAN only, %d loopback only",
+		len(m.OpenPortsSockets), counts["all"], counts["public"], counts["LAN"], counts["loopback"]))
 
-	// finished: show collected open ports or message
-	if len(m.OpenPortsLog) == 0 {
-		return header + utils.SubtleStyle.Render("No listening sockets found or command failed.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	public := publicInterfaces()
+	rows := []string{fmt.Sprintf("%-5s %-30s %-8s %-22s %-10s %-24s %-20s %s", "Proto", "Address", "Exposure", "Process", "User", "Unit / container", "Firewall", "Service")}
+	for _, s := range m.OpenPortsSockets {
+		where := s.Unit
+		switch {
+		case s.Netns != "":
+			where = "netns " + s.Netns
+		case s.Container != "":
+			where = s.Container
+		}
+		service := ""
+		if strings.HasPrefix(s.Proto, "tcp") {
+			service = serviceLabel(portNames[s.LocalPort], s.ID)
+		}
+		row := fmt.Sprintf("%-5s %-30s %-8s %-22s %-10s %-24s %-20s %s", s.Proto, socketAddr(s), s.Exposure, socketOwner(s), s.User, where, s.Firewall, service)
+		if _, exposed := firewallAccepts(s, public); len(exposed) > 0 || (s.Exposure == "public" && s.Firewall == "") {
+			rows = append(rows, utils.WarnStyle.Render(row))
+		} else {
+			rows = append(rows, utils.SubtleStyle.Render(row))
+		}
+	}
+	label := "Completed. Press esc to quit or b to go back."
+	if m.IdentifyChan != nil {
+		label = "Identifying services..."
 	}
-	return header + utils.SubtleStyle.Render(strings.Join(m.OpenPortsLog, "\n")) + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	return header + body + summary + "\n\n" + strings.Join(rows, "\n") + "\n\n" +
+		utils.SubtleStyle.Render("i: identify services on TCP ports") + "\n\n" + utils.SubtleStyle.Render(label)
 }
@@ -0,0 +1,98 @@
+package modules
+
+import (
+	"bufio"
+	_ "embed"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Offline MAC vendor lookup. A small OUI table is embedded in the binary; when
+// one of the usual system databases is installed it is loaded instead, so the
+// lookup never needs network access.
+
+//go:embed oui.txt
+var embeddedOUI string
+
+// ouiFiles are well-known locations of full OUI databases (ieee-data,
+// wireshark and nmap packages). The first readable one wins.
+var ouiFiles = []string{
+	"/usr/share/ieee-data/oui.txt",
+	"/usr/share/misc/oui.txt",
+	"/usr/share/wireshark/manuf",
+	"/usr/share/nmap/nmap-mac-prefixes",
+}
+
+var (
+	ouiOnce  sync.Once
+	ouiTable map[string]string
+)
+
+func loadOUI() {
+	ouiTable = map[string]string{}
+	for _, path := range ouiFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			parseOUILine(sc.Text())
+		}
+		f.Close()
+		if len(ouiTable) > 0 {
+			return
+		}
+	}
+	for _, l := range strings.Split(embeddedOUI, "\n") {
+		parseOUILine(l)
+	}
+}
+
+// parseOUILine accepts the nmap ("00000C Cisco"), wireshark ("00:00:0C\tCisco\tCisco Systems")
+// and IEEE ("00-00-0C   (hex)\t\tCisco Systems, Inc") formats.
+func parseOUILine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return
+	}
+	prefix := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(fields[0]))
+	if len(prefix) != 6 {
+		// skips wireshark /28 and /36 sub-blocks and IEEE "base 16" lines
+		return
+	}
+	rest := strings.TrimSpace(line[len(fields[0]):])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "(hex)"))
+	if i := strings.Index(rest, "\t"); i > 0 {
+		// wireshark: short name, then long name; keep the long one
+		rest = strings.TrimSpace(rest[i+1:])
+	}
+	if rest == "" {
+		return
+	}
+	ouiTable[prefix] = rest
+}
+
+// lookupVendor returns the vendor for a MAC address, "locally administered"
+// for randomized/virtual addresses, or "" when unknown.
+func lookupVendor(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) < 3 {
+		return ""
+	}
+	ouiOnce.Do(loadOUI)
+	key := strings.ToUpper(strings.ReplaceAll(hw[:3].String(), ":", ""))
+	if v, ok := ouiTable[key]; ok {
+		return v
+	}
+	if hw[0]&0x02 != 0 {
+		return "locally administered"
+	}
+	return ""
+}
@@ -0,0 +1,508 @@
+//go:build linux
+
+package modules
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Linux-only socket and netlink helpers. The matching stubs live in
+// platform_other.go so the Windows cross-build keeps working.
+
+// setMulticastHopLimit sets IPV6_MULTICAST_HOPS on an IPv6 socket.
+func setMulticastHopLimit(c syscall.Conn, hops int) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, hops)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setUnicastHops sets the TTL (IP_TTL) or hop limit (IPV6_UNICAST_HOPS) of
+// outgoing packets.
+func setUnicastHops(c syscall.Conn, v6 bool, hops int) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TTL
+	if v6 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, hops)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Neighbor states and flags from include/uapi/linux/neighbour.h.
+const (
+	nudIncomplete = 0x01
+	nudReachable  = 0x02
+	nudStale      = 0x04
+	nudDelay      = 0x08
+	nudProbe      = 0x10
+	nudFailed     = 0x20
+	nudNoARP      = 0x40
+	nudPermanent  = 0x80
+
+	ntfRouter = 0x80
+
+	ndaDst    = 1
+	ndaLLAddr = 2
+
+	sizeofNdMsg = 12
+)
+
+// readNeighbors dumps the IPv4 and IPv6 neighbor tables over rtnetlink.
+func readNeighbors() ([]utils.Neighbor, error) {
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []utils.Neighbor
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWNEIGH || len(msg.Data) < sizeofNdMsg {
+			continue
+		}
+		// struct ndmsg: family u8, pad u8, pad u16, ifindex s32, state u16, flags u8, type u8
+		ifindex := int(int32(binary.NativeEndian.Uint32(msg.Data[4:8])))
+		state := binary.NativeEndian.Uint16(msg.Data[8:10])
+		flags := msg.Data[10]
+
+		n := utils.Neighbor{State: neighborState(state), Router: flags&ntfRouter != 0}
+		for _, a := range parseRtAttrs(msg.Data[sizeofNdMsg:]) {
+			switch a.Attr.Type {
+			case ndaDst:
+				n.IP = net.IP(a.Value).String()
+			case ndaLLAddr:
+				n.MAC = net.HardwareAddr(a.Value).String()
+			}
+		}
+		if n.IP == "" || state == nudNoARP {
+			continue
+		}
+		if ifc, err := net.InterfaceByIndex(ifindex); err == nil {
+			n.Iface = ifc.Name
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func neighborState(s uint16) string {
+	switch {
+	case s&nudPermanent != 0:
+		return "PERMANENT"
+	case s&nudReachable != 0:
+		return "REACHABLE"
+	case s&nudStale != 0:
+		return "STALE"
+	case s&nudDelay != 0:
+		return "DELAY"
+	case s&nudProbe != 0:
+		return "PROBE"
+	case s&nudFailed != 0:
+		return "FAILED"
+	case s&nudIncomplete != 0:
+		return "INCOMPLETE"
+	case s&nudNoARP != 0:
+		return "NOARP"
+	default:
+		return "NONE"
+	}
+}
+
+// parseRtAttrs walks a buffer of struct rtattr. syscall.ParseNetlinkRouteAttr
+// only knows link, address and route messages.
+func parseRtAttrs(b []byte) []syscall.NetlinkRouteAttr {
+	var out []syscall.NetlinkRouteAttr
+	for len(b) >= syscall.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		t := binary.NativeEndian.Uint16(b[2:4])
+		if l < syscall.SizeofRtAttr || l > len(b) {
+			break
+		}
+		out = append(out, syscall.NetlinkRouteAttr{
+			Attr:  syscall.RtAttr{Len: uint16(l), Type: t},
+			Value: b[syscall.SizeofRtAttr:l],
+		})
+		aligned := (l + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return out
+}
+
+// sock_diag constants (linux/sock_diag.h, linux/inet_diag.h).
+const (
+	netlinkSockDiag     = 4
+	sockDiagByFamily    = 20
+	inetDiagInfo        = 2
+	inetDiagCong        = 4
+	sizeofInetDiagReqV2 = 56
+	sizeofInetDiagMsg   = 72
+)
+
+// readTCPInfo dumps the TCP sockets of our namespace over sock_diag and
+// returns their tcp_info keyed by socket inode.
+func readTCPInfo() (map[uint64]utils.TCPInfo, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkSockDiag)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	out := map[uint64]utils.TCPInfo{}
+	for i, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		// nlmsghdr followed by struct inet_diag_req_v2: family u8, protocol u8,
+		// ext u8, pad u8, states u32, inet_diag_sockid (left zero)
+		req := make([]byte, syscall.NLMSG_HDRLEN+sizeofInetDiagReqV2)
+		binary.NativeEndian.PutUint32(req[0:4], uint32(len(req)))
+		binary.NativeEndian.PutUint16(req[4:6], sockDiagByFamily)
+		binary.NativeEndian.PutUint16(req[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+		binary.NativeEndian.PutUint32(req[8:12], uint32(i+1))
+		r := req[syscall.NLMSG_HDRLEN:]
+		r[0] = family
+		r[1] = syscall.IPPROTO_TCP
+		r[2] = 1<<(inetDiagInfo-1) | 1<<(inetDiagCong-1)
+		binary.NativeEndian.PutUint32(r[4:8], 0xffffffff)
+		if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+			return nil, err
+		}
+		if err := readDiagReplies(fd, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// readDiagReplies reads one sock_diag dump up to NLMSG_DONE.
+func readDiagReplies(fd int, out map[uint64]utils.TCPInfo) error {
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) >= 4 {
+					if e := int32(binary.NativeEndian.Uint32(msg.Data[:4])); e != 0 {
+						return syscall.Errno(-e)
+					}
+				}
+				return nil
+			}
+			if len(msg.Data) < sizeofInetDiagMsg {
+				continue
+			}
+			// struct inet_diag_msg: the inode is the last field
+			inode := uint64(binary.NativeEndian.Uint32(msg.Data[68:72]))
+			var ti utils.TCPInfo
+			for _, a := range parseRtAttrs(msg.Data[sizeofInetDiagMsg:]) {
+				switch a.Attr.Type {
+				case inetDiagInfo:
+					parseTCPInfo(a.Value, &ti)
+				case inetDiagCong:
+					ti.CongAlg = strings.TrimRight(string(a.Value), "\x00")
+				}
+			}
+			if inode != 0 {
+				out[inode] = ti
+			}
+		}
+	}
+}
+
+// parseTCPInfo decodes struct tcp_info (linux/tcp.h). Older kernels send a
+// shorter struct; missing fields stay zero.
+func parseTCPInfo(b []byte, ti *utils.TCPInfo) {
+	u32 := func(off int) uint32 {
+		if off+4 > len(b) {
+			return 0
+		}
+		return binary.NativeEndian.Uint32(b[off:])
+	}
+	u64 := func(off int) uint64 {
+		if off+8 > len(b) {
+			return 0
+		}
+		return binary.NativeEndian.Uint64(b[off:])
+	}
+	if len(b) > 2 {
+		ti.Timeouts = b[2]
+	}
+	ti.MSS = u32(16)
+	ti.Lost = u32(32)
+	ti.Retrans = u32(36)
+	ti.RTT = time.Duration(u32(68)) * time.Microsecond
+	ti.RTTVar = time.Duration(u32(72)) * time.Microsecond
+	ti.Cwnd = u32(80)
+	ti.TotalRetrans = u32(100)
+	ti.MinRTT = time.Duration(u32(148)) * time.Microsecond
+	ti.DeliveryRate = u64(160)
+	ti.BytesSent = u64(200)
+	ti.BytesRetrans = u64(208)
+}
+
+// Route and rule attributes not exported by package syscall (rtnetlink.h, fib_rules.h).
+const (
+	rtaVia = 18
+
+	fraDst               = 1
+	fraSrc               = 2
+	fraIIfName           = 3
+	fraGoto              = 4
+	fraPriority          = 6
+	fraFwMark            = 10
+	fraSuppressPrefixLen = 14
+	fraTable             = 15
+	fraFwMask            = 16
+	fraOIfName           = 17
+	fraL3mdev            = 19
+
+	fibRuleInvert = 0x2
+
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	iflaVrfTable = 1
+)
+
+// readRoutes dumps every routing table, IPv4 and IPv6, over rtnetlink.
+func readRoutes() ([]utils.RouteEntry, error) {
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []utils.RouteEntry
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		// struct rtmsg: family, dst_len, src_len, tos, table, protocol, scope, type, flags u32
+		d := msg.Data
+		family, dstLen := d[0], int(d[1])
+		if family != syscall.AF_INET && family != syscall.AF_INET6 {
+			continue
+		}
+		r := utils.RouteEntry{
+			Family:  4,
+			TableID: int(d[4]),
+			Proto:   routeProtocol(d[5]),
+			Scope:   routeScope(d[6]),
+			Type:    routeType(d[7]),
+			TOS:     d[3],
+			Dst:     "default",
+		}
+		if family == syscall.AF_INET6 {
+			r.Family = 6
+		}
+		for _, a := range parseRtAttrs(d[syscall.SizeofRtMsg:]) {
+			switch a.Attr.Type {
+			case syscall.RTA_DST:
+				r.Dst = fmt.Sprintf("%s/%d", net.IP(a.Value), dstLen)
+			case syscall.RTA_GATEWAY:
+				r.Gateway = net.IP(a.Value).String()
+			case rtaVia:
+				// struct rtvia: family u16, address
+				if len(a.Value) > 2 {
+					r.Gateway = net.IP(a.Value[2:]).String()
+				}
+			case syscall.RTA_OIF:
+				r.Dev = ifName(int(binary.NativeEndian.Uint32(a.Value)))
+			case syscall.RTA_PREFSRC:
+				r.Src = net.IP(a.Value).String()
+			case syscall.RTA_PRIORITY:
+				r.Metric = int(binary.NativeEndian.Uint32(a.Value))
+			case syscall.RTA_TABLE:
+				r.TableID = int(binary.NativeEndian.Uint32(a.Value))
+			case syscall.RTA_MULTIPATH:
+				r.Nexthops = parseMultipath(a.Value)
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// parseMultipath decodes a list of struct rtnexthop with their nested attributes.
+func parseMultipath(b []byte) []utils.RouteNexthop {
+	var out []utils.RouteNexthop
+	for len(b) >= 8 {
+		// struct rtnexthop: len u16, flags u8, hops u8, ifindex s32
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < 8 || l > len(b) {
+			break
+		}
+		hop := utils.RouteNexthop{Dev: ifName(int(int32(binary.NativeEndian.Uint32(b[4:8])))), Weight: int(b[3]) + 1}
+		for _, a := range parseRtAttrs(b[8:l]) {
+			if a.Attr.Type == syscall.RTA_GATEWAY {
+				hop.Gateway = net.IP(a.Value).String()
+			}
+		}
+		out = append(out, hop)
+		aligned := (l + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return out
+}
+
+// readRules dumps the IPv4 and IPv6 policy routing rules over rtnetlink.
+func readRules() ([]utils.RouteRule, error) {
+	var out []utils.RouteRule
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		tab, err := syscall.NetlinkRIB(syscall.RTM_GETRULE, family)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(tab)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type != syscall.RTM_NEWRULE || len(msg.Data) < 12 {
+				continue
+			}
+			// struct fib_rule_hdr: family, dst_len, src_len, tos, table, res1, res2, action, flags u32
+			d := msg.Data
+			r := utils.RouteRule{
+				Family:            4,
+				TOS:               d[3],
+				TableID:           int(d[4]),
+				Action:            ruleAction(d[7]),
+				Invert:            binary.NativeEndian.Uint32(d[8:12])&fibRuleInvert != 0,
+				SuppressPrefixLen: -1,
+			}
+			if d[0] == syscall.AF_INET6 {
+				r.Family = 6
+			}
+			dstLen, srcLen := int(d[1]), int(d[2])
+			for _, a := range parseRtAttrs(d[12:]) {
+				switch a.Attr.Type {
+				case fraDst:
+					r.Dst = fmt.Sprintf("%s/%d", net.IP(a.Value), dstLen)
+				case fraSrc:
+					r.Src = fmt.Sprintf("%s/%d", net.IP(a.Value), srcLen)
+				case fraIIfName:
+					r.IIf = strings.TrimRight(string(a.Value), "\x00")
+				case fraOIfName:
+					r.OIf = strings.TrimRight(string(a.Value), "\x00")
+				case fraGoto:
+					r.Goto = int(binary.NativeEndian.Uint32(a.Value))
+				case fraPriority:
+					r.Priority = int(binary.NativeEndian.Uint32(a.Value))
+				case fraFwMark:
+					r.FwMark = binary.NativeEndian.Uint32(a.Value)
+				case fraFwMask:
+					r.FwMask = binary.NativeEndian.Uint32(a.Value)
+				case fraTable:
+					r.TableID = int(binary.NativeEndian.Uint32(a.Value))
+				case fraSuppressPrefixLen:
+					r.SuppressPrefixLen = int(int32(binary.NativeEndian.Uint32(a.Value)))
+				case fraL3mdev:
+					r.L3mdev = len(a.Value) > 0 && a.Value[0] != 0
+				}
+			}
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// readVRFTables maps VRF table ids to VRF device names.
+func readVRFTables() map[int]string {
+	out := map[int]string{}
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return out
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return out
+	}
+	for i := range msgs {
+		if msgs[i].Header.Type != syscall.RTM_NEWLINK {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[i])
+		if err != nil {
+			continue
+		}
+		var name string
+		var kind string
+		table := 0
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFLA_IFNAME:
+				name = strings.TrimRight(string(a.Value), "\x00")
+			case syscall.IFLA_LINKINFO:
+				for _, info := range parseRtAttrs(a.Value) {
+					switch info.Attr.Type {
+					case iflaInfoKind:
+						kind = strings.TrimRight(string(info.Value), "\x00")
+					case iflaInfoData:
+						for _, v := range parseRtAttrs(info.Value) {
+							if v.Attr.Type == iflaVrfTable && len(v.Value) >= 4 {
+								table = int(binary.NativeEndian.Uint32(v.Value))
+							}
+						}
+					}
+				}
+			}
+		}
+		if kind == "vrf" && table != 0 {
+			out[table] = name
+		}
+	}
+	return out
+}
+
+func ifName(index int) string {
+	if ifc, err := net.InterfaceByIndex(index); err == nil {
+		return ifc.Name
+	}
+	return fmt.Sprintf("if%d", index)
+}
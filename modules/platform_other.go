@@ -0,0 +1,39 @@
+//go:build !linux
+
+package modules
+
+import (
+	"errors"
+	"network-check/utils"
+	"syscall"
+)
+
+var errUnsupportedPlatform = errors.New("not supported on this platform")
+
+func setMulticastHopLimit(c syscall.Conn, hops int) error {
+	return errUnsupportedPlatform
+}
+
+func setUnicastHops(c syscall.Conn, v6 bool, hops int) error {
+	return errUnsupportedPlatform
+}
+
+func readNeighbors() ([]utils.Neighbor, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func readTCPInfo() (map[uint64]utils.TCPInfo, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func readRoutes() ([]utils.RouteEntry, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func readRules() ([]utils.RouteRule, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func readVRFTables() map[int]string {
+	return map[int]string{}
+}
@@ -0,0 +1,439 @@
+package modules
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Remote port reachability. The user enters a host and a port list such as
+// "example.com 22,80,443,8000-8100 udp:53,123"; without ports a default list
+// of common services is probed. TCP ports are connected to with a timeout:
+// a handshake means open, a reset closed, silence or an ICMP error filtered.
+// UDP ports get a protocol payload where one is known (DNS, NTP, SNMP) so a
+// listening service answers: a reply means open, ICMP port unreachable
+// closed, and silence open|filtered since UDP cannot tell the two apart.
+// At most m.PortScanWorkers probes run at once; results stream into the table.
+
+// defaultScanPorts is probed when the user gives only a host.
+var defaultScanPorts = "21,22,23,25,53,80,110,143,443,445,465,587,993,995,3306,3389,5432,6379,8080,8443 udp:53,123,161"
+
+// portNames labels well-known ports in the table.
+var portNames = map[int]string{
+	21: "ftp", 22: "ssh", 23: "telnet", 25: "smtp", 53: "dns", 80: "http", 110: "pop3", 123: "ntp",
+	143: "imap", 161: "snmp", 443: "https", 445: "smb", 465: "smtps", 587: "submission", 993: "imaps",
+	995: "pop3s", 1194: "openvpn", 3306: "mysql", 3389: "rdp", 5060: "sip", 5432: "postgresql",
+	6379: "redis", 8080: "http-alt", 8443: "https-alt", 11211: "memcached", 27017: "mongodb",
+}
+
+// udpPayloads are requests a listening service answers to. Ports without a
+// payload get an empty datagram, which many services ignore.
+var udpPayloads = map[int][]byte{
+	// DNS: query for the root NS records
+	53: mustHex("12340100000100000000000000000200 01"),
+	// NTP: client request, version 3
+	123: append([]byte{0x1b}, make([]byte, 47)...),
+	// SNMPv2c get-request for sysDescr.0 with community "public"
+	161: mustHex("302902010104067075626c6963a01c0204" + "4e43484b" + "020100020100300e300c06082b060102010101000500"),
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// portSpec is one port to probe.
+type portSpec struct {
+	proto string
+	port  int
+}
+
+func UpdatePortScan(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if !m.Loaded {
+			return m, nil
+		}
+		switch msg.String() {
+		case "a":
+			m.PortScanAll = !m.PortScanAll
+		case "i":
+			var targets []identifyTarget
+			for i, p := range m.PortScanPorts {
+				if p.Proto == "tcp" && p.State == "open" {
+					targets = append(targets, identifyTarget{index: i, ip: m.PortScanIP, name: m.PortScanHost, port: p.Port})
+				}
+			}
+			if len(targets) > 0 {
+				return startIdentify(m, targets)
+			}
+		}
+		return m, nil
+
+	case utils.FrameMsg:
+		if m.IdentifyChan != nil {
+			return pollIdentify(m, func(m *utils.Model, r utils.IdentifyResult) {
+				id := r.ID
+				m.PortScanPorts[r.Index].ID = &id
+			})
+		}
+		if !m.Loaded && m.PortScanChan == nil {
+			if !m.InputSubmitted {
+				return utils.PromptInput(m, "Host and ports to probe, e.g. example.com 22,80,443,8000-8100 udp:53,123 (host alone: common ports):", ""), nil
+			}
+			m.InputSubmitted = false
+			m.PortScanChan = make(chan utils.PortScanResult, 1024)
+			m.PortScanLog = []string{}
+			m.PortScanPorts = []utils.PortProbe{}
+			m.PortScanProbed = 0
+			m.PortScanTotal = 0
+			m.PortScanHost, m.PortScanIP = "", ""
+			if f := strings.Fields(m.Input); len(f) > 0 {
+				m.PortScanHost = strings.Trim(f[0], "[]")
+			}
+			go runPortScan(m.PortScanChan, strings.TrimSpace(m.Input), m.PortScanWorkers, m.PortScanTimeout)
+			return m, utils.Frame()
+		}
+
+		if m.PortScanChan != nil {
+			for {
+				select {
+				case r, ok := <-m.PortScanChan:
+					if !ok {
+						m.PortScanChan = nil
+						m.Loaded = true
+						return m, nil
+					}
+					switch {
+					case r.Msg != "":
+						m.PortScanLog = append(m.PortScanLog, r.Msg)
+					case r.IP != "":
+						m.PortScanIP = r.IP
+					case r.Probe != nil:
+						// keep the list ordered by protocol and port as it grows
+						p := *r.Probe
+						i := sort.Search(len(m.PortScanPorts), func(i int) bool {
+							q := m.PortScanPorts[i]
+							if q.Proto != p.Proto {
+								return q.Proto > p.Proto
+							}
+							return q.Port > p.Port
+						})
+						m.PortScanPorts = slices.Insert(m.PortScanPorts, i, p)
+					default:
+						m.PortScanProbed = r.Probed
+						m.PortScanTotal = r.Total
+					}
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+func runPortScan(ch chan<- utils.PortScanResult, input string, workers int, timeout time.Duration) {
+	defer close(ch)
+	if workers <= 0 {
+		workers = 64
+	}
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	note := func(s string) { ch <- utils.PortScanResult{Msg: s} }
+
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		note("enter a host name or address")
+		return
+	}
+	host := fields[0]
+	spec := strings.Join(fields[1:], ",")
+	if spec == "" {
+		spec = defaultScanPorts
+	}
+	ports, err := parsePortSpec(spec)
+	if err != nil {
+		note(err.Error())
+		return
+	}
+
+	ip, err := resolveHost(host)
+	if err != nil {
+		note(err.Error())
+		return
+	}
+	if ip.String() != strings.Trim(host, "[]") {
+		note(fmt.Sprintf("%s resolves to %s", host, ip))
+	}
+	ch <- utils.PortScanResult{IP: ip.String()}
+	note(fmt.Sprintf("probing %d ports of %s, %d at a time, %s timeout", len(ports), ip, workers, timeout))
+
+	total := len(ports)
+	var probed int64
+	ch <- utils.PortScanResult{Probed: 0, Total: total}
+
+	jobs := make(chan portSpec)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, total); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				var r utils.PortProbe
+				if p.proto == "udp" {
+					r = probeUDP(ip, p.port, timeout)
+				} else {
+					r = probeTCP(ip, p.port, timeout)
+				}
+				r.Service = portNames[p.port]
+				ch <- utils.PortScanResult{Probe: &r}
+				n := int(atomic.AddInt64(&probed, 1))
+				select {
+				case ch <- utils.PortScanResult{Probed: n, Total: total}:
+				default:
+				}
+			}
+		}()
+	}
+	for _, p := range ports {
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+	ch <- utils.PortScanResult{Probed: total, Total: total}
+}
+
+// resolveHost parses an address or looks the name up, preferring IPv4.
+func resolveHost(host string) (net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return ip, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return nil, fmt.Errorf("cannot resolve %s: %v", host, err)
+	}
+	for _, a := range addrs {
+		if a.To4() != nil {
+			return a, nil
+		}
+	}
+	return addrs[0], nil
+}
+
+// parsePortSpec parses comma or space separated ports and ranges. "udp:" or
+// "tcp:" (also "u:"/"t:") switches the protocol for the items that follow.
+func parsePortSpec(spec string) ([]portSpec, error) {
+	var out []portSpec
+	seen := map[portSpec]bool{}
+	proto := "tcp"
+	for _, item := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' }) {
+		item = strings.ToLower(item)
+		if p, rest, ok := strings.Cut(item, ":"); ok {
+			switch p {
+			case "tcp", "t":
+				proto = "tcp"
+			case "udp", "u":
+				proto = "udp"
+			default:
+				return nil, fmt.Errorf("unknown protocol %q (use tcp: or udp:)", p)
+			}
+			item = rest
+			if item == "" {
+				continue
+			}
+		}
+		lo, hi, isRange := strings.Cut(item, "-")
+		a, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("invalid port range %q", item)
+			}
+		}
+		if a < 1 || b > 65535 || a > b {
+			return nil, fmt.Errorf("port range %q outside 1-65535", item)
+		}
+		for port := a; port <= b; port++ {
+			ps := portSpec{proto, port}
+			if !seen[ps] {
+				seen[ps] = true
+				out = append(out, ps)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no ports given")
+	}
+	return out, nil
+}
+
+// probeTCP classifies a port by how a connect ends.
+func probeTCP(ip net.IP, port int, timeout time.Duration) utils.PortProbe {
+	r := utils.PortProbe{Proto: "tcp", Port: port}
+	start := time.Now()
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), timeout)
+	r.RTT = time.Since(start)
+	if err == nil {
+		c.Close()
+		r.State, r.Reason = "open", "syn-ack"
+		return r
+	}
+	r.State, r.Reason = probeError(err)
+	return r
+}
+
+// probeUDP sends the payload twice (UDP may be lost) and waits for a reply or
+// an ICMP error, which the kernel reports on the connected socket.
+func probeUDP(ip net.IP, port int, timeout time.Duration) utils.PortProbe {
+	r := utils.PortProbe{Proto: "udp", Port: port}
+	c, err := net.Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		r.State, r.Reason = probeError(err)
+		return r
+	}
+	defer c.Close()
+
+	buf := make([]byte, 1500)
+	start := time.Now()
+	for try := 0; try < 2; try++ {
+		if _, err := c.Write(udpPayloads[port]); err != nil {
+			r.RTT = time.Since(start)
+			r.State, r.Reason = probeError(err)
+			return r
+		}
+		_ = c.SetReadDeadline(time.Now().Add(timeout / 2))
+		n, err := c.Read(buf)
+		r.RTT = time.Since(start)
+		if err == nil {
+			r.State, r.Reason = "open", fmt.Sprintf("reply, %d bytes", n)
+			return r
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			r.State, r.Reason = probeError(err)
+			return r
+		}
+	}
+	r.State, r.Reason = "open|filtered", "no reply"
+	return r
+}
+
+// probeError maps a connect/read error to a port state and reason.
+func probeError(err error) (string, string) {
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		// TCP reset, or ICMP port unreachable on a UDP socket
+		var oe *net.OpError
+		if errors.As(err, &oe) && strings.HasPrefix(oe.Net, "udp") {
+			return "closed", "icmp port unreachable"
+		}
+		return "closed", "reset"
+	case errors.Is(err, os.ErrDeadlineExceeded), isTimeout(err):
+		return "filtered", "timeout"
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return "filtered", "icmp host unreachable"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "filtered", "network unreachable"
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return "filtered", "administratively prohibited"
+	case errors.As(err, &errno):
+		return "filtered", errno.Error()
+	}
+	return "filtered", err.Error()
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func ChosenPortScanView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("Port reachability:") + " TCP connect / UDP probes to a remote host\n\n"
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
+
+	var b strings.Builder
+	if len(m.PortScanLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.PortScanLog, "\n")) + "\n\n")
+	}
+
+	counts := map[string]int{}
+	for _, p := range m.PortScanPorts {
+		counts[p.State]++
+	}
+	if m.PortScanTotal > 0 {
+		b.WriteString(utils.Progressbar(float64(m.PortScanProbed)/float64(m.PortScanTotal)) + "\n")
+		b.WriteString(utils.SubtleStyle.Render(fmt.Sprintf("probed %d/%d • %d open • %d closed • %d filtered • %d open|filtered",
+			m.PortScanProbed, m.PortScanTotal, counts["open"], counts["closed"], counts["filtered"], counts["open|filtered"])) + "\n\n")
+	}
+	if m.Loaded && len(m.PortScanPorts) > 0 && counts["filtered"]+counts["open|filtered"] == len(m.PortScanPorts) {
+		b.WriteString(utils.WarnStyle.Render("WARNING: no port answered: the host is down, or a firewall on the path drops everything") + "\n\n")
+	}
+
+	// closed and filtered ports are only listed individually for short lists
+	showAll := m.PortScanAll || len(m.PortScanPorts) <= 50
+	rows := []string{fmt.Sprintf("%-5s %-6s %-14s %-26s %-9s %s", "Proto", "Port", "State", "Reason", "RTT", "Service")}
+	hidden := 0
+	for _, p := range m.PortScanPorts {
+		if !showAll && p.State != "open" && p.State != "open|filtered" {
+			hidden++
+			continue
+		}
+		row := fmt.Sprintf("%-5s %-6d %-14s %-26s %-9s %s", p.Proto, p.Port, p.State, p.Reason, fmt.Sprintf("%.1fms", float64(p.RTT.Microseconds())/1000), serviceLabel(p.Service, p.ID))
+		switch p.State {
+		case "open":
+			rows = append(rows, utils.KeywordStyle.Render(row))
+		default:
+			rows = append(rows, utils.SubtleStyle.Render(row))
+		}
+	}
+	if len(rows) > 1 {
+		b.WriteString(strings.Join(rows, "\n") + "\n")
+	}
+	if hidden > 0 {
+		b.WriteString(utils.SubtleStyle.Render(fmt.Sprintf("%d closed/filtered ports not listed (a: show all)", hidden)) + "\n")
+	}
+	b.WriteString("\n")
+
+	label := "Running..."
+	switch {
+	case m.IdentifyChan != nil:
+		label = "Identifying services..."
+	case m.Loaded:
+		if counts["open"] > 0 {
+			b.WriteString(utils.SubtleStyle.Render("i: identify services on open TCP ports • a: show all ports") + "\n\n")
+		}
+		label = "Completed. Press esc to quit or b to go back."
+	}
+	return header + b.String() + utils.SubtleStyle.Render(label)
+}
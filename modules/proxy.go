@@ -4,6 +4,9 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"network-check/utils"
 	"os"
 	"os/exec"
@@ -76,6 +79,11 @@ func UpdateProxy(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 				run("sh", "-c", "if [ -r ~/.bashrc ]; then grep -i proxy ~/.bashrc || true; fi")
 				run("sh", "-c", "if [ -r ~/.profile ]; then grep -i proxy ~/.profile || true; fi")
 
+				// what the HTTP checks of this tool will use
+				if pc := detectProxy(ctx); pc.HTTP != "" || pc.HTTPS != "" {
+					send(fmt.Sprintf("used by the HTTP timing check: %s", pc))
+				}
+
 				// final helpful note if nothing was emitted
 				// (since we already emitted env entries earlier, check channel not possible here;
 				// emit a generic note so user isn't left with empty result)
@@ -145,3 +153,157 @@ func ChosenProxyView(m utils.Model) string {
 	}
 	return header + utils.SubtleStyle.Render(strings.Join(m.ProxyLog, "\n")) + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
 }
+
+// proxyConfig is the proxy this host is set up to use, taken from the
+// first source that sets one: the environment, /etc/environment, the GNOME
+// settings, then git's http.proxy.
+type proxyConfig struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy string // comma-separated hosts, domains and CIDRs
+	Source  string
+}
+
+func (pc proxyConfig) String() string {
+	s := fmt.Sprintf("http %s, https %s", orNone(pc.HTTP), orNone(pc.HTTPS))
+	if pc.NoProxy != "" {
+		s += ", not for " + pc.NoProxy
+	}
+	return s + " (from " + pc.Source + ")"
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// detectProxy reads the sources the proxy check lists, in order.
+func detectProxy(ctx context.Context) proxyConfig {
+	fromVars := func(get func(string) string, source string) (proxyConfig, bool) {
+		first := func(names ...string) string {
+			for _, n := range names {
+				if v := strings.TrimSpace(get(n)); v != "" {
+					return v
+				}
+			}
+			return ""
+		}
+		all := first("ALL_PROXY", "all_proxy")
+		pc := proxyConfig{
+			HTTP:    first("HTTP_PROXY", "http_proxy"),
+			HTTPS:   first("HTTPS_PROXY", "https_proxy"),
+			NoProxy: first("NO_PROXY", "no_proxy"),
+			Source:  source,
+		}
+		if pc.HTTP == "" {
+			pc.HTTP = all
+		}
+		if pc.HTTPS == "" {
+			pc.HTTPS = all
+		}
+		return pc, pc.HTTP != "" || pc.HTTPS != ""
+	}
+
+	if pc, ok := fromVars(os.Getenv, "environment"); ok {
+		return pc
+	}
+	if b, err := os.ReadFile("/etc/environment"); err == nil {
+		vars := map[string]string{}
+		for _, line := range strings.Split(string(b), "\n") {
+			k, v, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=")
+			if ok {
+				vars[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"'`)
+			}
+		}
+		if pc, ok := fromVars(func(k string) string { return vars[k] }, "/etc/environment"); ok {
+			return pc
+		}
+	}
+
+	gsettings := func(schema, key string) string {
+		out, err := exec.CommandContext(ctx, "gsettings", "get", schema, key).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.Trim(strings.TrimSpace(string(out)), "'")
+	}
+	if gsettings("org.gnome.system.proxy", "mode") == "manual" {
+		hostPort := func(schema string) string {
+			host, port := gsettings(schema, "host"), gsettings(schema, "port")
+			if host == "" || port == "" || port == "0" {
+				return ""
+			}
+			return "http://" + net.JoinHostPort(host, strings.TrimPrefix(port, "uint32 "))
+		}
+		pc := proxyConfig{HTTP: hostPort("org.gnome.system.proxy.http"), HTTPS: hostPort("org.gnome.system.proxy.https"), Source: "GNOME settings"}
+		// ['localhost', '127.0.0.0/8']
+		ignore := strings.Trim(gsettings("org.gnome.system.proxy", "ignore-hosts"), "[]")
+		pc.NoProxy = strings.NewReplacer("'", "", " ", "").Replace(ignore)
+		if pc.HTTP != "" || pc.HTTPS != "" {
+			return pc
+		}
+	}
+
+	if out, err := exec.CommandContext(ctx, "git", "config", "--global", "--get", "http.proxy").Output(); err == nil {
+		if p := strings.TrimSpace(string(out)); p != "" {
+			return proxyConfig{HTTP: p, HTTPS: p, Source: "git http.proxy"}
+		}
+	}
+	return proxyConfig{Source: "none"}
+}
+
+// proxyFunc picks the proxy of a request the way Go's environment proxy
+// does: never for localhost and loopback addresses, nor for hosts NoProxy
+// lists.
+func (pc proxyConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		p := pc.HTTP
+		if req.URL.Scheme == "https" {
+			p = pc.HTTPS
+		}
+		host := req.URL.Hostname()
+		if p == "" || host == "localhost" || pc.bypass(host) {
+			return nil, nil
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return nil, nil
+		}
+		if !strings.Contains(p, "://") {
+			p = "http://" + p
+		}
+		return url.Parse(p)
+	}
+}
+
+// bypass reports whether NoProxy covers host.
+func (pc proxyConfig) bypass(host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, e := range strings.Split(strings.ToLower(pc.NoProxy), ",") {
+		e = strings.TrimSpace(e)
+		if h, _, err := net.SplitHostPort(e); err == nil {
+			e = h
+		}
+		switch {
+		case e == "":
+		case e == "*":
+			return true
+		case strings.Contains(e, "/"):
+			if _, n, err := net.ParseCIDR(e); err == nil && ip != nil && n.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(e, "*."):
+			if strings.HasSuffix(host, e[1:]) {
+				return true
+			}
+		default:
+			d := strings.TrimPrefix(e, ".")
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+	}
+	return false
+}
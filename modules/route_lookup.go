@@ -0,0 +1,440 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Route lookup: answers "which route will this packet take?" from the rules
+// and tables already collected by the routing check. The flow is entered in
+// "ip route get" syntax; the policy rules are walked in priority order the way
+// the kernel's fib_rules code does, explaining why each rule matched or not,
+// and the kernel's own answer from "ip route get" is shown for comparison.
+
+type routeFlow struct {
+	dst, src net.IP
+	family   int
+	iif, oif string
+	mark     uint32
+	tos      uint8
+}
+
+// parseRouteFlow accepts "DST [from SRC] [iif DEV] [oif DEV] [mark N] [tos N]".
+func parseRouteFlow(s string) (routeFlow, error) {
+	var f routeFlow
+	fields := strings.Fields(s)
+	if len(fields) > 0 && fields[0] == "to" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return f, fmt.Errorf("a destination address is required")
+	}
+	if f.dst = net.ParseIP(fields[0]); f.dst == nil {
+		return f, fmt.Errorf("%q is not an IP address", fields[0])
+	}
+	f.family = 6
+	if f.dst.To4() != nil {
+		f.family = 4
+	}
+	for i := 1; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			return f, fmt.Errorf("%q needs a value", fields[i])
+		}
+		key, val := fields[i], fields[i+1]
+		switch key {
+		case "from":
+			if f.src = net.ParseIP(val); f.src == nil {
+				return f, fmt.Errorf("%q is not an IP address", val)
+			}
+			if (f.src.To4() != nil) != (f.family == 4) {
+				return f, fmt.Errorf("source and destination are different address families")
+			}
+		case "iif":
+			f.iif = val
+		case "oif":
+			f.oif = val
+		case "mark", "fwmark":
+			n, err := strconv.ParseUint(val, 0, 32)
+			if err != nil {
+				return f, fmt.Errorf("bad mark %q", val)
+			}
+			f.mark = uint32(n)
+		case "tos", "dsfield":
+			n, err := strconv.ParseUint(val, 0, 8)
+			if err != nil {
+				return f, fmt.Errorf("bad tos %q", val)
+			}
+			f.tos = uint8(n)
+		default:
+			return f, fmt.Errorf("unknown keyword %q", key)
+		}
+	}
+	return f, nil
+}
+
+func (f routeFlow) String() string {
+	parts := []string{"to " + f.dst.String()}
+	if f.src != nil {
+		parts = append(parts, "from "+f.src.String())
+	}
+	if f.iif != "" {
+		parts = append(parts, "iif "+f.iif)
+	}
+	if f.oif != "" {
+		parts = append(parts, "oif "+f.oif)
+	}
+	if f.mark != 0 {
+		parts = append(parts, fmt.Sprintf("mark 0x%x", f.mark))
+	}
+	if f.tos != 0 {
+		parts = append(parts, fmt.Sprintf("tos 0x%02x", f.tos))
+	}
+	return strings.Join(parts, " ")
+}
+
+// prefixContains reports whether a rule/route prefix ("" or "default" for
+// any) contains ip.
+func prefixContains(prefix string, ip net.IP) (bool, int) {
+	if prefix == "" || prefix == "default" {
+		return true, 0
+	}
+	_, n, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return false, 0
+	}
+	ones, _ := n.Mask.Size()
+	return n.Contains(ip), ones
+}
+
+// ruleMismatch returns why a rule does not select the flow, or "" when it does.
+func ruleMismatch(r utils.RouteRule, f routeFlow) string {
+	reason := ""
+	iif := f.iif
+	if iif == "" {
+		// locally generated traffic is looked up with the loopback device as iif
+		iif = "lo"
+	}
+	switch {
+	case r.IIf != "" && r.IIf != iif:
+		reason = fmt.Sprintf("input interface is %s, rule wants %s", iif, r.IIf)
+	case r.OIf != "" && r.OIf != f.oif:
+		reason = fmt.Sprintf("rule wants output interface %s", r.OIf)
+	case r.FwMark != 0 || r.FwMask != 0:
+		mask := r.FwMask
+		if mask == 0 {
+			mask = 0xffffffff
+		}
+		if (f.mark^r.FwMark)&mask != 0 {
+			reason = fmt.Sprintf("mark 0x%x does not match 0x%x/0x%x", f.mark, r.FwMark, mask)
+		}
+	}
+	if reason == "" && r.Src != "" {
+		if f.src == nil {
+			reason = "no source given, the lookup uses the unspecified address which is not in " + r.Src
+		} else if ok, _ := prefixContains(r.Src, f.src); !ok {
+			reason = fmt.Sprintf("source %s not in %s", f.src, r.Src)
+		}
+	}
+	if reason == "" && r.Dst != "" {
+		if ok, _ := prefixContains(r.Dst, f.dst); !ok {
+			reason = fmt.Sprintf("destination %s not in %s", f.dst, r.Dst)
+		}
+	}
+	if reason == "" && r.TOS != 0 && r.TOS != f.tos {
+		reason = fmt.Sprintf("tos 0x%02x does not match 0x%02x", f.tos, r.TOS)
+	}
+	if reason == "" && r.L3mdev {
+		reason = "flow is not bound to a VRF device"
+	}
+
+	if r.Invert {
+		if reason == "" {
+			return "selector matches but the rule is inverted (not)"
+		}
+		return ""
+	}
+	return reason
+}
+
+// lookupTable picks the longest-prefix route for the flow in one table,
+// preferring the lowest metric among equal prefixes.
+func lookupTable(routes []utils.RouteEntry, table int, f routeFlow) (utils.RouteEntry, bool) {
+	var best utils.RouteEntry
+	bestLen := -1
+	for _, r := range routes {
+		if r.TableID != table || r.Family != f.family {
+			continue
+		}
+		if r.TOS != 0 && r.TOS != f.tos {
+			continue
+		}
+		ok, plen := prefixContains(r.Dst, f.dst)
+		if !ok {
+			continue
+		}
+		if plen > bestLen || (plen == bestLen && r.Metric < best.Metric) {
+			best, bestLen = r, plen
+		}
+	}
+	return best, bestLen >= 0
+}
+
+// defaultRules is what the kernel installs when no rules could be read.
+func defaultRules(family int) []utils.RouteRule {
+	rules := []utils.RouteRule{
+		{Family: family, Priority: 0, Action: "lookup", TableID: 255, Table: "local", SuppressPrefixLen: -1},
+		{Family: family, Priority: 32766, Action: "lookup", TableID: 254, Table: "main", SuppressPrefixLen: -1},
+	}
+	if family == 4 {
+		rules = append(rules, utils.RouteRule{Family: 4, Priority: 32767, Action: "lookup", TableID: 253, Table: "default", SuppressPrefixLen: -1})
+	}
+	return rules
+}
+
+// routeResult is where a route lookup ends: the rule and route chosen, or
+// why the packet is dropped.
+type routeResult struct {
+	matched bool // a rule led to a route
+	rule    utils.RouteRule
+	route   utils.RouteEntry
+	reject  string   // why the packet is dropped, "" when it is routed
+	devs    []string // egress devices, one per next hop of a multipath route
+	src     string   // source address and where it comes from
+}
+
+// resolveRoute walks the rules for the flow and returns the explanation lines
+// and the result.
+func resolveRoute(rules []utils.RouteRule, routes []utils.RouteEntry, f routeFlow) (steps []string, res routeResult) {
+	var fam []utils.RouteRule
+	for _, r := range rules {
+		if r.Family == f.family {
+			fam = append(fam, r)
+		}
+	}
+	if len(fam) == 0 {
+		fam = defaultRules(f.family)
+		steps = append(steps, "no policy rules available, assuming the kernel defaults")
+	}
+
+	for i := 0; i < len(fam); i++ {
+		r := fam[i]
+		prefix := formatRule(r) + "  → "
+		if why := ruleMismatch(r, f); why != "" {
+			steps = append(steps, prefix+"skipped: "+why)
+			continue
+		}
+		switch r.Action {
+		case "nop":
+			steps = append(steps, prefix+"matched, nop: continue")
+			continue
+		case "goto":
+			next := len(fam)
+			for j := range fam {
+				if fam[j].Priority >= r.Goto {
+					next = j
+					break
+				}
+			}
+			steps = append(steps, prefix+fmt.Sprintf("matched, jump to rule %d", r.Goto))
+			i = next - 1
+			continue
+		case "lookup":
+			route, ok := lookupTable(routes, r.TableID, f)
+			if !ok {
+				steps = append(steps, prefix+fmt.Sprintf("matched, no route in table %s: continue", r.Table))
+				continue
+			}
+			if route.Type == "throw" {
+				steps = append(steps, prefix+fmt.Sprintf("matched, table %s throws %s: continue", r.Table, route.Dst))
+				continue
+			}
+			if _, plen := prefixContains(route.Dst, f.dst); r.SuppressPrefixLen >= 0 && plen <= r.SuppressPrefixLen {
+				steps = append(steps, prefix+fmt.Sprintf("matched, %s suppressed (prefix length %d <= %d): continue", route.Dst, plen, r.SuppressPrefixLen))
+				continue
+			}
+			steps = append(steps, prefix+"matched, route "+formatRoute(route))
+			return steps, routeTo(r, route, f)
+		default:
+			// blackhole, unreachable, prohibit
+			steps = append(steps, prefix+"matched")
+			return steps, routeResult{reject: fmt.Sprintf("rule %d is %s: the packet is dropped", r.Priority, r.Action)}
+		}
+	}
+	return steps, routeResult{reject: "no rule produced a route: network unreachable"}
+}
+
+// routeTo fills in the egress devices and the source of the chosen route.
+func routeTo(rule utils.RouteRule, r utils.RouteEntry, f routeFlow) routeResult {
+	res := routeResult{matched: true, rule: rule, route: r}
+	if isRejectType(r.Type) {
+		res.reject = r.Type + " route: the packet is dropped"
+		return res
+	}
+	if r.Dev != "" {
+		res.devs = []string{r.Dev}
+	}
+	for _, nh := range r.Nexthops {
+		if !slices.Contains(res.devs, nh.Dev) {
+			res.devs = append(res.devs, nh.Dev)
+		}
+	}
+
+	switch {
+	case f.src != nil:
+		res.src = f.src.String() + " (given)"
+	case r.Src != "":
+		res.src = r.Src + " (route preferred source)"
+	case r.Type == "local":
+		res.src = f.dst.String()
+	default:
+		if ip := interfaceSource(r.Dev, f); ip != nil {
+			res.src = ip.String() + " (first address on " + r.Dev + ")"
+		} else {
+			res.src = "none available"
+		}
+	}
+	return res
+}
+
+// routeVerdict summarizes the chosen rule, table, route, next hop and source.
+func routeVerdict(res routeResult) []string {
+	var out []string
+	if res.matched {
+		r := res.route
+		out = append(out,
+			"rule:      "+strings.Replace(formatRule(res.rule), "\t", " ", 1),
+			"table:     "+r.Table,
+			"route:     "+strings.ReplaceAll(formatRoute(r), "\n\t", "; "))
+	}
+	if res.reject != "" {
+		return append(out, "WARNING: "+res.reject)
+	}
+	r := res.route
+	switch {
+	case r.Type == "local":
+		out = append(out, "gateway:   none, the destination is a local address")
+	case r.Gateway != "":
+		out = append(out, "gateway:   "+r.Gateway)
+	case len(r.Nexthops) > 0:
+		var hops []string
+		for _, nh := range r.Nexthops {
+			hops = append(hops, formatNexthop(nh))
+		}
+		out = append(out, "gateway:   multipath, one of: "+strings.Join(hops, ", "))
+	default:
+		out = append(out, "gateway:   none, destination is on-link")
+	}
+	egress := strings.Join(res.devs, ", ")
+	if r.Dev == "" && len(r.Nexthops) > 0 {
+		egress += " (per next hop)"
+	}
+	return append(out, "egress:    "+egress, "source:    "+res.src)
+}
+
+// interfaceSource picks a source address of the right family on dev,
+// preferring global addresses unless the destination is link-local.
+func interfaceSource(dev string, f routeFlow) net.IP {
+	ifc, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil
+	}
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return nil
+	}
+	var fallback net.IP
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || (ipn.IP.To4() != nil) != (f.family == 4) {
+			continue
+		}
+		if ipn.IP.IsLinkLocalUnicast() != f.dst.IsLinkLocalUnicast() {
+			if fallback == nil {
+				fallback = ipn.IP
+			}
+			continue
+		}
+		return ipn.IP
+	}
+	return fallback
+}
+
+// startRouteLookup resolves the submitted flow and asks the kernel for its
+// answer in the background.
+func startRouteLookup(m utils.Model) (utils.Model, tea.Cmd) {
+	m.InputSubmitted = false
+	m.RouteQuery = strings.TrimSpace(m.Input)
+	m.RouteLookup = []string{}
+	m.RouteKernel = []string{}
+
+	f, err := parseRouteFlow(m.RouteQuery)
+	if err != nil {
+		m.RouteLookup = []string{"WARNING: " + err.Error()}
+		return m, nil
+	}
+	steps, res := resolveRoute(m.RouteRules, m.RouteEntries, f)
+	m.RouteLookup = append([]string{"flow: " + f.String(), ""}, routeVerdict(res)...)
+	m.RouteLookup = append(m.RouteLookup, "")
+	m.RouteLookup = append(m.RouteLookup, steps...)
+
+	m.RouteGetChan = make(chan string, 64)
+	go func(ch chan<- string, f routeFlow) {
+		defer close(ch)
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		args := []string{"-" + strconv.Itoa(f.family), "route", "get"}
+		args = append(args, strings.Fields(f.String())...)
+		out, err := exec.CommandContext(ctx, "ip", args...).CombinedOutput()
+		if err != nil && len(out) == 0 {
+			out = []byte(err.Error())
+		}
+		for _, l := range strings.Split(string(out), "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				select {
+				case ch <- l:
+				default:
+				}
+			}
+		}
+	}(m.RouteGetChan, f)
+	return m, utils.Frame()
+}
+
+// pollRouteLookup drains the "ip route get" output.
+func pollRouteLookup(m utils.Model) (utils.Model, tea.Cmd) {
+	for {
+		select {
+		case line, ok := <-m.RouteGetChan:
+			if !ok {
+				m.RouteGetChan = nil
+				return m, nil
+			}
+			m.RouteKernel = append(m.RouteKernel, line)
+		default:
+			return m, utils.Frame()
+		}
+	}
+}
+
+func routeLookupView(m utils.Model) string {
+	out := utils.KeywordStyle.Render("Route lookup") + "\n" + utils.RenderFindings(m.RouteLookup)
+
+	kernel := "running ip route get..."
+	if m.RouteGetChan == nil {
+		kernel = strings.Join(m.RouteKernel, "\n")
+	}
+	if kernel != "" {
+		out += "\n\n" + utils.KeywordStyle.Render("Kernel (ip route get)") + "\n" + utils.SubtleStyle.Render(kernel)
+	}
+	return out
+}
@@ -3,70 +3,86 @@ package modules
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"network-check/utils"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-// Check routing tables: runs "ip route show" (preferred) or falls back to "route -n".
-// Streams lines into a channel from a goroutine and collects them into m.RouteLog.
+// Check routing tables: dumps the policy rules and every routing table (IPv4
+// and IPv6) over rtnetlink and streams them as utils.RouteResult values. When
+// netlink is unavailable it falls back to the text output of "ip route show"
+// or "route -n". Once loaded, "l" opens the route lookup (route_lookup.go).
 func UpdateRouting(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
-	switch msg.(type) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if m.Loaded && msg.String() == "l" {
+			query := m.RouteQuery
+			if query == "" {
+				query = "1.1.1.1"
+			}
+			return utils.PromptInput(m, "Destination to look up, ip route get syntax: DST [from SRC] [iif DEV] [oif DEV] [mark N] [tos N]", query), nil
+		}
+		return m, nil
+
 	case utils.FrameMsg:
+		if m.RouteGetChan != nil {
+			return pollRouteLookup(m)
+		}
+		if m.Loaded && m.InputSubmitted {
+			return startRouteLookup(m)
+		}
+
 		if !m.Loaded && m.RouteChan == nil {
-			m.RouteChan = make(chan string, 256)
-			go func(ch chan<- string) {
+			m.RouteChan = make(chan utils.RouteResult, 1024)
+			m.RouteLog = []string{}
+			m.RouteRules = []utils.RouteRule{}
+			m.RouteEntries = []utils.RouteEntry{}
+			m.RouteFindings = []string{}
+			m.RouteLookup = []string{}
+			m.RouteKernel = []string{}
+			go func(ch chan<- utils.RouteResult) {
 				defer close(ch)
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-
-				// try "ip route show" first
-				cmd := exec.CommandContext(ctx, "ip", "route", "show")
-				stdout, err := cmd.StdoutPipe()
-				if err == nil {
-					if err := cmd.Start(); err == nil {
-						scanner := bufio.NewScanner(stdout)
-						for scanner.Scan() {
-							line := strings.TrimSpace(scanner.Text())
-							if line != "" {
-								select {
-								case ch <- line:
-								default:
-								}
-							}
-						}
-						_ = cmd.Wait()
-						return
-					}
-				}
 
-				// fallback to "route -n"
-				cmd = exec.CommandContext(ctx, "route", "-n")
-				stdout, err = cmd.StdoutPipe()
-				if err == nil {
-					if err := cmd.Start(); err == nil {
-						scanner := bufio.NewScanner(stdout)
-						for scanner.Scan() {
-							line := strings.TrimSpace(scanner.Text())
-							if line != "" {
-								select {
-								case ch <- line:
-								default:
-								}
-							}
-						}
-						_ = cmd.Wait()
-						return
+				// blocking: the table must arrive whole, the findings and the
+				// route lookup work on it
+				send := func(r utils.RouteResult) { ch <- r }
+
+				routes, err := readRoutes()
+				if err != nil {
+					send(utils.RouteResult{Msg: fmt.Sprintf("netlink route dump failed (%v), falling back to ip route / route -n", err)})
+					for _, line := range routeCommandOutput() {
+						send(utils.RouteResult{Msg: line})
 					}
+					return
+				}
+				rules, err := readRules()
+				if err != nil {
+					send(utils.RouteResult{Msg: fmt.Sprintf("could not read policy rules: %v", err)})
 				}
 
-				// if both fail, emit a helpful message
-				select {
-				case ch <- "could not run 'ip route' or 'route -n' (permission or binary missing)":
-				default:
+				names := routeTableNames()
+				for id, vrf := range readVRFTables() {
+					names[id] = "vrf " + vrf
+				}
+				for i := range rules {
+					rules[i].Table = tableName(names, rules[i].TableID)
+					send(utils.RouteResult{Rule: &rules[i]})
+				}
+				for i := range routes {
+					routes[i].Table = tableName(names, routes[i].TableID)
+					send(utils.RouteResult{Route: &routes[i]})
 				}
 			}(m.RouteChan)
 
@@ -77,19 +93,24 @@ func UpdateRouting(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 		if m.RouteChan != nil {
 			for {
 				select {
-				case line, ok := <-m.RouteChan:
+				case r, ok := <-m.RouteChan:
 					if !ok {
 						// finished
 						m.RouteChan = nil
 						m.Loaded = true
+						sortRules(m.RouteRules)
+						sortRoutes(m.RouteEntries)
+						m.RouteFindings = routeFindings(m.RouteRules, m.RouteEntries)
 						return m, nil
 					}
-					trim := strings.TrimSpace(line)
-					if trim == "" {
-						continue
+					switch {
+					case r.Rule != nil:
+						m.RouteRules = append(m.RouteRules, *r.Rule)
+					case r.Route != nil:
+						m.RouteEntries = append(m.RouteEntries, *r.Route)
+					case strings.TrimSpace(r.Msg) != "":
+						m.RouteLog = append(m.RouteLog, strings.TrimSpace(r.Msg))
 					}
-					m.RouteLog = append(m.RouteLog, trim)
-					return m, utils.Frame()
 				default:
 					return m, utils.Frame()
 				}
@@ -99,20 +120,412 @@ func UpdateRouting(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// routeCommandOutput runs "ip route show" (preferred) or "route -n" and
+// returns the non-empty lines.
+func routeCommandOutput() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, args := range [][]string{{"ip", "route", "show"}, {"route", "-n"}} {
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+		if err != nil {
+			continue
+		}
+		var lines []string
+		for _, l := range strings.Split(string(out), "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		return lines
+	}
+	return []string{"could not run 'ip route' or 'route -n' (permission or binary missing)"}
+}
+
+// routeTableNames reads the iproute2 table name database.
+func routeTableNames() map[int]string {
+	names := map[int]string{255: "local", 254: "main", 253: "default"}
+	var files []string
+	for _, dir := range []string{"/usr/share/iproute2", "/usr/lib/iproute2", "/etc/iproute2"} {
+		files = append(files, filepath.Join(dir, "rt_tables"))
+		extra, _ := filepath.Glob(filepath.Join(dir, "rt_tables.d", "*.conf"))
+		files = append(files, extra...)
+	}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			// "254	main", comments start with '#'
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			id, err := strconv.ParseUint(fields[0], 0, 32)
+			if err == nil && id != 0 {
+				names[int(id)] = fields[1]
+			}
+		}
+		f.Close()
+	}
+	return names
+}
+
+func tableName(names map[int]string, id int) string {
+	if n, ok := names[id]; ok {
+		return n
+	}
+	return strconv.Itoa(id)
+}
+
+// Names from linux/rtnetlink.h and /etc/iproute2/rt_protos.
+
+func routeProtocol(p uint8) string {
+	switch p {
+	case 0:
+		return "unspec"
+	case 1:
+		return "redirect"
+	case 2:
+		return "kernel"
+	case 3:
+		return "boot"
+	case 4:
+		return "static"
+	case 8:
+		return "gated"
+	case 9:
+		return "ra"
+	case 10:
+		return "mrt"
+	case 11:
+		return "zebra"
+	case 12:
+		return "bird"
+	case 13:
+		return "dnrouted"
+	case 14:
+		return "xorp"
+	case 15:
+		return "ntk"
+	case 16:
+		return "dhcp"
+	case 42:
+		return "babel"
+	case 186:
+		return "bgp"
+	case 187:
+		return "isis"
+	case 188:
+		return "ospf"
+	case 189:
+		return "rip"
+	case 192:
+		return "eigrp"
+	}
+	return strconv.Itoa(int(p))
+}
+
+func routeScope(s uint8) string {
+	switch s {
+	case 0:
+		return "global"
+	case 200:
+		return "site"
+	case 253:
+		return "link"
+	case 254:
+		return "host"
+	case 255:
+		return "nowhere"
+	}
+	return strconv.Itoa(int(s))
+}
+
+func routeType(t uint8) string {
+	switch t {
+	case 1:
+		return "unicast"
+	case 2:
+		return "local"
+	case 3:
+		return "broadcast"
+	case 4:
+		return "anycast"
+	case 5:
+		return "multicast"
+	case 6:
+		return "blackhole"
+	case 7:
+		return "unreachable"
+	case 8:
+		return "prohibit"
+	case 9:
+		return "throw"
+	case 10:
+		return "nat"
+	}
+	return strconv.Itoa(int(t))
+}
+
+func ruleAction(a uint8) string {
+	switch a {
+	case 1:
+		return "lookup"
+	case 2:
+		return "goto"
+	case 3:
+		return "nop"
+	case 6:
+		return "blackhole"
+	case 7:
+		return "unreachable"
+	case 8:
+		return "prohibit"
+	}
+	return strconv.Itoa(int(a))
+}
+
+// isRejectType reports whether a route or rule type drops matching packets.
+func isRejectType(t string) bool {
+	return t == "blackhole" || t == "unreachable" || t == "prohibit"
+}
+
+// sortRules orders rules by family, then priority, as "ip rule" lists them.
+func sortRules(rules []utils.RouteRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Family != rules[j].Family {
+			return rules[i].Family < rules[j].Family
+		}
+		return rules[i].Priority < rules[j].Priority
+	})
+}
+
+// sortRoutes groups routes by family and table (main first, then local, then
+// the rest by id), keeping kernel order within a table.
+func sortRoutes(routes []utils.RouteEntry) {
+	rank := func(id int) int {
+		switch id {
+		case 254:
+			return -2
+		case 255:
+			return -1
+		}
+		return id
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Family != routes[j].Family {
+			return routes[i].Family < routes[j].Family
+		}
+		return rank(routes[i].TableID) < rank(routes[j].TableID)
+	})
+}
+
+// routeFindings flags equal-metric duplicate default routes and routes or
+// rules that silently drop traffic.
+func routeFindings(rules []utils.RouteRule, routes []utils.RouteEntry) []string {
+	var out []string
+
+	defaults := map[string][]utils.RouteEntry{}
+	var keys []string
+	for _, r := range routes {
+		if r.Dst != "default" || r.Type != "unicast" {
+			continue
+		}
+		key := fmt.Sprintf("IPv%d table %s metric %d", r.Family, r.Table, r.Metric)
+		if _, ok := defaults[key]; !ok {
+			keys = append(keys, key)
+		}
+		defaults[key] = append(defaults[key], r)
+	}
+	for _, key := range keys {
+		if len(defaults[key]) < 2 {
+			continue
+		}
+		var hops []string
+		for _, r := range defaults[key] {
+			hops = append(hops, strings.TrimSpace("via "+r.Gateway+" dev "+r.Dev))
+		}
+		out = append(out, fmt.Sprintf("WARNING: %d default routes with equal metric (%s): %s; the kernel picks one arbitrarily", len(hops), key, strings.Join(hops, ", ")))
+	}
+
+	for _, r := range routes {
+		if isRejectType(r.Type) {
+			out = append(out, fmt.Sprintf("WARNING: %s route %s in table %s drops matching traffic", r.Type, r.Dst, r.Table))
+		}
+	}
+	for _, r := range rules {
+		if isRejectType(r.Action) {
+			out = append(out, fmt.Sprintf("WARNING: IPv%d rule %d is %s: %s", r.Family, r.Priority, r.Action, formatRule(r)))
+		}
+	}
+	return out
+}
+
+// formatRule renders a rule the way "ip rule" does.
+func formatRule(r utils.RouteRule) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d:\t", r.Priority)
+	if r.Invert {
+		b.WriteString("not ")
+	}
+	if r.Src != "" {
+		b.WriteString("from " + r.Src)
+	} else {
+		b.WriteString("from all")
+	}
+	if r.Dst != "" {
+		b.WriteString(" to " + r.Dst)
+	}
+	if r.TOS != 0 {
+		fmt.Fprintf(&b, " tos 0x%02x", r.TOS)
+	}
+	if r.FwMark != 0 || r.FwMask != 0 {
+		fmt.Fprintf(&b, " fwmark 0x%x", r.FwMark)
+		if r.FwMask != 0 && r.FwMask != 0xffffffff {
+			fmt.Fprintf(&b, "/0x%x", r.FwMask)
+		}
+	}
+	if r.IIf != "" {
+		b.WriteString(" iif " + r.IIf)
+	}
+	if r.OIf != "" {
+		b.WriteString(" oif " + r.OIf)
+	}
+	switch {
+	case r.L3mdev:
+		b.WriteString(" lookup [l3mdev-table]")
+	case r.Action == "lookup":
+		b.WriteString(" lookup " + r.Table)
+	case r.Action == "goto":
+		fmt.Fprintf(&b, " goto %d", r.Goto)
+	default:
+		b.WriteString(" " + r.Action)
+	}
+	if r.SuppressPrefixLen >= 0 {
+		fmt.Fprintf(&b, " suppress_prefixlength %d", r.SuppressPrefixLen)
+	}
+	return b.String()
+}
+
+// formatRoute renders a route the way "ip route" does.
+func formatRoute(r utils.RouteEntry) string {
+	var b strings.Builder
+	if r.Type != "unicast" {
+		b.WriteString(r.Type + " ")
+	}
+	b.WriteString(r.Dst)
+	if r.Gateway != "" {
+		b.WriteString(" via " + r.Gateway)
+	}
+	if r.Dev != "" {
+		b.WriteString(" dev " + r.Dev)
+	}
+	if r.TOS != 0 {
+		fmt.Fprintf(&b, " tos 0x%02x", r.TOS)
+	}
+	b.WriteString(" proto " + r.Proto)
+	if r.Scope != "global" {
+		b.WriteString(" scope " + r.Scope)
+	}
+	if r.Src != "" {
+		b.WriteString(" src " + r.Src)
+	}
+	if r.Metric != 0 {
+		fmt.Fprintf(&b, " metric %d", r.Metric)
+	}
+	for _, nh := range r.Nexthops {
+		b.WriteString("\n\tnexthop " + formatNexthop(nh))
+	}
+	return b.String()
+}
+
+// formatNexthop renders a next hop like ip route: "via X dev Y weight N".
+func formatNexthop(nh utils.RouteNexthop) string {
+	s := fmt.Sprintf("dev %s weight %d", nh.Dev, nh.Weight)
+	if nh.Gateway != "" {
+		s = "via " + nh.Gateway + " " + s
+	}
+	return s
+}
+
 func ChosenRoutingView(m utils.Model) string {
-	header := utils.KeywordStyle.Render("Routing tables:") + " ip route / route -n\n\n"
+	header := utils.KeywordStyle.Render("Routing tables:") + " policy rules and all tables via netlink\n\n"
+
+	var notes string
+	if len(m.RouteLog) > 0 {
+		notes = utils.SubtleStyle.Render(strings.Join(m.RouteLog, "\n")) + "\n\n"
+	}
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
 
 	if !m.Loaded {
-		body := utils.SubtleStyle.Render("querying routing table...")
-		if len(m.RouteLog) > 0 {
-			body = strings.Join(m.RouteLog, "\n")
-		}
-		return header + body + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+		body := utils.SubtleStyle.Render(fmt.Sprintf("querying routing tables... %d rules, %d routes", len(m.RouteRules), len(m.RouteEntries)))
+		return header + notes + body + "\n\n" + utils.SubtleStyle.Render("Running...")
 	}
 
-	// finished: show collected routing entries or message
-	if len(m.RouteLog) == 0 {
+	if len(m.RouteRules) == 0 && len(m.RouteEntries) == 0 {
+		if notes != "" {
+			return header + notes + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+		}
 		return header + utils.SubtleStyle.Render("No routing entries collected or command failed.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
 	}
-	return header + utils.SubtleStyle.Render(strings.Join(m.RouteLog, "\n")) + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+
+	var sections []string
+	if len(m.RouteLookup) > 0 {
+		sections = append(sections, routeLookupView(m))
+	}
+	if len(m.RouteFindings) > 0 {
+		sections = append(sections, utils.RenderFindings(m.RouteFindings))
+	}
+
+	for _, family := range []int{4, 6} {
+		var lines []string
+		for _, r := range m.RouteRules {
+			if r.Family != family {
+				continue
+			}
+			line := formatRule(r)
+			if isRejectType(r.Action) {
+				lines = append(lines, utils.WarnStyle.Render(line))
+			} else {
+				lines = append(lines, utils.SubtleStyle.Render(line))
+			}
+		}
+		if len(lines) > 0 {
+			sections = append(sections, utils.KeywordStyle.Render(fmt.Sprintf("IPv%d rules", family))+"\n"+strings.Join(lines, "\n"))
+		}
+
+		table := ""
+		lines = nil
+		for _, r := range m.RouteEntries {
+			if r.Family != family {
+				continue
+			}
+			if r.Table != table {
+				if len(lines) > 0 {
+					sections = append(sections, strings.Join(lines, "\n"))
+				}
+				table = r.Table
+				lines = []string{utils.KeywordStyle.Render(fmt.Sprintf("IPv%d table %s", family, table))}
+			}
+			line := formatRoute(r)
+			if isRejectType(r.Type) {
+				lines = append(lines, utils.WarnStyle.Render(line))
+			} else {
+				lines = append(lines, utils.SubtleStyle.Render(line))
+			}
+		}
+		if len(lines) > 0 {
+			sections = append(sections, strings.Join(lines, "\n"))
+		}
+	}
+
+	footer := utils.SubtleStyle.Render("l: which route will a packet take?") + "\n" +
+		utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	return header + notes + strings.Join(sections, "\n\n") + "\n\n" + footer
 }
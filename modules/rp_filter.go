@@ -0,0 +1,443 @@
+package modules
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Reverse-path filtering check: reads the per-interface rp_filter,
+// accept_local and src_valid_mark sysctls and replays the kernel's source
+// validation (a reverse route lookup towards the packet's source from the
+// receiving interface's address, done with iif lo and no mark unless
+// src_valid_mark is set) for a sample source in every connected prefix plus
+// an off-link address, unmarked and with every mark policy rules match on,
+// arriving on every interface. The
+// combinations the kernel would drop as martians are reported together with
+// the martian counters from /proc/net/stat and the kernel log.
+
+// rpOffLinkSample stands in for "any address on the internet" (TEST-NET-3).
+const rpOffLinkSample = "203.0.113.1"
+
+type rpConf struct {
+	rpFilter     int // effective: max(all, iface)
+	acceptLocal  bool
+	srcValidMark bool
+	logMartians  bool
+}
+
+func UpdateRPFilter(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	switch msg.(type) {
+	case utils.FrameMsg:
+		if !m.Loaded && m.RPFilterChan == nil {
+			m.RPFilterChan = make(chan string, 1024)
+			m.RPFilterLog = []string{}
+			go func(ch chan<- string) {
+				defer close(ch)
+				send := func(s string) {
+					select {
+					case ch <- s:
+					default:
+					}
+				}
+				checkRPFilter(send)
+			}(m.RPFilterChan)
+			return m, utils.Frame()
+		}
+
+		if m.RPFilterChan != nil {
+			for {
+				select {
+				case line, ok := <-m.RPFilterChan:
+					if !ok {
+						m.RPFilterChan = nil
+						m.Loaded = true
+						return m, nil
+					}
+					m.RPFilterLog = append(m.RPFilterLog, line)
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+func readSysctlInt(path string) (int, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n, err == nil
+}
+
+// readRPConf combines the "all" and per-interface values the way the kernel
+// does: rp_filter takes the maximum, the boolean knobs are ORed.
+func readRPConf(iface string) rpConf {
+	get := func(dev, key string) int {
+		n, _ := readSysctlInt(filepath.Join("/proc/sys/net/ipv4/conf", dev, key))
+		return n
+	}
+	c := rpConf{
+		rpFilter:     max(get("all", "rp_filter"), get(iface, "rp_filter")),
+		acceptLocal:  get("all", "accept_local")+get(iface, "accept_local") > 0,
+		srcValidMark: get("all", "src_valid_mark")+get(iface, "src_valid_mark") > 0,
+		logMartians:  get("all", "log_martians")+get(iface, "log_martians") > 0,
+	}
+	return c
+}
+
+func rpFilterMode(n int) string {
+	switch n {
+	case 0:
+		return "off"
+	case 1:
+		return "strict"
+	case 2:
+		return "loose"
+	}
+	return strconv.Itoa(n)
+}
+
+// rpSample is a source address packets could arrive from, and their mark.
+type rpSample struct {
+	ip    net.IP
+	label string
+	mark  uint32
+}
+
+func checkRPFilter(send func(string)) {
+	if _, ok := readSysctlInt("/proc/sys/net/ipv4/conf/all/rp_filter"); !ok {
+		send("could not read /proc/sys/net/ipv4/conf: reverse-path filtering is a Linux feature")
+		return
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		send(fmt.Sprintf("could not list interfaces: %v", err))
+		return
+	}
+
+	// per-interface sysctls and IPv4 prefixes
+	confs := map[string]rpConf{}
+	var names []string
+	var samples []rpSample
+	local := map[string]bool{}
+	ifAddr := map[string]net.IP{} // first IPv4 address, the lookup's source
+	ifNets := map[string][]*net.IPNet{}
+	send("Interface sysctls (effective values, all + interface):")
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagLoopback != 0 || ifc.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		has4 := false
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil {
+				continue
+			}
+			if !has4 {
+				ifAddr[ifc.Name] = ipn.IP.To4()
+			}
+			has4 = true
+			local[ipn.IP.String()] = true
+			ifNets[ifc.Name] = append(ifNets[ifc.Name], ipn)
+			if host := samplePrefixHost(ipn); host != nil {
+				samples = append(samples, rpSample{ip: host, label: fmt.Sprintf("%s (%s)", host, ipn.String())})
+			}
+		}
+		if !has4 {
+			continue
+		}
+		c := readRPConf(ifc.Name)
+		confs[ifc.Name] = c
+		names = append(names, ifc.Name)
+		send(fmt.Sprintf("  %-12s rp_filter=%s accept_local=%d src_valid_mark=%d log_martians=%d",
+			ifc.Name, rpFilterMode(c.rpFilter), b2i(c.acceptLocal), b2i(c.srcValidMark), b2i(c.logMartians)))
+	}
+	if len(names) == 0 {
+		send("No IPv4 interfaces are up.")
+		return
+	}
+	samples = append(samples, rpSample{ip: net.ParseIP(rpOffLinkSample), label: rpOffLinkSample + " (off-link)"})
+
+	routes, err := readRoutes()
+	if err != nil {
+		send(fmt.Sprintf("could not read routing tables: %v", err))
+		return
+	}
+	rules, err := readRules()
+	if err != nil {
+		send(fmt.Sprintf("could not read policy rules, assuming the defaults: %v", err))
+	}
+	tables := routeTableNames()
+	for i := range routes {
+		routes[i].Table = tableName(tables, routes[i].TableID)
+	}
+	for i := range rules {
+		rules[i].Table = tableName(tables, rules[i].TableID)
+	}
+	sortRules(rules)
+
+	// marked traffic (VPNs, policy routing) takes other routes back when
+	// src_valid_mark lets the lookup see the mark
+	marks := map[uint32]bool{}
+	for _, r := range rules {
+		if r.Family == 4 && r.FwMark != 0 && !marks[r.FwMark] {
+			marks[r.FwMark] = true
+			samples = append(samples, rpSample{net.ParseIP(rpOffLinkSample), fmt.Sprintf("%s mark 0x%x (off-link)", rpOffLinkSample, r.FwMark), r.FwMark})
+		}
+	}
+
+	// replay the reverse lookup for every source on every interface
+	send("")
+	send("Predicted source validation (source → arriving on interface):")
+	drops := 0
+	for _, s := range samples {
+		if local[s.ip.String()] {
+			continue
+		}
+		for _, name := range names {
+			c := confs[name]
+			if c.rpFilter == 0 {
+				continue
+			}
+			// the kernel looks up the route back from the address the
+			// packet was sent to, so "from" policy rules apply
+			f := routeFlow{dst: s.ip, src: ifAddr[name], family: 4}
+			if c.srcValidMark {
+				f.mark = s.mark
+			}
+			_, res := resolveRoute(rules, routes, f)
+			reason := ""
+			switch {
+			case res.reject != "":
+				reason = "no usable route back to the source (" + res.reject + ")"
+			case c.rpFilter == 1 && !slices.Contains(res.devs, name):
+				reason = fmt.Sprintf("strict mode and the reply route leaves via %s", strings.Join(res.devs, ", "))
+			}
+			if reason == "" {
+				continue
+			}
+			drops++
+			send(fmt.Sprintf("DROP  %-34s on %-10s %s", s.label, name, reason))
+		}
+	}
+	if drops == 0 {
+		send("  no source/interface combination is dropped by rp_filter")
+	} else {
+		send(fmt.Sprintf("WARNING: %d source/interface combinations would be dropped as martians; traffic arriving there (asymmetric routing) is silently discarded", drops))
+	}
+
+	// a local source only arrives where another interface of this host
+	// sits in the same prefix: ports cabled to each other, veth pairs
+	var noLocal []string
+	for _, name := range names {
+		if confs[name].acceptLocal {
+			continue
+		}
+	peers:
+		for _, other := range names {
+			if other == name {
+				continue
+			}
+			for _, n := range ifNets[name] {
+				for _, o := range ifNets[other] {
+					if n.Contains(o.IP) {
+						noLocal = append(noLocal, fmt.Sprintf("%s (%s of %s is in %s)", name, o.IP, other, n))
+						break peers
+					}
+				}
+			}
+		}
+	}
+	if len(noLocal) > 0 {
+		send(fmt.Sprintf("NOTE: accept_local is off on %s: packets this host sends to itself across the link arrive with a local source and are dropped there (loopback cabling, veth pairs)", strings.Join(noLocal, ", ")))
+	}
+
+	// rules keyed on marks are invisible to the reverse lookup without src_valid_mark
+	for _, r := range rules {
+		if r.Family != 4 || (r.FwMark == 0 && r.FwMask == 0) {
+			continue
+		}
+		for _, name := range names {
+			if c := confs[name]; c.rpFilter > 0 && !c.srcValidMark {
+				send(fmt.Sprintf("WARNING: rule %d matches fwmark 0x%x but src_valid_mark is off on %s: the rp_filter lookup ignores the mark and may pick a different route", r.Priority, r.FwMark, name))
+			}
+		}
+		break
+	}
+	for _, r := range rules {
+		if r.Family == 4 && r.IIf != "" && r.IIf != "lo" {
+			send(fmt.Sprintf("NOTE: rule %d only applies to traffic arriving on %s; the rp_filter lookup runs with iif lo and does not see it", r.Priority, r.IIf))
+		}
+	}
+	send("NOTE: IPv6 has no rp_filter sysctl; reverse-path checks there come from netfilter (fib saddr / rpfilter match)")
+
+	// counters
+	send("")
+	send("Martian counters:")
+	if dst, src, ok := martianStats(); ok {
+		send(fmt.Sprintf("  /proc/net/stat/rt_cache: in_martian_src=%d in_martian_dst=%d", src, dst))
+	} else {
+		send("  /proc/net/stat/rt_cache not available")
+	}
+	if n, ok := netstatCounter("TcpExt", "IPReversePathFilter"); ok {
+		line := fmt.Sprintf("  TcpExt IPReversePathFilter=%d", n)
+		if n > 0 {
+			line = "WARNING: " + strings.TrimSpace(line) + " packets already dropped by reverse-path filtering since boot"
+		}
+		send(line)
+	}
+	for _, l := range martianLog() {
+		send(l)
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// samplePrefixHost picks a host address in the prefix other than our own.
+func samplePrefixHost(ipn *net.IPNet) net.IP {
+	ones, bits := ipn.Mask.Size()
+	if bits-ones < 2 {
+		return nil
+	}
+	base := ipn.IP.Mask(ipn.Mask).To4()
+	for i := 1; i <= 2; i++ {
+		host := make(net.IP, 4)
+		copy(host, base)
+		host[3] += byte(i)
+		if !host.Equal(ipn.IP) {
+			return host
+		}
+	}
+	return nil
+}
+
+// martianStats sums the per-CPU in_martian_dst/in_martian_src columns.
+func martianStats() (dst, src uint64, ok bool) {
+	f, err := os.Open("/proc/net/stat/rt_cache")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return 0, 0, false
+	}
+	iDst, iSrc := -1, -1
+	for i, h := range strings.Fields(sc.Text()) {
+		switch h {
+		case "in_martian_dst":
+			iDst = i
+		case "in_martian_src":
+			iSrc = i
+		}
+	}
+	if iDst < 0 || iSrc < 0 {
+		return 0, 0, false
+	}
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) <= max(iDst, iSrc) {
+			continue
+		}
+		d, _ := strconv.ParseUint(fields[iDst], 16, 64)
+		s, _ := strconv.ParseUint(fields[iSrc], 16, 64)
+		dst += d
+		src += s
+	}
+	return dst, src, true
+}
+
+// netstatCounter reads one counter from the header/value line pairs of
+// /proc/net/netstat.
+func netstatCounter(group, name string) (uint64, bool) {
+	b, err := os.ReadFile("/proc/net/netstat")
+	if err != nil {
+		return 0, false
+	}
+	lines := strings.Split(string(b), "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		keys, vals := strings.Fields(lines[i]), strings.Fields(lines[i+1])
+		if len(keys) == 0 || keys[0] != group+":" || len(vals) != len(keys) {
+			continue
+		}
+		for j, k := range keys {
+			if k == name {
+				n, err := strconv.ParseUint(vals[j], 10, 64)
+				return n, err == nil
+			}
+		}
+	}
+	return 0, false
+}
+
+// martianLog counts "martian source" lines in the kernel log (logged only
+// when log_martians is set) and returns the most recent ones.
+func martianLog() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "dmesg").Output()
+	if err != nil {
+		return []string{"  kernel log not readable (dmesg needs root on most systems)"}
+	}
+	var hits []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if strings.Contains(l, "martian source") || strings.Contains(l, "martian destination") {
+			hits = append(hits, strings.TrimSpace(l))
+		}
+	}
+	if len(hits) == 0 {
+		return []string{"  kernel log: no martian messages"}
+	}
+	res := []string{fmt.Sprintf("WARNING: kernel log has %d martian messages, latest:", len(hits))}
+	if len(hits) > 5 {
+		hits = hits[len(hits)-5:]
+	}
+	for _, h := range hits {
+		res = append(res, "  "+h)
+	}
+	return res
+}
+
+func ChosenRPFilterView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("Reverse-path filtering:") + " rp_filter sysctls, predicted martian drops\n\n"
+
+	var lines []string
+	for _, l := range m.RPFilterLog {
+		if strings.HasPrefix(l, "WARNING") || strings.HasPrefix(l, "DROP") {
+			lines = append(lines, utils.WarnStyle.Render(l))
+		} else {
+			lines = append(lines, utils.SubtleStyle.Render(l))
+		}
+	}
+	body := strings.Join(lines, "\n")
+
+	if !m.Loaded {
+		if body == "" {
+			body = utils.SubtleStyle.Render("reading sysctls and routing tables...")
+		}
+		return header + body + "\n\n" + utils.SubtleStyle.Render("Running...")
+	}
+	return header + body + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+}
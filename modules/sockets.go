@@ -0,0 +1,283 @@
+package modules
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Socket tables from /proc. /proc/net/{tcp,udp,raw}[6] list the sockets of
+// one network namespace with their inode; the owning process is found by
+// matching that inode against the "socket:[N]" links in /proc/<pid>/fd.
+// Sockets of other namespaces (containers) are read through /proc/<pid>/net
+// of one process per namespace.
+
+var procNetFiles = []string{"tcp", "tcp6", "udp", "udp6", "raw", "raw6"}
+
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED", "02": "SYN-SENT", "03": "SYN-RECV", "04": "FIN-WAIT-1",
+	"05": "FIN-WAIT-2", "06": "TIME-WAIT", "07": "CLOSE", "08": "CLOSE-WAIT",
+	"09": "LAST-ACK", "0A": "LISTEN", "0B": "CLOSING", "0C": "NEW-SYN-RECV",
+}
+
+// readSockets parses the socket tables of the namespace pid lives in, or of
+// our own namespace when pid is 0.
+func readSockets(pid int) ([]utils.Socket, error) {
+	dir := "/proc/net"
+	if pid != 0 {
+		dir = fmt.Sprintf("/proc/%d/net", pid)
+	}
+	var out []utils.Socket
+	var lastErr error
+	read := 0
+	for _, name := range procNetFiles {
+		data, err := os.ReadFile(dir + "/" + name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		read++
+		out = append(out, parseProcNet(string(data), name)...)
+	}
+	if read == 0 {
+		return nil, lastErr
+	}
+	return out, nil
+}
+
+// parseProcNet parses one /proc/net/{tcp,udp,raw}[6] table:
+// "sl local rem st tx_queue:rx_queue tr:when retrnsmt uid timeout inode ...".
+func parseProcNet(data, proto string) []utils.Socket {
+	var out []utils.Socket
+	lines := strings.Split(data, "\n")
+	for _, l := range lines[min(1, len(lines)):] {
+		f := strings.Fields(l)
+		if len(f) < 10 {
+			continue
+		}
+		local, lport, ok1 := parseProcAddr(f[1])
+		remote, rport, ok2 := parseProcAddr(f[2])
+		if !ok1 || !ok2 {
+			continue
+		}
+		s := utils.Socket{Proto: proto, Local: local.String(), LocalPort: lport, Remote: remote.String(), RemotePort: rport}
+		switch {
+		case strings.HasPrefix(proto, "tcp"):
+			s.State = tcpStates[f[3]]
+		case f[3] == "01":
+			s.State = "ESTABLISHED"
+		default:
+			s.State = "UNCONN"
+		}
+		tx, rx, _ := strings.Cut(f[4], ":")
+		s.TxQueue, _ = strconv.ParseUint(tx, 16, 64)
+		s.RxQueue, _ = strconv.ParseUint(rx, 16, 64)
+		s.UID, _ = strconv.Atoi(f[7])
+		s.Inode, _ = strconv.ParseUint(f[9], 10, 64)
+		out = append(out, s)
+	}
+	return out
+}
+
+// parseProcAddr decodes "0100007F:0016". The address is printed as 32-bit
+// words in host byte order, the port in hex.
+func parseProcAddr(s string) (net.IP, int, bool) {
+	a, p, ok := strings.Cut(s, ":")
+	if !ok || (len(a) != 8 && len(a) != 32) {
+		return nil, 0, false
+	}
+	ip := make(net.IP, len(a)/2)
+	for i := 0; i < len(a); i += 8 {
+		w, err := strconv.ParseUint(a[i:i+8], 16, 32)
+		if err != nil {
+			return nil, 0, false
+		}
+		binary.NativeEndian.PutUint32(ip[i/2:], uint32(w))
+	}
+	port, err := strconv.ParseUint(p, 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return ip, int(port), true
+}
+
+// sockOwner is the process holding a socket.
+type sockOwner struct {
+	pid       int
+	comm      string
+	unit      string
+	container string
+}
+
+// socketOwners maps socket inodes to their owning process. It also returns
+// one pid per network namespace other than ours, and the number of processes
+// whose file descriptors could not be read (not running as root).
+func socketOwners() (owners map[uint64]sockOwner, namespaces map[string]int, denied int) {
+	owners = map[uint64]sockOwner{}
+	namespaces = map[string]int{}
+	self, _ := os.Readlink("/proc/self/ns/net")
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return owners, namespaces, 0
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid)); err == nil && ns != self {
+			if p, ok := namespaces[ns]; !ok || pid < p {
+				namespaces[ns] = pid
+			}
+		}
+		fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+		if err != nil {
+			if os.IsPermission(err) {
+				denied++
+			}
+			continue
+		}
+		var info *sockOwner
+		for _, fd := range fds {
+			link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if o, ok := owners[inode]; ok && o.pid < pid {
+				// shared with a child (prefork servers): keep the parent
+				continue
+			}
+			if info == nil {
+				info = processInfo(pid)
+			}
+			owners[inode] = *info
+		}
+	}
+	return owners, namespaces, denied
+}
+
+func processInfo(pid int) *sockOwner {
+	o := &sockOwner{pid: pid}
+	if b, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		o.comm = strings.TrimSpace(string(b))
+	}
+	if b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid)); err == nil {
+		o.unit, o.container = cgroupUnit(string(b))
+	}
+	return o
+}
+
+var (
+	containerIDRe = regexp.MustCompile(`(?:(docker|libpod|crio|cri-containerd)[-/])?([0-9a-f]{64})`)
+	lxcRe         = regexp.MustCompile(`(?:lxc\.payload\.|/lxc/)([^/]+)`)
+	runtimeNames  = map[string]string{"docker": "docker", "libpod": "podman", "crio": "cri-o", "cri-containerd": "containerd"}
+)
+
+// cgroupUnit extracts the systemd unit and the container from the contents
+// of /proc/<pid>/cgroup, preferring the unified (v2) or name=systemd line.
+func cgroupUnit(data string) (unit, container string) {
+	path := ""
+	for _, l := range strings.Split(data, "\n") {
+		parts := strings.SplitN(l, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" || parts[1] == "name=systemd" || path == "" {
+			path = parts[2]
+		}
+	}
+
+	if m := lxcRe.FindStringSubmatch(path); m != nil {
+		container = "lxc " + m[1]
+	} else if m := containerIDRe.FindStringSubmatch(path); m != nil {
+		runtime := runtimeNames[m[1]]
+		if runtime == "" {
+			runtime = "container"
+		}
+		if strings.Contains(path, "kubepods") {
+			runtime = "k8s " + runtime
+		}
+		container = runtime + " " + m[2][:12]
+	}
+
+	elems := strings.Split(path, "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		e := elems[i]
+		if container != "" && containerIDRe.MatchString(e) {
+			continue
+		}
+		if strings.HasSuffix(e, ".service") || strings.HasSuffix(e, ".scope") || strings.HasSuffix(e, ".socket") {
+			return e, container
+		}
+	}
+	return "", container
+}
+
+// userNames caches uid lookups.
+var (
+	userNames   = map[int]string{}
+	userNamesMu sync.Mutex
+)
+
+func userName(uid int) string {
+	userNamesMu.Lock()
+	defer userNamesMu.Unlock()
+	if n, ok := userNames[uid]; ok {
+		return n
+	}
+	n := strconv.Itoa(uid)
+	if u, err := user.LookupId(n); err == nil {
+		n = u.Username
+	}
+	userNames[uid] = n
+	return n
+}
+
+// allSockets reads the sockets of our namespace and of every other namespace
+// a process lives in, with their owners filled in.
+func allSockets(note func(string)) ([]utils.Socket, error) {
+	owners, namespaces, denied := socketOwners()
+	socks, err := readSockets(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range sortedKeys(namespaces) {
+		pid := namespaces[ns]
+		other, err := readSockets(pid)
+		if err != nil {
+			continue
+		}
+		label := ns
+		if o := processInfo(pid); o.container != "" {
+			label = o.container
+		}
+		for i := range other {
+			other[i].Netns = label
+		}
+		socks = append(socks, other...)
+	}
+	if denied > 0 {
+		note(fmt.Sprintf("the open files of %d processes could not be read: run as root to see the owner of every socket", denied))
+	}
+
+	for i := range socks {
+		s := &socks[i]
+		s.User = userName(s.UID)
+		if o, ok := owners[s.Inode]; ok && s.Inode != 0 {
+			s.PID, s.Command, s.Unit, s.Container = o.pid, o.comm, o.unit, o.container
+		}
+	}
+	return socks, nil
+}
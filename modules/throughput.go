@@ -0,0 +1,479 @@
+package modules
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Throughput test against a bwserver (bw_server.go) on another of our
+// hosts. The user enters the server, optionally with its port, followed by
+// "tcp [STREAMS]" (the default, m.ThroughputStreams parallel streams) or
+// "udp RATE" with a target rate such as 50M. The test runs the download
+// (server to us), then the upload, for m.ThroughputSecs each; every second
+// of either direction is shown as it completes, and UDP tests add the
+// datagrams lost and the jitter.
+
+// bwUDPRate is the UDP target rate when none is given, in bits per second.
+const bwUDPRate = 10_000_000
+
+func UpdateThroughput(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg.(type) {
+	case utils.FrameMsg:
+		if !m.Loaded && m.ThroughputChan == nil {
+			if !m.InputSubmitted {
+				return utils.PromptInput(m, "bwserver to test against: HOST[:PORT] [tcp [STREAMS] | udp [RATE]] (run 'network-check bwserver' on the other host):", m.ThroughputTarget), nil
+			}
+			m.InputSubmitted = false
+			m.ThroughputLog = []string{}
+			m.ThroughputIntervals = []utils.BwInterval{}
+			addr, req, err := parseThroughputSpec(m.Input, m.ThroughputStreams)
+			if err != nil {
+				m.ThroughputLog = append(m.ThroughputLog, err.Error())
+				m.Loaded = true
+				return m, nil
+			}
+			m.ThroughputTarget = strings.TrimSpace(m.Input)
+			req.Secs = max(m.ThroughputSecs, 1)
+			m.ThroughputChan = make(chan utils.BwResult, 256)
+			go runThroughput(m.ThroughputChan, addr, req)
+			return m, utils.Frame()
+		}
+
+		if m.ThroughputChan != nil {
+			for {
+				select {
+				case r, ok := <-m.ThroughputChan:
+					if !ok {
+						m.ThroughputChan = nil
+						m.Loaded = true
+						return m, nil
+					}
+					if r.Msg != "" {
+						m.ThroughputLog = append(m.ThroughputLog, r.Msg)
+						continue
+					}
+					m.ThroughputIntervals = append(m.ThroughputIntervals, *r.Interval)
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseThroughputSpec parses "HOST[:PORT] [tcp [STREAMS] | udp [RATE]]".
+func parseThroughputSpec(input string, streams int) (string, bwRequest, error) {
+	f := strings.Fields(input)
+	if len(f) == 0 || len(f) > 3 {
+		return "", bwRequest{}, fmt.Errorf("expected HOST[:PORT] [tcp [STREAMS] | udp [RATE]], got %q", input)
+	}
+	addr := f[0]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(bwPort))
+	}
+	req := bwRequest{Proto: "tcp", Streams: max(streams, 1)}
+	if len(f) > 1 {
+		req.Proto = strings.ToLower(f[1])
+	}
+	switch req.Proto {
+	case "tcp":
+		if len(f) > 2 {
+			n, err := strconv.Atoi(f[2])
+			if err != nil || n < 1 || n > bwMaxStreams {
+				return "", bwRequest{}, fmt.Errorf("invalid stream count %q (1 to %d)", f[2], bwMaxStreams)
+			}
+			req.Streams = n
+		}
+	case "udp":
+		req.Streams, req.Rate, req.Size = 0, bwUDPRate, bwUDPDefault
+		if len(f) > 2 {
+			rate, err := parseBitRate(f[2])
+			if err != nil {
+				return "", bwRequest{}, err
+			}
+			req.Rate = rate
+		}
+	default:
+		return "", bwRequest{}, fmt.Errorf("unknown protocol %q (tcp or udp)", f[1])
+	}
+	return addr, req, nil
+}
+
+// parseBitRate parses a rate in bits per second with an optional k, M or G
+// suffix ("500k", "50M", "1.5G").
+func parseBitRate(s string) (uint64, error) {
+	mult := 1.0
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(s), "bit/s"), "bps")
+	switch {
+	case strings.HasSuffix(num, "k"):
+		mult, num = 1e3, strings.TrimSuffix(num, "k")
+	case strings.HasSuffix(num, "m"):
+		mult, num = 1e6, strings.TrimSuffix(num, "m")
+	case strings.HasSuffix(num, "g"):
+		mult, num = 1e9, strings.TrimSuffix(num, "g")
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 || v*mult > bwMaxRate {
+		return 0, fmt.Errorf("invalid rate %q (e.g. 500k, 50M or 1G bit/s, at most 10G)", s)
+	}
+	return uint64(v * mult), nil
+}
+
+// runThroughput runs the download, then the upload.
+func runThroughput(ch chan<- utils.BwResult, addr string, req bwRequest) {
+	defer close(ch)
+	what := fmt.Sprintf("%d TCP streams", req.Streams)
+	if req.Proto == "udp" {
+		what = fmt.Sprintf("UDP at %sbit/s in %d-byte datagrams", formatBitRate(req.Rate/8), req.Size)
+	}
+	ch <- utils.BwResult{Msg: fmt.Sprintf("testing against %s with %s, %d s per direction", addr, what, req.Secs)}
+	for _, dir := range []string{"download", "upload"} {
+		req.Dir = dir
+		if err := runBwDirection(ch, addr, req); err != nil {
+			ch <- utils.BwResult{Msg: fmt.Sprintf("%s: %v", dir, err)}
+		}
+	}
+}
+
+// bwMessage is any line the server sends on the control connection.
+type bwMessage struct {
+	bwReport
+	Error string `json:"error,omitempty"`
+}
+
+// runBwDirection runs one direction of the test.
+func runBwDirection(ch chan<- utils.BwResult, addr string, req bwRequest) error {
+	ctrl, err := net.DialTimeout("tcp", addr, bwJoinWait)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+	dec := json.NewDecoder(ctrl)
+	if err := json.NewEncoder(ctrl).Encode(bwHello{Request: &req}); err != nil {
+		return err
+	}
+	_ = ctrl.SetReadDeadline(time.Now().Add(bwJoinWait))
+	var rep bwReply
+	if err := dec.Decode(&rep); err != nil {
+		return fmt.Errorf("no answer from a bwserver at %s: %w", addr, err)
+	}
+	if rep.Error != "" {
+		return errors.New("server: " + rep.Error)
+	}
+	// the server keeps the control connection open for the whole test
+	_ = ctrl.SetReadDeadline(time.Now().Add(time.Duration(req.Secs)*time.Second + 2*bwJoinWait))
+
+	emit := func(r bwReport, secs float64) {
+		ch <- utils.BwResult{Interval: &utils.BwInterval{
+			Proto: req.Proto, Dir: req.Dir, Sec: r.Sec, Bytes: r.Bytes, Secs: secs,
+			Packets: r.Packets, Lost: r.Lost, Jitter: time.Duration(r.Jitter) * time.Microsecond,
+		}}
+	}
+
+	if req.Dir == "upload" {
+		stop := make(chan struct{})
+		defer close(stop)
+		if req.Proto == "tcp" {
+			if err := bwSendTCP(addr, rep.Token, req, stop); err != nil {
+				return err
+			}
+		} else {
+			uc, err := net.Dial("udp", addr)
+			if err != nil {
+				return err
+			}
+			defer uc.Close()
+			go func() {
+				_ = sendUDPPaced(func(b []byte) error {
+					select {
+					case <-stop:
+						return net.ErrClosed
+					default:
+					}
+					_, err := uc.Write(b)
+					return err
+				}, rep.Token, req.Rate, req.Size, time.Duration(req.Secs)*time.Second)
+			}()
+		}
+		// the server counts what arrives and reports every second
+		for {
+			var msg bwMessage
+			if err := dec.Decode(&msg); err != nil {
+				return fmt.Errorf("control connection: %w", err)
+			}
+			if msg.Error != "" {
+				return errors.New("server: " + msg.Error)
+			}
+			if msg.Done {
+				emit(msg.bwReport, float64(req.Secs))
+				return nil
+			}
+			emit(msg.bwReport, 1)
+		}
+	}
+
+	// downloads end when the server closes the control connection
+	ended := make(chan error, 1)
+	go func() {
+		var msg bwMessage
+		for {
+			if err := dec.Decode(&msg); err != nil {
+				ended <- nil
+				return
+			}
+			if msg.Error != "" {
+				ended <- errors.New("server: " + msg.Error)
+				return
+			}
+		}
+	}()
+	var snapshot func() bwReport
+	if req.Proto == "tcp" {
+		var got atomic.Uint64
+		if err := bwReceiveTCP(addr, rep.Token, req, &got); err != nil {
+			return err
+		}
+		snapshot = func() bwReport { return bwReport{Bytes: got.Load()} }
+	} else {
+		uc, err := net.Dial("udp", addr)
+		if err != nil {
+			return err
+		}
+		defer uc.Close()
+		var stats bwUDPStats
+		hello := make([]byte, bwUDPHeader)
+		binary.BigEndian.PutUint32(hello, rep.Token)
+		for range 3 {
+			_, _ = uc.Write(hello)
+		}
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, err := uc.Read(buf)
+				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					// ICMP errors (port unreachable) surface here
+					continue
+				}
+				if n >= bwUDPHeader && binary.BigEndian.Uint32(buf) == rep.Token {
+					stats.add(buf[:n], time.Now())
+				}
+			}
+		}()
+		snapshot = stats.report
+	}
+	return sampleEverySecond(emit, snapshot, ended)
+}
+
+// bwSendTCP opens the upload streams and writes to them until the server
+// closes them or stop is closed.
+func bwSendTCP(addr string, token uint32, req bwRequest, stop <-chan struct{}) error {
+	conns, err := bwJoinTCP(addr, token, req.Streams)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Duration(req.Secs)*time.Second + bwJoinWait)
+	for _, c := range conns {
+		go func(c net.Conn) {
+			defer c.Close()
+			_ = c.SetWriteDeadline(deadline)
+			go func() {
+				<-stop
+				c.Close()
+			}()
+			buf := make([]byte, bwBlockSize)
+			for {
+				if _, err := c.Write(buf); err != nil {
+					return
+				}
+			}
+		}(c)
+	}
+	return nil
+}
+
+// bwReceiveTCP opens the download streams and counts what arrives on them
+// into got.
+func bwReceiveTCP(addr string, token uint32, req bwRequest, got *atomic.Uint64) error {
+	conns, err := bwJoinTCP(addr, token, req.Streams)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Duration(req.Secs)*time.Second + bwJoinWait)
+	for _, c := range conns {
+		go func(c net.Conn) {
+			defer c.Close()
+			_ = c.SetReadDeadline(deadline)
+			buf := make([]byte, bwBlockSize)
+			for {
+				n, err := c.Read(buf)
+				got.Add(uint64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(c)
+	}
+	return nil
+}
+
+// bwJoinTCP opens n data streams of the session token.
+func bwJoinTCP(addr string, token uint32, n int) ([]net.Conn, error) {
+	hello, _ := json.Marshal(bwHello{Join: token})
+	hello = append(hello, '\n')
+	var conns []net.Conn
+	for range n {
+		c, err := net.DialTimeout("tcp", addr, bwJoinWait)
+		if err == nil {
+			_, err = c.Write(hello)
+		}
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("opening stream %d: %w", len(conns)+1, err)
+		}
+		conns = append(conns, c)
+	}
+	return conns, nil
+}
+
+// sampleEverySecond emits the change of the cumulative counters every
+// second until ended yields, then the last partial second and the totals.
+func sampleEverySecond(emit func(bwReport, float64), snapshot func() bwReport, ended <-chan error) error {
+	start := time.Now()
+	last := start
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	var prev bwReport
+	diff := func(cur bwReport, sec int) bwReport {
+		return bwReport{Sec: sec, Bytes: cur.Bytes - prev.Bytes, Packets: cur.Packets - prev.Packets, Lost: cur.Lost - prev.Lost, Jitter: cur.Jitter}
+	}
+	for sec := 1; ; sec++ {
+		select {
+		case <-tick.C:
+			cur := snapshot()
+			emit(diff(cur, sec), time.Since(last).Seconds())
+			prev, last = cur, time.Now()
+		case err := <-ended:
+			// count what is still in flight, over the time the server sent
+			end := time.Now()
+			time.Sleep(200 * time.Millisecond)
+			cur := snapshot()
+			if r := diff(cur, sec); r.Bytes > 0 && end.Sub(last) > 100*time.Millisecond {
+				emit(r, end.Sub(last).Seconds())
+			}
+			emit(bwReport{Bytes: cur.Bytes, Packets: cur.Packets, Lost: cur.Lost, Jitter: cur.Jitter}, end.Sub(start).Seconds())
+			return err
+		}
+	}
+}
+
+// bwIntervalRate is the throughput of an interval in bytes per second.
+func bwIntervalRate(iv utils.BwInterval) uint64 {
+	if iv.Secs <= 0 {
+		return 0
+	}
+	return uint64(float64(iv.Bytes) / iv.Secs)
+}
+
+func bwLoss(iv utils.BwInterval) float64 {
+	if iv.Packets+iv.Lost == 0 {
+		return 0
+	}
+	return 100 * float64(iv.Lost) / float64(iv.Packets+iv.Lost)
+}
+
+// throughputFindings compares the totals of both directions.
+func throughputFindings(ivs []utils.BwInterval) []string {
+	var out []string
+	totals := map[string]utils.BwInterval{}
+	for _, iv := range ivs {
+		if iv.Sec == 0 {
+			totals[iv.Dir] = iv
+		}
+	}
+	for _, dir := range []string{"download", "upload"} {
+		t, ok := totals[dir]
+		if !ok || t.Proto != "udp" {
+			continue
+		}
+		if l := bwLoss(t); l >= 1 {
+			out = append(out, fmt.Sprintf("WARNING: %s lost %.1f%% of the datagrams: the path cannot carry the target rate (try a lower one to find its limit)", dir, l))
+		}
+	}
+	d, dok := totals["download"]
+	u, uok := totals["upload"]
+	if dok && uok && d.Proto == "tcp" {
+		if dr, ur := bwIntervalRate(d), bwIntervalRate(u); dr > 0 && ur > 0 && (dr > 3*ur || ur > 3*dr) {
+			out = append(out, fmt.Sprintf("NOTE: download %sbit/s and upload %sbit/s differ widely: an asymmetric link (ADSL, cable, shaping) or a duplex mismatch", formatBitRate(dr), formatBitRate(ur)))
+		}
+	}
+	return out
+}
+
+func ChosenThroughputView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("Throughput test:") + " built-in bwserver, TCP streams or UDP at a target rate\n\n"
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
+
+	var b strings.Builder
+	if len(m.ThroughputLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.ThroughputLog, "\n")) + "\n\n")
+	}
+
+	if len(m.ThroughputIntervals) > 0 {
+		udp := m.ThroughputIntervals[0].Proto == "udp"
+		head := fmt.Sprintf("%-9s %-6s %12s %10s", "Dir", "Sec", "Bitrate", "Transfer")
+		if udp {
+			head += fmt.Sprintf(" %9s %7s %6s %9s", "Datagrams", "Lost", "Loss%", "Jitter")
+		}
+		rows := []string{head}
+		for _, iv := range m.ThroughputIntervals {
+			sec := strconv.Itoa(iv.Sec)
+			if iv.Sec == 0 {
+				sec = fmt.Sprintf("%.0fs", iv.Secs)
+			}
+			row := fmt.Sprintf("%-9s %-6s %12s %10s", iv.Dir, sec, formatBitRate(bwIntervalRate(iv))+"bit/s", formatByteCount(iv.Bytes))
+			if udp {
+				row += fmt.Sprintf(" %9d %7d %6.1f %9s", iv.Packets, iv.Lost, bwLoss(iv), formatRTT(iv.Jitter))
+			}
+			if iv.Sec == 0 {
+				rows = append(rows, utils.KeywordStyle.Render(row))
+			} else {
+				rows = append(rows, utils.SubtleStyle.Render(row))
+			}
+		}
+		b.WriteString(strings.Join(rows, "\n") + "\n\n")
+
+		if findings := utils.RenderFindings(throughputFindings(m.ThroughputIntervals)); findings != "" {
+			b.WriteString(findings + "\n\n")
+		}
+	} else if m.ThroughputChan != nil {
+		b.WriteString(utils.SubtleStyle.Render("connecting...") + "\n\n")
+	}
+
+	if m.ThroughputChan != nil {
+		return header + b.String() + utils.SubtleStyle.Render("Running... press esc to quit.")
+	}
+	return header + b.String() + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+}
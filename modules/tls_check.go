@@ -0,0 +1,531 @@
+package modules
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"network-check/utils"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// TLS endpoint inspection: the user enters HOST[:PORT] (443 by default),
+// optionally with ca=FILE,... for extra PEM bundles to trust, sni=NAME
+// when the name to ask for differs from the host, and issuer=NAME for the
+// CA the certificate should come from. One handshake, offering h2 and
+// http/1.1, shows the protocol version, cipher suite, ALPN and OCSP
+// stapling; the chain the server sent is listed with expiry countdowns,
+// matched against the name and verified against the system roots, and
+// against the system roots plus the bundles when some are given. A chain
+// issued by a known TLS inspection product, or by another CA than the one
+// expected, reveals a corporate interception proxy.
+
+const tlsCheckTimeout = 10 * time.Second
+
+// tlsExpirySoon is when an expiry becomes a warning.
+const tlsExpirySoon = 14 * 24 * time.Hour
+
+// tlsInterceptors are names found in the issuers of certificates that TLS
+// inspection products (proxies, firewalls, antivirus) forge on the fly.
+var tlsInterceptors = []string{
+	"zscaler", "netskope", "fortinet", "fortigate", "palo alto", "blue coat", "bluecoat",
+	"forcepoint", "websense", "sophos", "kaspersky", "eset", "avast", "avg technologies",
+	"bitdefender", "mcafee", "check point", "checkpoint", "barracuda", "cisco umbrella",
+	"opendns", "mitmproxy", "portswigger", "charles proxy", "do_not_trust", "fiddler",
+	"untangle", "smoothwall", "lightspeed", "securly", "contentkeeper", "iboss",
+	"menlo security", "symantec web", "sonicwall", "watchguard", "cloudflare gateway",
+}
+
+// tlsCheckSpec is what the user asked for.
+type tlsCheckSpec struct {
+	addr       string
+	serverName string
+	caFiles    []string
+	wantIssuer string
+}
+
+func UpdateTLSCheck(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
+
+	switch msg.(type) {
+	case utils.FrameMsg:
+		if !m.Loaded && m.TLSCheckChan == nil {
+			if !m.InputSubmitted {
+				return utils.PromptInput(m, "TLS endpoint: HOST[:PORT] [ca=FILE,...] [sni=NAME] [issuer=NAME]:", m.TLSCheckTarget), nil
+			}
+			m.InputSubmitted = false
+			m.TLSCheckLog = []string{}
+			m.TLSCheck = nil
+			spec, err := parseTLSCheckSpec(m.Input)
+			if err != nil {
+				m.TLSCheckLog = append(m.TLSCheckLog, err.Error())
+				m.Loaded = true
+				return m, nil
+			}
+			m.TLSCheckTarget = strings.TrimSpace(m.Input)
+			m.TLSCheckChan = make(chan utils.TLSCheckResult, 16)
+			go runTLSCheck(m.TLSCheckChan, spec)
+			return m, utils.Frame()
+		}
+
+		if m.TLSCheckChan != nil {
+			for {
+				select {
+				case r, ok := <-m.TLSCheckChan:
+					if !ok {
+						m.TLSCheckChan = nil
+						m.Loaded = true
+						return m, nil
+					}
+					if r.Msg != "" {
+						m.TLSCheckLog = append(m.TLSCheckLog, r.Msg)
+						continue
+					}
+					m.TLSCheck = r.Inspection
+				default:
+					return m, utils.Frame()
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseTLSCheckSpec parses "HOST[:PORT] [ca=FILE,...] [sni=NAME] [issuer=NAME]".
+// The issuer name may contain spaces: it runs to the next option.
+func parseTLSCheckSpec(input string) (tlsCheckSpec, error) {
+	var spec tlsCheckSpec
+	var issuer []string
+	inIssuer := false
+	for _, f := range strings.Fields(input) {
+		k, v, ok := strings.Cut(f, "=")
+		switch {
+		case ok && k == "ca":
+			inIssuer = false
+			for _, file := range strings.Split(v, ",") {
+				if file != "" {
+					spec.caFiles = append(spec.caFiles, file)
+				}
+			}
+		case ok && k == "sni":
+			inIssuer = false
+			spec.serverName = v
+		case ok && k == "issuer":
+			inIssuer = true
+			issuer = append(issuer, v)
+		case inIssuer:
+			issuer = append(issuer, f)
+		case spec.addr == "":
+			spec.addr = f
+		default:
+			return tlsCheckSpec{}, fmt.Errorf("unexpected %q: expected HOST[:PORT] [ca=FILE,...] [sni=NAME] [issuer=NAME]", f)
+		}
+	}
+	if spec.addr == "" {
+		return tlsCheckSpec{}, errors.New("no host given")
+	}
+	spec.addr = strings.TrimPrefix(strings.TrimPrefix(spec.addr, "https://"), "tls://")
+	spec.addr = strings.TrimSuffix(spec.addr, "/")
+	host, port, err := net.SplitHostPort(spec.addr)
+	if err != nil {
+		host, port = strings.Trim(spec.addr, "[]"), "443"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return tlsCheckSpec{}, fmt.Errorf("invalid port %q", port)
+	}
+	spec.addr = net.JoinHostPort(host, port)
+	if spec.serverName == "" {
+		spec.serverName = host
+	}
+	spec.wantIssuer = strings.Join(issuer, " ")
+	return spec, nil
+}
+
+// runTLSCheck does the handshake and the verifications.
+func runTLSCheck(ch chan<- utils.TLSCheckResult, spec tlsCheckSpec) {
+	defer close(ch)
+
+	var extra []*x509.Certificate
+	for _, file := range spec.caFiles {
+		certs, err := readPEMCerts(file)
+		if err != nil {
+			ch <- utils.TLSCheckResult{Msg: fmt.Sprintf("CA bundle %s: %v", file, err)}
+			continue
+		}
+		ch <- utils.TLSCheckResult{Msg: fmt.Sprintf("CA bundle %s: %d certificates", file, len(certs))}
+		extra = append(extra, certs...)
+	}
+
+	ch <- utils.TLSCheckResult{Msg: fmt.Sprintf("connecting to %s (SNI %s)", spec.addr, spec.serverName)}
+	cfg := &tls.Config{
+		// the chain is verified below, against each set of roots
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+		// offer what legacy servers need too, so they are inspected and
+		// reported rather than failing the handshake
+		MinVersion:   tls.VersionTLS10,
+		CipherSuites: tlsAllCipherSuites(),
+	}
+	if net.ParseIP(spec.serverName) == nil {
+		cfg.ServerName = spec.serverName
+	}
+	start := time.Now()
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: tlsCheckTimeout}, "tcp", spec.addr, cfg)
+	if err != nil {
+		ch <- utils.TLSCheckResult{Msg: "handshake failed: " + err.Error()}
+		return
+	}
+	took := time.Since(start)
+	st := c.ConnectionState()
+	c.Close()
+
+	in := &utils.TLSInspection{
+		Addr:        c.RemoteAddr().String(),
+		ServerName:  spec.serverName,
+		Version:     tls.VersionName(st.Version),
+		Cipher:      tls.CipherSuiteName(st.CipherSuite),
+		ALPN:        st.NegotiatedProtocol,
+		Handshake:   took,
+		OCSPStapled: len(st.OCSPResponse),
+		WantIssuer:  spec.wantIssuer,
+	}
+	for i, cert := range st.PeerCertificates {
+		in.Chain = append(in.Chain, describeCert(cert))
+		// the raw names, as the displayed ones fall back differently
+		if i > 0 && in.Misordered == 0 && !bytes.Equal(st.PeerCertificates[i-1].RawIssuer, cert.RawSubject) {
+			in.Misordered = i
+		}
+	}
+	if len(st.PeerCertificates) == 0 {
+		ch <- utils.TLSCheckResult{Msg: "the server sent no certificate"}
+		ch <- utils.TLSCheckResult{Inspection: in}
+		return
+	}
+
+	leaf := st.PeerCertificates[0]
+	if err := leaf.VerifyHostname(spec.serverName); err != nil {
+		in.NameErr = err.Error()
+	}
+	in.Validations = append(in.Validations, verifyTLSChain(st.PeerCertificates, "system", nil))
+	if len(extra) > 0 {
+		in.Validations = append(in.Validations, verifyTLSChain(st.PeerCertificates, "system + "+strings.Join(spec.caFiles, ", "), extra))
+	}
+	ch <- utils.TLSCheckResult{Inspection: in}
+}
+
+// tlsAllCipherSuites lists every suite Go implements, the insecure ones
+// included.
+func tlsAllCipherSuites() []uint16 {
+	var ids []uint16
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids = append(ids, cs.ID)
+	}
+	return ids
+}
+
+// readPEMCerts reads every certificate of a PEM bundle.
+func readPEMCerts(file string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for rest := b; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, c)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificate in it")
+	}
+	return certs, nil
+}
+
+// verifyTLSChain verifies the chain the server sent against the system
+// roots plus extra, the extra roots alone when the system has none.
+func verifyTLSChain(chain []*x509.Certificate, label string, extra []*x509.Certificate) utils.TLSValidation {
+	v := utils.TLSValidation{Roots: label}
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	for _, c := range extra {
+		roots.AddCert(c)
+	}
+	inter := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		inter.AddCert(c)
+	}
+	// the name is checked on its own, a mismatch should not hide the rest
+	chains, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: inter})
+	if err != nil {
+		v.Err = err.Error()
+		var ua x509.UnknownAuthorityError
+		if errors.As(err, &ua) && len(chain) == 1 && !chain[0].IsCA {
+			v.Err += " (the server sends no intermediate certificate)"
+		}
+		return v
+	}
+	for _, c := range chains[0] {
+		v.Path = append(v.Path, certName(c))
+	}
+	return v
+}
+
+func describeCert(c *x509.Certificate) utils.TLSCert {
+	d := utils.TLSCert{
+		Subject:   certName(c),
+		Issuer:    c.Issuer.CommonName,
+		SANs:      slices.Clone(c.DNSNames),
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		SigAlg:    c.SignatureAlgorithm.String(),
+		IsCA:      c.IsCA,
+	}
+	if len(c.Issuer.Organization) > 0 {
+		d.IssuerOrg = c.Issuer.Organization[0]
+	}
+	if d.Issuer == "" {
+		d.Issuer = d.IssuerOrg
+	}
+	if d.Issuer == "" {
+		d.Issuer = c.Issuer.String()
+	}
+	for _, ip := range c.IPAddresses {
+		d.SANs = append(d.SANs, ip.String())
+	}
+	d.SelfSigned = c.Subject.String() == c.Issuer.String() && c.CheckSignatureFrom(c) == nil
+	switch k := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		d.Key = fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		d.Key = "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		d.Key = "Ed25519"
+	default:
+		d.Key = c.PublicKeyAlgorithm.String()
+	}
+	return d
+}
+
+// certName is the common name of a certificate, or its first SAN, or its
+// whole subject.
+func certName(c *x509.Certificate) string {
+	switch {
+	case c.Subject.CommonName != "":
+		return c.Subject.CommonName
+	case len(c.DNSNames) > 0:
+		return c.DNSNames[0]
+	}
+	return c.Subject.String()
+}
+
+// issuerName is the issuer's organization and common name, as in
+// "Let's Encrypt R11".
+func issuerName(c utils.TLSCert) string {
+	if c.IssuerOrg == "" || strings.Contains(c.Issuer, c.IssuerOrg) {
+		return c.Issuer
+	}
+	return c.IssuerOrg + " " + c.Issuer
+}
+
+// formatExpiry counts the time left until t, or since it passed.
+func formatExpiry(t, now time.Time) string {
+	d := t.Sub(now)
+	days := int(d.Hours() / 24)
+	switch {
+	case d < 0:
+		return fmt.Sprintf("EXPIRED %d days ago", int(-d.Hours()/24))
+	case days == 0:
+		return fmt.Sprintf("expires in %.0f hours", d.Hours())
+	}
+	return fmt.Sprintf("expires in %d days", days)
+}
+
+// tlsInterceptor returns the inspection product named in the issuers of
+// the chain, if any.
+func tlsInterceptor(chain []utils.TLSCert) string {
+	for _, c := range chain {
+		issuer := strings.ToLower(c.Issuer + " " + c.IssuerOrg)
+		for _, name := range tlsInterceptors {
+			if strings.Contains(issuer, name) {
+				return issuerName(c)
+			}
+		}
+	}
+	return ""
+}
+
+// tlsFindings flags what is wrong or risky about the endpoint.
+func tlsFindings(in *utils.TLSInspection, now time.Time) []string {
+	var out []string
+	if in.NameErr != "" {
+		out = append(out, fmt.Sprintf("WARNING: the certificate does not cover %s: %s", in.ServerName, in.NameErr))
+	}
+	for i, v := range in.Validations {
+		switch {
+		case v.Err != "":
+			out = append(out, fmt.Sprintf("WARNING: the chain does not validate against the %s roots: %s", v.Roots, v.Err))
+		case i > 0 && in.Validations[0].Err != "":
+			out = append(out, fmt.Sprintf("NOTE: the chain only validates with the bundles given (root %s): a private CA", v.Path[len(v.Path)-1]))
+		}
+	}
+
+	if who := tlsInterceptor(in.Chain); who != "" {
+		out = append(out, fmt.Sprintf("WARNING: issued by %s, a TLS inspection product: a corporate proxy or security software decrypts this connection", who))
+	}
+	if in.WantIssuer != "" && len(in.Chain) > 0 {
+		want := strings.ToLower(in.WantIssuer)
+		if !slices.ContainsFunc(in.Chain, func(c utils.TLSCert) bool {
+			return strings.Contains(strings.ToLower(c.Issuer+" "+c.IssuerOrg), want)
+		}) {
+			out = append(out, fmt.Sprintf("WARNING: issued by %s, not %s: the connection is intercepted (TLS inspection proxy) or the site changed CA", issuerName(in.Chain[0]), in.WantIssuer))
+		}
+	}
+
+	for i, c := range in.Chain {
+		switch left := c.NotAfter.Sub(now); {
+		case left < 0:
+			out = append(out, fmt.Sprintf("WARNING: certificate %d (%s) expired on %s", i, c.Subject, c.NotAfter.Format("2006-01-02")))
+		case left < tlsExpirySoon:
+			out = append(out, fmt.Sprintf("WARNING: certificate %d (%s) %s", i, c.Subject, formatExpiry(c.NotAfter, now)))
+		}
+		if now.Before(c.NotBefore) {
+			out = append(out, fmt.Sprintf("WARNING: certificate %d (%s) is not valid before %s: check this host's clock", i, c.Subject, c.NotBefore.Format("2006-01-02 15:04")))
+		}
+		if strings.Contains(c.SigAlg, "SHA1") || strings.Contains(c.SigAlg, "MD5") {
+			if !c.SelfSigned {
+				out = append(out, fmt.Sprintf("WARNING: certificate %d (%s) is signed with %s", i, c.Subject, c.SigAlg))
+			}
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(c.Key, "RSA ")); err == nil && n < 2048 {
+			out = append(out, fmt.Sprintf("WARNING: certificate %d (%s) has a %d-bit RSA key", i, c.Subject, n))
+		}
+	}
+	if len(in.Chain) == 1 && in.Chain[0].SelfSigned {
+		out = append(out, "WARNING: the certificate is self-signed")
+	}
+	if i := in.Misordered; i > 0 {
+		out = append(out, fmt.Sprintf("NOTE: certificate %d (%s) did not issue certificate %d: the server sends the chain out of order or with extra certificates", i, in.Chain[i].Subject, i-1))
+	}
+
+	switch in.Version {
+	case "TLS 1.0", "TLS 1.1", "SSLv3":
+		out = append(out, fmt.Sprintf("WARNING: %s is deprecated, the server should offer TLS 1.2 or 1.3", in.Version))
+	}
+	if slices.ContainsFunc(tls.InsecureCipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == in.Cipher }) {
+		out = append(out, fmt.Sprintf("WARNING: the cipher suite %s is insecure", in.Cipher))
+	}
+	if in.OCSPStapled == 0 {
+		out = append(out, "NOTE: no OCSP response stapled: clients that check revocation ask the CA themselves, which slows the first connection")
+	}
+	if in.ALPN == "" {
+		out = append(out, "NOTE: no ALPN protocol negotiated: the server does not advertise HTTP/2 (or is not an HTTP server)")
+	}
+	return out
+}
+
+func ChosenTLSCheckView(m utils.Model) string {
+	header := utils.KeywordStyle.Render("TLS inspection:") + " protocol, cipher, certificate chain and trust\n\n"
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
+
+	var b strings.Builder
+	if len(m.TLSCheckLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.TLSCheckLog, "\n")) + "\n\n")
+	}
+
+	if in := m.TLSCheck; in != nil {
+		now := time.Now()
+		alpn := in.ALPN
+		if alpn == "" {
+			alpn = "none"
+		}
+		ocsp := "none"
+		if in.OCSPStapled > 0 {
+			ocsp = fmt.Sprintf("stapled (%d bytes)", in.OCSPStapled)
+		}
+		lines := []string{
+			fmt.Sprintf("%-12s %s (SNI %s)", "Endpoint", in.Addr, in.ServerName),
+			fmt.Sprintf("%-12s %s, %s", "Protocol", in.Version, in.Cipher),
+			fmt.Sprintf("%-12s %s", "ALPN", alpn),
+			fmt.Sprintf("%-12s %s", "OCSP", ocsp),
+			fmt.Sprintf("%-12s %s", "Handshake", formatRTT(in.Handshake)),
+		}
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(lines, "\n")) + "\n\n")
+
+		b.WriteString(utils.KeywordStyle.Render("Chain sent by the server") + "\n")
+		for i, c := range in.Chain {
+			kind := "leaf"
+			switch {
+			case c.SelfSigned:
+				kind = "root"
+			case c.IsCA:
+				kind = "CA"
+			}
+			row := fmt.Sprintf("%d %-4s %-40s issuer %-36s %-10s %-16s %s (%s)", i, kind, clipText(c.Subject, 40), clipText(c.Issuer, 36),
+				c.Key, c.SigAlg, c.NotAfter.Format("2006-01-02"), formatExpiry(c.NotAfter, now))
+			if c.NotAfter.Sub(now) < tlsExpirySoon {
+				b.WriteString(utils.WarnStyle.Render(row) + "\n")
+			} else {
+				b.WriteString(utils.SubtleStyle.Render(row) + "\n")
+			}
+		}
+		if len(in.Chain) > 0 && len(in.Chain[0].SANs) > 0 {
+			sans := in.Chain[0].SANs
+			more := ""
+			if len(sans) > 8 {
+				sans, more = sans[:8], fmt.Sprintf(" (+%d more)", len(in.Chain[0].SANs)-8)
+			}
+			match := "matches " + in.ServerName
+			if in.NameErr != "" {
+				match = "does NOT match " + in.ServerName
+			}
+			b.WriteString(utils.SubtleStyle.Render(fmt.Sprintf("  SANs: %s%s, %s", strings.Join(sans, ", "), more, match)) + "\n")
+		}
+		b.WriteString("\n")
+
+		for _, v := range in.Validations {
+			if v.Err != "" {
+				b.WriteString(utils.WarnStyle.Render(fmt.Sprintf("Against %s roots: does not validate", v.Roots)) + "\n")
+				continue
+			}
+			b.WriteString(utils.SubtleStyle.Render(fmt.Sprintf("Against %s roots: valid, %s", v.Roots, strings.Join(v.Path, " ← "))) + "\n")
+		}
+		b.WriteString("\n")
+
+		if findings := utils.RenderFindings(tlsFindings(in, now)); findings != "" {
+			b.WriteString(findings + "\n\n")
+		}
+	} else if m.TLSCheckChan != nil {
+		b.WriteString(utils.SubtleStyle.Render("connecting...") + "\n\n")
+	}
+
+	if m.TLSCheckChan != nil {
+		return header + b.String() + utils.SubtleStyle.Render("Running... press esc to quit.")
+	}
+	return header + b.String() + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+}
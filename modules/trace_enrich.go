@@ -0,0 +1,366 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"network-check/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hop enrichment for the traceroute: every responder gets its reverse DNS
+// name and, from an offline IP-to-ASN database, the AS that announces it.
+// Nothing is looked up online; the database is a file the user downloads
+// once, plain or gzipped: the iptoasn.com TSV ("first\tlast\tASN\tCC\tname"),
+// a CAIDA pfx2as file ("addr\tlen\tASN") or "CIDR ASN [name]" lines. The
+// file named by $NETWORK_CHECK_ASN_DB is used, else the first of asnFiles
+// that can be read. Ranges may overlap, as the prefixes of a routing table
+// do; the table is flattened when loaded so the most specific range wins.
+// Addresses outside the public internet (RFC 1918, carrier-grade NAT,
+// link-local, ULA) are tagged instead.
+
+// asnEnv names the database file explicitly.
+const asnEnv = "NETWORK_CHECK_ASN_DB"
+
+// asnFiles are the places searched for the database, in order.
+var asnFiles = []string{
+	"ip2asn-combined.tsv.gz",
+	"ip2asn-combined.tsv",
+	"~/.local/share/network-check/ip2asn-combined.tsv.gz",
+	"~/.local/share/network-check/ip2asn-combined.tsv",
+	"~/.local/share/network-check/ip2asn-v4.tsv.gz",
+	"~/.local/share/network-check/ip2asn-v4.tsv",
+	"/usr/share/network-check/ip2asn-combined.tsv.gz",
+	"/usr/share/network-check/ip2asn-combined.tsv",
+	"/usr/share/network-check/ip2asn-v4.tsv.gz",
+	"/usr/share/network-check/ip2asn-v4.tsv",
+}
+
+// specialRanges tags addresses that no AS announces.
+var specialRanges = []struct {
+	cidr string
+	tag  string
+}{
+	{"10.0.0.0/8", "private"},
+	{"172.16.0.0/12", "private"},
+	{"192.168.0.0/16", "private"},
+	{"100.64.0.0/10", "CGNAT"},
+	{"127.0.0.0/8", "loopback"},
+	{"169.254.0.0/16", "link-local"},
+	{"fc00::/7", "ULA"},
+	{"fe80::/10", "link-local"},
+	{"::1/128", "loopback"},
+}
+
+// asnRange is one row of the database, with both ends as 16-byte addresses.
+type asnRange struct {
+	first, last net.IP
+	asn         int
+	org         string
+}
+
+var (
+	asnOnce   sync.Once
+	asnTable  []asnRange // sorted by first address, without overlaps
+	asnSource string     // file the table was read from, "" when none
+	asnErr    error      // why the file named by asnEnv could not be used
+)
+
+func loadASN() {
+	if path := os.Getenv(asnEnv); path != "" {
+		table, err := readASNFile(path)
+		if err == nil && len(table) == 0 {
+			err = fmt.Errorf("no ranges in %s", path)
+		}
+		if err != nil {
+			asnErr = err
+			return
+		}
+		asnTable, asnSource = flattenASN(table), path
+		return
+	}
+	home, _ := os.UserHomeDir()
+	for _, path := range asnFiles {
+		if strings.HasPrefix(path, "~/") {
+			if home == "" {
+				continue
+			}
+			path = filepath.Join(home, path[2:])
+		}
+		table, err := readASNFile(path)
+		if err != nil || len(table) == 0 {
+			continue
+		}
+		asnTable, asnSource = flattenASN(table), path
+		return
+	}
+}
+
+// flattenASN turns possibly overlapping ranges into sorted disjoint ones in
+// which every address keeps the AS of the narrowest range containing it.
+// Ranges are walked by first address, wider ones first, with a stack of the
+// ranges that enclose the current one.
+func flattenASN(table []asnRange) []asnRange {
+	sort.Slice(table, func(i, j int) bool {
+		a, b := table[i], table[j]
+		if c := bytes.Compare(a.first, b.first); c != 0 {
+			return c < 0
+		}
+		if c := bytes.Compare(a.last, b.last); c != 0 {
+			return c > 0
+		}
+		return a.asn < b.asn
+	})
+	var out []asnRange
+	var stack []asnRange
+	var next net.IP = make(net.IP, 16) // first address not yet covered, nil past the end
+	emit := func(r asnRange, to net.IP) {
+		if next == nil || bytes.Compare(next, to) > 0 {
+			return
+		}
+		out = append(out, asnRange{first: next, last: to, asn: r.asn, org: r.org})
+		next = ipAfter(to)
+	}
+	for _, r := range table {
+		for len(stack) > 0 && bytes.Compare(stack[len(stack)-1].last, r.first) < 0 {
+			emit(stack[len(stack)-1], stack[len(stack)-1].last)
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 && next != nil && bytes.Compare(next, r.first) < 0 {
+			emit(stack[len(stack)-1], ipBefore(r.first))
+		}
+		if next != nil && bytes.Compare(next, r.first) < 0 {
+			next = slices.Clone(r.first)
+		}
+		stack = append(stack, r)
+	}
+	for len(stack) > 0 {
+		emit(stack[len(stack)-1], stack[len(stack)-1].last)
+		stack = stack[:len(stack)-1]
+	}
+	return out
+}
+
+// ipAfter returns the address after ip, nil after the last one.
+func ipAfter(ip net.IP) net.IP {
+	out := slices.Clone(ip)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			return out
+		}
+	}
+	return nil
+}
+
+// ipBefore returns the address before ip, which must not be the first one.
+func ipBefore(ip net.IP) net.IP {
+	out := slices.Clone(ip)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]--
+		if out[i] != 0xff {
+			return out
+		}
+	}
+	return out
+}
+
+func readASNFile(path string) ([]asnRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var table []asnRange
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if row, ok := parseASNLine(sc.Text()); ok {
+			table = append(table, row)
+		}
+	}
+	return table, sc.Err()
+}
+
+// parseASNLine accepts the iptoasn ("1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET"),
+// pfx2as ("1.0.0.0\t24\t13335") and CIDR ("1.0.0.0/24 13335 Cloudflare")
+// formats. Unrouted rows (AS 0) are skipped.
+func parseASNLine(line string) (asnRange, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return asnRange{}, false
+	}
+	if f := strings.Split(line, "\t"); len(f) >= 3 && !strings.Contains(f[0], "/") {
+		if _, err := strconv.Atoi(f[1]); err == nil {
+			// pfx2as: the prefix length in its own column
+			return parseASNLine(f[0] + "/" + f[1] + " " + f[2])
+		}
+		first, last := net.ParseIP(f[0]), net.ParseIP(f[1])
+		asn, err := parseASNumber(f[2])
+		if first == nil || last == nil || err != nil || asn == 0 {
+			return asnRange{}, false
+		}
+		org := ""
+		if len(f) >= 5 {
+			org = strings.TrimSpace(f[4])
+		}
+		return asnRange{first: first.To16(), last: last.To16(), asn: asn, org: org}, true
+	}
+
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return asnRange{}, false
+	}
+	_, n, err := net.ParseCIDR(f[0])
+	asn, aerr := parseASNumber(f[1])
+	if err != nil || aerr != nil || asn == 0 {
+		return asnRange{}, false
+	}
+	first, last := n.IP.To16(), make(net.IP, 16)
+	mask := n.Mask
+	if len(mask) == 4 {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range last {
+		last[i] = first[i] | ^mask[i]
+	}
+	return asnRange{first: first, last: last, asn: asn, org: strings.Join(f[2:], " ")}, true
+}
+
+// parseASNumber parses "13335" or "AS13335". Of a multi-origin prefix
+// ("13335_209242") or an AS set ("13335,209242") the first AS is taken.
+func parseASNumber(s string) (int, error) {
+	if i := strings.IndexAny(s, "_,"); i >= 0 {
+		s = s[:i]
+	}
+	return strconv.Atoi(strings.TrimPrefix(s, "AS"))
+}
+
+// lookupASN returns the AS announcing ip, or 0 when the database has no
+// range for it (or there is no database).
+func lookupASN(ip net.IP) (int, string) {
+	asnOnce.Do(loadASN)
+	ip = ip.To16()
+	i := sort.Search(len(asnTable), func(i int) bool { return bytes.Compare(asnTable[i].first, ip) > 0 })
+	if i == 0 || ip == nil {
+		return 0, ""
+	}
+	if r := asnTable[i-1]; bytes.Compare(ip, r.last) <= 0 {
+		return r.asn, r.org
+	}
+	return 0, ""
+}
+
+// asnStatus says where AS numbers come from, or how to get them.
+func asnStatus() string {
+	asnOnce.Do(loadASN)
+	if asnErr != nil {
+		return fmt.Sprintf("ASN database from $%s: %v", asnEnv, asnErr)
+	}
+	if asnSource == "" {
+		return "no offline ASN database found: save ip2asn-combined.tsv(.gz) from iptoasn.com in ~/.local/share/network-check/, or name a database file in $" + asnEnv + ", to see the AS of every hop"
+	}
+	return fmt.Sprintf("AS numbers from %s (%d ranges)", asnSource, len(asnTable))
+}
+
+// addressRange returns the tag of addresses outside the public internet.
+func addressRange(ip net.IP) string {
+	for _, r := range specialRanges {
+		if _, n, err := net.ParseCIDR(r.cidr); err == nil && n.Contains(ip) {
+			return r.tag
+		}
+	}
+	return ""
+}
+
+// traceHopInfo looks up everything shown next to a responder's address.
+func traceHopInfo(ip net.IP, timeout time.Duration) utils.TraceHopInfo {
+	info := utils.TraceHopInfo{Addr: ip.String(), Range: addressRange(ip)}
+	if info.Range == "" {
+		info.ASN, info.ASOrg = lookupASN(ip)
+	}
+	info.Name = reverseName(info.Addr, timeout)
+	return info
+}
+
+// hopASN is the AS of the first responder of a hop with a known AS.
+func hopASN(h utils.TraceHop, infos map[string]utils.TraceHopInfo) (int, string) {
+	for _, a := range h.Addrs {
+		if in, ok := infos[a]; ok && in.ASN != 0 {
+			return in.ASN, in.ASOrg
+		}
+	}
+	return 0, ""
+}
+
+// hopRange is the range tag of the hop's first responder.
+func hopRange(h utils.TraceHop, infos map[string]utils.TraceHopInfo) string {
+	if len(h.Addrs) == 0 {
+		return ""
+	}
+	return infos[h.Addrs[0]].Range
+}
+
+// asBoundaries returns the TTLs at which the path enters a different AS
+// than the last hop with a known one; hops without an AS are skipped.
+func asBoundaries(hops []utils.TraceHop, infos map[string]utils.TraceHopInfo) map[int]bool {
+	out := map[int]bool{}
+	prev := 0
+	for _, h := range hops {
+		asn, _ := hopASN(h, infos)
+		if asn == 0 {
+			continue
+		}
+		if prev != 0 && asn != prev {
+			out[h.TTL] = true
+		}
+		prev = asn
+	}
+	return out
+}
+
+// enrichFindings notes carrier-grade NAT on the path and lists the ASes it
+// crosses.
+func enrichFindings(hops []utils.TraceHop, infos map[string]utils.TraceHopInfo) []string {
+	var out []string
+	for _, h := range hops {
+		if hopRange(h, infos) == "CGNAT" {
+			out = append(out, fmt.Sprintf("NOTE: hop %d (%s) is in 100.64.0.0/10: the ISP puts you behind carrier-grade NAT, inbound connections and port forwarding cannot reach you", h.TTL, hopHost(h)))
+			break
+		}
+	}
+	var path []string
+	prev := 0
+	for _, h := range hops {
+		if asn, org := hopASN(h, infos); asn != 0 && asn != prev {
+			name := fmt.Sprintf("AS%d", asn)
+			if org != "" {
+				name += " " + org
+			}
+			path = append(path, name)
+			prev = asn
+		}
+	}
+	if len(path) > 1 {
+		out = append(out, "NOTE: AS path: "+strings.Join(path, " → "))
+	}
+	return out
+}
@@ -0,0 +1,228 @@
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"network-check/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Traceroute history. Every run is saved as JSON under
+// ~/.local/share/network-check/traces, one file per run named after the
+// target, the probe method and the start time. It is rewritten every
+// traceSaveInterval while it goes on, and once more when r starts a new run
+// or s, b or quitting stops it.
+// One run per target can be kept as the baseline. The live path is then
+// compared with the previous run or the baseline: hops that appeared,
+// disappeared or changed router, RTT shifts per hop and changes of the AS
+// path, which is how a routing change at the ISP shows up.
+
+// traceSaveInterval is how often a running trace is written to disk.
+const traceSaveInterval = 30 * time.Second
+
+// traceRTTShift is the smallest change of a hop's average RTT reported, in
+// ms; shifts must also be at least a fifth of the old average.
+const traceRTTShift = 5.0
+
+const traceTimeFormat = "20060102T150405"
+
+// dataDir is where saved results are kept.
+func dataDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "network-check"), nil
+}
+
+func traceDir() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "traces"), nil
+}
+
+// traceKey names the files of one target and probe method.
+func traceKey(target, proto string, port int) string {
+	key := strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, target) + "_" + proto
+	if proto == "udp" || proto == "tcp" {
+		key += strconv.Itoa(port)
+	}
+	return key
+}
+
+// traceSnapshot summarizes the hops shown for the current run.
+func traceSnapshot(m utils.Model) utils.TracePath {
+	p := utils.TracePath{Target: m.TraceTarget, Proto: m.TraceProto, Port: m.TracePort, Start: m.TraceStarted, Saved: time.Now()}
+	if p.Proto == "" {
+		p.Proto = "icmp"
+	}
+	for _, h := range traceHopsShown(m) {
+		asn, org := hopASN(h, m.TraceInfo)
+		p.Hops = append(p.Hops, utils.TracePathHop{
+			TTL: h.TTL, Addrs: slices.Clone(h.Addrs), ASN: asn, ASOrg: org,
+			Sent: h.Sent, Loss: hopLoss(h), Avg: hopAvg(h),
+		})
+	}
+	return p
+}
+
+// saveTraceRun writes the current run once any hop has answered.
+func saveTraceRun(m *utils.Model) {
+	m.TraceSavedAt = time.Now()
+	p := traceSnapshot(*m)
+	if !slices.ContainsFunc(p.Hops, func(h utils.TracePathHop) bool { return len(h.Addrs) > 0 }) {
+		return
+	}
+	name := traceKey(p.Target, p.Proto, p.Port) + "-" + p.Start.Format(traceTimeFormat) + ".json"
+	if err := writeTracePath(name, p); err != nil {
+		msg := "could not save the run: " + err.Error()
+		if n := len(m.TraceLog); n == 0 || m.TraceLog[n-1] != msg {
+			m.TraceLog = append(m.TraceLog, msg)
+		}
+	}
+}
+
+// saveTraceBaseline keeps the current run as the baseline of its target.
+func saveTraceBaseline(m utils.Model) error {
+	p := traceSnapshot(m)
+	return writeTracePath(traceKey(p.Target, p.Proto, p.Port)+"-baseline.json", p)
+}
+
+func writeTracePath(name string, p utils.TracePath) error {
+	dir, err := traceDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name), b, 0o644)
+}
+
+func readTracePath(path string) (*utils.TracePath, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p utils.TracePath
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return &p, nil
+}
+
+// loadTraceRef reads the baseline, or the latest run that started before
+// the current one.
+func loadTraceRef(m utils.Model, kind string) (*utils.TracePath, error) {
+	dir, err := traceDir()
+	if err != nil {
+		return nil, err
+	}
+	key := traceKey(m.TraceTarget, m.TraceProto, m.TracePort)
+	if kind == "baseline" {
+		p, err := readTracePath(filepath.Join(dir, key+"-baseline.json"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no baseline saved for %s yet (press m to keep this run as the baseline)", traceSpec(m))
+		}
+		return p, err
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, key+"-*.json"))
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	current := key + "-" + m.TraceStarted.Format(traceTimeFormat) + ".json"
+	for _, f := range files {
+		base := filepath.Base(f)
+		if base == current || base == key+"-baseline.json" || base > current {
+			continue
+		}
+		return readTracePath(f)
+	}
+	return nil, fmt.Errorf("no earlier run of %s saved yet", traceSpec(m))
+}
+
+// traceASPath is the sequence of ASes a path crosses, hops without a known
+// AS left out.
+func traceASPath(p utils.TracePath) []int {
+	var out []int
+	for _, h := range p.Hops {
+		if h.ASN != 0 && (len(out) == 0 || out[len(out)-1] != h.ASN) {
+			out = append(out, h.ASN)
+		}
+	}
+	return out
+}
+
+func formatASPath(path []int) string {
+	s := make([]string, len(path))
+	for i, asn := range path {
+		s[i] = fmt.Sprintf("AS%d", asn)
+	}
+	return strings.Join(s, " → ")
+}
+
+// compareTracePaths lists how cur differs from ref. Lines that point to a
+// routing change or a slower path start with WARNING.
+func compareTracePaths(ref, cur utils.TracePath) []string {
+	var out []string
+	hop := func(p utils.TracePath, ttl int) utils.TracePathHop {
+		if ttl <= len(p.Hops) {
+			return p.Hops[ttl-1]
+		}
+		return utils.TracePathHop{TTL: ttl}
+	}
+
+	if a, b := traceASPath(ref), traceASPath(cur); len(a) > 0 && len(b) > 0 && !slices.Equal(a, b) {
+		out = append(out, fmt.Sprintf("WARNING: AS path changed: %s (was %s)", formatASPath(b), formatASPath(a)))
+	}
+	if len(ref.Hops) != len(cur.Hops) && len(cur.Hops) > 0 {
+		out = append(out, fmt.Sprintf("the path is %d hops long, %d before", len(cur.Hops), len(ref.Hops)))
+	}
+
+	for ttl := 1; ttl <= max(len(ref.Hops), len(cur.Hops)); ttl++ {
+		o, c := hop(ref, ttl), hop(cur, ttl)
+		switch {
+		case len(o.Addrs) == 0 && len(c.Addrs) > 0:
+			out = append(out, fmt.Sprintf("hop %d: %s appeared", ttl, strings.Join(c.Addrs, ", ")))
+		case len(o.Addrs) > 0 && len(c.Addrs) == 0 && ttl > len(cur.Hops):
+			out = append(out, fmt.Sprintf("hop %d: %s disappeared", ttl, strings.Join(o.Addrs, ", ")))
+		case len(o.Addrs) > 0 && len(c.Addrs) == 0 && c.Sent >= traceMinSent:
+			out = append(out, fmt.Sprintf("hop %d: %s no longer answers", ttl, strings.Join(o.Addrs, ", ")))
+		case len(o.Addrs) > 0 && len(c.Addrs) > 0 && !slices.ContainsFunc(c.Addrs, func(a string) bool { return slices.Contains(o.Addrs, a) }):
+			out = append(out, fmt.Sprintf("hop %d: %s replaced %s", ttl, strings.Join(c.Addrs, ", "), strings.Join(o.Addrs, ", ")))
+		}
+
+		if o.Avg == 0 || c.Avg == 0 || c.Sent < 3 {
+			continue
+		}
+		if d := c.Avg - o.Avg; math.Abs(d) >= max(traceRTTShift, o.Avg/5) {
+			line := fmt.Sprintf("hop %d (%s): avg %.1f → %.1f ms (%+.1f)", ttl, c.Addrs[0], o.Avg, c.Avg, d)
+			if d > 0 {
+				line = "WARNING: " + line
+			}
+			out = append(out, line)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, fmt.Sprintf("no change: same hops and AS path, every hop's RTT within %.0f ms or 20%%", traceRTTShift))
+	}
+	return out
+}
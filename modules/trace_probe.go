@@ -0,0 +1,550 @@
+package modules
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"network-check/utils"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Probe engine of the continuous traceroute. Probes go out with TTL 1, 2,
+// 3... once per interval; routers answer with ICMP time exceeded, quoting the
+// start of the probe, and the destination with an echo reply, a SYN-ACK/RST
+// or a port unreachable. Every probe carries a sequence number the reply
+// gives back, so it is matched to the probe, and thus the TTL, it answers. A
+// probe left without a reply for traceTimeout is reported lost.
+//
+// Probes are Paris-traceroute style: the fields routers hash on for ECMP
+// stay the same for every probe, so all of them follow one path instead of
+// zigzagging between parallel links. ICMP echo keeps its checksum constant
+// by compensating the sequence number in the payload, UDP keeps both ports
+// and carries the sequence in its checksum, and TCP SYNs keep both ports and
+// carry it in the TCP sequence number.
+//
+// Everything needs raw sockets (root); without them the worker falls back to
+// a single traceroute/tracepath run.
+
+const traceTimeout = 2 * time.Second
+
+var tracePayload = []byte("network-check trace")
+
+// Default destination ports of the UDP and TCP modes.
+const (
+	traceUDPPort = 33434
+	traceTCPPort = 80
+)
+
+// traceOptions configures runTrace.
+type traceOptions struct {
+	interval time.Duration
+	maxHops  int
+	proto    string // icmp, udp or tcp
+	port     int    // destination port of udp and tcp probes
+}
+
+// traceProber sends the probes of one method and recognizes the replies.
+type traceProber interface {
+	// send emits the probe with sequence number seq at the given TTL.
+	send(ttl int, seq uint16) error
+	// quoted finds the probe an ICMP message refers to: proto is the
+	// protocol of the quoted packet and b its transport header. Echo replies
+	// are passed as themselves with proto ICMP.
+	quoted(proto byte, b []byte) (uint16, bool)
+	// answers reads replies that arrive outside ICMP (SYN-ACK or RST) until
+	// the prober is closed.
+	answers(found func(seq uint16, from net.IP))
+	close()
+}
+
+// traceInflight is a probe waiting for its reply.
+type traceInflight struct {
+	ttl  int
+	sent time.Time
+}
+
+// runTrace probes the path to target until stop is closed.
+func runTrace(ch chan<- utils.TraceResult, stop <-chan struct{}, target string, opt traceOptions) {
+	defer close(ch)
+	send := func(r utils.TraceResult) bool {
+		select {
+		case ch <- r:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	note := func(s string) { send(utils.TraceResult{Msg: s}) }
+
+	ip, err := resolveHost(target)
+	if err != nil {
+		note(err.Error())
+		return
+	}
+	v6 := ip.To4() == nil
+	network, laddr := "ip4:icmp", "0.0.0.0"
+	if v6 {
+		network, laddr = "ip6:ipv6-icmp", "::"
+	}
+	c, err := net.ListenPacket(network, laddr)
+	var icmp *net.IPConn
+	var p traceProber
+	if err == nil {
+		icmp = c.(*net.IPConn)
+		p, err = newTraceProber(icmp, ip, opt)
+		if err != nil {
+			icmp.Close()
+		}
+	}
+	if err != nil {
+		note(fmt.Sprintf("raw sockets unavailable (%v): run as root for the live view, showing one traceroute run instead", err))
+		traceCommand(note, target, opt)
+		return
+	}
+	what := "ICMP echo"
+	if opt.proto != "icmp" {
+		what = fmt.Sprintf("%s port %d", strings.ToUpper(opt.proto), opt.port)
+	}
+	note(fmt.Sprintf("tracing %s (%s) with %s, one probe per hop every %s", target, ip, what, opt.interval))
+
+	// enrich new responders (reverse DNS can be slow) without holding up
+	// the probes; ch stays open until every lookup has been sent
+	var enrich sync.WaitGroup
+	defer enrich.Wait()
+	enrich.Add(1)
+	go func() {
+		defer enrich.Done()
+		note(asnStatus())
+	}()
+
+	var mu sync.Mutex
+	inflight := map[uint16]traceInflight{}
+	responders := map[string]bool{}
+	var destTTL atomic.Int32
+	found := func(seq uint16, from net.IP, final bool) bool {
+		mu.Lock()
+		pr, ok := inflight[seq]
+		delete(inflight, seq)
+		known := responders[from.String()]
+		responders[from.String()] = true
+		mu.Unlock()
+		if !known {
+			enrich.Add(1)
+			go func() {
+				defer enrich.Done()
+				info := traceHopInfo(from, 2*time.Second)
+				send(utils.TraceResult{Info: &info})
+			}()
+		}
+		if !ok {
+			// answered after it was reported lost
+			return true
+		}
+		reached := final || from.Equal(ip)
+		if d := destTTL.Load(); reached && (d == 0 || int32(pr.ttl) < d) {
+			destTTL.Store(int32(pr.ttl))
+		}
+		probe := utils.TraceProbe{TTL: pr.ttl, Addr: from.String(), RTT: time.Since(pr.sent), Reached: reached}
+		return send(utils.TraceResult{Probe: &probe})
+	}
+
+	// readers: ICMP for every method, plus the prober's own replies
+	var wg sync.WaitGroup
+	wg.Add(2)
+	defer func() {
+		icmp.Close()
+		p.close()
+		wg.Wait()
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := icmp.ReadFrom(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			seq, final, ok := parseTraceReply(buf[:n], v6, p)
+			if ok && !found(seq, from.(*net.IPAddr).IP, final) {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		p.answers(func(seq uint16, from net.IP) { found(seq, from, true) })
+	}()
+
+	var seq uint16
+	writeFailed := false
+	tick := time.NewTicker(opt.interval)
+	defer tick.Stop()
+	for {
+		limit := opt.maxHops
+		if d := int(destTTL.Load()); d > 0 {
+			limit = d
+		}
+		// spread a round over the interval so routers see at most one probe at a time
+		gap := min(opt.interval/time.Duration(limit), 20*time.Millisecond)
+		for ttl := 1; ttl <= limit; ttl++ {
+			// 0 is skipped: a UDP checksum of 0 means "none"
+			if seq++; seq == 0 {
+				seq++
+			}
+			mu.Lock()
+			inflight[seq] = traceInflight{ttl: ttl, sent: time.Now()}
+			mu.Unlock()
+			if err := p.send(ttl, seq); err != nil && !writeFailed {
+				// the probe stays in flight and is reported lost
+				writeFailed = true
+				note(fmt.Sprintf("sending probes fails: %v", err))
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(gap):
+			}
+		}
+
+		var lost []utils.TraceProbe
+		mu.Lock()
+		for s, pr := range inflight {
+			if time.Since(pr.sent) > traceTimeout {
+				lost = append(lost, utils.TraceProbe{TTL: pr.ttl})
+				delete(inflight, s)
+			}
+		}
+		mu.Unlock()
+		for i := range lost {
+			if !send(utils.TraceResult{Probe: &lost[i]}) {
+				return
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// parseTraceReply returns the sequence number of the probe an ICMP message
+// answers, and whether it came from the destination (echo reply, port
+// unreachable) rather than a router on the way (time exceeded).
+func parseTraceReply(b []byte, v6 bool, p traceProber) (seq uint16, final, ok bool) {
+	if len(b) < 8 {
+		return 0, false, false
+	}
+	echoReply, timeExceeded, unreachable, protoICMP := byte(0), byte(11), byte(3), byte(1)
+	if v6 {
+		echoReply, timeExceeded, unreachable, protoICMP = 129, 3, 1, 58
+	}
+	switch b[0] {
+	case echoReply:
+		seq, ok := p.quoted(protoICMP, b)
+		return seq, true, ok
+	case timeExceeded, unreachable:
+	default:
+		return 0, false, false
+	}
+
+	// the error quotes our IP header and at least 8 bytes after it
+	inner := b[8:]
+	switch {
+	case !v6 && len(inner) >= 20:
+		hl := int(inner[0]&0x0f) * 4
+		if len(inner) < hl+8 {
+			return 0, false, false
+		}
+		seq, ok := p.quoted(inner[9], inner[hl:])
+		return seq, false, ok
+	case v6 && len(inner) >= 48:
+		seq, ok := p.quoted(inner[6], inner[40:])
+		return seq, false, ok
+	}
+	return 0, false, false
+}
+
+// newTraceProber opens the sockets of opt.proto. ICMP probes share the
+// socket the replies are read from.
+func newTraceProber(icmp *net.IPConn, dst net.IP, opt traceOptions) (traceProber, error) {
+	v6 := dst.To4() == nil
+	switch opt.proto {
+	case "udp", "tcp":
+		src, err := traceSource(dst)
+		if err != nil {
+			return nil, err
+		}
+		network := "ip4:" + opt.proto
+		if v6 {
+			network = "ip6:" + opt.proto
+		}
+		c, err := net.ListenPacket(network, src.String())
+		if err != nil {
+			return nil, err
+		}
+		conn := c.(*net.IPConn)
+		if err := setUnicastHops(conn, v6, 1); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		sport, dport := uint16(49152+rand.IntN(16384)), uint16(opt.port)
+		if opt.proto == "udp" {
+			return &udpProber{conn: conn, src: src, dst: dst, v6: v6, sport: sport, dport: dport}, nil
+		}
+		return &tcpProber{conn: conn, src: src, dst: dst, v6: v6, sport: sport, dport: dport, base: rand.Uint32()}, nil
+	}
+
+	if err := setUnicastHops(icmp, v6, 1); err != nil {
+		return nil, err
+	}
+	return &icmpProber{conn: icmp, dst: dst, v6: v6, id: uint16(os.Getpid() & 0xffff)}, nil
+}
+
+// traceSource asks the routing table which source address reaches dst.
+func traceSource(dst net.IP) (net.IP, error) {
+	c, err := net.Dial("udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// icmpProber sends echo requests with a fixed identifier and checksum.
+type icmpProber struct {
+	conn *net.IPConn
+	dst  net.IP
+	v6   bool
+	id   uint16
+}
+
+func (p *icmpProber) send(ttl int, seq uint16) error {
+	if err := setUnicastHops(p.conn, p.v6, ttl); err != nil {
+		return err
+	}
+	_, err := p.conn.WriteTo(icmpEcho(p.v6, p.id, seq), &net.IPAddr{IP: p.dst})
+	return err
+}
+
+func (p *icmpProber) quoted(proto byte, b []byte) (uint16, bool) {
+	if (proto != 1 && proto != 58) || len(b) < 8 || binary.BigEndian.Uint16(b[4:]) != p.id {
+		return 0, false
+	}
+	// echo request (8, 128) quoted in an error, or echo reply (0, 129)
+	if b[0] != 8 && b[0] != 128 && b[0] != 0 && b[0] != 129 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b[6:]), true
+}
+
+func (p *icmpProber) answers(func(uint16, net.IP)) {}
+
+// close leaves the shared socket to runTrace.
+func (p *icmpProber) close() {}
+
+// icmpEcho builds an echo request. The word after the header is the
+// complement of seq, so the checksum (which ECMP may hash on) stays the
+// same for every probe. The kernel fills in the ICMPv6 checksum, which
+// covers a pseudo header.
+func icmpEcho(v6 bool, id, seq uint16) []byte {
+	b := make([]byte, 10+len(tracePayload))
+	b[0] = 8
+	if v6 {
+		b[0] = 128
+	}
+	binary.BigEndian.PutUint16(b[4:], id)
+	binary.BigEndian.PutUint16(b[6:], seq)
+	binary.BigEndian.PutUint16(b[8:], ^seq)
+	copy(b[10:], tracePayload)
+	if !v6 {
+		binary.BigEndian.PutUint16(b[2:], ^onesSum(0, b))
+	}
+	return b
+}
+
+// udpProber sends datagrams from one source port over a raw socket. The
+// checksum field carries the sequence number; two payload bytes are chosen
+// so it is still the correct checksum and the destination answers with port
+// unreachable instead of dropping a corrupt datagram.
+type udpProber struct {
+	conn         *net.IPConn
+	src, dst     net.IP
+	v6           bool
+	sport, dport uint16
+}
+
+func (p *udpProber) send(ttl int, seq uint16) error {
+	if err := setUnicastHops(p.conn, p.v6, ttl); err != nil {
+		return err
+	}
+	b := make([]byte, 10+len(tracePayload))
+	binary.BigEndian.PutUint16(b[0:], p.sport)
+	binary.BigEndian.PutUint16(b[2:], p.dport)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[6:], seq)
+	copy(b[10:], tracePayload)
+	// a datagram with a valid checksum sums to 0xffff
+	sum := onesSum(pseudoHeaderSum(p.src, p.dst, 17, len(b)), b)
+	binary.BigEndian.PutUint16(b[8:], ^sum)
+	_, err := p.conn.WriteTo(b, &net.IPAddr{IP: p.dst})
+	return err
+}
+
+func (p *udpProber) quoted(proto byte, b []byte) (uint16, bool) {
+	if proto != 17 || len(b) < 8 || binary.BigEndian.Uint16(b[0:]) != p.sport || binary.BigEndian.Uint16(b[2:]) != p.dport {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b[6:]), true
+}
+
+// answers drains the raw socket, which gets a copy of every UDP datagram;
+// a reply from an open port cannot be tied to a probe.
+func (p *udpProber) answers(func(uint16, net.IP)) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := p.conn.ReadFrom(buf); errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (p *udpProber) close() { p.conn.Close() }
+
+// tcpProber sends SYNs from one source port over a raw socket. The kernel
+// answers the SYN-ACK of an open port with a reset, so no connection is left
+// half open.
+type tcpProber struct {
+	conn         *net.IPConn
+	src, dst     net.IP
+	v6           bool
+	sport, dport uint16
+	base         uint32 // added to seq to form the TCP sequence number
+}
+
+func (p *tcpProber) send(ttl int, seq uint16) error {
+	if err := setUnicastHops(p.conn, p.v6, ttl); err != nil {
+		return err
+	}
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:], p.sport)
+	binary.BigEndian.PutUint16(b[2:], p.dport)
+	binary.BigEndian.PutUint32(b[4:], p.base+uint32(seq))
+	b[12] = 5 << 4 // data offset
+	b[13] = 0x02   // SYN
+	binary.BigEndian.PutUint16(b[14:], 64240)
+	binary.BigEndian.PutUint16(b[16:], ^onesSum(pseudoHeaderSum(p.src, p.dst, 6, len(b)), b))
+	_, err := p.conn.WriteTo(b, &net.IPAddr{IP: p.dst})
+	return err
+}
+
+func (p *tcpProber) quoted(proto byte, b []byte) (uint16, bool) {
+	if proto != 6 || len(b) < 8 || binary.BigEndian.Uint16(b[0:]) != p.sport || binary.BigEndian.Uint16(b[2:]) != p.dport {
+		return 0, false
+	}
+	return uint16(binary.BigEndian.Uint32(b[4:]) - p.base), true
+}
+
+// answers reads SYN-ACKs and resets to our port; they acknowledge seq+1.
+func (p *tcpProber) answers(found func(uint16, net.IP)) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		b := buf[:n]
+		if n < 20 || binary.BigEndian.Uint16(b[0:]) != p.dport || binary.BigEndian.Uint16(b[2:]) != p.sport || b[13]&0x14 == 0 {
+			continue
+		}
+		found(uint16(binary.BigEndian.Uint32(b[8:])-p.base-1), from.(*net.IPAddr).IP)
+	}
+}
+
+func (p *tcpProber) close() { p.conn.Close() }
+
+// pseudoHeaderSum is the checksum contribution of the IPv4 or IPv6 pseudo
+// header of a TCP or UDP segment.
+func pseudoHeaderSum(src, dst net.IP, proto byte, length int) uint16 {
+	var ph []byte
+	if s4, d4 := src.To4(), dst.To4(); s4 != nil && d4 != nil {
+		ph = append(append(ph, s4...), d4...)
+		ph = append(ph, 0, proto, byte(length>>8), byte(length))
+	} else {
+		ph = append(append(ph, src.To16()...), dst.To16()...)
+		ph = binary.BigEndian.AppendUint32(ph, uint32(length))
+		ph = append(ph, 0, 0, 0, proto)
+	}
+	return onesSum(0, ph)
+}
+
+// onesSum adds b as 16-bit words to sum in one's complement (RFC 1071).
+func onesSum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+// traceCommand streams one run of traceroute, or tracepath where traceroute
+// is missing.
+func traceCommand(note func(string), target string, opt traceOptions) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	traceroute := []string{"traceroute", "-n", "-w", "1", "-q", "1"}
+	tracepath := []string{"tracepath", "-n"}
+	switch opt.proto {
+	case "tcp":
+		traceroute = append(traceroute, "-T", "-p", strconv.Itoa(opt.port))
+		tracepath = nil
+	case "udp":
+		traceroute = append(traceroute, "-U", "-p", strconv.Itoa(opt.port))
+		tracepath = append(tracepath, "-p", strconv.Itoa(opt.port))
+	}
+	for _, args := range [][]string{traceroute, tracepath} {
+		if args == nil {
+			continue
+		}
+		cmd := exec.CommandContext(ctx, args[0], append(args[1:], target)...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			continue
+		}
+		if err := cmd.Start(); err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				note(line)
+			}
+		}
+		_ = cmd.Wait()
+		return
+	}
+	note("could not run 'traceroute' or 'tracepath' (missing or requires privileges)")
+}
@@ -1,103 +1,138 @@
 package modules
 
 import (
-	"bufio"
-	"context"
+	"errors"
+	"fmt"
+	"math"
 	"network-check/utils"
-	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-// Traceroute check: prefer `traceroute` then fall back to `tracepath`.
-// Streams output lines into m.TraceChan and collects them into m.TraceLog.
-// Expects model to have fields: TraceChan chan string, TraceLog []string, TraceTarget string.
+// Continuous traceroute, mtr-style. The user enters a host (default
+// m.TraceTarget), optionally followed by the probe method and port: "icmp"
+// (the default), "udp [port]" or "tcp [port]", e.g. "api.example.com tcp 443"
+// to follow the path of HTTPS traffic through firewalls that drop ICMP. The
+// probe engine (trace_probe.go) then sends one probe per hop every
+// m.TraceInterval until stopped, and each hop's loss and RTT statistics are
+// updated live. Loss seen at a single router but not at the hops after it is
+// ICMP rate limiting of that router, not packet loss; traceFindings spells
+// out which one it is. Responders are enriched with their reverse DNS name
+// and AS (trace_enrich.go); the first hop of every new AS, where traffic is
+// handed to the next network, is highlighted. Runs are saved and compared
+// with earlier ones (trace_history.go). Like the firewall watch, Loaded is
+// set while probing so the view keeps its keys and b goes back.
+
+// traceMinSent is the number of probes per hop before loss is judged.
+const traceMinSent = 10
 
 func UpdateTraceroute(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
-	switch msg.(type) {
-	case utils.FrameMsg:
-		// start traceroute worker on first frame for this view
-		if !m.Loaded && m.TraceChan == nil {
-			m.TraceChan = make(chan string, 512)
-			target := m.TraceTarget
-			if target == "" {
-				target = "8.8.8.8"
-			}
-			go func(ch chan<- string, tgt string) {
-				defer close(ch)
-				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-				defer cancel()
-
-				// try traceroute first
-				cmd := exec.CommandContext(ctx, "traceroute", "-n", "-w", "1", "-q", "1", tgt)
-				stdout, err := cmd.StdoutPipe()
-				if err == nil {
-					if err := cmd.Start(); err == nil {
-						scanner := bufio.NewScanner(stdout)
-						for scanner.Scan() {
-							line := strings.TrimSpace(scanner.Text())
-							if line != "" {
-								select {
-								case ch <- line:
-								default:
-								}
-							}
-						}
-						_ = cmd.Wait()
-						return
-					}
-				}
+	if m.InputActive {
+		return utils.UpdateInput(msg, m)
+	}
 
-				// fallback to tracepath (common on some distros)
-				cmd = exec.CommandContext(ctx, "tracepath", "-n", tgt)
-				stdout, err = cmd.StdoutPipe()
-				if err == nil {
-					if err := cmd.Start(); err == nil {
-						scanner := bufio.NewScanner(stdout)
-						for scanner.Scan() {
-							line := strings.TrimSpace(scanner.Text())
-							if line != "" {
-								select {
-								case ch <- line:
-								default:
-								}
-							}
-						}
-						_ = cmd.Wait()
-						return
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if !m.Loaded {
+			return m, nil
+		}
+		switch msg.String() {
+		case "s":
+			if m.TraceStop != nil {
+				close(m.TraceStop)
+				m.TraceStop = nil
+				saveTraceRun(&m)
+				return m, nil
+			}
+			if m.TraceChan == nil {
+				return startTrace(m)
+			}
+		case "r":
+			// the statistics start over as a new run
+			saveTraceRun(&m)
+			m.TraceHops = []utils.TraceHop{}
+			m.TraceDestTTL = 0
+			m.TraceStarted = time.Now()
+		case "c":
+			// compare with: nothing → previous run → baseline → nothing
+			kind := map[string]string{"": "previous", "previous": "baseline"}[m.TraceRefKind]
+			m.TraceRef, m.TraceRefKind = nil, ""
+			if kind != "" {
+				ref, err := loadTraceRef(m, kind)
+				if err != nil {
+					m.TraceLog = append(m.TraceLog, err.Error())
+					if kind == "previous" {
+						// still offer the baseline on the next press
+						m.TraceRefKind = kind
 					}
+					return m, nil
 				}
+				m.TraceRef, m.TraceRefKind = ref, kind
+			}
+		case "m":
+			if err := saveTraceBaseline(m); err != nil {
+				m.TraceLog = append(m.TraceLog, "could not save the baseline: "+err.Error())
+			} else {
+				m.TraceLog = append(m.TraceLog, fmt.Sprintf("this run is now the baseline of %s", traceSpec(m)))
+			}
+		}
+		return m, nil
 
-				// if both fail, emit a helpful message
-				select {
-				case ch <- "could not run 'traceroute' or 'tracepath' (missing or requires privileges)":
-				default:
+	case utils.FrameMsg:
+		if !m.Loaded && m.TraceChan == nil {
+			if !m.InputSubmitted {
+				return utils.PromptInput(m, "Host to trace, optionally with the probe method: HOST [icmp | udp [PORT] | tcp [PORT]]:", traceSpec(m)), nil
+			}
+			m.InputSubmitted = false
+			m.TraceLog = []string{}
+			if strings.TrimSpace(m.Input) != "" {
+				host, proto, port, err := parseTraceSpec(m.Input)
+				if err != nil {
+					m.TraceLog = append(m.TraceLog, err.Error())
+					m.TraceHops = []utils.TraceHop{}
+					m.Loaded = true
+					return m, nil
 				}
-			}(m.TraceChan, target)
-
-			return m, utils.Frame()
+				m.TraceTarget, m.TraceProto, m.TracePort = host, proto, port
+			}
+			m.TraceHops = []utils.TraceHop{}
+			m.TraceDestTTL = 0
+			m.TraceStarted = time.Now()
+			m.TraceSavedAt = m.TraceStarted
+			m.TraceRef, m.TraceRefKind = nil, ""
+			m.Loaded = true
+			return startTrace(m)
 		}
 
-		// poll trace channel
 		if m.TraceChan != nil {
 			for {
 				select {
-				case line, ok := <-m.TraceChan:
+				case r, ok := <-m.TraceChan:
 					if !ok {
-						// finished
 						m.TraceChan = nil
-						m.Loaded = true
+						m.TraceStop = nil
 						return m, nil
 					}
-					trim := strings.TrimSpace(line)
-					if trim == "" {
+					if r.Msg != "" {
+						m.TraceLog = append(m.TraceLog, r.Msg)
 						continue
 					}
-					m.TraceLog = append(m.TraceLog, trim)
-					return m, utils.Frame()
+					if r.Info != nil {
+						if m.TraceInfo == nil {
+							m.TraceInfo = map[string]utils.TraceHopInfo{}
+						}
+						m.TraceInfo[r.Info.Addr] = *r.Info
+						continue
+					}
+					addTraceProbe(&m, *r.Probe)
 				default:
+					if m.TraceStop != nil && time.Since(m.TraceSavedAt) >= traceSaveInterval {
+						saveTraceRun(&m)
+					}
 					return m, utils.Frame()
 				}
 			}
@@ -106,19 +141,278 @@ func UpdateTraceroute(msg tea.Msg, m utils.Model) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// startTrace starts (or resumes) probing m.TraceTarget.
+func startTrace(m utils.Model) (utils.Model, tea.Cmd) {
+	m.TraceChan = make(chan utils.TraceResult, 1024)
+	m.TraceStop = make(chan struct{})
+	m.TraceOnStop = saveTraceRun
+	opt := traceOptions{interval: m.TraceInterval, maxHops: m.TraceMaxHops, proto: m.TraceProto, port: m.TracePort}
+	if opt.interval <= 0 {
+		opt.interval = time.Second
+	}
+	if opt.maxHops <= 0 {
+		opt.maxHops = 30
+	}
+	if opt.proto == "" {
+		opt.proto = "icmp"
+	}
+	go runTrace(m.TraceChan, m.TraceStop, m.TraceTarget, opt)
+	return m, utils.Frame()
+}
+
+// parseTraceSpec parses "HOST [icmp | udp [PORT] | tcp [PORT]]".
+func parseTraceSpec(input string) (host, proto string, port int, err error) {
+	f := strings.Fields(input)
+	if len(f) == 0 || len(f) > 3 {
+		return "", "", 0, fmt.Errorf("expected HOST [icmp | udp [PORT] | tcp [PORT]], got %q", input)
+	}
+	host, proto = f[0], "icmp"
+	if len(f) > 1 {
+		proto = strings.ToLower(f[1])
+	}
+	switch proto {
+	case "icmp":
+		if len(f) > 2 {
+			return "", "", 0, errors.New("ICMP probes take no port")
+		}
+		return host, proto, 0, nil
+	case "udp":
+		port = traceUDPPort
+	case "tcp":
+		port = traceTCPPort
+	default:
+		return "", "", 0, fmt.Errorf("unknown probe method %q (icmp, udp or tcp)", f[1])
+	}
+	if len(f) > 2 {
+		if port, err = strconv.Atoi(f[2]); err != nil || port < 1 || port > 65535 {
+			return "", "", 0, fmt.Errorf("invalid port %q", f[2])
+		}
+	}
+	return host, proto, port, nil
+}
+
+// traceSpec formats the current target for the prompt.
+func traceSpec(m utils.Model) string {
+	if m.TraceProto == "" || m.TraceProto == "icmp" {
+		return m.TraceTarget
+	}
+	return fmt.Sprintf("%s %s %d", m.TraceTarget, m.TraceProto, m.TracePort)
+}
+
+// addTraceProbe folds one probe outcome into the statistics of its hop.
+func addTraceProbe(m *utils.Model, p utils.TraceProbe) {
+	for len(m.TraceHops) < p.TTL {
+		m.TraceHops = append(m.TraceHops, utils.TraceHop{TTL: len(m.TraceHops) + 1})
+	}
+	h := &m.TraceHops[p.TTL-1]
+	h.Sent++
+	if p.Addr == "" {
+		return
+	}
+	h.Recv++
+	if !slices.Contains(h.Addrs, p.Addr) {
+		h.Addrs = append(h.Addrs, p.Addr)
+	}
+	h.Last = p.RTT
+	if h.Recv == 1 || p.RTT < h.Best {
+		h.Best = p.RTT
+	}
+	h.Worst = max(h.Worst, p.RTT)
+	h.Sum += p.RTT
+	ms := float64(p.RTT.Microseconds()) / 1000
+	h.SumSq += ms * ms
+	if p.Reached && (m.TraceDestTTL == 0 || p.TTL < m.TraceDestTTL) {
+		m.TraceDestTTL = p.TTL
+	}
+}
+
+// traceHopsShown cuts the hop list at the destination or, while it has not
+// answered, after the first silent hop past the last answering one.
+func traceHopsShown(m utils.Model) []utils.TraceHop {
+	hops := m.TraceHops
+	if m.TraceDestTTL > 0 {
+		return hops[:min(m.TraceDestTTL, len(hops))]
+	}
+	last := 0
+	for i, h := range hops {
+		if h.Recv > 0 {
+			last = i + 1
+		}
+	}
+	return hops[:min(last+1, len(hops))]
+}
+
+func hopLoss(h utils.TraceHop) float64 {
+	if h.Sent == 0 {
+		return 0
+	}
+	return 100 * float64(h.Sent-h.Recv) / float64(h.Sent)
+}
+
+func hopAvg(h utils.TraceHop) float64 {
+	if h.Recv == 0 {
+		return 0
+	}
+	return float64(h.Sum.Microseconds()) / 1000 / float64(h.Recv)
+}
+
+func hopStdDev(h utils.TraceHop) float64 {
+	if h.Recv == 0 {
+		return 0
+	}
+	avg := hopAvg(h)
+	return math.Sqrt(max(0, h.SumSq/float64(h.Recv)-avg*avg))
+}
+
+func hopHost(h utils.TraceHop) string {
+	switch len(h.Addrs) {
+	case 0:
+		return "???"
+	case 1:
+		return h.Addrs[0]
+	}
+	return fmt.Sprintf("%s (+%d)", h.Addrs[0], len(h.Addrs)-1)
+}
+
+// hopName is hopHost with the reverse DNS name of the first responder in
+// front of its address, cut to width.
+func hopName(h utils.TraceHop, infos map[string]utils.TraceHopInfo, width int) string {
+	s := hopHost(h)
+	if len(h.Addrs) > 0 && infos[h.Addrs[0]].Name != "" {
+		s = infos[h.Addrs[0]].Name + " (" + s + ")"
+	}
+	return clipText(s, width)
+}
+
+// hopAS is the AS column: number and organization, or the range tag of
+// addresses no AS announces.
+func hopAS(h utils.TraceHop, infos map[string]utils.TraceHopInfo, width int) string {
+	if r := hopRange(h, infos); r != "" {
+		return r
+	}
+	asn, org := hopASN(h, infos)
+	if asn == 0 {
+		return ""
+	}
+	return clipText(strings.TrimSpace(fmt.Sprintf("AS%d %s", asn, org)), width)
+}
+
+func clipText(s string, width int) string {
+	if r := []rune(s); len(r) > width {
+		return string(r[:width-1]) + "…"
+	}
+	return s
+}
+
+// traceFindings tells loss that carries through to the destination from
+// routers that only rate-limit the ICMP errors they send about our probes.
+func traceFindings(hops []utils.TraceHop, reached bool, proto string, port int) []string {
+	if len(hops) == 0 || hops[0].Sent < traceMinSent {
+		return nil
+	}
+	var out []string
+	last := hops[len(hops)-1]
+	if !reached {
+		why := "it, or a firewall in front of it, drops ICMP echo (try tcp with the port of the service)"
+		switch proto {
+		case "tcp":
+			why = fmt.Sprintf("SYNs to port %d are dropped on the way or by the host", port)
+		case "udp":
+			why = fmt.Sprintf("port %d is open and ignores the probe, or the port unreachable reply is filtered", port)
+		}
+		out = append(out, fmt.Sprintf("NOTE: the destination has not answered %d probes: %s; the path after hop %d is unknown", hops[0].Sent, why, last.TTL-1))
+	}
+
+	for i, h := range hops[:len(hops)-1] {
+		l := hopLoss(h)
+		if h.Sent < traceMinSent || l < 10 {
+			continue
+		}
+		// a later hop that loses much less shows the packets went through
+		for _, later := range hops[i+1:] {
+			if later.Sent < traceMinSent || later.Recv == 0 || hopLoss(later) >= l/2 {
+				continue
+			}
+			if h.Recv == 0 {
+				out = append(out, fmt.Sprintf("NOTE: hop %d never answers but hop %d does: that router does not send time exceeded (or it is filtered), nothing is lost there", h.TTL, later.TTL))
+			} else {
+				out = append(out, fmt.Sprintf("NOTE: hop %d (%s) shows %.0f%% loss but hop %d only %.0f%%: the router rate-limits its ICMP replies, traffic passing through is not lost",
+					h.TTL, hopHost(h), l, later.TTL, hopLoss(later)))
+			}
+			break
+		}
+	}
+
+	if end := hopLoss(last); reached && last.Sent >= traceMinSent && end >= 2 {
+		// loss starts at the first hop from which every hop loses about as much
+		origin := len(hops) - 1
+		for i := len(hops) - 2; i >= 0; i-- {
+			if hops[i].Recv == 0 || hopLoss(hops[i]) < end/2 {
+				break
+			}
+			origin = i
+		}
+		o := hops[origin]
+		out = append(out, fmt.Sprintf("WARNING: %.0f%% loss to the destination, starting at hop %d (%s): every hop from there on loses about as much", end, o.TTL, hopHost(o)))
+	}
+	return out
+}
+
 func ChosenTracerouteView(m utils.Model) string {
-	header := utils.KeywordStyle.Render("Traceroute:") + " traceroute / tracepath\n\n"
+	method := "ICMP echo"
+	if m.TraceProto == "udp" || m.TraceProto == "tcp" {
+		method = fmt.Sprintf("%s port %d", strings.ToUpper(m.TraceProto), m.TracePort)
+	}
+	header := utils.KeywordStyle.Render("Traceroute:") + " continuous " + method + " probes per hop, Paris-style fixed flow (mtr-style)\n\n"
+
+	if m.InputActive {
+		return header + utils.InputView(m)
+	}
+
+	var b strings.Builder
+	if len(m.TraceLog) > 0 {
+		b.WriteString(utils.SubtleStyle.Render(strings.Join(m.TraceLog, "\n")) + "\n\n")
+	}
+
+	hops := traceHopsShown(m)
+	if len(hops) > 0 {
+		ms := func(d time.Duration) string { return fmt.Sprintf("%.1f", float64(d.Microseconds())/1000) }
+		boundaries := asBoundaries(hops, m.TraceInfo)
+		rows := []string{fmt.Sprintf("%-4s %-48s %-22s %6s %5s %8s %8s %8s %8s %8s", "Hop", "Host", "AS", "Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "StDev")}
+		for _, h := range hops {
+			row := fmt.Sprintf("%-4d %-48s %-22s %6.1f %5d", h.TTL, hopName(h, m.TraceInfo, 48), hopAS(h, m.TraceInfo, 22), hopLoss(h), h.Sent)
+			if h.Recv > 0 {
+				row += fmt.Sprintf(" %8s %8.1f %8s %8s %8.1f", ms(h.Last), hopAvg(h), ms(h.Best), ms(h.Worst), hopStdDev(h))
+			}
+			switch {
+			case h.TTL == m.TraceDestTTL:
+				rows = append(rows, utils.KeywordStyle.Render(row))
+			case boundaries[h.TTL]:
+				// first hop in a new AS: the handover between networks
+				rows = append(rows, utils.CheckboxStyle.Render(row))
+			default:
+				rows = append(rows, utils.SubtleStyle.Render(row))
+			}
+		}
+		b.WriteString(strings.Join(rows, "\n") + "\n\n")
+
+		if findings := utils.RenderFindings(append(traceFindings(hops, m.TraceDestTTL > 0, m.TraceProto, m.TracePort), enrichFindings(hops, m.TraceInfo)...)); findings != "" {
+			b.WriteString(findings + "\n\n")
+		}
 
-	if !m.Loaded {
-		body := utils.SubtleStyle.Render("running traceroute...")
-		if len(m.TraceLog) > 0 {
-			body = strings.Join(m.TraceLog, "\n")
+		if m.TraceRef != nil {
+			ref := m.TraceRef
+			b.WriteString(utils.KeywordStyle.Render(fmt.Sprintf("Compared with the %s run", m.TraceRefKind)) +
+				utils.SubtleStyle.Render(fmt.Sprintf(" of %s (%s ago):", ref.Start.Format("2006-01-02 15:04"), time.Since(ref.Start).Round(time.Minute))) + "\n")
+			b.WriteString(utils.RenderFindings(compareTracePaths(*ref, traceSnapshot(m))) + "\n\n")
 		}
-		return header + body + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+		b.WriteString(utils.SubtleStyle.Render("s: stop/resume probing • r: reset statistics • c: compare with the previous run / baseline / off • m: keep as baseline") + "\n\n")
+	} else if m.TraceChan != nil {
+		b.WriteString(utils.SubtleStyle.Render("waiting for replies...") + "\n\n")
 	}
 
-	if len(m.TraceLog) == 0 {
-		return header + utils.SubtleStyle.Render("No traceroute output collected or command failed.") + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	if m.TraceChan != nil {
+		return header + b.String() + utils.SubtleStyle.Render("Running... press s to stop, esc to quit or b to go back.")
 	}
-	return header + utils.SubtleStyle.Render(strings.Join(m.TraceLog, "\n")) + "\n\n" + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
+	return header + b.String() + utils.SubtleStyle.Render("Completed. Press esc to quit or b to go back.")
 }
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// A minimal one-line text prompt shared by checks that need a target from the
+// user (a CIDR, a host, a URL...). While InputActive is set the global
+// shortcuts (q, b, v) are typed into the prompt instead; esc goes back to the
+// menu and ctrl+c still quits. Enter sets InputSubmitted and the check reads
+// the value from Input.
+
+// PromptInput opens the prompt with a label and an initial value.
+func PromptInput(m Model, label, value string) Model {
+	m.InputLabel = label
+	m.Input = value
+	m.InputActive = true
+	m.InputSubmitted = false
+	return m
+}
+
+// UpdateInput edits the prompt from key presses. On enter it closes the
+// prompt and schedules a frame so the check can start its worker.
+func UpdateInput(msg tea.Msg, m Model) (Model, tea.Cmd) {
+	km, ok := msg.(tea.KeyMsg)
+	if !ok {
+		return m, nil
+	}
+	switch km.Type {
+	case tea.KeyEnter:
+		m.InputActive = false
+		m.InputSubmitted = true
+		return m, Frame()
+	case tea.KeyBackspace:
+		if r := []rune(m.Input); len(r) > 0 {
+			m.Input = string(r[:len(r)-1])
+		}
+	case tea.KeyCtrlU:
+		m.Input = ""
+	case tea.KeySpace:
+		m.Input += " "
+	case tea.KeyRunes:
+		m.Input += string(km.Runes)
+	}
+	return m, nil
+}
+
+// InputView renders the prompt with a cursor and a short help line.
+func InputView(m Model) string {
+	return m.InputLabel + "\n\n" +
+		CheckboxStyle.Render("> ") + m.Input + CheckboxStyle.Render("█") + "\n\n" +
+		SubtleStyle.Render("enter: start") + DotStyle +
+		SubtleStyle.Render("ctrl+u: clear") + DotStyle +
+		SubtleStyle.Render("esc: back to menu")
+}
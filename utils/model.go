@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
@@ -22,6 +23,12 @@ type Model struct {
 
 	Logging bool
 
+	// shared text prompt (see input.go)
+	Input          string
+	InputLabel     string
+	InputActive    bool
+	InputSubmitted bool
+
 	// ping-specific fields
 	PingIP           string
 	PingTotal        int
@@ -56,30 +63,155 @@ type Model struct {
 	DHCPFound   bool
 	DHCPInfo    string
 
+	// IPv6 RA / DHCPv6-specific fields
+	RATimeout int
+	RAChan    chan string
+	RALog     []string
+
 	// ARP-specific fields
-	ARPChan chan string
-	ARPLog  []string
+	ARPChan     chan NeighborResult
+	ARPLog      []string
+	ARPEntries  []Neighbor
+	ARPSortCol  int // index into the neighbor table columns
+	ARPSortDesc bool
+
+	// ARP monitor (spoofing / duplicate address detection)
+	ARPMonitorSecs int
+	ARPMonChan     chan string
+	ARPMonLog      []string
+
+	// LAN scan-specific fields
+	ScanChan     chan ScanResult
+	ScanLog      []string
+	ScanHosts    []ScanHost
+	ScanProbed   int
+	ScanTotal    int
+	ScanRate     int // probes per second
+	ScanMaxHosts int // refuse prefixes with more addresses than this
+
+	// Port scan-specific fields
+	PortScanChan    chan PortScanResult
+	PortScanLog     []string
+	PortScanPorts   []PortProbe
+	PortScanProbed  int
+	PortScanTotal   int
+	PortScanWorkers int           // concurrent probes
+	PortScanTimeout time.Duration // per probe
+	PortScanAll     bool          // list closed and filtered ports too
+	PortScanHost    string        // host as entered, for TLS SNI and HTTP Host
+	PortScanIP      string        // address the host resolved to
+
+	// Service identification of open ports (open ports and port scan views)
+	IdentifyChan chan IdentifyResult
 
 	// Routing-specific fields
-	RouteChan chan string
-	RouteLog  []string
+	RouteChan     chan RouteResult
+	RouteLog      []string
+	RouteRules    []RouteRule
+	RouteEntries  []RouteEntry
+	RouteFindings []string
+	RouteQuery    string   // last flow entered in the route lookup
+	RouteLookup   []string // rule walk and verdict for RouteQuery
+	RouteKernel   []string // "ip route get" output for comparison
+	RouteGetChan  chan string
+
+	// Reverse-path filtering-specific fields
+	RPFilterChan chan string
+	RPFilterLog  []string
 
 	// Firewall-specific fields
-	FirewallChan chan string
-	FirewallLog  []string
+	FirewallChan        chan FirewallResult
+	FirewallLog         []string
+	FirewallTables      []FirewallTable
+	FirewallOpen        map[string]bool // expanded tree nodes, keyed by table / table+chain
+	FirewallCursor      int
+	FirewallFindings    []FirewallFinding
+	FirewallAllFindings bool                 // show every finding instead of the first few
+	FirewallFlow        string               // last flow entered in the packet tracer
+	FirewallTrace       *FirewallTrace       // tracer output for FirewallFlow, nil before a trace
+	FirewallWatchChan   chan []FirewallTable // counter snapshots while watching
+	FirewallWatchStop   chan struct{}        // closed to stop the watch worker
+	FirewallWatchAt     time.Time            // when the last snapshot was applied
+	FirewallDeltas      map[string][2]uint64 // packets/bytes per second by rule or chain key
+	FirewallWatchTotal  map[string]uint64    // packets since watching started
 
 	// Open ports-specific fields
-	OpenPortsChan chan string
-	OpenPortsLog  []string
+	OpenPortsChan    chan SocketResult
+	OpenPortsLog     []string
+	OpenPortsSockets []Socket
+
+	// Connections-specific fields
+	ConnChan     chan SocketResult
+	ConnLog      []string
+	ConnEntries  []Socket
+	ConnSortCol  int // index into the connection table columns
+	ConnSortDesc bool
+	ConnFilter   string // words every shown connection must contain
+	ConnOffset   int    // first table row shown
 
 	// Traceroute-specific fields
-	TraceChan   chan string
-	TraceLog    []string
-	TraceTarget string
+	TraceChan     chan TraceResult
+	TraceStop     chan struct{} // closed to stop probing
+	TraceOnStop   func(*Model)  // saves the running trace before b or quitting stops it
+	TraceLog      []string
+	TraceTarget   string
+	TraceProto    string                  // icmp, udp or tcp
+	TracePort     int                     // destination port of udp and tcp probes
+	TraceHops     []TraceHop              // indexed by TTL-1
+	TraceDestTTL  int                     // lowest TTL the destination answered at, 0 until it does
+	TraceInfo     map[string]TraceHopInfo // reverse DNS and AS by responder address
+	TraceInterval time.Duration
+	TraceMaxHops  int
+	TraceStarted  time.Time  // start of the current run, which names its saved file
+	TraceSavedAt  time.Time  // when the current run was last written to disk
+	TraceRef      *TracePath // saved run the live path is compared with, nil for none
+	TraceRefKind  string     // previous or baseline
 
 	// Bandwidth-specific fields
-	BandwidthChan chan string
-	BandwidthLog  []string
+	BandwidthChan    chan BandwidthResult
+	BandwidthLog     []string
+	BandwidthResult  *SpeedResult
+	BandwidthHistory []SpeedResult // earlier results, oldest first
+
+	// Throughput test (bwserver client)-specific fields
+	ThroughputChan      chan BwResult
+	ThroughputLog       []string
+	ThroughputTarget    string // HOST[:PORT] [tcp [STREAMS] | udp [RATE]] as last entered
+	ThroughputIntervals []BwInterval
+	ThroughputSecs      int // length of each direction
+	ThroughputStreams   int // default parallel TCP streams
+
+	// Bufferbloat test-specific fields
+	BloatChan    chan BloatResult
+	BloatLog     []string
+	BloatTarget  string // LOAD [PING_TARGET] as last entered
+	BloatPhase   string // phase running now
+	BloatSamples []BloatSample
+	BloatLoads   []BloatLoad
+	BloatSecs    int      // length of each loaded phase
+	BloatShaping []string // shaping qdiscs on this host, nil until checked
+
+	// HTTP timing-specific fields
+	HTTPTimingChan   chan HTTPTimingResult
+	HTTPTimingLog    []string
+	HTTPTimingTarget string // URL [COUNT] [-k] as last entered
+	HTTPTimings      []HTTPTiming
+	HTTPTimingCount  int // default number of runs
+
+	// TLS inspection-specific fields
+	TLSCheckChan   chan TLSCheckResult
+	TLSCheckLog    []string
+	TLSCheckTarget string // HOST[:PORT] [ca=FILE,...] [sni=NAME] [issuer=NAME] as last entered
+	TLSCheck       *TLSInspection
+
+	// Interface traffic monitor-specific fields
+	IfTrafficChan  chan IfReading
+	IfTrafficStop  chan struct{} // closed to stop polling
+	IfTrafficLog   []string
+	IfTrafficLast  IfReading             // previous reading, deltas are taken against it
+	IfTrafficHist  map[string][]IfSample // per interface, oldest first
+	IfTrafficTotal map[string]IfSample   // errors, drops and fifo summed since start
+	IfTrafficAll   bool                  // show loopback, down and idle interfaces too
 
 	// Latency-specific fields
 	LatencyChan chan string
@@ -125,6 +257,31 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	// global key handling (quit)
 	if msg, ok := msg.(tea.KeyMsg); ok {
 		k := msg.String()
+
+		// while a check is prompting for input, keys belong to the prompt
+		if m.Chosen && m.InputActive {
+			switch k {
+			case "ctrl+c":
+				m.Quitting = true
+				if LoggingFile != nil {
+					_ = LoggingFile.Close()
+					LoggingFile = nil
+				}
+				return m, tea.Quit
+			case "esc":
+				m.Chosen = false
+				m.Loaded = false
+				m.InputActive = false
+				m.InputSubmitted = false
+				if m.FirewallWatchStop != nil {
+					close(m.FirewallWatchStop)
+					m.FirewallWatchStop = nil
+				}
+				m.FirewallWatchChan = nil
+				return m, nil
+			}
+			return updateChosen(msg, m)
+		}
 		// toggle logging with "v"
 		if k == "v" {
 			if m.Logging {
@@ -148,6 +305,9 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		if k == "q" || k == "esc" || k == "ctrl+c" {
 			m.Quitting = true
+			if m.TraceStop != nil && m.TraceOnStop != nil {
+				m.TraceOnStop(&m)
+			}
 			// ensure log file closed on quit
 			if LoggingFile != nil {
 				_ = LoggingFile.Close()
@@ -169,6 +329,40 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.ARPChan = nil
 			m.FirewallChan = nil
 			m.OpenPortsChan = nil
+			m.ConnChan = nil
+			m.PortScanChan = nil
+			m.IdentifyChan = nil
+			m.ThroughputChan = nil
+			m.BloatChan = nil
+			m.HTTPTimingChan = nil
+			m.TLSCheckChan = nil
+
+			// stop the firewall counter watch if it is running
+			if m.FirewallWatchStop != nil {
+				close(m.FirewallWatchStop)
+				m.FirewallWatchStop = nil
+			}
+			m.FirewallWatchChan = nil
+
+			// stop the continuous traceroute, keeping the run it measured
+			if m.TraceStop != nil {
+				if m.TraceOnStop != nil {
+					m.TraceOnStop(&m)
+				}
+				close(m.TraceStop)
+				m.TraceStop = nil
+			}
+			m.TraceChan = nil
+
+			// stop the interface traffic monitor
+			if m.IfTrafficStop != nil {
+				close(m.IfTrafficStop)
+				m.IfTrafficStop = nil
+			}
+			m.IfTrafficChan = nil
+
+			// forget the previous prompt answer so the check asks again
+			m.InputSubmitted = false
 
 			// reset progress counters
 			m.PingCount = 0
@@ -223,6 +417,8 @@ func updateChoices(msg tea.Msg, m Model) (tea.Model, tea.Cmd) {
 			}
 		case "enter", " ":
 			m.Chosen = true
+			m.InputActive = false
+			m.InputSubmitted = false
 			return m, Frame()
 		}
 	}
@@ -1,5 +1,7 @@
 package utils
 
+import "time"
+
 type PingResult struct {
 	Index   int
 	Success bool
@@ -18,3 +20,476 @@ type DnsResult struct {
 	Success bool
 	Done    bool
 }
+
+// Neighbor is one parsed ARP / NDP neighbor table entry.
+type Neighbor struct {
+	IP      string
+	MAC     string
+	Iface   string
+	State   string // REACHABLE, STALE, DELAY, PROBE, FAILED, INCOMPLETE, PERMANENT, NOARP
+	Router  bool
+	Gateway bool // next hop of a default route
+	Vendor  string
+}
+
+// NeighborResult carries one neighbor entry, or a status line when Msg is set.
+type NeighborResult struct {
+	Entry Neighbor
+	Msg   string
+}
+
+// Socket is one parsed entry of /proc/net/{tcp,udp,raw}[6] with its owner.
+type Socket struct {
+	Proto      string // tcp, udp or raw, with a 6 suffix for IPv6
+	Local      string
+	LocalPort  int // protocol number for raw sockets
+	Remote     string
+	RemotePort int
+	State      string // LISTEN, ESTABLISHED... ; UNCONN for bound UDP/raw sockets
+	UID        int
+	Inode      uint64
+	TxQueue    uint64
+	RxQueue    uint64
+	PID        int // 0 when the owner could not be read
+	Command    string
+	User       string
+	Unit       string // systemd unit of the owner
+	Container  string // container the owner runs in
+	Netns      string // network namespace, when not the host's
+	Exposure   string // loopback, LAN, public or all
+	Firewall   string // firewall verdict for new inbound connections, per interface
+	TCP        *TCPInfo
+	ID         *ServiceID
+}
+
+// TCPInfo is the part of the kernel's struct tcp_info shown per connection.
+type TCPInfo struct {
+	RTT          time.Duration
+	RTTVar       time.Duration
+	MinRTT       time.Duration
+	Cwnd         uint32 // congestion window in segments
+	MSS          uint32
+	Timeouts     uint8  // unrecovered retransmission timeouts in a row
+	Retrans      uint32 // segments currently retransmitted and unacknowledged
+	TotalRetrans uint32
+	Lost         uint32
+	DeliveryRate uint64 // bytes per second
+	BytesSent    uint64
+	BytesRetrans uint64
+	CongAlg      string
+}
+
+// SocketResult carries one socket, or a status line when Msg is set.
+type SocketResult struct {
+	Entry Socket
+	Msg   string
+}
+
+// ScanHost is one live host found by the LAN sweep.
+type ScanHost struct {
+	IP     string
+	MAC    string
+	Vendor string
+	Name   string // reverse DNS
+	RTT    time.Duration
+	Method string // arp, icmp or tcp/<port>
+}
+
+// ScanResult carries a live host, a status line (Msg) or a progress update.
+type ScanResult struct {
+	Host   ScanHost
+	Msg    string
+	Probed int
+	Total  int
+}
+
+// ServiceID is what banner grabbing found behind an open TCP port.
+type ServiceID struct {
+	Service string // ssh, smtp, ftp, mysql, redis, http, https, tls, pop3, imap or unknown
+	Version string // software and version as announced by the server
+	Detail  string // banner line, HTTP status, certificate subject and ALPN...
+}
+
+// IdentifyResult carries the identification of one row of a port table.
+type IdentifyResult struct {
+	Index int
+	ID    ServiceID
+}
+
+// PortProbe is the outcome of probing one port of a remote host.
+type PortProbe struct {
+	Proto   string // tcp or udp
+	Port    int
+	State   string // open, closed, filtered, or open|filtered for silent UDP ports
+	Reason  string // syn-ack, reset, timeout, reply, icmp port unreachable...
+	RTT     time.Duration
+	Service string // well-known name of the port
+	ID      *ServiceID
+}
+
+// PortScanResult carries a probed port, a status line (Msg), the resolved
+// address (IP) or a progress update.
+type PortScanResult struct {
+	Probe  *PortProbe
+	Msg    string
+	IP     string
+	Probed int
+	Total  int
+}
+
+// RouteEntry is one route from any routing table (IPv4 or IPv6).
+type RouteEntry struct {
+	Family   int // 4 or 6
+	TableID  int
+	Table    string
+	Type     string // unicast, local, broadcast, blackhole, unreachable, prohibit...
+	Dst      string // "default" or a CIDR
+	Gateway  string
+	Dev      string
+	Src      string // preferred source address
+	Proto    string
+	Scope    string
+	Metric   int
+	TOS      uint8
+	Nexthops []RouteNexthop // multipath next hops
+}
+
+// RouteNexthop is one next hop of a multipath route.
+type RouteNexthop struct {
+	Gateway string // "" when the next hop is on-link
+	Dev     string
+	Weight  int
+}
+
+// RouteRule is one policy routing rule.
+type RouteRule struct {
+	Family            int // 4 or 6
+	Priority          int
+	Src               string // CIDR, "" for all
+	Dst               string
+	TOS               uint8
+	FwMark            uint32
+	FwMask            uint32
+	IIf               string
+	OIf               string
+	Invert            bool
+	Action            string // lookup, goto, nop, blackhole, unreachable, prohibit
+	TableID           int
+	Table             string
+	Goto              int
+	L3mdev            bool
+	SuppressPrefixLen int // -1 when unset
+}
+
+// RouteResult carries a parsed rule, a parsed route, or a status line (Msg).
+type RouteResult struct {
+	Rule  *RouteRule
+	Route *RouteEntry
+	Msg   string
+}
+
+// FirewallMatch is one condition of a firewall rule, normalized across the
+// nftables and iptables backends. Field is "" for expressions the parser does
+// not understand; Raw always holds the expression as the backend prints it.
+type FirewallMatch struct {
+	Field  string // saddr, daddr, sport, dport, proto, iif, oif, ct state, mark, ...
+	Negate bool
+	Values []string // addresses/CIDRs, ports or "lo-hi" ranges, names, states
+	Raw    string
+}
+
+// FirewallRule is one rule of a chain.
+type FirewallRule struct {
+	Handle     int // nft handle, or the 1-based position for iptables
+	Matches    []FirewallMatch
+	Verdict    string // accept, drop, reject, jump, goto, return, or "" to continue
+	Target     string // chain for jump/goto, or the extension target (LOG, MASQUERADE...)
+	Statements []string
+	Counter    bool
+	Packets    uint64
+	Bytes      uint64
+	Comment    string
+	Text       string // the rule rendered in the backend's own syntax
+}
+
+// FirewallChain is a base chain (attached to a hook) or a regular chain.
+type FirewallChain struct {
+	Name     string
+	Type     string // filter, nat, route
+	Hook     string // "" for regular chains
+	Priority int
+	Policy   string
+	Packets  uint64 // policy counters (iptables)
+	Bytes    uint64
+	Rules    []FirewallRule
+}
+
+// FirewallTable is one table of a backend.
+type FirewallTable struct {
+	Backend string // nftables, iptables, ip6tables
+	Family  string // ip, ip6, inet, arp, bridge, netdev
+	Name    string
+	Chains  []FirewallChain
+}
+
+// FirewallFinding is one result of the rule hygiene analysis. Chain and
+// Handle point to the offending rule when there is one.
+type FirewallFinding struct {
+	Severity string // WARNING or NOTE
+	Table    string // "backend/family/name"
+	Chain    string
+	Handle   int
+	Text     string
+}
+
+// FirewallTrace is a flow's path through the rules, from the packet tracer.
+type FirewallTrace struct {
+	Lines   []string // chains and rules as they were evaluated
+	Verdict string   // ACCEPT, DROP or REJECT, "" when the flow could not be traced
+	At      string   // the chain that dropped or rejected the packet
+	Skipped bool     // rules the tracer cannot evaluate were skipped, so the verdict may be wrong
+}
+
+// FirewallResult carries a parsed table, a finding, or a status line (Msg).
+type FirewallResult struct {
+	Table   *FirewallTable
+	Finding *FirewallFinding
+	Msg     string
+}
+
+// TraceProbe is the outcome of one probe of the continuous traceroute.
+type TraceProbe struct {
+	TTL     int
+	Addr    string // responder; empty when the probe was lost
+	RTT     time.Duration
+	Reached bool // the destination itself answered
+}
+
+// TraceHop accumulates the probes sent with one TTL.
+type TraceHop struct {
+	TTL   int
+	Addrs []string // responders in order of first reply, several behind ECMP
+	Sent  int
+	Recv  int
+	Last  time.Duration
+	Best  time.Duration
+	Worst time.Duration
+	Sum   time.Duration
+	SumSq float64 // sum of squared RTTs in ms², for the standard deviation
+}
+
+// TraceHopInfo is what is known about a responder beyond its address.
+type TraceHopInfo struct {
+	Addr  string
+	Name  string // reverse DNS
+	ASN   int    // 0 when unknown
+	ASOrg string
+	Range string // private, CGNAT, link-local, ULA or loopback; "" for public addresses
+}
+
+// TraceResult carries a probe outcome, the enrichment of a new responder
+// (Info) or a status line (Msg).
+type TraceResult struct {
+	Probe *TraceProbe
+	Info  *TraceHopInfo
+	Msg   string
+}
+
+// TracePath is a saved traceroute run, the unit path comparisons work on.
+type TracePath struct {
+	Target string         `json:"target"`
+	Proto  string         `json:"proto"`
+	Port   int            `json:"port,omitempty"`
+	Start  time.Time      `json:"start"`
+	Saved  time.Time      `json:"saved"`
+	Hops   []TracePathHop `json:"hops"`
+}
+
+// TracePathHop is the summary of one hop of a saved run.
+type TracePathHop struct {
+	TTL   int      `json:"ttl"`
+	Addrs []string `json:"addrs,omitempty"` // empty when the hop never answered
+	ASN   int      `json:"asn,omitempty"`
+	ASOrg string   `json:"as_org,omitempty"`
+	Sent  int      `json:"sent"`
+	Loss  float64  `json:"loss"`             // percent
+	Avg   float64  `json:"avg_ms,omitempty"` // ms
+}
+
+// BwInterval is one second of a throughput test against a bwserver, or with
+// Sec 0 the total of one direction.
+type BwInterval struct {
+	Proto   string // tcp or udp
+	Dir     string // download or upload
+	Sec     int
+	Bytes   uint64
+	Secs    float64       // length of the interval
+	Packets int           // udp datagrams received
+	Lost    int           // udp datagrams missing from the sequence
+	Jitter  time.Duration // udp interarrival jitter (RFC 3550)
+}
+
+// BwResult carries an interval or a status line (Msg).
+type BwResult struct {
+	Interval *BwInterval
+	Msg      string
+}
+
+// IfCounters is one reading of an interface's statistics.
+type IfCounters struct {
+	Name      string
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrs    uint64
+	RxDrop    uint64
+	RxFifo    uint64
+	RxOver    uint64 // receive ring overruns, from sysfs
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrs    uint64
+	TxDrop    uint64
+	TxFifo    uint64
+	TxColls   uint64
+	Speed     int    // link speed in Mbit/s, 0 when unknown
+	OperState string // up, down, unknown...
+}
+
+// IfSample is the traffic of one interface over one polling interval.
+type IfSample struct {
+	RxBits float64 // per second
+	TxBits float64
+	RxPkts float64
+	TxPkts float64
+	Errs   uint64 // rx+tx errors in the interval
+	Drops  uint64
+	Fifo   uint64 // fifo errors and overruns
+}
+
+// IfReading is a set of counters and when they were read.
+type IfReading struct {
+	At       time.Time
+	Counters []IfCounters
+	Err      string
+}
+
+// SpeedResult is the outcome of an internet speed test, whichever tool ran
+// it. Rates are in bits per second.
+type SpeedResult struct {
+	Tool       string        `json:"tool"` // speedtest (Ookla), speedtest-cli or librespeed-cli
+	Time       time.Time     `json:"time"`
+	Download   float64       `json:"download_bps"`
+	Upload     float64       `json:"upload_bps"`
+	Latency    time.Duration `json:"latency"`
+	Jitter     time.Duration `json:"jitter,omitempty"`      // 0 when the tool does not measure it
+	PacketLoss float64       `json:"packet_loss,omitempty"` // percent, -1 when not measured
+	Server     string        `json:"server"`                // name and location
+	ServerHost string        `json:"server_host,omitempty"`
+	ISP        string        `json:"isp,omitempty"`
+	ClientIP   string        `json:"client_ip,omitempty"`
+	URL        string        `json:"url,omitempty"` // shareable result page
+}
+
+// BandwidthResult carries a speed test result or a status line (Msg).
+type BandwidthResult struct {
+	Result *SpeedResult
+	Msg    string
+}
+
+// BloatSample is one latency probe of a bufferbloat test.
+type BloatSample struct {
+	Phase string // idle, download, upload or bidirectional
+	RTT   time.Duration
+	Lost  bool
+}
+
+// BloatLoad is the rate the load generator reached in one direction of a
+// bufferbloat test phase.
+type BloatLoad struct {
+	Phase string
+	Dir   string // download or upload
+	Rate  uint64 // bytes per second
+}
+
+// BloatResult carries a latency sample, a load rate, the start of a phase
+// (Phase), the shaping found on this host (Shaping, non-nil once checked)
+// or a status line (Msg).
+type BloatResult struct {
+	Sample  *BloatSample
+	Load    *BloatLoad
+	Phase   string
+	Shaping []string
+	Msg     string
+}
+
+// HTTPTiming is one request of an HTTP timing run; a run that follows
+// redirects has one per hop. The phases add up to Total; phases a reused
+// connection skips are 0.
+type HTTPTiming struct {
+	Run      int
+	Hop      int // 0 for the requested URL, then one per redirect
+	URL      string
+	Offset   time.Duration // start of the request within its run
+	DNS      time.Duration
+	Connect  time.Duration
+	TLS      time.Duration
+	Wait     time.Duration // request written to first response byte
+	Transfer time.Duration // first to last byte of the body
+	TTFB     time.Duration // start of the request to first byte
+	Total    time.Duration
+	Bytes    int64
+	Status   string
+	Code     int
+	Proto    string // HTTP/1.1, HTTP/2.0...
+	Addr     string // address connected to, the proxy's when one is used
+	Err      string
+}
+
+// HTTPTimingResult carries a request's timing or a status line (Msg).
+type HTTPTimingResult struct {
+	Timing *HTTPTiming
+	Msg    string
+}
+
+// TLSInspection is what a TLS handshake with an endpoint showed.
+type TLSInspection struct {
+	Addr        string
+	ServerName  string // SNI sent and name the certificate must match
+	Version     string
+	Cipher      string
+	ALPN        string // negotiated protocol, empty for none
+	Handshake   time.Duration
+	OCSPStapled int       // size of the stapled OCSP response, 0 for none
+	Chain       []TLSCert // as the server sent it, leaf first
+	Misordered  int       // first certificate that did not issue the one before it, 0 when none
+	NameErr     string    // why the leaf does not cover ServerName, empty when it does
+	Validations []TLSValidation
+	WantIssuer  string // issuer the user expects, empty for any
+}
+
+// TLSCert is one certificate of a chain.
+type TLSCert struct {
+	Subject    string
+	Issuer     string
+	IssuerOrg  string
+	SANs       []string // DNS names and IP addresses
+	NotBefore  time.Time
+	NotAfter   time.Time
+	SigAlg     string
+	Key        string // algorithm and size
+	IsCA       bool
+	SelfSigned bool
+}
+
+// TLSValidation is the outcome of verifying the chain against one set of
+// roots.
+type TLSValidation struct {
+	Roots string   // system, or system plus the bundles given
+	Path  []string // subjects from the leaf to the root, when it validates
+	Err   string
+}
+
+// TLSCheckResult carries an inspection or a status line (Msg).
+type TLSCheckResult struct {
+	Inspection *TLSInspection
+	Msg        string
+}
@@ -25,6 +25,7 @@ var (
 	KeywordStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("211"))
 	SubtleStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
 	CheckboxStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("212"))
+	WarnStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("203"))
 	ProgressEmpty = SubtleStyle.Render(ProgressEmptyChar)
 	DotStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("236")).Render(DotChar)
 	MainStyle     = lipgloss.NewStyle().MarginLeft(2)
@@ -32,6 +33,20 @@ var (
 	Ramp = MakeRampStyles("#B14FFF", "#00FFA3", ProgressBarWidth)
 )
 
+// RenderFindings styles finding lines, WARNING ones in WarnStyle and the
+// rest subtle, one per line.
+func RenderFindings(lines []string) string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		if strings.HasPrefix(l, "WARNING") {
+			out[i] = WarnStyle.Render(l)
+		} else {
+			out[i] = SubtleStyle.Render(l)
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
 var (
 	LoggingFile *os.File
 )